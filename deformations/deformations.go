@@ -2,8 +2,9 @@ package deformations
 
 import (
 	"fmt"
-	"log"
 	"math"
+	"sort"
+	"sync"
 )
 
 type Deformation interface {
@@ -121,43 +122,82 @@ func (r *RigidDeformation) FromMap(data map[string]interface{}) error {
 	if !ok {
 		return fmt.Errorf("displacements must be a list")
 	}
+	if len(displacements) != 3 {
+		return fmt.Errorf("displacements must have 3 elements, got %d", len(displacements))
+	}
 	r.Displacements = make([]float64, len(displacements))
+	var err error
 	for i, d := range displacements {
-		r.Displacements[i] = d.(float64)
+		if r.Displacements[i], err = toFloat64(d); err != nil {
+			return fmt.Errorf("displacements must be a list of floats")
+		}
+	}
+	if r.Type, ok = data["type"].(string); !ok {
+		return fmt.Errorf("type must be a string")
 	}
-	r.Type = data["type"].(string)
 	return nil
 }
 
+// Logistic function of t rising from 0 to 1 around center over lengthscale
+func Sigmoid(t, center, lengthscale float64) float64 {
+	return 1 / (1 + math.Exp(-(t-center)/lengthscale))
+}
+
 type SigmoidDeformation struct {
 	Deformation
+	// displacement by Amplitude*Sigmoid(p.d, Center, Lengthscale) along unit direction d,
+	// given by Vector if set (normalised when applied), otherwise by axis Direction x, y or z
 	Amplitude   float64
 	Center      float64
 	Lengthscale float64
 	Direction   string
+	Vector      []float64
 	Type        string
 }
 
-func (s *SigmoidDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+// Unit vector of the displacement direction, false if neither Vector nor Direction is valid
+func (s *SigmoidDeformation) axis() (float64, float64, float64, bool) {
+	if s.Vector != nil {
+		if len(s.Vector) != 3 {
+			return 0, 0, 0, false
+		}
+		norm := math.Sqrt(s.Vector[0]*s.Vector[0] + s.Vector[1]*s.Vector[1] + s.Vector[2]*s.Vector[2])
+		if norm == 0 || math.IsNaN(norm) || math.IsInf(norm, 0) {
+			return 0, 0, 0, false
+		}
+		return s.Vector[0] / norm, s.Vector[1] / norm, s.Vector[2] / norm, true
+	}
 	switch s.Direction {
 	case "x":
-		return x + s.Amplitude/(1+math.Exp(-(x-s.Center)/s.Lengthscale)), y, z
+		return 1, 0, 0, true
 	case "y":
-		return x, y + s.Amplitude/(1+math.Exp(-(y-s.Center)/s.Lengthscale)), z
+		return 0, 1, 0, true
 	case "z":
-		return x, y, z + s.Amplitude/(1+math.Exp(-(z-s.Center)/s.Lengthscale))
-	default:
-		log.Fatal("Invalid direction")
-		return 0, 0, 0
+		return 0, 0, 1, true
 	}
+	return 0, 0, 0, false
+}
+
+// Points are left unchanged if the direction is invalid, which FromMap rejects.
+func (s *SigmoidDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	dx, dy, dz, ok := s.axis()
+	if !ok {
+		return x, y, z
+	}
+	u := s.Amplitude * Sigmoid(x*dx+y*dy+z*dz, s.Center, s.Lengthscale)
+	return x + u*dx, y + u*dy, z + u*dz
 }
 
 func (s *SigmoidDeformation) ToMap() map[string]interface{} {
+	var direction interface{} = s.Direction
+	if s.Vector != nil {
+		direction = s.Vector
+	}
 	return map[string]interface{}{
 		"amplitude":   s.Amplitude,
 		"center":      s.Center,
 		"lengthscale": s.Lengthscale,
-		"direction":   s.Direction,
+		"direction":   direction,
 		"type":        s.Type,
 	}
 }
@@ -175,8 +215,76 @@ func (s *SigmoidDeformation) FromMap(data map[string]interface{}) error {
 	if s.Lengthscale, err = toFloat64(data["lengthscale"]); err != nil {
 		return fmt.Errorf("lengthscale must be a float")
 	}
-	if s.Direction, ok = data["direction"].(string); !ok {
-		return fmt.Errorf("direction must be a string")
+	// axis name or vector
+	s.Direction, s.Vector = "", nil
+	if name, ok := data["direction"].(string); ok {
+		s.Direction = name
+	} else if s.Vector, err = toVec3(data["direction"]); err != nil {
+		return fmt.Errorf("direction must be x, y, z or a list of 3 floats")
+	}
+	if _, _, _, ok := s.axis(); !ok {
+		return fmt.Errorf("direction must be x, y, z or a non-zero vector, got %v", data["direction"])
+	}
+	if s.Type, ok = data["type"].(string); !ok {
+		return fmt.Errorf("type must be a string")
+	}
+	return nil
+}
+
+type SwirlDeformation struct {
+	Deformation
+	// rotation about Axis through Center by MaxAngle (radians) on the axis,
+	// decaying as a Gaussian with radial distance Sigma from the axis
+	Axis     []float64
+	Center   []float64
+	MaxAngle float64
+	Sigma    float64
+	Type     string
+}
+
+func (s *SwirlDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	norm := math.Sqrt(s.Axis[0]*s.Axis[0] + s.Axis[1]*s.Axis[1] + s.Axis[2]*s.Axis[2])
+	ax, ay, az := s.Axis[0]/norm, s.Axis[1]/norm, s.Axis[2]/norm
+	vx, vy, vz := x-s.Center[0], y-s.Center[1], z-s.Center[2]
+	// split into components along and perpendicular to the axis
+	h := vx*ax + vy*ay + vz*az
+	wx, wy, wz := vx-h*ax, vy-h*ay, vz-h*az
+	r2 := wx*wx + wy*wy + wz*wz
+	th := s.MaxAngle * math.Exp(-r2/(2*s.Sigma*s.Sigma))
+	c, sn := math.Cos(th), math.Sin(th)
+	// rotate perpendicular component about the axis (Rodrigues with a.w = 0)
+	cx, cy, cz := ay*wz-az*wy, az*wx-ax*wz, ax*wy-ay*wx
+	wx, wy, wz = wx*c+cx*sn, wy*c+cy*sn, wz*c+cz*sn
+	return s.Center[0] + h*ax + wx, s.Center[1] + h*ay + wy, s.Center[2] + h*az + wz
+}
+
+func (s *SwirlDeformation) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"axis":      s.Axis,
+		"center":    s.Center,
+		"max_angle": s.MaxAngle,
+		"sigma":     s.Sigma,
+		"type":      s.Type,
+	}
+}
+
+func (s *SwirlDeformation) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var err error
+	if s.Axis, err = toVec3(data["axis"]); err != nil {
+		return fmt.Errorf("axis must be a list of 3 floats")
+	}
+	if s.Axis[0] == 0 && s.Axis[1] == 0 && s.Axis[2] == 0 {
+		return fmt.Errorf("axis must be non-zero")
+	}
+	if s.Center, err = toVec3(data["center"]); err != nil {
+		return fmt.Errorf("center must be a list of 3 floats")
+	}
+	if s.MaxAngle, err = toFloat64(data["max_angle"]); err != nil {
+		return fmt.Errorf("max_angle must be a float")
+	}
+	if s.Sigma, err = toFloat64(data["sigma"]); err != nil || s.Sigma <= 0 {
+		return fmt.Errorf("sigma must be a positive float")
 	}
 	if s.Type, ok = data["type"].(string); !ok {
 		return fmt.Errorf("type must be a string")
@@ -184,33 +292,281 @@ func (s *SigmoidDeformation) FromMap(data map[string]interface{}) error {
 	return nil
 }
 
+type BendDeformation struct {
+	Deformation
+	// pure bending of a beam along the z axis into a circular arc in the xz plane.
+	// The neutral axis keeps its length and the beam bends towards +x for positive Curvature
+	Curvature float64
+	Type      string
+}
+
+func (b *BendDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	if b.Curvature == 0 {
+		return x, y, z
+	}
+	// centre of curvature at (1/Curvature, 0, 0). Deformed point at radius r and angle th
+	// from the centre came from distance Rc-r from the axis at arc length Rc*th
+	Rc := 1.0 / b.Curvature
+	dx := x - Rc
+	r := math.Copysign(math.Sqrt(dx*dx+z*z), Rc)
+	th := math.Atan2(z*math.Copysign(1, Rc), -dx*math.Copysign(1, Rc))
+	return Rc - r, y, Rc * th
+}
+
+func (b *BendDeformation) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"curvature": b.Curvature,
+		"type":      b.Type,
+	}
+}
+
+func (b *BendDeformation) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var err error
+	if b.Curvature, err = toFloat64(data["curvature"]); err != nil {
+		return fmt.Errorf("curvature must be a float")
+	}
+	if b.Type, ok = data["type"].(string); !ok {
+		return fmt.Errorf("type must be a string")
+	}
+	return nil
+}
+
+type RotationDeformation struct {
+	Deformation
+	// rigid rotation of the object about Center, either by Angle (degrees, right-handed) about Axis
+	// or, when Euler is set, by Euler[0], Euler[1] and Euler[2] degrees about the fixed x, y and z axes
+	// in that order. Apply returns the inversely rotated point at which the object is sampled
+	Axis   []float64
+	Angle  float64
+	Euler  []float64
+	Center []float64
+	Type   string
+	rot    [3][3]float64 // rotation matrix of the object
+}
+
+// Rotation of the object about the origin by Euler angles in degrees about the fixed x, y and z axes
+func NewEulerRotation(rx, ry, rz float64) *RotationDeformation {
+	r := &RotationDeformation{Euler: []float64{rx, ry, rz}, Center: []float64{0, 0, 0}, Type: "rotation"}
+	r.init()
+	return r
+}
+
+// Right-handed rotation matrix by angle th (radians) about unit axis a
+func axisRotation(a [3]float64, th float64) [3][3]float64 {
+	c, s := math.Cos(th), math.Sin(th)
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] = (1 - c) * a[i] * a[j]
+			if i == j {
+				m[i][j] += c
+			}
+		}
+	}
+	m[0][1] -= s * a[2]
+	m[0][2] += s * a[1]
+	m[1][0] += s * a[2]
+	m[1][2] -= s * a[0]
+	m[2][0] -= s * a[1]
+	m[2][1] += s * a[0]
+	return m
+}
+
+func (r *RotationDeformation) init() {
+	if r.Euler != nil {
+		r.rot = [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+		for k := 0; k < 3; k++ {
+			var a [3]float64
+			a[k] = 1
+			m := axisRotation(a, r.Euler[k]*math.Pi/180)
+			var out [3][3]float64
+			for i := 0; i < 3; i++ {
+				for j := 0; j < 3; j++ {
+					for l := 0; l < 3; l++ {
+						out[i][j] += m[i][l] * r.rot[l][j]
+					}
+				}
+			}
+			r.rot = out
+		}
+		return
+	}
+	norm := math.Sqrt(r.Axis[0]*r.Axis[0] + r.Axis[1]*r.Axis[1] + r.Axis[2]*r.Axis[2])
+	r.rot = axisRotation([3]float64{r.Axis[0] / norm, r.Axis[1] / norm, r.Axis[2] / norm}, r.Angle*math.Pi/180)
+}
+
+func (r *RotationDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	v := [3]float64{x - r.Center[0], y - r.Center[1], z - r.Center[2]}
+	// inverse rotation is the transpose
+	var out [3]float64
+	for i := 0; i < 3; i++ {
+		out[i] = r.Center[i] + r.rot[0][i]*v[0] + r.rot[1][i]*v[1] + r.rot[2][i]*v[2]
+	}
+	return out[0], out[1], out[2]
+}
+
+func (r *RotationDeformation) ToMap() map[string]interface{} {
+	data := map[string]interface{}{
+		"center": r.Center,
+		"type":   r.Type,
+	}
+	if r.Euler != nil {
+		data["euler"] = r.Euler
+	} else {
+		data["axis"] = r.Axis
+		data["angle"] = r.Angle
+	}
+	return data
+}
+
+func (r *RotationDeformation) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var err error
+	r.Center = []float64{0, 0, 0}
+	if _, ok = data["center"]; ok {
+		if r.Center, err = toVec3(data["center"]); err != nil {
+			return fmt.Errorf("center must be a list of 3 floats")
+		}
+	}
+	r.Euler = nil
+	if _, ok = data["euler"]; ok {
+		if r.Euler, err = toVec3(data["euler"]); err != nil {
+			return fmt.Errorf("euler must be a list of 3 angles in degrees")
+		}
+	} else {
+		if r.Axis, err = toVec3(data["axis"]); err != nil {
+			return fmt.Errorf("axis must be a list of 3 floats")
+		}
+		if r.Axis[0] == 0 && r.Axis[1] == 0 && r.Axis[2] == 0 {
+			return fmt.Errorf("axis must be non-zero")
+		}
+		if r.Angle, err = toFloat64(data["angle"]); err != nil {
+			return fmt.Errorf("angle must be a float")
+		}
+	}
+	if r.Type, ok = data["type"].(string); !ok {
+		return fmt.Errorf("type must be a string")
+	}
+	r.init()
+	return nil
+}
+
+type InterpolatedDeformation struct {
+	Deformation
+	// pointwise linear interpolation (1-Weight)*From(p) + Weight*To(p) between two deformation states,
+	// e.g. of a moving object between two frames. A nil deformation is the identity
+	From   Deformation
+	To     Deformation
+	Weight float64
+	Type   string
+}
+
+// Deformation state a fraction w of the way from deformation a to deformation b. Either may be nil for the identity
+func NewInterpolatedDeformation(a, b Deformation, w float64) *InterpolatedDeformation {
+	return &InterpolatedDeformation{From: a, To: b, Weight: w, Type: "interpolated"}
+}
+
+func (d *InterpolatedDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	x0, y0, z0 := x, y, z
+	if d.From != nil {
+		x0, y0, z0 = d.From.Apply(x, y, z)
+	}
+	x1, y1, z1 := x, y, z
+	if d.To != nil {
+		x1, y1, z1 = d.To.Apply(x, y, z)
+	}
+	w := d.Weight
+	return (1-w)*x0 + w*x1, (1-w)*y0 + w*y1, (1-w)*z0 + w*z1
+}
+
+func (d *InterpolatedDeformation) ToMap() map[string]interface{} {
+	data := map[string]interface{}{
+		"weight": d.Weight,
+		"type":   d.Type,
+	}
+	if d.From != nil {
+		data["from"] = d.From.ToMap()
+	}
+	if d.To != nil {
+		data["to"] = d.To.ToMap()
+	}
+	return data
+}
+
+func (d *InterpolatedDeformation) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var err error
+	d.From, d.To = nil, nil
+	if from, ok := data["from"].(map[string]interface{}); ok {
+		if d.From, err = NewDeformation(from); err != nil {
+			return fmt.Errorf("from: %v", err)
+		}
+	}
+	if to, ok := data["to"].(map[string]interface{}); ok {
+		if d.To, err = NewDeformation(to); err != nil {
+			return fmt.Errorf("to: %v", err)
+		}
+	}
+	if d.Weight, err = toFloat64(data["weight"]); err != nil {
+		return fmt.Errorf("weight must be a float")
+	}
+	if d.Type, ok = data["type"].(string); !ok {
+		return fmt.Errorf("type must be a string")
+	}
+	return nil
+}
+
 type DeformationFactory struct{}
 
 func (f *DeformationFactory) Create(data map[string]interface{}) (Deformation, error) {
 	return NewDeformation(data)
 }
 
+// Constructors of empty deformations by type name, see RegisterDeformation
+var registry = map[string]func() Deformation{
+	"gaussian":     func() Deformation { return &GaussianDeformation{} },
+	"linear":       func() Deformation { return &LinearDeformation{} },
+	"rigid":        func() Deformation { return &RigidDeformation{} },
+	"sigmoid":      func() Deformation { return &SigmoidDeformation{} },
+	"swirl":        func() Deformation { return &SwirlDeformation{} },
+	"bend":         func() Deformation { return &BendDeformation{} },
+	"rotation":     func() Deformation { return &RotationDeformation{} },
+	"interpolated": func() Deformation { return &InterpolatedDeformation{} },
+}
+var registryMu sync.RWMutex
+
+// Register constructor of empty deformations of type typeName, replacing any previous constructor for it.
+// Registered types can be built by NewDeformation and DeformationFactory.
+func RegisterDeformation(typeName string, constructor func() Deformation) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[typeName] = constructor
+}
+
+// Sorted names of the registered deformation types
+func DeformationTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func NewDeformation(data map[string]interface{}) (Deformation, error) {
-	switch data["type"] {
-	case "gaussian":
-		g := &GaussianDeformation{}
-		err := g.FromMap(data)
-		return g, err
-	case "linear":
-		l := &LinearDeformation{}
-		err := l.FromMap(data)
-		return l, err
-	case "rigid":
-		r := &RigidDeformation{}
-		err := r.FromMap(data)
-		return r, err
-	case "sigmoid":
-		s := &SigmoidDeformation{}
-		err := s.FromMap(data)
-		return s, err
-	default:
-		return nil, fmt.Errorf("unknown deformation type")
+	typeName, _ := data["type"].(string)
+	registryMu.RLock()
+	constructor, ok := registry[typeName]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown deformation type '%v'", data["type"])
 	}
+	d := constructor()
+	err := d.FromMap(data)
+	return d, err
 }
 
 func toFloat64(data interface{}) (float64, error) {
@@ -223,3 +579,18 @@ func toFloat64(data interface{}) (float64, error) {
 		return 0.0, fmt.Errorf("data is not a float64")
 	}
 }
+
+func toVec3(data interface{}) ([]float64, error) {
+	slice, ok := data.([]interface{})
+	if !ok || len(slice) != 3 {
+		return nil, fmt.Errorf("data is not a list of 3 elements")
+	}
+	out := make([]float64, 3)
+	for i, val := range slice {
+		var err error
+		if out[i], err = toFloat64(val); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,219 @@
+package deformations
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSwirlDeformation(t *testing.T) {
+	d, err := NewDeformation(map[string]interface{}{
+		"type":      "swirl",
+		"axis":      []interface{}{0.0, 0.0, 1.0},
+		"center":    []interface{}{0.0, 0.0, 0.0},
+		"max_angle": math.Pi / 2,
+		"sigma":     0.1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// close to the axis the rotation is maximal: (r,0) -> (0,r)
+	x, y, z := d.Apply(0.001, 0.0, 0.5)
+	if math.Abs(x) > 1e-5 || math.Abs(y-0.001) > 1e-5 || z != 0.5 {
+		t.Errorf("expected 90 degree rotation near axis, got (%v, %v, %v)", x, y, z)
+	}
+	// beyond 3 sigma the rotation is negligible
+	for _, r := range []float64{0.3, 0.5, 1.0} {
+		x, y, z = d.Apply(r, 0.0, -0.2)
+		if th := math.Atan2(y, x); th > 0.012*math.Pi/2 || z != -0.2 {
+			t.Errorf("expected negligible rotation at r=%v, got angle %v", r, th)
+		}
+	}
+	// radial distance is preserved
+	x, y, _ = d.Apply(0.1, 0.05, 0.0)
+	if math.Abs(math.Hypot(x, y)-math.Hypot(0.1, 0.05)) > 1e-12 {
+		t.Errorf("swirl changed radial distance")
+	}
+	// zero width would give NaN on the axis
+	for _, sigma := range []float64{0.0, -0.1} {
+		_, err := NewDeformation(map[string]interface{}{
+			"type":      "swirl",
+			"axis":      []interface{}{0.0, 0.0, 1.0},
+			"center":    []interface{}{0.0, 0.0, 0.0},
+			"max_angle": math.Pi / 2,
+			"sigma":     sigma,
+		})
+		if err == nil {
+			t.Errorf("expected error for sigma %v", sigma)
+		}
+	}
+}
+
+func TestBendDeformation(t *testing.T) {
+	for _, curvature := range []float64{0.8, -0.8} {
+		b, err := NewDeformation(map[string]interface{}{"type": "bend", "curvature": curvature})
+		if err != nil {
+			t.Fatal(err)
+		}
+		Rc := 1.0 / curvature
+		for _, ref := range [][3]float64{{0, 0, 0}, {0, 0, 0.7}, {0.1, 0.2, -0.5}, {-0.1, 0.0, 0.9}} {
+			// bend reference point forward onto the arc
+			th := ref[2] / Rc
+			rho := Rc - ref[0]
+			x, y, z := Rc-rho*math.Cos(th), ref[1], rho*math.Sin(th)
+			X, Y, Z := b.Apply(x, y, z)
+			if math.Abs(X-ref[0]) > 1e-12 || math.Abs(Y-ref[1]) > 1e-12 || math.Abs(Z-ref[2]) > 1e-12 {
+				t.Errorf("curvature %v: deformed %v maps to %v, expected %v", curvature, []float64{x, y, z}, []float64{X, Y, Z}, ref)
+			}
+		}
+		// beam bends towards +x for positive curvature
+		x, _, _ := b.Apply(0, 0, 0.5)
+		if (curvature > 0) != (x < 0) {
+			t.Errorf("curvature %v: unexpected bending direction, axis point maps to x=%v", curvature, x)
+		}
+	}
+}
+
+func TestSigmoidDirection(t *testing.T) {
+	spec := map[string]interface{}{
+		"type":        "sigmoid",
+		"amplitude":   0.2,
+		"center":      0.0,
+		"lengthscale": 0.1,
+		"direction":   []interface{}{1.0, 1.0, 0},
+	}
+	d, err := NewDeformation(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// far along the diagonal the full amplitude is applied along it
+	for _, p := range [][3]float64{{0.5, 0.5, 0.3}, {0.9, 0.2, -0.4}} {
+		x, y, z := d.Apply(p[0], p[1], p[2])
+		u := 0.2 * Sigmoid((p[0]+p[1])/math.Sqrt2, 0.0, 0.1)
+		if math.Abs(x-p[0]-u/math.Sqrt2) > 1e-12 || math.Abs(y-p[1]-u/math.Sqrt2) > 1e-12 || z != p[2] {
+			t.Errorf("%v maps to (%v, %v, %v), expected displacement %v along the diagonal", p, x, y, z, u)
+		}
+	}
+	// axis names are the same as unit vectors
+	for axis, vec := range map[string][]interface{}{"x": {1.0, 0.0, 0.0}, "z": {0.0, 0.0, 2.0}} {
+		spec["direction"] = axis
+		a, err := NewDeformation(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec["direction"] = vec
+		b, err := NewDeformation(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ax, ay, az := a.Apply(0.05, -0.1, 0.02)
+		bx, by, bz := b.Apply(0.05, -0.1, 0.02)
+		if math.Abs(ax-bx) > 1e-15 || math.Abs(ay-by) > 1e-15 || math.Abs(az-bz) > 1e-15 {
+			t.Errorf("direction %s: (%v, %v, %v) differs from vector %v: (%v, %v, %v)", axis, ax, ay, az, vec, bx, by, bz)
+		}
+	}
+	for _, bad := range []interface{}{"w", []interface{}{0.0, 0.0, 0.0}, []interface{}{1.0, 0.0}, 3.0} {
+		spec["direction"] = bad
+		if _, err := NewDeformation(spec); err == nil {
+			t.Errorf("expected error for direction %v", bad)
+		}
+	}
+}
+
+// Shift along x by Offset, registered by TestRegisterDeformation
+type shiftDeformation struct {
+	Deformation
+	Offset float64
+}
+
+func (s *shiftDeformation) Apply(x, y, z float64) (float64, float64, float64) {
+	return x + s.Offset, y, z
+}
+
+func (s *shiftDeformation) ToMap() map[string]interface{} {
+	return map[string]interface{}{"type": "test_shift", "offset": s.Offset}
+}
+
+func (s *shiftDeformation) FromMap(data map[string]interface{}) error {
+	var err error
+	s.Offset, err = toFloat64(data["offset"])
+	return err
+}
+
+func TestRotationDeformation(t *testing.T) {
+	euler := NewEulerRotation(0, 0, 90)
+	axis, err := NewDeformation(map[string]interface{}{"type": "rotation", "axis": []interface{}{0.0, 0.0, 2.0}, "angle": 90.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// object point (1, 0.5, 0.3) is carried to (-0.5, 1, 0.3) by a quarter turn about z
+	for _, d := range []Deformation{euler, axis} {
+		x, y, z := d.Apply(-0.5, 1, 0.3)
+		if math.Abs(x-1) > 1e-12 || math.Abs(y-0.5) > 1e-12 || math.Abs(z-0.3) > 1e-12 {
+			t.Errorf("%v: expected (1, 0.5, 0.3), got (%v, %v, %v)", d.ToMap(), x, y, z)
+		}
+	}
+	// x then y: object point on z goes to -y under x = 90, and stays there under y
+	d := NewEulerRotation(90, 30, 0)
+	if x, y, z := d.Apply(0, -1, 0); math.Abs(x) > 1e-12 || math.Abs(y) > 1e-12 || math.Abs(z-1) > 1e-12 {
+		t.Errorf("expected (0, 0, 1), got (%v, %v, %v)", x, y, z)
+	}
+	// rotation about a centre keeps it fixed
+	c, err := NewDeformation(map[string]interface{}{"type": "rotation", "euler": []interface{}{10.0, 20.0, 30.0}, "center": []interface{}{0.1, 0.2, 0.3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, y, z := c.Apply(0.1, 0.2, 0.3); math.Abs(x-0.1) > 1e-12 || math.Abs(y-0.2) > 1e-12 || math.Abs(z-0.3) > 1e-12 {
+		t.Errorf("expected centre to be fixed, got (%v, %v, %v)", x, y, z)
+	}
+}
+
+func TestInterpolatedDeformation(t *testing.T) {
+	d, err := NewDeformation(map[string]interface{}{
+		"type":   "interpolated",
+		"from":   map[string]interface{}{"type": "rigid", "displacements": []interface{}{0.4, 0.0, 0.0}},
+		"weight": 0.25,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing to is the identity, so a quarter of the way the displacement is 0.3
+	if x, y, z := d.Apply(0.1, 0.2, 0.3); math.Abs(x-0.4) > 1e-12 || y != 0.2 || z != 0.3 {
+		t.Errorf("expected (0.4, 0.2, 0.3), got (%v, %v, %v)", x, y, z)
+	}
+	to := &RigidDeformation{Displacements: []float64{0, 0, 1}, Type: "rigid"}
+	for _, w := range []float64{0, 1} {
+		x, y, z := NewInterpolatedDeformation(nil, to, w).Apply(0.1, 0.2, 0.3)
+		if x != 0.1 || y != 0.2 || math.Abs(z-0.3-w) > 1e-12 {
+			t.Errorf("weight %v: expected end state, got (%v, %v, %v)", w, x, y, z)
+		}
+	}
+}
+
+func TestRegisterDeformation(t *testing.T) {
+	for _, name := range []string{"gaussian", "linear", "rigid", "sigmoid", "swirl", "bend", "rotation", "interpolated"} {
+		if _, ok := registry[name]; !ok {
+			t.Errorf("built-in deformation %s is not registered", name)
+		}
+	}
+	factory := &DeformationFactory{}
+	spec := map[string]interface{}{"type": "test_shift", "offset": 0.5}
+	if _, err := factory.Create(spec); err == nil {
+		t.Fatal("expected error for unregistered type")
+	}
+	RegisterDeformation("test_shift", func() Deformation { return &shiftDeformation{} })
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test_shift")
+		registryMu.Unlock()
+	}()
+	d, err := factory.Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, y, z := d.Apply(0.1, 0.2, 0.3); x != 0.6 || y != 0.2 || z != 0.3 {
+		t.Errorf("expected (0.6, 0.2, 0.3), got (%v, %v, %v)", x, y, z)
+	}
+	if n := len(DeformationTypes()); n != 9 {
+		t.Errorf("expected 9 registered types, got %v", DeformationTypes())
+	}
+}
@@ -0,0 +1,72 @@
+// Package exr implements a minimal OpenEXR encoder for single channel float images.
+//
+// Images are written as single-part scanline files without compression,
+// with one 32-bit float channel named "Y".
+package exr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const magic = 20000630
+
+// Write header attribute with given name, type and value
+func writeAttribute(buf *bytes.Buffer, name, typ string, value []byte) {
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.WriteString(typ)
+	buf.WriteByte(0)
+	binary.Write(buf, binary.LittleEndian, int32(len(value)))
+	buf.Write(value)
+}
+
+// Little-endian encoding of values
+func le(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// Encode writes width x height float values pix (row-major, top row first) as an EXR image.
+func Encode(w io.Writer, width, height int, pix []float32) error {
+	var buf bytes.Buffer
+	buf.Write(le(int32(magic), int32(2))) // version 2, single-part scanline
+
+	// channel list: name, pixel type (2 = FLOAT), pLinear, reserved, x and y sampling
+	var ch bytes.Buffer
+	ch.WriteString("Y")
+	ch.WriteByte(0)
+	ch.Write(le(int32(2), uint8(0), [3]uint8{}, int32(1), int32(1)))
+	ch.WriteByte(0)
+	writeAttribute(&buf, "channels", "chlist", ch.Bytes())
+	writeAttribute(&buf, "compression", "compression", []byte{0})
+	window := le(int32(0), int32(0), int32(width-1), int32(height-1))
+	writeAttribute(&buf, "dataWindow", "box2i", window)
+	writeAttribute(&buf, "displayWindow", "box2i", window)
+	writeAttribute(&buf, "lineOrder", "lineOrder", []byte{0})
+	writeAttribute(&buf, "pixelAspectRatio", "float", le(float32(1)))
+	writeAttribute(&buf, "screenWindowCenter", "v2f", le(float32(0), float32(0)))
+	writeAttribute(&buf, "screenWindowWidth", "float", le(float32(1)))
+	buf.WriteByte(0)
+
+	// offset table with one entry per scanline, followed by scanlines (y, size, data)
+	line_size := 4 * width
+	offset := uint64(buf.Len() + 8*height)
+	for y := 0; y < height; y++ {
+		buf.Write(le(offset))
+		offset += uint64(8 + line_size)
+	}
+	for y := 0; y < height; y++ {
+		buf.Write(le(int32(y), int32(line_size)))
+		for x := 0; x < width; x++ {
+			binary.Write(&buf, binary.LittleEndian, math.Float32bits(pix[y*width+x]))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,87 @@
+package exr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// Minimal decoder for files written by Encode
+func decode(t *testing.T, data []byte) (int, int, []float32) {
+	r := bytes.NewReader(data)
+	var m, version int32
+	binary.Read(r, binary.LittleEndian, &m)
+	binary.Read(r, binary.LittleEndian, &version)
+	if m != magic || version != 2 {
+		t.Fatalf("bad magic %d or version %d", m, version)
+	}
+	readString := func() string {
+		var s []byte
+		for {
+			b, _ := r.ReadByte()
+			if b == 0 {
+				return string(s)
+			}
+			s = append(s, b)
+		}
+	}
+	var width, height int
+	attrs := map[string]string{}
+	for {
+		name := readString()
+		if name == "" {
+			break
+		}
+		typ := readString()
+		attrs[name] = typ
+		var size int32
+		binary.Read(r, binary.LittleEndian, &size)
+		value := make([]byte, size)
+		r.Read(value)
+		if name == "dataWindow" {
+			var box [4]int32
+			binary.Read(bytes.NewReader(value), binary.LittleEndian, &box)
+			width, height = int(box[2]-box[0]+1), int(box[3]-box[1]+1)
+		}
+	}
+	if attrs["channels"] != "chlist" || attrs["compression"] != "compression" {
+		t.Fatalf("missing required attributes %v", attrs)
+	}
+	offsets := make([]uint64, height)
+	binary.Read(r, binary.LittleEndian, &offsets)
+	pix := make([]float32, width*height)
+	for y := 0; y < height; y++ {
+		line := bytes.NewReader(data[offsets[y]:])
+		var ly, size int32
+		binary.Read(line, binary.LittleEndian, &ly)
+		binary.Read(line, binary.LittleEndian, &size)
+		if int(ly) != y || int(size) != 4*width {
+			t.Fatalf("bad scanline header y=%d size=%d", ly, size)
+		}
+		binary.Read(line, binary.LittleEndian, pix[y*width:(y+1)*width])
+	}
+	return width, height, pix
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	const width, height = 5, 3
+	pix := make([]float32, width*height)
+	for i := range pix {
+		pix[i] = float32(math.Exp(-float64(i) / 3))
+	}
+	pix[7] = 12.5 // beyond [0,1] range
+	var buf bytes.Buffer
+	if err := Encode(&buf, width, height, pix); err != nil {
+		t.Fatal(err)
+	}
+	w, h, out := decode(t, buf.Bytes())
+	if w != width || h != height {
+		t.Fatalf("expected %dx%d, got %dx%d", width, height, w, h)
+	}
+	for i := range pix {
+		if out[i] != pix[i] {
+			t.Errorf("pixel %d: expected %v, got %v", i, pix[i], out[i])
+		}
+	}
+}
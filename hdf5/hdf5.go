@@ -0,0 +1,343 @@
+// Package hdf5 implements a minimal HDF5 writer for float datasets with attributes.
+//
+// Files use superblock version 2 and a root group whose links are stored compactly in its
+// version 2 object header. Datasets are contiguous little-endian IEEE floats in the root group.
+// Attributes are compact and may be float64, int, string or []float64 values.
+package hdf5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+var signature = []byte{0x89, 'H', 'D', 'F', '\r', '\n', 0x1a, '\n'}
+
+const (
+	superblockSize = 48
+	undefined      = math.MaxUint64 // undefined address
+
+	msgDataspace = 0x0001
+	msgLinkInfo  = 0x0002
+	msgDatatype  = 0x0003
+	msgFillValue = 0x0005
+	msgLink      = 0x0006
+	msgLayout    = 0x0008
+	msgGroupInfo = 0x000a
+	msgAttribute = 0x000c
+)
+
+// Dataset of float32 or float64 values in row-major order with the given shape.
+type Dataset struct {
+	Name  string
+	Shape []int
+	Data  interface{} // []float32, []float64 or Float32Stream
+	Attrs map[string]interface{}
+}
+
+// Float32Stream supplies N little-endian float32 values from R while the file is encoded,
+// so that large datasets need not be held in memory.
+type Float32Stream struct {
+	R io.Reader
+	N int
+}
+
+// File with datasets and attributes in the root group.
+type File struct {
+	Datasets []Dataset
+	Attrs    map[string]interface{}
+}
+
+// Little-endian encoding of values
+func le(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// Jenkins lookup3 hashlittle with initial value 0, used for all HDF5 metadata checksums
+func checksum(data []byte) uint32 {
+	rot := func(x uint32, k uint) uint32 { return x<<k | x>>(32-k) }
+	a := 0xdeadbeef + uint32(len(data))
+	b, c := a, a
+	for len(data) > 12 {
+		a += binary.LittleEndian.Uint32(data[0:])
+		b += binary.LittleEndian.Uint32(data[4:])
+		c += binary.LittleEndian.Uint32(data[8:])
+		a -= c
+		a ^= rot(c, 4)
+		c += b
+		b -= a
+		b ^= rot(a, 6)
+		a += c
+		c -= b
+		c ^= rot(b, 8)
+		b += a
+		a -= c
+		a ^= rot(c, 16)
+		c += b
+		b -= a
+		b ^= rot(a, 19)
+		a += c
+		c -= b
+		c ^= rot(b, 4)
+		b += a
+		data = data[12:]
+	}
+	if len(data) == 0 {
+		return c
+	}
+	// last block zero padded
+	var tail [12]byte
+	copy(tail[:], data)
+	a += binary.LittleEndian.Uint32(tail[0:])
+	b += binary.LittleEndian.Uint32(tail[4:])
+	c += binary.LittleEndian.Uint32(tail[8:])
+	c ^= b
+	c -= rot(b, 14)
+	a ^= c
+	a -= rot(c, 11)
+	b ^= a
+	b -= rot(a, 25)
+	c ^= b
+	c -= rot(b, 16)
+	a ^= c
+	a -= rot(c, 4)
+	b ^= a
+	b -= rot(a, 14)
+	c ^= b
+	c -= rot(b, 24)
+	return c
+}
+
+// Datatype message of a little-endian IEEE float of the given size in bytes
+func floatType(size int) []byte {
+	if size == 4 {
+		return le(uint8(0x11), [3]uint8{0x20, 31, 0}, uint32(4), uint16(0), uint16(32), uint8(23), uint8(8), uint8(0), uint8(23), uint32(127))
+	}
+	return le(uint8(0x11), [3]uint8{0x20, 63, 0}, uint32(8), uint16(0), uint16(64), uint8(52), uint8(11), uint8(0), uint8(52), uint32(1023))
+}
+
+// Datatype message of a little-endian signed 64-bit integer
+func intType() []byte {
+	return le(uint8(0x10), [3]uint8{0x08, 0, 0}, uint32(8), uint16(0), uint16(64))
+}
+
+// Datatype message of an ASCII null-padded string of fixed length n
+func stringType(n int) []byte {
+	return le(uint8(0x13), [3]uint8{0x01, 0, 0}, uint32(n))
+}
+
+// Dataspace message of the given shape. Empty shape gives a scalar
+func dataspace(shape []int) []byte {
+	if len(shape) == 0 {
+		return le(uint8(2), uint8(0), uint8(0), uint8(0))
+	}
+	buf := le(uint8(2), uint8(len(shape)), uint8(0), uint8(1))
+	for _, n := range shape {
+		buf = append(buf, le(uint64(n))...)
+	}
+	return buf
+}
+
+// Attribute message (version 3) with datatype, dataspace and data derived from value
+func attribute(name string, value interface{}) ([]byte, error) {
+	var dtype, space, data []byte
+	switch v := value.(type) {
+	case float64:
+		dtype, space, data = floatType(8), dataspace(nil), le(v)
+	case int:
+		dtype, space, data = intType(), dataspace(nil), le(int64(v))
+	case string:
+		n := max(len(v), 1)
+		dtype, space, data = stringType(n), dataspace(nil), append([]byte(v), make([]byte, n-len(v))...)
+	case []float64:
+		dtype, space, data = floatType(8), dataspace([]int{len(v)}), le(v)
+	default:
+		return nil, fmt.Errorf("attribute %s: unsupported type %T", name, value)
+	}
+	buf := le(uint8(3), uint8(0), uint16(len(name)+1), uint16(len(dtype)), uint16(len(space)), uint8(0))
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	buf = append(buf, dtype...)
+	buf = append(buf, space...)
+	return append(buf, data...), nil
+}
+
+// Attribute messages in order of name
+func attributes(attrs map[string]interface{}) ([][]byte, error) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([][]byte, 0, len(names))
+	for _, name := range names {
+		msg, err := attribute(name, attrs[name])
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+type message struct {
+	typ      uint8
+	constant bool
+	data     []byte
+}
+
+// Version 2 object header with a single chunk holding the messages
+func objectHeader(msgs []message) []byte {
+	var body []byte
+	for _, m := range msgs {
+		flags := uint8(0)
+		if m.constant {
+			flags = 1
+		}
+		body = append(body, le(m.typ, uint16(len(m.data)), flags)...)
+		body = append(body, m.data...)
+	}
+	// flags 2: chunk size stored in 4 bytes
+	buf := append([]byte("OHDR"), le(uint8(2), uint8(2), uint32(len(body)))...)
+	buf = append(buf, body...)
+	return append(buf, le(checksum(buf))...)
+}
+
+// Number of values and element size of dataset values
+func (d *Dataset) size() (int, int, error) {
+	n := 1
+	for _, s := range d.Shape {
+		n *= s
+	}
+	var count, elem int
+	switch v := d.Data.(type) {
+	case []float32:
+		count, elem = len(v), 4
+	case []float64:
+		count, elem = len(v), 8
+	case Float32Stream:
+		count, elem = v.N, 4
+	default:
+		return 0, 0, fmt.Errorf("dataset %s: unsupported data type %T", d.Name, d.Data)
+	}
+	if count != n {
+		return 0, 0, fmt.Errorf("dataset %s: %d values for shape %v", d.Name, count, d.Shape)
+	}
+	return n, elem, nil
+}
+
+// Write the raw little-endian values of the dataset to w
+func (d *Dataset) write(w io.Writer, size int) error {
+	if v, ok := d.Data.(Float32Stream); ok {
+		n, err := io.CopyN(w, v.R, int64(size))
+		if err != nil {
+			return fmt.Errorf("dataset %s: %d of %d bytes: %w", d.Name, n, size, err)
+		}
+		return nil
+	}
+	_, err := w.Write(le(d.Data))
+	return err
+}
+
+// Object header of dataset d with values stored at address addr
+func (d *Dataset) header(addr uint64, size, elem int) ([]byte, error) {
+	attrs, err := attributes(d.Attrs)
+	if err != nil {
+		return nil, fmt.Errorf("dataset %s: %w", d.Name, err)
+	}
+	msgs := []message{
+		{msgDataspace, false, dataspace(d.Shape)},
+		{msgDatatype, true, floatType(elem)},
+		// space allocated early, fill value written if set (none is)
+		{msgFillValue, true, le(uint8(3), uint8(0x09))},
+		// contiguous layout
+		{msgLayout, false, le(uint8(3), uint8(1), addr, uint64(size))},
+	}
+	for _, a := range attrs {
+		msgs = append(msgs, message{msgAttribute, false, a})
+	}
+	return objectHeader(msgs), nil
+}
+
+// Encode writes the file to w.
+func (f *File) Encode(w io.Writer) error {
+	sizes := make([]int, len(f.Datasets))
+	elems := make([]int, len(f.Datasets))
+	for i := range f.Datasets {
+		n, elem, err := f.Datasets[i].size()
+		if err != nil {
+			return err
+		}
+		sizes[i], elems[i] = n*elem, elem
+	}
+	root_attrs, err := attributes(f.Attrs)
+	if err != nil {
+		return err
+	}
+	// root group: link info (no dense storage), group info and one hard link per dataset
+	root := func(addrs []uint64) []byte {
+		msgs := []message{
+			{msgLinkInfo, false, le(uint8(0), uint8(0), uint64(undefined), uint64(undefined))},
+			{msgGroupInfo, false, le(uint8(0), uint8(0))},
+		}
+		for i, d := range f.Datasets {
+			link := le(uint8(1), uint8(0), uint8(len(d.Name)))
+			link = append(link, d.Name...)
+			msgs = append(msgs, message{msgLink, false, append(link, le(addrs[i])...)})
+		}
+		for _, a := range root_attrs {
+			msgs = append(msgs, message{msgAttribute, false, a})
+		}
+		return objectHeader(msgs)
+	}
+	for _, d := range f.Datasets {
+		if len(d.Name) == 0 || len(d.Name) > 255 {
+			return fmt.Errorf("dataset name %q must have 1 to 255 characters", d.Name)
+		}
+	}
+	// header sizes do not depend on the addresses, so lay out root header, dataset headers, then data
+	addrs := make([]uint64, len(f.Datasets))
+	offset := uint64(superblockSize + len(root(addrs)))
+	headers := make([][]byte, len(f.Datasets))
+	for i := range f.Datasets {
+		h, err := f.Datasets[i].header(0, sizes[i], elems[i])
+		if err != nil {
+			return err
+		}
+		addrs[i] = offset
+		offset += uint64(len(h))
+	}
+	for i := range f.Datasets {
+		if headers[i], err = f.Datasets[i].header(offset, sizes[i], elems[i]); err != nil {
+			return err
+		}
+		offset += uint64(sizes[i])
+	}
+
+	var buf bytes.Buffer
+	buf.Write(signature)
+	// version 2, 8-byte offsets and lengths, base address 0, no superblock extension
+	buf.Write(le(uint8(2), uint8(8), uint8(8), uint8(0), uint64(0), uint64(undefined), offset, uint64(superblockSize)))
+	buf.Write(le(checksum(buf.Bytes())))
+	buf.Write(root(addrs))
+	for _, h := range headers {
+		buf.Write(h)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	// values follow the metadata, streamed without a copy of the whole file in memory
+	for i := range f.Datasets {
+		if err := f.Datasets[i].write(w, sizes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package hdf5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type decodedDataset struct {
+	shape []int
+	elem  int
+	data  []byte
+	attrs map[string]interface{}
+}
+
+// Minimal decoder for files written by Encode. Returns root attributes and datasets by name
+func decode(t *testing.T, data []byte) (map[string]interface{}, map[string]decodedDataset) {
+	if !bytes.Equal(data[:8], signature) || data[8] != 2 {
+		t.Fatalf("bad signature or superblock version")
+	}
+	if binary.LittleEndian.Uint32(data[44:]) != checksum(data[:44]) {
+		t.Fatal("bad superblock checksum")
+	}
+	if eof := binary.LittleEndian.Uint64(data[28:]); eof != uint64(len(data)) {
+		t.Fatalf("end of file address %d, file size %d", eof, len(data))
+	}
+	parseSpace := func(b []byte) []int {
+		shape := make([]int, b[1])
+		for k := range shape {
+			shape[k] = int(binary.LittleEndian.Uint64(b[4+8*k:]))
+		}
+		return shape
+	}
+	// messages of the object header at addr
+	header := func(addr uint64) map[uint8][][]byte {
+		if string(data[addr:addr+4]) != "OHDR" || data[addr+4] != 2 {
+			t.Fatalf("bad object header at %d", addr)
+		}
+		size := uint64(binary.LittleEndian.Uint32(data[addr+6:]))
+		end := addr + 10 + size
+		if binary.LittleEndian.Uint32(data[end:]) != checksum(data[addr:end]) {
+			t.Fatalf("bad object header checksum at %d", addr)
+		}
+		msgs := map[uint8][][]byte{}
+		for p := addr + 10; p < end; {
+			typ, n := data[p], uint64(binary.LittleEndian.Uint16(data[p+1:]))
+			msgs[typ] = append(msgs[typ], data[p+4:p+4+n])
+			p += 4 + n
+		}
+		return msgs
+	}
+	parseAttrs := func(msgs [][]byte) map[string]interface{} {
+		attrs := map[string]interface{}{}
+		for _, m := range msgs {
+			name_size, dtype_size, space_size := int(binary.LittleEndian.Uint16(m[2:])), int(binary.LittleEndian.Uint16(m[4:])), int(binary.LittleEndian.Uint16(m[6:]))
+			name := string(m[9 : 9+name_size-1])
+			dtype := m[9+name_size : 9+name_size+dtype_size]
+			shape := parseSpace(m[9+name_size+dtype_size:])
+			value := m[9+name_size+dtype_size+space_size:]
+			switch dtype[0] & 0x0f {
+			case 0:
+				attrs[name] = int(int64(binary.LittleEndian.Uint64(value)))
+			case 1:
+				floats := make([]float64, len(value)/8)
+				binary.Read(bytes.NewReader(value), binary.LittleEndian, floats)
+				if len(shape) == 0 {
+					attrs[name] = floats[0]
+				} else {
+					attrs[name] = floats
+				}
+			case 3:
+				attrs[name] = string(bytes.TrimRight(value, "\x00"))
+			}
+		}
+		return attrs
+	}
+	root := header(binary.LittleEndian.Uint64(data[36:]))
+	if len(root[msgLinkInfo]) != 1 || len(root[msgGroupInfo]) != 1 {
+		t.Fatal("root group lacks link info or group info message")
+	}
+	datasets := map[string]decodedDataset{}
+	for _, link := range root[msgLink] {
+		n := int(link[2])
+		name := string(link[3 : 3+n])
+		msgs := header(binary.LittleEndian.Uint64(link[3+n:]))
+		layout := msgs[msgLayout][0]
+		addr, size := binary.LittleEndian.Uint64(layout[2:]), binary.LittleEndian.Uint64(layout[10:])
+		datasets[name] = decodedDataset{
+			shape: parseSpace(msgs[msgDataspace][0]),
+			elem:  int(binary.LittleEndian.Uint32(msgs[msgDatatype][0][4:])),
+			data:  data[addr : addr+size],
+			attrs: parseAttrs(msgs[msgAttribute]),
+		}
+	}
+	return parseAttrs(root[msgAttribute]), datasets
+}
+
+func TestChecksum(t *testing.T) {
+	// reference values of lookup3 hashlittle with initval 0
+	if c := checksum(nil); c != 0xdeadbeef {
+		t.Errorf("empty input: expected 0xdeadbeef, got %#x", c)
+	}
+	if c := checksum([]byte("Four score and seven years ago")); c != 0x17770551 {
+		t.Errorf("expected 0x17770551, got %#x", c)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	stack := make([]float32, 2*3*4)
+	for i := range stack {
+		stack[i] = float32(i) / 7
+	}
+	angles := []float64{0, 90, 180, 90}
+	f := File{
+		Datasets: []Dataset{
+			{Name: "projections", Shape: []int{2, 3, 4}, Data: stack, Attrs: map[string]interface{}{"quantity": "transmittance"}},
+			{Name: "angles", Shape: []int{2, 2}, Data: angles},
+		},
+		Attrs: map[string]interface{}{"fl_x": 12.5, "w": 4, "geometry": "cone_beam", "orbit_axis": []float64{0, 0, 1}},
+	}
+	var buf bytes.Buffer
+	if err := f.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	attrs, datasets := decode(t, buf.Bytes())
+	if !reflect.DeepEqual(attrs, f.Attrs) {
+		t.Errorf("expected root attributes %v, got %v", f.Attrs, attrs)
+	}
+	proj := datasets["projections"]
+	if !reflect.DeepEqual(proj.shape, []int{2, 3, 4}) || proj.elem != 4 {
+		t.Fatalf("projections: shape %v element size %d", proj.shape, proj.elem)
+	}
+	for i, v := range stack {
+		if got := math.Float32frombits(binary.LittleEndian.Uint32(proj.data[4*i:])); got != v {
+			t.Fatalf("projections value %d: expected %v, got %v", i, v, got)
+		}
+	}
+	if proj.attrs["quantity"] != "transmittance" {
+		t.Errorf("expected quantity attribute, got %v", proj.attrs)
+	}
+	ang := datasets["angles"]
+	if !reflect.DeepEqual(ang.shape, []int{2, 2}) || ang.elem != 8 {
+		t.Fatalf("angles: shape %v element size %d", ang.shape, ang.elem)
+	}
+	for i, v := range angles {
+		if got := math.Float64frombits(binary.LittleEndian.Uint64(ang.data[8*i:])); got != v {
+			t.Errorf("angle %d: expected %v, got %v", i, v, got)
+		}
+	}
+
+	f.Datasets[0].Shape = []int{2, 3, 5}
+	if err := f.Encode(&buf); err == nil {
+		t.Error("expected error for data not matching shape")
+	}
+}
+
+func TestEncodeStream(t *testing.T) {
+	values := make([]float32, 2*5)
+	for i := range values {
+		values[i] = float32(i) * 0.25
+	}
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.LittleEndian, values)
+	encode := func(data interface{}) ([]byte, error) {
+		f := File{Datasets: []Dataset{{Name: "projections", Shape: []int{2, 5}, Data: data}}}
+		var buf bytes.Buffer
+		err := f.Encode(&buf)
+		return buf.Bytes(), err
+	}
+	want, err := encode(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := encode(Float32Stream{R: bytes.NewReader(raw.Bytes()), N: len(values)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("streamed dataset encodes differently from the slice")
+	}
+	if _, err := encode(Float32Stream{R: bytes.NewReader(raw.Bytes()[:12]), N: len(values)}); err == nil {
+		t.Error("expected error for a stream with too few values")
+	}
+}
+
+// Script reading the file given as argument with h5py and printing its contents as JSON
+const h5pyScript = `
+import json, sys
+import h5py
+with h5py.File(sys.argv[1], "r") as f:
+    def value(v):
+        return v.decode() if isinstance(v, bytes) else v.tolist() if hasattr(v, "tolist") else v
+    print(json.dumps({
+        "attrs": {k: value(v) for k, v in f.attrs.items()},
+        "datasets": {name: {"shape": list(d.shape), "dtype": d.dtype.str, "values": d[()].ravel().tolist(),
+                            "attrs": {k: value(v) for k, v in d.attrs.items()}} for name, d in f.items()},
+    }))
+`
+
+// Check files written by Encode against the reference HDF5 library through h5py, so that the format is
+// not only checked by decode. Skipped where python3 with h5py is not installed.
+func TestReadWithH5py(t *testing.T) {
+	if err := exec.Command("python3", "-c", "import h5py").Run(); err != nil {
+		t.Skip("python3 with h5py not available")
+	}
+	stack := make([]float32, 2*3*4)
+	for i := range stack {
+		stack[i] = float32(i) / 7
+	}
+	f := File{
+		Datasets: []Dataset{
+			{Name: "projections", Shape: []int{2, 3, 4}, Data: stack, Attrs: map[string]interface{}{"quantity": "transmittance"}},
+			{Name: "angles", Shape: []int{2, 2}, Data: []float64{0, 90, 180, 90}},
+		},
+		Attrs: map[string]interface{}{"fl_x": 12.5, "w": 4, "geometry": "cone_beam", "orbit_axis": []float64{0, 0, 1}},
+	}
+	var buf bytes.Buffer
+	if err := f.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "test.h5")
+	if err := os.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("python3", "-c", h5pyScript, fn).CombinedOutput()
+	if err != nil {
+		t.Fatalf("h5py cannot read the file: %v\n%s", err, out)
+	}
+	var got struct {
+		Attrs    map[string]interface{}
+		Datasets map[string]struct {
+			Shape  []int
+			Dtype  string
+			Values []float64
+			Attrs  map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("unexpected h5py output %s: %v", out, err)
+	}
+	wantAttrs := map[string]interface{}{"fl_x": 12.5, "w": 4.0, "geometry": "cone_beam", "orbit_axis": []interface{}{0.0, 0.0, 1.0}}
+	if !reflect.DeepEqual(got.Attrs, wantAttrs) {
+		t.Errorf("expected root attributes %v, got %v", wantAttrs, got.Attrs)
+	}
+	proj := got.Datasets["projections"]
+	if !reflect.DeepEqual(proj.Shape, []int{2, 3, 4}) || proj.Dtype != "<f4" || proj.Attrs["quantity"] != "transmittance" {
+		t.Fatalf("projections: shape %v dtype %s attributes %v", proj.Shape, proj.Dtype, proj.Attrs)
+	}
+	for i, v := range stack {
+		if float32(proj.Values[i]) != v {
+			t.Fatalf("projections value %d: expected %v, got %v", i, v, proj.Values[i])
+		}
+	}
+	if ang := got.Datasets["angles"]; !reflect.DeepEqual(ang.Values, []float64{0, 90, 180, 90}) || ang.Dtype != "<f8" {
+		t.Errorf("angles: dtype %s values %v", ang.Dtype, ang.Values)
+	}
+}
@@ -9,20 +9,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-gl/mathgl/mgl64"
 	"github.com/igrega348/xray_projection_render/deformations"
+	"github.com/igrega348/xray_projection_render/exr"
+	"github.com/igrega348/xray_projection_render/hdf5"
 	"github.com/igrega348/xray_projection_render/objects"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -34,246 +46,2072 @@ import (
 // Global variables
 var lat = []objects.Object{}
 var df = []deformations.Deformation{}
+var df_schedule = []ScheduleEntry{}
 var density_multiplier = 1.0
 var integrate = integrate_hierarchical
+var integration_method = "hierarchical" // name of integrate, see set_integration
 var flat_field = 0.0
-var warned_clipping_max = false
-var warned_clipping_min = false
+var refine_factor = 10      // number of fine steps per coarse step DS in hierarchical integration
+var background_gain = 1.0   // png pixel values are background_gain*value + background_offset
+var background_offset = 0.0 // see background_gain
+var warned_non_finite = false
 var text_progress = false
+var quiet = false
+var output_quantity = "transmittance"
+var mask_threshold = 0.0 // density above which a ray counts as occupied in mask output
+// rays integrated since reset_clipping and how many of them had nonzero density at smin or smax,
+// i.e. were clipped by the integration span. Updated atomically by concurrent pixel goroutines
+var clip_rays, clipped_smin, clipped_smax atomic.Int64
 
-const cube_half_diagonal = 1.74
+var sample_counts [][]int                    // number of density evaluations per pixel, recorded when not nil
+var density_trace func(x, y, z, rho float64) // called on every density evaluation when not nil. Not safe for concurrent rendering
+
+// world-space slab outside of which the scene is treated as empty
+var clip_min = mgl64.Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+var clip_max = mgl64.Vec3{math.Inf(1), math.Inf(1), math.Inf(1)}
+
+// half diagonal of the cube [-1, 1]^3 which holds the scene, and default half length of the ray span
+var cube_half_diagonal = 1.74
+
+// default relative margin applied to the half length of the ray span so that objects touching
+// the cube are not clipped at smin or smax
+const default_span_margin = 1.05
+
+// default number of grid points along each axis of the deformation export
+const default_deformation_export_res = 32
+
+// default exponent of the gamma and log tone maps
+const default_tonemap_exponent = 2.2
+
+// Read file and unmarshal its contents into out. Format is chosen from the file extension
+// (.yaml, .yml or .json, case insensitive).
+func unmarshal_file(fn string, out interface{}) error {
+	ext := strings.ToLower(filepath.Ext(fn))
+	if ext != ".yaml" && ext != ".yml" && ext != ".json" {
+		return fmt.Errorf("unknown file extension '%s' of '%s' (expected .yaml, .yml or .json)", ext, fn)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	if ext == ".json" {
+		err = json.Unmarshal(data, out)
+	} else {
+		err = yaml.Unmarshal(data, out)
+	}
+	if err != nil {
+		return fmt.Errorf("error unmarshalling '%s': %w", fn, err)
+	}
+	return nil
+}
+
+// Read a single deformation from file. Deformation can be in JSON or YAML format (.json, .yaml or .yml).
+func read_deformation(fn string) (deformations.Deformation, error) {
+	factory := &deformations.DeformationFactory{}
+	out := map[string]interface{}{}
+	if err := unmarshal_file(fn, &out); err != nil {
+		return nil, err
+	}
+	d, err := factory.Create(out)
+	if err != nil {
+		return nil, fmt.Errorf("error creating %v deformation from '%s': %w", out["type"], fn, err)
+	}
+	return d, nil
+}
 
 // Load deformation from file. Deformation can be in JSON or YAML format.
-// Supported deformation types can be found in deformations package (gaussian, linear, rigid and sigmoid).
+// Supported deformation types can be found in deformations package (gaussian, linear, rigid, sigmoid, swirl, bend and rotation).
 func load_deformation(fn string) error {
 	if len(fn) == 0 {
 		log.Info().Msg("No deformation file provided")
 		return nil
 	}
 	log.Info().Msgf("Loading deformation from '%s'", fn)
-	data, err := os.ReadFile(fn)
+	deformation, err := read_deformation(fn)
 	if err != nil {
-		log.Fatal().Err(err)
+		return err
 	}
-	factory := &deformations.DeformationFactory{}
+	log.Info().Msgf("Deformation: %v", deformation)
+	df = append(df, deformation)
+	return nil
+}
 
-	out := map[string]interface{}{}
-	switch ext := fn[len(fn)-4:]; ext {
-	case "yaml":
-		err = yaml.Unmarshal(data, &out)
+// One entry of a deformation schedule.
+// The deformation applies to frame Frame and all following frames until the next entry.
+type ScheduleEntry struct {
+	Frame       int
+	Time        float64
+	Deformation deformations.Deformation
+}
+
+// Load deformation schedule from file. Schedule is a JSON or YAML list of entries, each with
+// a 'frame' index, an optional 'time' label and either an inline 'deformation' map or
+// a 'file' path pointing to a deformation file. Entries without time get default_time.
+func load_deformation_schedule(fn string, default_time float64) error {
+	if len(fn) == 0 {
+		return nil
+	}
+	log.Info().Msgf("Loading deformation schedule from '%s'", fn)
+	var out []interface{}
+	if err := unmarshal_file(fn, &out); err != nil {
+		return err
+	}
+	factory := &deformations.DeformationFactory{}
+	for i, item := range out {
+		entry_data, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("schedule entry %d is not a map", i)
+		}
+		entry := ScheduleEntry{Time: default_time}
+		frame, err := objects.ToFloat64(entry_data["frame"])
 		if err != nil {
-			log.Error().Msgf("Error unmarshalling YAML: %v", err)
+			return fmt.Errorf("schedule entry %d: frame is not a number", i)
+		}
+		entry.Frame = int(frame)
+		if t, ok := entry_data["time"]; ok {
+			if entry.Time, err = objects.ToFloat64(t); err != nil {
+				return fmt.Errorf("schedule entry %d: time is not a number", i)
+			}
+		}
+		if deformation_data, ok := entry_data["deformation"].(map[string]interface{}); ok {
+			entry.Deformation, err = factory.Create(deformation_data)
+		} else if file, ok := entry_data["file"].(string); ok {
+			entry.Deformation, err = read_deformation(file)
+		} else {
+			err = fmt.Errorf("neither deformation nor file given")
 		}
-	case "json":
-		err = json.Unmarshal(data, &out)
 		if err != nil {
-			log.Error().Msgf("Error unmarshalling JSON: %v", err)
+			return fmt.Errorf("schedule entry %d: %v", i, err)
 		}
-	default:
-		fmt.Println("Unknown file extension:", ext)
+		df_schedule = append(df_schedule, entry)
 	}
-	deformation, err := factory.Create(out)
-	if err != nil {
-		fmt.Println("Error creating deformation:", err)
-		return err
+	sort.SliceStable(df_schedule, func(i, j int) bool { return df_schedule[i].Frame < df_schedule[j].Frame })
+	log.Info().Msgf("Loaded %d deformation schedule entries", len(df_schedule))
+	return nil
+}
+
+// Find the schedule entry which applies to frame i_img.
+// Returns false if frame precedes all scheduled entries.
+func scheduled_entry(i_img int) (ScheduleEntry, bool) {
+	var entry ScheduleEntry
+	found := false
+	for _, e := range df_schedule {
+		if e.Frame > i_img {
+			break
+		}
+		entry = e
+		found = true
 	}
-	log.Info().Msgf("Deformation: %v", deformation)
-	df = append(df, deformation)
-	return err
+	return entry, found
 }
 
 // Load object from file. Object can be in JSON or YAML format.
-// Supported object types can be found in objects package (tessellated_obj_coll, object_collection, sphere, cube and cylinder).
-// If object is not loaded correctly, the program will render blank scene.
+// Supported object types are those registered in the objects package (see objects.ObjectTypes and objects.RegisterObject).
+// If object cannot be loaded, an error is returned and the scene is left unchanged.
 func load_object(fn string) error {
 	log.Info().Msgf("Loading object from '%s'", fn)
-	data, err := os.ReadFile(fn)
+	out := map[string]interface{}{}
+	if err := unmarshal_file(fn, &out); err != nil {
+		return err
+	}
+	// data files named in the scene are relative to it
+	defer func(dir string) { objects.DataDir = dir }(objects.DataDir)
+	objects.DataDir = filepath.Dir(fn)
+	type_name, _ := out["type"].(string)
+	obj, err := objects.NewObjectOfType(type_name)
 	if err != nil {
-		log.Fatal().Err(err)
+		return fmt.Errorf("unknown object type '%v' in '%s'", out["type"], fn)
 	}
-	out := map[string]interface{}{}
-	switch ext := fn[len(fn)-4:]; ext {
-	case "yaml":
-		err = yaml.Unmarshal(data, &out)
-		if err != nil {
-			log.Error().Msgf("Error unmarshalling YAML: %v", err)
-		}
-	case "json":
-		err = json.Unmarshal(data, &out)
-		if err != nil {
-			log.Error().Msgf("Error unmarshalling JSON: %v", err)
-		}
-	default:
-		log.Warn().Msgf("Unknown file extension: %s", ext)
-	}
-	// based on the type of object, convert to the appropriate object
-	var obj objects.Object
-	switch out["type"] {
-	case "tessellated_obj_coll":
-		obj = &objects.TessellatedObjColl{}
-	case "object_collection":
-		obj = &objects.ObjectCollection{}
-	case "sphere":
-		obj = &objects.Sphere{}
-	case "cube":
-		obj = &objects.Cube{}
-	case "cylinder":
-		obj = &objects.Cylinder{}
-	case "parallelepiped":
-		obj = &objects.Parallelepiped{}
-	default:
-		log.Fatal().Msgf("Unknown object type: %v", out["type"])
+	if err := obj.FromMap(out); err != nil {
+		return fmt.Errorf("error creating %v from '%s': %w", out["type"], fn, err)
+	}
+	if err := objects.CheckEmission(obj, out); err != nil {
+		return fmt.Errorf("error creating %v from '%s': %w", out["type"], fn, err)
 	}
-	err = obj.FromMap(out)
 	lat = append(lat, obj)
-	if err != nil {
-		log.Error().Msgf("Error converting to object collection: %v", err)
+	return nil
+}
+
+// Integrate along a single ray and write every density sample as CSV rows s,x,y,z,density to w,
+// where s is the distance along the ray from origin, in the order the integrator evaluated them.
+// Returns the optical depth.
+func trace_ray(w io.Writer, origin, direction mgl64.Vec3, ds, smin, smax float64) (float64, error) {
+	unit := direction.Normalize()
+	var werr error
+	fmt.Fprintln(w, "s,x,y,z,density")
+	density_trace = func(x, y, z, rho float64) {
+		s := mgl64.Vec3{x, y, z}.Sub(origin).Dot(unit)
+		if _, err := fmt.Fprintf(w, "%g,%g,%g,%g,%g\n", s, x, y, z, rho); err != nil && werr == nil {
+			werr = err
+		}
 	}
-	return err
+	defer func() { density_trace = nil }()
+	T, _ := integrate(origin, direction, ds, smin, smax)
+	return T, werr
+}
+
+// Number of direct children of composite objects, 0 for primitives
+func num_children(obj objects.Object) int {
+	switch o := obj.(type) {
+	case *objects.ObjectCollection:
+		return len(o.Objects)
+	case *objects.TessellatedObjColl:
+		return len(o.UC.Struts.Objects)
+	case *objects.Instanced:
+		return len(o.Instances)
+	case *objects.SphereCloud:
+		return len(o.Centers)
+	case *objects.LatticeRepeat:
+		return 1
+	}
+	return 0
 }
 
-// Deform the coordinates based on the deformation loaded from file. If no deformation is loaded, return the original coordinates.
+// Write diagnostics of obj to w: type, number of children, bounding box, min feature size and
+// Monte Carlo estimates of volume fraction and mass within the bounding box from n_samples points.
+func write_info(w io.Writer, obj objects.Object, n_samples int) {
+	lo, hi := obj.BoundingBox()
+	fmt.Fprintf(w, "type: %v\n", obj.ToMap()["type"])
+	fmt.Fprintf(w, "children: %d\n", num_children(obj))
+	fmt.Fprintf(w, "bounding box: %v to %v\n", lo, hi)
+	fmt.Fprintf(w, "min feature size: %g\n", obj.MinFeatureSize())
+	if math.IsInf(lo.Len(), 0) || math.IsInf(hi.Len(), 0) {
+		fmt.Fprintln(w, "volume fraction: unknown (unbounded)")
+		return
+	}
+	mass, fraction := objects.EstimateMass(obj, lo, hi, n_samples, rand.New(rand.NewSource(0)))
+	fmt.Fprintf(w, "volume fraction: %.4f (of bounding box, %d samples)\n", fraction, n_samples)
+	fmt.Fprintf(w, "mass: %.6g\n", mass)
+}
+
+// Deform the coordinates based on the deformations loaded from file. If no deformation is loaded, return the original coordinates.
+// Multiple deformations are composed in the order they were loaded.
 func deform(x, y, z float64) (float64, float64, float64) {
-	if len(df) == 0 {
-		return x, y, z
-	} else if len(df) == 1 {
-		x, y, z = df[0].Apply(x, y, z)
-		return x, y, z
-	} else {
-		log.Fatal().Msg("Multiple deformations not yet supported")
-		return x, y, z
+	for _, d := range df {
+		x, y, z = d.Apply(x, y, z)
 	}
+	return x, y, z
 }
 
 // Compute the density of the scene at the given coordinates.
 // Transform the coordinates first based on the deformation field.
 func density(x, y, z float64) float64 {
+	rho := scene_density(x, y, z)
+	if density_trace != nil {
+		density_trace(x, y, z, rho)
+	}
+	return rho
+}
+
+func scene_density(x, y, z float64) float64 {
+	if x < clip_min[0] || x > clip_max[0] || y < clip_min[1] || y > clip_max[1] || z < clip_min[2] || z > clip_max[2] {
+		return 0.0
+	}
+	x0, y0, z0 := x, y, z
+	x, y, z = deform(x, y, z)
+	rho := lat[0].Density(x, y, z) * density_multiplier
+	if math.IsNaN(rho) || math.IsInf(rho, 0) {
+		if !warned_non_finite {
+			log.Warn().Msgf("Non-finite density %v at (%v, %v, %v) treated as 0", rho, x0, y0, z0)
+			warned_non_finite = true
+		}
+		return 0.0
+	}
+	return rho
+}
+
+// Emission coefficient of the scene (see objects.Emitter) with the same clipping and deformation as scene_density.
+func scene_emission(x, y, z float64) float64 {
+	if x < clip_min[0] || x > clip_max[0] || y < clip_min[1] || y > clip_max[1] || z < clip_min[2] || z > clip_max[2] {
+		return 0.0
+	}
 	x, y, z = deform(x, y, z)
-	return lat[0].Density(x, y, z) * density_multiplier
+	return objects.Emission(lat[0], x, y, z)
+}
+
+// Integrate the emission along the ray without attenuation using the midpoint rule with step ds/refine_factor,
+// the resolution to which the hierarchical method refines boundaries.
+func integrate_emission(origin, direction mgl64.Vec3, ds, smin, smax float64) float64 {
+	direction = direction.Normalize()
+	h := ds / float64(refine_factor)
+	E := 0.0
+	for s := smin + 0.5*h; s < smax; s += h {
+		E += scene_emission(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s) * h
+	}
+	return E
+}
+
+// Select the integration method by name: simple, hierarchical, importance or reference.
+func set_integration(name string) error {
+	switch name {
+	case "simple":
+		integrate = integrate_along_ray
+	case "hierarchical":
+		integrate = integrate_hierarchical
+	case "importance":
+		integrate = integrate_importance
+	case "reference":
+		integrate = integrate_reference
+	default:
+		return fmt.Errorf("unknown integration method: %s", name)
+	}
+	integration_method = name
+	log.Info().Msgf("Using %s integration method", name)
+	return nil
 }
 
-// Integrate the density along the ray from the origin to the end point.
+// Reset the clipping counters, e.g. at the start of a view
+func reset_clipping() {
+	clip_rays.Store(0)
+	clipped_smin.Store(0)
+	clipped_smax.Store(0)
+}
+
+// Fractions of the rays integrated since reset_clipping which were clipped at smin and at smax.
+// Only hierarchical integration checks for clipping, so both are 0 for other methods
+func clipping_fractions() (float64, float64) {
+	n := clip_rays.Load()
+	if n == 0 {
+		return 0, 0
+	}
+	return float64(clipped_smin.Load()) / float64(n), float64(clipped_smax.Load()) / float64(n)
+}
+
+// Integrate the density along the ray from the origin to the end point and return the optical depth
+// together with the number of density evaluations.
 // Simple integration method with fixed step size.
-func integrate_along_ray(origin, direction mgl64.Vec3, ds, smin, smax float64) float64 {
+func integrate_along_ray(origin, direction mgl64.Vec3, ds, smin, smax float64) (float64, int) {
 	direction = direction.Normalize()
 	T := flat_field
+	n := 0
 	for s := smin; s < smax; s += ds {
 		x := origin[0] + direction[0]*s
 		y := origin[1] + direction[1]*s
 		z := origin[2] + direction[2]*s
 		T += density(x, y, z) * ds
+		n++
+	}
+	return T, n
+}
+
+// Integrate the density along the ray from the origin to the end point and return the optical depth
+// together with the number of density evaluations.
+// Hierarchical integration method which is more efficient than simple integration.
+// Refines the integration step size to DS/refine_factor within coarse steps where density changes.
+func integrate_hierarchical(origin, direction mgl64.Vec3, DS, smin, smax float64) (float64, int) {
+	direction = direction.Normalize()
+	// check clipping
+	clip_rays.Add(1)
+	if density(origin[0]+direction[0]*smin, origin[1]+direction[1]*smin, origin[2]+direction[2]*smin) > 0 {
+		clipped_smin.Add(1)
+	}
+	if density(origin[0]+direction[0]*smax, origin[1]+direction[1]*smax, origin[2]+direction[2]*smax) > 0 {
+		clipped_smax.Add(1)
+	}
+	// integrate using sliding window
+	right := smin + DS
+	left := smin
+	ds := DS / float64(refine_factor)
+	prev_rho := 0.0
+	T := flat_field
+	n := 2 // clipping checks
+	for right <= smax {
+		x := origin[0] + direction[0]*right
+		y := origin[1] + direction[1]*right
+		z := origin[2] + direction[2]*right
+		rho := density(x, y, z)
+		n++
+		if (rho == 0) != (prev_rho == 0) { // rho changed between left and right
+			// count fine steps explicitly: accumulating left += ds can fall just short of right
+			// and sample the transition point twice
+			for k := 1; k < refine_factor; k++ {
+				s := left + float64(k)*ds
+				x := origin[0] + direction[0]*s
+				y := origin[1] + direction[1]*s
+				z := origin[2] + direction[2]*s
+				T += density(x, y, z) * ds
+				n++
+			}
+			T += rho * ds // reuse rho from right
+		} else {
+			T += rho * DS
+		}
+		prev_rho = rho
+		left = right
+		right += DS
+	}
+	return T, n
+}
+
+// Integrate the density along the ray from the origin to the end point and return the optical depth
+// together with the number of density evaluations.
+// Reference integration method: midpoint rule with fixed step DS/100.
+// Slow, but used to validate the faster integrators.
+func integrate_reference(origin, direction mgl64.Vec3, DS, smin, smax float64) (float64, int) {
+	direction = direction.Normalize()
+	ds := DS / 100.0
+	steps := int(math.Ceil((smax - smin) / ds))
+	T := flat_field
+	for k := 0; k < steps; k++ {
+		s := smin + (float64(k)+0.5)*ds
+		T += density(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s) * ds
+	}
+	return T, steps
+}
+
+// Integrate the density along the ray from the origin to the end point and return the optical depth
+// together with the number of density evaluations.
+// Importance integration method: a coarse scan with step DS first locates intervals of nonzero density,
+// then only those intervals (padded by one coarse step) are integrated with fine step DS/10.
+// Features thinner than DS can be missed by the coarse scan.
+func integrate_importance(origin, direction mgl64.Vec3, DS, smin, smax float64) (float64, int) {
+	direction = direction.Normalize()
+	n := 0
+	// coarse scan for intervals [start, end] containing nonzero density.
+	// Boundaries lie between coarse samples, so intervals start one step before the first nonzero sample
+	// and end at the first zero sample after it
+	var intervals [][2]float64
+	inside := false
+	for s := smin; s <= smax; s += DS {
+		rho := density(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s)
+		n++
+		if rho != 0 && !inside {
+			inside = true
+			start := math.Max(s-DS, smin)
+			if len(intervals) > 0 && start <= intervals[len(intervals)-1][1] {
+				// reopen previous interval
+				continue
+			}
+			intervals = append(intervals, [2]float64{start, smax})
+		} else if rho == 0 && inside {
+			intervals[len(intervals)-1][1] = s
+			inside = false
+		}
+	}
+	if inside {
+		intervals[len(intervals)-1][1] = smax
+	}
+	// fine integration within intervals
+	ds := DS / 10.0
+	T := flat_field
+	for _, interval := range intervals {
+		for s := interval[0] + 0.5*ds; s < interval[1]; s += ds {
+			T += density(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s) * ds
+			n++
+		}
+	}
+	return T, n
+}
+
+// Azimuthal angle th (degrees) and polar angle phi (radians) of the camera for image i_img.
+// Out of plane views draw phi uniformly on the sphere restricted to the band [polar_min, polar_max] (degrees).
+func generateCameraAngles(i_img, num_images int, out_of_plane bool, polar_min, polar_max float64) (float64, float64) {
+	dth := 360.0 / float64(num_images)
+	th := float64(i_img)*dth + 90.0
+	if !out_of_plane {
+		return th, math.Pi / 2.0
+	}
+	// uniform in cos(phi) gives uniform area density on the sphere
+	zmin := math.Cos(mgl64.DegToRad(polar_max))
+	zmax := math.Cos(mgl64.DegToRad(polar_min))
+	z := zmin + rand.Float64()*(zmax-zmin)
+	return th, math.Acos(z)
+}
+
+// Camera to world matrix for camera at distance R looking at the origin. Azimuthal angle th (degrees)
+// and polar angle phi (radians) are measured about orbit_axis, which is also the up direction.
+func camera_from_angles(th, phi, R float64, orbit_axis mgl64.Vec3) mgl64.Mat4 {
+	eye := mgl64.Vec3{R * math.Cos(mgl64.DegToRad(float64(th))) * math.Sin(phi), R * math.Sin(mgl64.DegToRad(float64(th))) * math.Sin(phi), math.Cos(phi) * R}
+	up := mgl64.Vec3{0, 0, 1}
+	// rotate the orbit about z onto the orbit axis
+	rot := mgl64.QuatBetweenVectors(up, orbit_axis)
+	eye = rot.Rotate(eye)
+	up = rot.Rotate(up)
+	center := mgl64.Vec3{0, 0, 0}
+	camera := mgl64.LookAtV(eye, center, up)
+	// use the matrix to transform coordinates from camera space to world space
+	return camera.Inv()
+}
+
+// Load camera keyframes from a JSON or YAML list of entries with 'eye' and optional 'target'
+// (default origin) and 'up' (default up) positions. Returns camera to world matrix of each keyframe.
+func load_camera_keyframes(fn string, up mgl64.Vec3) ([]mgl64.Mat4, error) {
+	var out []interface{}
+	if err := unmarshal_file(fn, &out); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no keyframes in '%s'", fn)
+	}
+	keyframes := make([]mgl64.Mat4, len(out))
+	for i, item := range out {
+		data, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("keyframe %d is not a map", i)
+		}
+		var eye, target mgl64.Vec3
+		key_up := up
+		vecs := map[string]*mgl64.Vec3{"eye": &eye, "target": &target, "up": &key_up}
+		for key, vec := range vecs {
+			if _, ok := data[key]; !ok && key != "eye" {
+				continue
+			}
+			slice, ok := data[key].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("keyframe %d: %s is not a Vec3", i, key)
+			}
+			if err := objects.ToVec(&slice, vec); err != nil {
+				return nil, fmt.Errorf("keyframe %d: %s: %v", i, key, err)
+			}
+		}
+		if eye.Sub(target).Len() == 0 || eye.Sub(target).Cross(key_up).Len() == 0 {
+			return nil, fmt.Errorf("keyframe %d: eye must differ from target and view direction must not be parallel to up", i)
+		}
+		keyframes[i] = mgl64.LookAtV(eye, target, key_up).Inv()
+	}
+	return keyframes, nil
+}
+
+// Camera to world matrix of frame i_img of num_images on a smooth path through the keyframes, which are
+// spread evenly over the frames. Positions follow a uniform Catmull-Rom spline with the end keyframes
+// repeated, orientations are interpolated by slerp between consecutive keyframes.
+func camera_on_path(keyframes []mgl64.Mat4, i_img, num_images int) mgl64.Mat4 {
+	n := len(keyframes)
+	if n == 1 || num_images < 2 {
+		return keyframes[0]
+	}
+	u := float64(i_img) * float64(n-1) / float64(num_images-1)
+	k := min(int(u), n-2)
+	t := u - float64(k)
+	p := func(i int) mgl64.Vec3 {
+		return keyframes[max(0, min(i, n-1))].Col(3).Vec3()
+	}
+	p0, p1, p2, p3 := p(k-1), p(k), p(k+1), p(k+2)
+	eye := p1.Mul(2).
+		Add(p2.Sub(p0).Mul(t)).
+		Add(p0.Mul(2).Sub(p1.Mul(5)).Add(p2.Mul(4)).Sub(p3).Mul(t * t)).
+		Add(p1.Mul(3).Sub(p0).Sub(p2.Mul(3)).Add(p3).Mul(t * t * t)).
+		Mul(0.5)
+	q1 := mgl64.Mat4ToQuat(keyframes[k]).Normalize()
+	q2 := mgl64.Mat4ToQuat(keyframes[k+1]).Normalize()
+	// shortest arc
+	if q1.Dot(q2) < 0 {
+		q2 = q2.Scale(-1)
+	}
+	camera := mgl64.QuatSlerp(q1, q2, t).Normalize().Mat4()
+	camera.SetCol(3, eye.Vec4(1))
+	return camera
+}
+
+// Outward surface normal of the scene at given coordinates, zero away from surfaces.
+// Uses the object's surface normal if there is no deformation, otherwise central differences with step h.
+func surface_normal(x, y, z, h float64) mgl64.Vec3 {
+	if len(df) == 0 {
+		return objects.SurfaceNormal(lat[0], x, y, z, h)
+	}
+	g := mgl64.Vec3{
+		(density(x+h, y, z) - density(x-h, y, z)) / (2 * h),
+		(density(x, y+h, z) - density(x, y-h, z)) / (2 * h),
+		(density(x, y, z+h) - density(x, y, z-h)) / (2 * h),
+	}
+	if g.Len() == 0 {
+		return g
+	}
+	return g.Normalize().Mul(-1)
+}
+
+// March along the ray with step ds and return distance to the first sample with nonzero density.
+// Second return value is false if the ray does not hit the scene between smin and smax.
+func first_hit(origin, direction mgl64.Vec3, ds, smin, smax float64) (float64, bool) {
+	direction = direction.Normalize()
+	for s := smin; s < smax; s += ds {
+		if density(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s) != 0 {
+			return s, true
+		}
+	}
+	return math.Inf(1), false
+}
+
+// March along the ray with step ds and report whether any sample has density above threshold,
+// i.e. whether the maximum density along the ray exceeds it. Returns early at the first such sample.
+// Second return value is the number of density evaluations.
+func ray_occupied(origin, direction mgl64.Vec3, ds, smin, smax, threshold float64) (bool, int) {
+	direction = direction.Normalize()
+	n := 0
+	for s := smin; s < smax; s += ds {
+		n++
+		if density(origin[0]+direction[0]*s, origin[1]+direction[1]*s, origin[2]+direction[2]*s) > threshold {
+			return true, n
+		}
+	}
+	return false, n
+}
+
+// Compute outward surface normal at the first hit of the ray and set it in normals at i, j.
+// Normal is zero for rays which miss the scene.
+func computeNormal(normals [][]mgl64.Vec3, i, j int, origin, direction mgl64.Vec3, ds, smin, smax float64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	normals[i][j] = mgl64.Vec3{}
+	s, hit := first_hit(origin, direction, ds, smin, smax)
+	if !hit {
+		return
+	}
+	p := origin.Add(direction.Normalize().Mul(s))
+	// first hit is within ds of the surface, so the gradient is resolved with step ds
+	normals[i][j] = surface_normal(p[0], p[1], p[2], ds)
+}
+
+// Compute the dark-field value (integrated emission) of the ray and set it in darkfield at i, j.
+func computeDarkfield(darkfield [][]float64, i, j int, origin, direction mgl64.Vec3, ds, smin, smax float64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	darkfield[i][j] = integrate_emission(origin, direction, ds, smin, smax)
+}
+
+// Compute the dark-field value at i, j as the average integrated emission over spp rays through the same
+// jittered positions within the pixel as computePixelSupersampled.
+func computeDarkfieldSupersampled(darkfield [][]float64, i, j, frame, spp int, ray func(x, y float64) (mgl64.Vec3, mgl64.Vec3), ds, smin, smax float64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	sum := 0.0
+	for k := 0; k < spp; k++ {
+		dx, dy := pixel_jitter(i, j, k, frame)
+		origin, direction := ray(float64(i)+dx, float64(j)+dy)
+		sum += integrate_emission(origin, direction, ds, smin, smax)
+	}
+	darkfield[i][j] = sum / float64(spp)
+}
+
+// Compute the pixel value for ray starting at origin and going in direction,
+// between smin and smax, with step size ds. Set the value in the image at i, j.
+// Pixel value is transmittance exp(-T), attenuation T, distance to the first nonzero density
+// (infinite for misses) or occupancy 0/1 depending on output_quantity.
+func computePixel(img [][]float64, i, j int, origin, direction mgl64.Vec3, ds, smin, smax float64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	val, n := ray_value(origin, direction, ds, smin, smax)
+	if sample_counts != nil && output_quantity != "depth" {
+		sample_counts[i][j] = n
+	}
+	img[i][j] = val
+}
+
+// Pixel value of a single ray according to output_quantity and the number of density evaluations.
+func ray_value(origin, direction mgl64.Vec3, ds, smin, smax float64) (float64, int) {
+	if output_quantity == "depth" {
+		s, _ := first_hit(origin, direction, ds, smin, smax)
+		return s, 0
+	}
+	if output_quantity == "mask" {
+		hit, n := ray_occupied(origin, direction, ds, smin, smax, mask_threshold)
+		if hit {
+			return 1, n
+		}
+		return 0, n
+	}
+	T, n := integrate(origin, direction, ds, smin, smax)
+	if output_quantity == "attenuation" {
+		return T, n
+	}
+	return math.Exp(-T), n
+}
+
+// Integer hash of pixel, sample and frame indices (lowbias32 finalizer applied to each input in turn).
+func jitter_hash(i, j, sample, frame int) uint32 {
+	h := uint32(0x9e3779b9)
+	for _, v := range []int{i, j, sample, frame} {
+		h ^= uint32(v)
+		h ^= h >> 16
+		h *= 0x7feb352d
+		h ^= h >> 15
+		h *= 0x846ca68b
+		h ^= h >> 16
+	}
+	return h
+}
+
+// Deterministic sub-pixel offset in [0,1)^2 of the given sample of pixel (i,j) in frame.
+// Depends only on its arguments, so pixels can be computed in any order without a shared RNG.
+func pixel_jitter(i, j, sample, frame int) (float64, float64) {
+	h := jitter_hash(i, j, sample, frame)
+	g := jitter_hash(i, j, sample, ^frame)
+	// top 24 bits give exactly representable values below 1
+	return float64(h>>8) / (1 << 24), float64(g>>8) / (1 << 24)
+}
+
+// Compute the pixel value at i, j as the average over spp rays through jittered positions within the pixel.
+// ray gives the ray through a detector position in pixel units. Depth is the nearest hit over all rays
+// and a mask pixel is occupied when at least half of its rays are.
+func computePixelSupersampled(img [][]float64, i, j, frame, spp int, ray func(x, y float64) (mgl64.Vec3, mgl64.Vec3), ds, smin, smax float64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	sum := 0.0
+	nearest := math.Inf(1)
+	n_total := 0
+	for k := 0; k < spp; k++ {
+		dx, dy := pixel_jitter(i, j, k, frame)
+		origin, direction := ray(float64(i)+dx, float64(j)+dy)
+		val, n := ray_value(origin, direction, ds, smin, smax)
+		sum += val
+		nearest = math.Min(nearest, val)
+		n_total += n
+	}
+	if sample_counts != nil && output_quantity != "depth" {
+		sample_counts[i][j] = n_total
+	}
+	if output_quantity == "depth" {
+		img[i][j] = nearest
+	} else if output_quantity == "mask" {
+		img[i][j] = 0
+		if sum >= 0.5*float64(spp) {
+			img[i][j] = 1
+		}
+	} else {
+		img[i][j] = sum / float64(spp)
+	}
+}
+
+// Add first-order scatter to the transmittance in img within i in [i0, i1) and j in [j0, j1):
+// img += fraction * G_sigma * (1 - img), where G_sigma is a normalised Gaussian blur of standard
+// deviation sigma pixels, applied separably with neighbours outside the region clamped to its border.
+func add_scatter(img [][]float64, i0, i1, j0, j1 int, fraction, sigma float64) {
+	ni, nj := i1-i0, j1-j0
+	absorbed := make([][]float64, ni)
+	for i := range absorbed {
+		absorbed[i] = make([]float64, nj)
+		for j := range absorbed[i] {
+			absorbed[i][j] = 1 - img[i+i0][j+j0]
+		}
+	}
+	if sigma > 0 {
+		half := int(math.Ceil(3 * sigma))
+		kernel := make([]float64, 2*half+1)
+		sum := 0.0
+		for k := range kernel {
+			d := float64(k - half)
+			kernel[k] = math.Exp(-d * d / (2 * sigma * sigma))
+			sum += kernel[k]
+		}
+		for k := range kernel {
+			kernel[k] /= sum
+		}
+		tmp := make([][]float64, ni)
+		for i := range tmp {
+			tmp[i] = make([]float64, nj)
+			for j := range tmp[i] {
+				for k, w := range kernel {
+					tmp[i][j] += w * absorbed[max(0, min(i+k-half, ni-1))][j]
+				}
+			}
+		}
+		for i := range absorbed {
+			for j := range absorbed[i] {
+				absorbed[i][j] = 0
+				for k, w := range kernel {
+					absorbed[i][j] += w * tmp[i][max(0, min(j+k-half, nj-1))]
+				}
+			}
+		}
+	}
+	for i := range absorbed {
+		for j := range absorbed[i] {
+			img[i+i0][j+j0] += fraction * absorbed[i][j]
+		}
+	}
+}
+
+// Replace img within i in [i0, i1) and j in [j0, j1) by (1-weight)*img + weight*|grad img|, where the gradient
+// is given by the Sobel operator scaled so that a unit step gives magnitude 1. Neighbours outside the region
+// are clamped to its border.
+func edge_enhance(img [][]float64, i0, i1, j0, j1 int, weight float64) {
+	at := func(i, j int) float64 {
+		return img[max(i0, min(i, i1-1))][max(j0, min(j, j1-1))]
+	}
+	mag := make([][]float64, i1-i0)
+	for i := i0; i < i1; i++ {
+		mag[i-i0] = make([]float64, j1-j0)
+		for j := j0; j < j1; j++ {
+			gx := at(i+1, j-1) + 2*at(i+1, j) + at(i+1, j+1) - at(i-1, j-1) - 2*at(i-1, j) - at(i-1, j+1)
+			gy := at(i-1, j+1) + 2*at(i, j+1) + at(i+1, j+1) - at(i-1, j-1) - 2*at(i, j-1) - at(i+1, j-1)
+			mag[i-i0][j-j0] = math.Hypot(gx, gy) / 4
+		}
+	}
+	for i := i0; i < i1; i++ {
+		for j := j0; j < j1; j++ {
+			img[i][j] = (1-weight)*img[i][j] + weight*mag[i-i0][j-j0]
+		}
+	}
+}
+
+// Read frame records written by append_frame_record. Returns frames keyed by file path.
+// Missing file gives no records.
+func read_frame_records(fn string) (map[string]OneFrameParams, error) {
+	out := map[string]OneFrameParams{}
+	data, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		var frame OneFrameParams
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			// last line can be truncated if previous run was interrupted while writing
+			log.Warn().Msgf("Ignoring corrupt frame record: %v", err)
+			continue
+		}
+		out[frame.FilePath] = frame
+	}
+	return out, nil
+}
+
+// Append frame parameters as a JSON line to file fn.
+func append_frame_record(fn string, frame OneFrameParams) error {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// Check if png image fn exists and has the expected dimensions.
+// For other formats only check that the file is not empty.
+func image_complete(fn string, w, h int) bool {
+	if filepath.Ext(fn) != ".png" {
+		info, err := os.Stat(fn)
+		return err == nil && info.Size() > 0
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	return err == nil && cfg.Width == w && cfg.Height == h
+}
+
+// Create built-in lattice tessellated over the cube [-0.5,0.5]^3.
+// Strut radius, unit cell size and strut density are given by rad, scale and rho.
+func builtin_lattice(name string, rad, scale, rho float64) (objects.Object, error) {
+	var uc objects.UnitCell
+	switch name {
+	case "kelvin":
+		uc = objects.MakeKelvin(rad, scale, rho)
+	case "diamond":
+		uc = objects.MakeDiamond(rad, scale, rho)
+	default:
+		return nil, fmt.Errorf("unknown built-in lattice: %s", name)
+	}
+	return &objects.TessellatedObjColl{UC: uc, Xmin: -0.5, Xmax: 0.5, Ymin: -0.5, Ymax: 0.5, Zmin: -0.5, Zmax: 0.5}, nil
+}
+
+// Compute camera distance such that the bounding sphere of obj (centred at the origin)
+// fits within the field of view fov (degrees) with relative margin.
+func auto_distance(obj objects.Object, fov, margin float64) float64 {
+	return distance_for_radius(objects.BoundingRadius(obj), fov, margin)
+}
+
+// Camera distance at which a sphere of radius rb at the origin fits within the field of view fov (degrees).
+func distance_for_radius(rb, fov, margin float64) float64 {
+	return rb * (1 + margin) / math.Sin(mgl64.DegToRad(fov/2))
+}
+
+// Size of a detector pixel projected to the plane through the centre of the scene at distance R
+// from the source, i.e. the detector pixel pitch divided by the cone beam magnification.
+func pixel_footprint(res int, fov, R float64) float64 {
+	f := 1 / math.Tan(mgl64.DegToRad(fov/2))
+	return 2 * R / (f * float64(res))
+}
+
+// Integration step inferred from the object and imaging geometry. A third of the smallest feature size
+// of obj, but in cone beam geometry no finer than the pixel footprint at the object, which gives
+// about one sample per projected voxel and avoids over-sampling at low magnification.
+func auto_ds(obj objects.Object, res int, fov, R float64, geometry string) float64 {
+	ds := obj.MinFeatureSize() / 3.0
+	if geometry == "cone_beam" {
+		ds = math.Max(ds, pixel_footprint(res, fov, R))
+	}
+	return ds
+}
+
+// Load flat field image (beam profile) from png file. Values are taken from the first channel
+// and scaled to [0,1]. Returned buffer is indexed the same way as the rendered image, i.e. img[i][j]
+// with j increasing upwards.
+func load_flat_field_image(fn string, res int) ([][]float64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ff, err := png.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	b := ff.Bounds()
+	if b.Dx() != res || b.Dy() != res {
+		return nil, fmt.Errorf("flat field image '%s' is %dx%d but rendered images are %dx%d", fn, b.Dx(), b.Dy(), res, res)
+	}
+	out := make([][]float64, res)
+	for i := range out {
+		out[i] = make([]float64, res)
+		for j := range out[i] {
+			r, _, _, _ := ff.At(b.Min.X+i, b.Min.Y+res-1-j).RGBA()
+			out[i][j] = float64(r) / 0xffff
+		}
+	}
+	return out, nil
+}
+
+// Compute origin and direction of the ray through the centre of pixel (i,j) given camera to world matrix
+// and focal length f. In cone beam geometry all rays start at the camera.
+// In fan beam geometry rays within a row diverge from a source point in the plane of the row,
+// while rows are parallel and spaced such that magnification at distance R matches cone beam.
+func pixel_ray(i, j int, res_f, f, R float64, camera mgl64.Mat4, geometry string) (mgl64.Vec3, mgl64.Vec3) {
+	return pixel_ray_at(float64(i)+0.5, float64(j)+0.5, res_f, f, R, camera, geometry)
+}
+
+// Ray through detector position (x,y) given in pixel units, e.g. (i+dx, j+dy) for a sub-pixel offset.
+// Pixel (i,j) covers [i, i+1) x [j, j+1) and the optical axis is at (res/2, res/2), matching CX and CY
+// in transforms.json since image row res-1-j holds j.
+func pixel_ray_at(x, y, res_f, f, R float64, camera mgl64.Mat4, geometry string) (mgl64.Vec3, mgl64.Vec3) {
+	src := mgl64.Vec3{0, 0, 0}
+	pix := mgl64.Vec3{x/(res_f/2) - 1, y/(res_f/2) - 1, -f}
+	if geometry == "fan_beam" {
+		src[1] = pix[1] * R / f
+		pix[1] = src[1]
+	}
+	origin := mgl64.TransformCoordinate(src, camera)
+	vx := mgl64.TransformCoordinate(pix, camera) // coordinates of pixel (i,j) at focal plane in real space
+	return origin, vx.Sub(origin)
+}
+
+// Distances along the ray from origin in direction between which it can meet the sphere of radius half_span
+// about the origin, which holds the scene. The start is clamped to 0 so that nothing behind origin is integrated.
+func ray_span(origin, direction mgl64.Vec3, half_span float64) (float64, float64) {
+	s := -origin.Dot(direction.Normalize()) // closest approach to the origin
+	return math.Max(0, s-half_span), math.Max(0, s+half_span)
+}
+
+// Helper function to measure elapsed time.
+func timer() func() {
+	start := time.Now()
+	return func() {
+		log.Info().Msgf("Elapsed time: %v", time.Since(start))
+	}
+}
+
+// Parse comma-separated list of numbers. Empty string gives empty list.
+func parseFloatList(s string) ([]float64, error) {
+	out := []float64{}
+	if len(strings.TrimSpace(s)) == 0 {
+		return out, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		val, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// Parse comma-separated list of integers. Empty string gives empty list.
+func parseIntList(s string) ([]int, error) {
+	out := []int{}
+	if len(strings.TrimSpace(s)) == 0 {
+		return out, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		val, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// Azimuthal and polar angle in degrees about orbit_axis (as used by camera_from_angles, azimuth wrapped
+// to [0, 360)) and eye position of a frame. Angles are recovered from the camera position, so they are
+// also available for reused or resumed frames.
+func frame_angles(frame OneFrameParams, orbit_axis mgl64.Vec3) (float64, float64, mgl64.Vec3) {
+	eye := mgl64.Vec3{frame.TransformMatrix[0][3], frame.TransformMatrix[1][3], frame.TransformMatrix[2][3]}
+	local := mgl64.QuatBetweenVectors(mgl64.Vec3{0, 0, 1}, orbit_axis).Inverse().Rotate(eye)
+	azimuth := math.Mod(mgl64.RadToDeg(math.Atan2(local[1], local[0]))+360, 360)
+	polar := mgl64.RadToDeg(math.Acos(mgl64.Clamp(local[2]/local.Len(), -1, 1)))
+	return azimuth, polar, eye
+}
+
+// Write CSV with one row per frame: file path, azimuthal and polar angle (see frame_angles) and the eye position.
+func write_angles_csv(fn string, tp TransformParams, orbit_axis mgl64.Vec3) error {
+	var sb strings.Builder
+	sb.WriteString("file_path,azimuth,polar,eye_x,eye_y,eye_z\n")
+	for _, frame := range tp.Frames {
+		azimuth, polar, eye := frame_angles(frame, orbit_axis)
+		fmt.Fprintf(&sb, "%s,%.6f,%.6f,%.9g,%.9g,%.9g\n", frame.FilePath, azimuth, polar, eye[0], eye[1], eye[2])
+	}
+	return os.WriteFile(fn, []byte(sb.String()), 0644)
+}
+
+// Convert a camera-to-world matrix between the OpenGL convention used internally (camera looks along -z,
+// y up) and the OpenCV convention (camera looks along +z, y down) by flipping the camera y and z axes.
+// The flip is its own inverse, so the same call converts in either direction. Other conventions are unchanged.
+func convert_camera_convention(c2w mgl64.Mat4, convention string) mgl64.Mat4 {
+	if convention != "opencv" {
+		return c2w
+	}
+	return c2w.Mul4(mgl64.Diag4(mgl64.Vec4{1, -1, -1, 1}))
+}
+
+// File name of the hdf5 output within the output directory
+const hdf5_name = "projections.h5"
+
+// Projections of a run in frame order, held in memory up to max_in_memory frames (0 for no limit).
+// Beyond that, buffered frames are flushed to a temporary spool file in dir and streamed back by data.
+type projection_spool struct {
+	max_in_memory int
+	dir           string
+	buf           []float32
+	file          *os.File
+	n             int // number of values added
+}
+
+// Append the raw values of one projection, flushing the buffer to the spool file when it holds max_in_memory frames.
+func (ps *projection_spool) add(pix []float32) error {
+	ps.buf = append(ps.buf, pix...)
+	ps.n += len(pix)
+	if ps.max_in_memory <= 0 || len(ps.buf) < ps.max_in_memory*len(pix) {
+		return nil
+	}
+	if ps.file == nil {
+		var err error
+		if ps.file, err = os.CreateTemp(ps.dir, "projections_*.spool"); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(ps.file)
+	if err := binary.Write(w, binary.LittleEndian, ps.buf); err != nil {
+		return err
+	}
+	ps.buf = ps.buf[:0]
+	return w.Flush()
+}
+
+// All values added so far: the in-memory slice if nothing was spooled, otherwise a stream over the spool file and buffer
+func (ps *projection_spool) data() (interface{}, error) {
+	if ps.file == nil {
+		return ps.buf, nil
+	}
+	if _, err := ps.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var tail bytes.Buffer
+	binary.Write(&tail, binary.LittleEndian, ps.buf)
+	return hdf5.Float32Stream{R: io.MultiReader(bufio.NewReader(ps.file), &tail), N: ps.n}, nil
+}
+
+// Remove the spool file, if any
+func (ps *projection_spool) close() {
+	if ps.file != nil {
+		ps.file.Close()
+		os.Remove(ps.file.Name())
+		ps.file = nil
+	}
+}
+
+// Write the projections stack (raw values, frames in the order of tp.Frames, rows top first) to an hdf5 file with
+// datasets projections (N, H, W), angles (N, 2) holding azimuth and polar angle in degrees (see frame_angles)
+// and transform_matrices (N, 4, 4), and the intrinsics of tp as attributes of the root group.
+// stack is a []float32 or an hdf5.Float32Stream.
+func write_hdf5(fn string, tp TransformParams, stack interface{}, orbit_axis mgl64.Vec3) error {
+	n := len(tp.Frames)
+	angles := make([]float64, 0, 2*n)
+	matrices := make([]float64, 0, 16*n)
+	for _, frame := range tp.Frames {
+		azimuth, polar, _ := frame_angles(frame, orbit_axis)
+		angles = append(angles, azimuth, polar)
+		for _, row := range frame.TransformMatrix {
+			matrices = append(matrices, row...)
+		}
+	}
+	geometry := tp.Geometry
+	if geometry == "" {
+		geometry = "cone_beam"
+	}
+	camera_convention := tp.CameraConvention
+	if camera_convention == "" {
+		camera_convention = "opengl"
+	}
+	f := hdf5.File{
+		Datasets: []hdf5.Dataset{
+			{Name: "projections", Shape: []int{n, tp.H, tp.W}, Data: stack, Attrs: map[string]interface{}{"quantity": output_quantity}},
+			{Name: "angles", Shape: []int{n, 2}, Data: angles, Attrs: map[string]interface{}{"columns": "azimuth,polar", "units": "degrees"}},
+			{Name: "transform_matrices", Shape: []int{n, 4, 4}, Data: matrices, Attrs: map[string]interface{}{"camera_convention": camera_convention}},
+		},
+		Attrs: map[string]interface{}{
+			"camera_angle_x": tp.CameraAngle,
+			"fl_x":           tp.FL_X,
+			"fl_y":           tp.FL_Y,
+			"cx":             tp.CX,
+			"cy":             tp.CY,
+			"w":              tp.W,
+			"h":              tp.H,
+			"geometry":       geometry,
+			"orbit_axis":     []float64{orbit_axis[0], orbit_axis[1], orbit_axis[2]},
+		},
+	}
+	if tp.RowSpacing > 0 {
+		f.Attrs["row_spacing"] = tp.RowSpacing
+	}
+	out, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := f.Encode(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Encode image as png to file fn
+func write_png(fn string, img image.Image) error {
+	out, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Encode width x height raw values pix as exr to file fn
+func write_exr(fn string, width, height int, pix []float32) error {
+	out, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := exr.Encode(out, width, height, pix); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Raw pixel values within window as float32, top row first
+func raw_pixels(img [][]float64, res int, window image.Rectangle) []float32 {
+	pix := make([]float32, 0, window.Dx()*window.Dy())
+	for j := res - 1 - window.Min.Y; j >= res-window.Max.Y; j-- {
+		for i := window.Min.X; i < window.Max.X; i++ {
+			pix = append(pix, float32(img[i][j]))
+		}
+	}
+	return pix
+}
+
+// Write cameras.txt and images.txt in COLMAP text format to directory dir.
+// All frames share one PINHOLE camera. COLMAP stores world-to-camera transforms with the camera
+// looking along +z and y pointing down, whereas transform_matrix is camera-to-world looking along -z.
+func write_colmap(dir string, tp TransformParams) error {
+	cameras := "# Camera list with one line of data per camera:\n#   CAMERA_ID, MODEL, WIDTH, HEIGHT, PARAMS[]\n"
+	cameras += fmt.Sprintf("1 PINHOLE %d %d %g %g %g %g\n", tp.W, tp.H, tp.FL_X, tp.FL_Y, tp.CX, tp.CY)
+	if err := os.WriteFile(filepath.Join(dir, "cameras.txt"), []byte(cameras), 0644); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("# Image list with two lines of data per image:\n")
+	sb.WriteString("#   IMAGE_ID, QW, QX, QY, QZ, TX, TY, TZ, CAMERA_ID, NAME\n")
+	sb.WriteString("#   POINTS2D[] as (X, Y, POINT3D_ID)\n")
+	for i, frame := range tp.Frames {
+		var c2w mgl64.Mat4
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				c2w.Set(r, c, frame.TransformMatrix[r][c])
+			}
+		}
+		// COLMAP uses the OpenCV convention
+		if tp.CameraConvention != "opencv" {
+			c2w = convert_camera_convention(c2w, "opencv")
+		}
+		w2c := c2w.Inv()
+		q := mgl64.Mat4ToQuat(w2c).Normalize()
+		t := w2c.Col(3)
+		fmt.Fprintf(&sb, "%d %.10g %.10g %.10g %.10g %.10g %.10g %.10g 1 %s\n\n", i+1, q.W, q.V[0], q.V[1], q.V[2], t[0], t[1], t[2], frame.FilePath)
+	}
+	return os.WriteFile(filepath.Join(dir, "images.txt"), []byte(sb.String()), 0644)
+}
+
+// Parameters of a render run for the manifest: the render parameters and the global settings which drive the
+// render, named after their command line flags.
+type ManifestParams struct {
+	RenderParams
+	Integration      string        `json:"integration"`
+	RefineFactor     int           `json:"refine_factor"` // value in effect, replacing 0 for the default
+	ClipMin          []interface{} `json:"clip_min"`      // x, y and z, null where unbounded
+	ClipMax          []interface{} `json:"clip_max"`
+	BoundarySoftness float64       `json:"boundary_softness"`
+	MaskThreshold    float64       `json:"mask_threshold"`
+	OutputQuantity   string        `json:"output_quantity"`
+}
+
+// Components of v for JSON output, with null for infinite components which JSON cannot represent
+func json_vec3(v mgl64.Vec3) []interface{} {
+	out := make([]interface{}, 3)
+	for k := range v {
+		if !math.IsInf(v[k], 0) {
+			out[k] = v[k]
+		}
+	}
+	return out
+}
+
+// Summary of a render run for provenance.
+type Manifest struct {
+	Params            ManifestParams           `json:"params"`
+	ObjectSHA256      string                   `json:"object_sha256,omitempty"` // hash of the input object file
+	Deformations      []map[string]interface{} `json:"deformations"`            // static deformations or schedule entries
+	Resolution        int                      `json:"resolution"`
+	NumFrames         int                      `json:"num_frames"`
+	MinValue          float64                  `json:"min_value"`
+	MaxValue          float64                  `json:"max_value"`
+	ElapsedSeconds    float64                  `json:"elapsed_seconds"`
+	DensityMultiplier float64                  `json:"density_multiplier"`
+	FlatField         float64                  `json:"flat_field"`
+	BackgroundGain    float64                  `json:"background_gain"`
+	BackgroundOffset  float64                  `json:"background_offset"`
+	OutputQuantity    string                   `json:"output_quantity"`
+	ClippedSmin       float64                  `json:"clipped_fraction_smin"` // fraction of rays with nonzero density at the start of the span
+	ClippedSmax       float64                  `json:"clipped_fraction_smax"` // fraction of rays with nonzero density at the end of the span
+}
+
+// Tone map of a png value v in [0, 1]. linear is the identity, gamma gives v^exponent and log compresses
+// exponent decades of dynamic range as log10(1 + (10^exponent - 1) v) / exponent. Both keep 0 and 1 fixed.
+func tonemap(v float64, mode string, exponent float64) float64 {
+	switch mode {
+	case "gamma":
+		return math.Pow(v, exponent)
+	case "log":
+		return math.Log10(1+(math.Pow(10, exponent)-1)*v) / exponent
+	}
+	return v
+}
+
+// Write v as indented JSON to file fn.
+func write_json(fn string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
+
+// Read transform parameters written by a previous run.
+func read_transforms_file(fn string) (TransformParams, error) {
+	var tp TransformParams
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return tp, err
+	}
+	err = json.Unmarshal(data, &tp)
+	return tp, err
+}
+
+// Merge partial transforms written by chunked jobs (see RenderParams.ChunkAngles) into a single set
+// with frames ordered by their global index. Intrinsics are taken from the first file and must agree
+// between files, and the frame indices must cover 0..n-1 exactly once.
+func MergeTransforms(paths []string) (TransformParams, error) {
+	var merged TransformParams
+	if len(paths) == 0 {
+		return merged, fmt.Errorf("no transforms files to merge")
+	}
+	for k, fn := range paths {
+		tp, err := read_transforms_file(fn)
+		if err != nil {
+			return merged, fmt.Errorf("%s: %w", fn, err)
+		}
+		if k == 0 {
+			merged = tp
+			merged.Frames = nil
+		} else if tp.W != merged.W || tp.H != merged.H || tp.FL_X != merged.FL_X || tp.FL_Y != merged.FL_Y || tp.Geometry != merged.Geometry {
+			return merged, fmt.Errorf("%s: intrinsics differ from %s", fn, paths[0])
+		}
+		for i, frame := range tp.Frames {
+			if frame.FrameIndex == nil {
+				return merged, fmt.Errorf("%s: frame %d has no frame_index", fn, i)
+			}
+			merged.Frames = append(merged.Frames, frame)
+		}
+	}
+	sort.SliceStable(merged.Frames, func(a, b int) bool {
+		return *merged.Frames[a].FrameIndex < *merged.Frames[b].FrameIndex
+	})
+	for i, frame := range merged.Frames {
+		if *frame.FrameIndex != i {
+			return merged, fmt.Errorf("frame indices are not 0..%d: found %d at position %d", len(merged.Frames)-1, *frame.FrameIndex, i)
+		}
+	}
+	return merged, nil
+}
+
+// Parameters for each image.
+type OneFrameParams struct {
+	FilePath        string      `json:"file_path"`
+	Time            float64     `json:"time"`
+	TransformMatrix [][]float64 `json:"transform_matrix"`
+	FrameIndex      *int        `json:"frame_index,omitempty"`    // global index of the frame in chunked runs
+	FlatFieldRef    *int        `json:"flat_field_ref,omitempty"` // index of the flat-field reference acquisition of the frame
+	DatasetIndex    *int        `json:"dataset_index,omitempty"`  // index of the frame in the projections dataset of hdf5 output
+}
+
+// Transform parameters for all images.
+type TransformParams struct {
+	CameraAngle float64 `json:"camera_angle_x"`
+	FL_X        float64 `json:"fl_x"`
+	FL_Y        float64 `json:"fl_y"`
+	W           int     `json:"w"`
+	H           int     `json:"h"`
+	CX          float64 `json:"cx"`
+	CY          float64 `json:"cy"`
+	Geometry    string  `json:"geometry,omitempty"`    // fan_beam if not cone beam
+	RowSpacing  float64 `json:"row_spacing,omitempty"` // fan beam: spacing of detector rows at the rotation axis
+	ROI         []int   `json:"roi,omitempty"`         // x0,y0,x1,y1 of the rendered window within the full detector
+	// camera axes of transform_matrix: opencv if not the default opengl
+	CameraConvention string `json:"camera_convention,omitempty"`
+	// tone map applied to png values and its exponent, omitted for linear
+	Tonemap         string           `json:"tonemap,omitempty"`
+	TonemapExponent float64          `json:"tonemap_exponent,omitempty"`
+	Frames          []OneFrameParams `json:"frames"`
+}
+
+// Parameters controlling the rendering.
+type RenderParams struct {
+	Input               string    `json:"input"`                         // object file, used by render
+	OutputDir           string    `json:"output_dir"`                    // directory for the images
+	FnamePattern        string    `json:"fname_pattern"`                 // Sprintf pattern for image file names
+	Res                 int       `json:"resolution"`                    // resolution of the square images
+	NumImages           int       `json:"num_projections"`               // number of projections
+	OutOfPlane          bool      `json:"out_of_plane"`                  // random polar angle
+	PolarMin            float64   `json:"polar_min"`                     // lower bound of random polar angle in degrees
+	PolarMax            float64   `json:"polar_max"`                     // upper bound of random polar angle in degrees (0 together with PolarMin 0 means 180)
+	DS                  float64   `json:"ds"`                            // integration step size. If negative, infer from object
+	R                   float64   `json:"R"`                             // distance between camera and centre of scene
+	FOV                 float64   `json:"fov"`                           // field of view in degrees
+	JobsModulo          int       `json:"jobs_modulo"`                   // number of jobs run independently
+	JobNum              int       `json:"job"`                           // job number
+	ChunkAngles         bool      `json:"chunk_angles"`                  // write the job's frames to its own directory and partial transforms file for MergeTransforms
+	TransformsFile      string    `json:"transforms_file"`               // output file for transform parameters
+	DeformationFile     string    `json:"deformation_file"`              // optional deformation file
+	DeformationSchedule string    `json:"deformation_schedule"`          // optional per-frame deformation schedule
+	MotionBlurSamples   int       `json:"motion_blur_samples"`           // projections averaged over each frame's exposure while the schedule moves the object. 0 or 1 for none
+	TimeLabel           float64   `json:"time_label"`                    // time label for frames
+	FrameTimes          []float64 `json:"frame_times"`                   // optional time label per frame, overrides TimeLabel
+	FlatFieldRefs       []int     `json:"flat_field_refs"`               // optional index of the flat-field reference per frame, stored in the transforms
+	Transparency        bool      `json:"transparency"`                  // transparent background
+	ROI                 []int     `json:"roi"`                           // optional region of interest x0,y0,x1,y1
+	Grayscale           bool      `json:"grayscale"`                     // 16-bit grayscale output
+	Roll                []float64 `json:"roll"`                          // detector roll about view direction in degrees. Single value or one per frame
+	Geometry            string    `json:"geometry"`                      // beam geometry: cone_beam (default) or fan_beam
+	FlatFieldImage      string    `json:"flat_field_image"`              // optional image with per-pixel beam profile
+	FlatFieldImageMode  string    `json:"flat_field_image_mode"`         // how flat field image is applied: multiply (default) or add
+	AutoDistance        bool      `json:"auto_distance"`                 // compute R from bounding box of the object and FOV
+	AutoDistanceMargin  float64   `json:"auto_distance_margin"`          // relative margin around the object for AutoDistance
+	OrbitAxis           []float64 `json:"orbit_axis"`                    // axis of the camera orbit and up direction. Default z
+	CenterObject        bool      `json:"center_object"`                 // translate the object so that its bounding box is centred at the origin
+	Strict              bool      `json:"strict"`                        // fail instead of warning when the object lies mostly outside the renderable region
+	ObjectEuler         []float64 `json:"object_euler"`                  // optional rotation of the object about the origin by Euler angles x,y,z in degrees
+	ExportDeformation   string    `json:"export_deformation"`            // optional .npy or raw file for the displacement p - deform(p) over the integrated region, see write_deformation_volume
+	DeformationGridRes  int       `json:"export_deformation_resolution"` // grid points along each axis of the deformation export. 0 gives default_deformation_export_res
+	Resume              bool      `json:"resume"`                        // skip frames already rendered by a previous run
+	Overwrite           bool      `json:"overwrite"`                     // allow the command line to render over existing images and transforms, see check_overwrite
+	OutputFormat        string    `json:"output_format"`                 // png (default), exr or hdf5 (single file for the whole run)
+	Invert              bool      `json:"invert"`                        // store 1 - value in output images (bright object on dark background)
+	CameraExport        string    `json:"camera_export"`                 // optional additional camera format: colmap
+	CameraConvention    string    `json:"camera_convention"`             // axes of the stored transform_matrix: opengl (default, looks along -z) or opencv (looks along +z, y down)
+	AnglesCSV           string    `json:"angles_csv"`                    // optional CSV file with azimuthal and polar angle and eye position of each frame
+	ReuseTransforms     string    `json:"reuse_transforms"`              // optional transforms file of a previous run whose camera poses are rendered
+	SkipObjectDump      bool      `json:"skip_object_dump"`              // do not write the rendered object as YAML after the run
+	ObjectOut           string    `json:"object_out"`                    // file for the object dump. Empty gives object.yaml in the parent of OutputDir
+	MaxInMemory         int       `json:"max_projections_in_memory"`     // hdf5 output: projections held in memory before spooling to a temporary file. 0 for no limit
+	CameraKeyframes     string    `json:"camera_keyframes"`              // optional camera keyframes interpolated over the frames, see load_camera_keyframes
+	ProfileSamples      bool      `json:"profile_samples"`               // also save number of density evaluations per pixel as samples_<image>.png
+	Preview             bool      `json:"preview"`                       // render a single low-resolution preview.png without metadata output
+	NormalMap           bool      `json:"normal_map"`                    // also save surface normals at first hit as normal_<image>.png
+	EmitDarkfield       bool      `json:"emit_darkfield"`                // also save the integrated emission of the objects (without attenuation) as darkfield_<image>
+	ClampMax            float64   `json:"clamp_max"`                     // png values (not depth) are divided by ClampMax and clamped to [0, 1]. 0 only clamps
+	ScatterFraction     float64   `json:"scatter_fraction"`              // fraction of the absorbed signal 1-transmittance added back as blurred scatter. 0 disables
+	ScatterBlur         float64   `json:"scatter_blur"`                  // standard deviation of the scatter blur in pixels
+	PixelStride         int       `json:"pixel_stride"`                  // compute every PixelStride-th pixel in each direction and fill the rest from the nearest. 0 or 1 computes all
+	DrawBBox            bool      `json:"draw_bbox"`                     // draw the bounding box of the scene and the coordinate axes over RGBA png images
+	EdgeEnhance         float64   `json:"edge_enhance"`                  // weight of Sobel gradient magnitude blended into the projection. 0 disables
+	Tonemap             string    `json:"tonemap"`                       // tone map of png values: linear (default), gamma or log, see tonemap
+	TonemapExponent     float64   `json:"tonemap_exponent"`              // exponent of the gamma and log tone maps. 0 gives default_tonemap_exponent
+	SpanMargin          float64   `json:"span_margin"`                   // multiplier of cube_half_diagonal giving the half length of the ray span. 0 gives default_span_margin
+	RefineFactor        int       `json:"refine_factor"`                 // fine steps per coarse step in hierarchical integration. 0 gives the default of 10
+	SPP                 int       `json:"spp"`                           // rays per pixel with deterministic jitter. 0 or 1 gives a single ray through the pixel
+}
+
+// Add object to the scene. Scene must contain exactly one object when rendering,
+// use objects.NewCollection to combine several.
+func AddObject(obj objects.Object) {
+	lat = append(lat, obj)
+}
+
+// Built-in test phantom consisting of an object and a known deformation.
+// bent_beam is a cylinder along z bent into a circular arc by BendDeformation.
+func phantom(name string) (objects.Object, deformations.Deformation, error) {
+	switch name {
+	case "bent_beam":
+		beam := &objects.Cylinder{P0: mgl64.Vec3{0, 0, -0.8}, P1: mgl64.Vec3{0, 0, 0.8}, Radius: 0.1, Rho: 1.0}
+		return beam, &deformations.BendDeformation{Curvature: 0.5, Type: "bend"}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown phantom: %s", name)
+	}
+}
+
+// Ground truth displacement field of a deformation sampled on a regular grid
+type DisplacementGrid struct {
+	Points        [][3]float64 `json:"points"`        // points in the deformed configuration
+	Displacements [][3]float64 `json:"displacements"` // displacement from the reference configuration
+}
+
+// Sample the displacement p - apply(p) on an n^3 grid spanning [lo, hi], returning the grid points and displacements
+// in the order of indices i, j, k along x, y and z (fastest). A point p of the deformed object shows the undeformed
+// object at apply(p), so the material there was displaced by p - apply(p) from the reference configuration.
+func sample_displacements(apply func(x, y, z float64) (float64, float64, float64), n int, lo, hi mgl64.Vec3) ([][3]float64, [][3]float64) {
+	points := make([][3]float64, 0, n*n*n)
+	displacements := make([][3]float64, 0, n*n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				p := [3]float64{}
+				for a, idx := range []int{i, j, k} {
+					p[a] = lo[a] + (hi[a]-lo[a])*float64(idx)/math.Max(float64(n-1), 1)
+				}
+				x, y, z := apply(p[0], p[1], p[2])
+				points = append(points, p)
+				displacements = append(displacements, [3]float64{p[0] - x, p[1] - y, p[2] - z})
+			}
+		}
+	}
+	return points, displacements
+}
+
+// Sample displacement p - d.Apply(p) of deformation d (see sample_displacements) on n^3 grid spanning [lo, hi]^3
+// and write it to JSON file fn.
+func write_displacement_grid(fn string, d deformations.Deformation, n int, lo, hi float64) error {
+	grid := DisplacementGrid{}
+	grid.Points, grid.Displacements = sample_displacements(d.Apply, n, mgl64.Vec3{lo, lo, lo}, mgl64.Vec3{hi, hi, hi})
+	data, err := json.MarshalIndent(grid, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
+
+// Sample the displacement p - deform(p) of the composed deformations (see sample_displacements), with the same sign
+// as write_displacement_grid, on an n^3 grid spanning the box [lo, hi] and write it to file fn. The components are
+// float32 volumes of shape (3, n, n, n) indexed by component, x, y and z (fastest). Written as .npy if fn has that
+// extension, otherwise as raw little-endian values.
+func write_deformation_volume(fn string, n int, lo, hi mgl64.Vec3) error {
+	_, displacements := sample_displacements(deform, n, lo, hi)
+	vol := make([]float32, 3*n*n*n)
+	for idx, u := range displacements {
+		for a := 0; a < 3; a++ {
+			vol[a*n*n*n+idx] = float32(u[a])
+		}
+	}
+	var buf bytes.Buffer
+	if strings.ToLower(filepath.Ext(fn)) == ".npy" {
+		// npy version 1.0: magic, header length and a dict padded with spaces to a multiple of 64 bytes
+		header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (3, %d, %d, %d), }", n, n, n)
+		pad := 64 - (10+len(header)+1)%64
+		header += strings.Repeat(" ", pad%64) + "\n"
+		buf.WriteString("\x93NUMPY\x01\x00")
+		binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+		buf.WriteString(header)
+	}
+	binary.Write(&buf, binary.LittleEndian, vol)
+	return os.WriteFile(fn, buf.Bytes(), 0644)
+}
+
+// Fraction of the volume of the box [lo, hi] within the cube [-e, e]^3.
+// Along axes where the box is flat, its extent counts as inside if it lies within the cube.
+func fraction_in_cube(lo, hi mgl64.Vec3, e float64) float64 {
+	fraction := 1.0
+	for k := 0; k < 3; k++ {
+		overlap := math.Min(hi[k], e) - math.Max(lo[k], -e)
+		if overlap < 0 {
+			return 0
+		}
+		if hi[k] > lo[k] {
+			fraction *= overlap / (hi[k] - lo[k])
+		}
+	}
+	return fraction
+}
+
+// Span margin in effect for the requested margin m, which is 0 for default_span_margin.
+func resolve_span_margin(m float64) (float64, error) {
+	if m == 0 {
+		return default_span_margin, nil
+	}
+	if m < 0 {
+		return 0, fmt.Errorf("span margin must be positive, got %v", m)
+	}
+	return m, nil
+}
+
+// Check that the object with bounding box lo, hi is mostly within the renderable region, the cube [-half_span, half_span]^3
+// around the integration span of the rays. Returns an error describing the problem if at most half of the box is inside.
+// Unbounded boxes pass.
+func check_renderable(lo, hi mgl64.Vec3, half_span float64) error {
+	if math.IsInf(lo.Len(), 0) || math.IsInf(hi.Len(), 0) {
+		return nil
+	}
+	fraction := fraction_in_cube(lo, hi, half_span)
+	if fraction == 0 {
+		return fmt.Errorf("object bounding box %v to %v lies wholly outside the renderable region [%.3g, %.3g]^3, images will be blank", lo, hi, -half_span, half_span)
+	}
+	if fraction <= 0.5 {
+		return fmt.Errorf("only %.0f%% of object bounding box %v to %v lies within the renderable region [%.3g, %.3g]^3", 100*fraction, lo, hi, -half_span, half_span)
+	}
+	return nil
+}
+
+// Report whether the ray from origin along direction intersects the bounding box of the scene.
+// Deformed scenes have unknown extent, so every ray is reported to hit them.
+func RayHitsScene(origin, direction mgl64.Vec3) bool {
+	if len(lat) == 0 {
+		return false
+	}
+	if len(df) > 0 || len(df_schedule) > 0 {
+		return true
+	}
+	lo, hi := lat[0].BoundingBox()
+	_, _, hit := ray_box_intersection(origin, direction, lo, hi)
+	return hit
+}
+
+// Report whether the bounding box of the scene, clipped to the clip slab, lies entirely outside the frustum
+// of the pixels in window, so that the whole view is background. Conservative: deformed or unbounded
+// scenes are never reported empty, and the frustum is widened by half a pixel to cover jittered rays.
+func view_is_empty(camera mgl64.Mat4, f, R float64, res int, window image.Rectangle, geometry string) bool {
+	if len(lat) == 0 {
+		return true
+	}
+	if len(df) > 0 || len(df_schedule) > 0 {
+		return false
+	}
+	lo, hi := lat[0].BoundingBox()
+	for k := 0; k < 3; k++ {
+		lo[k], hi[k] = math.Max(lo[k], clip_min[k]), math.Min(hi[k], clip_max[k])
+		if lo[k] > hi[k] {
+			return true
+		}
+	}
+	if math.IsInf(lo.Len(), 0) || math.IsInf(hi.Len(), 0) {
+		return false
+	}
+	// detector coordinates of the window edges, see pixel_ray
+	half := float64(res) / 2
+	u0, u1 := float64(window.Min.X)/half-1, float64(window.Max.X)/half-1
+	v0, v1 := float64(res-window.Max.Y)/half-1, float64(res-window.Min.Y)/half-1
+	// frustum as half-spaces g(p) >= 0 in camera coordinates, camera looking along -z.
+	// A point p projects to u = f*p_x/(-p_z), and v = f*p_y/(-p_z) in cone beam or v = f*p_y/R in fan beam
+	planes := []func(p mgl64.Vec3) float64{
+		func(p mgl64.Vec3) float64 { return -p[2] },
+		func(p mgl64.Vec3) float64 { return f*p[0] + u0*p[2] },
+		func(p mgl64.Vec3) float64 { return -f*p[0] - u1*p[2] },
+	}
+	if geometry == "fan_beam" {
+		planes = append(planes,
+			func(p mgl64.Vec3) float64 { return f*p[1]/R - v0 },
+			func(p mgl64.Vec3) float64 { return v1 - f*p[1]/R })
+	} else {
+		planes = append(planes,
+			func(p mgl64.Vec3) float64 { return f*p[1] + v0*p[2] },
+			func(p mgl64.Vec3) float64 { return -f*p[1] - v1*p[2] })
+	}
+	world_to_camera := camera.Inv()
+	var corners [8]mgl64.Vec3
+	for c := range corners {
+		corner := lo
+		for k := 0; k < 3; k++ {
+			if c&(1<<k) != 0 {
+				corner[k] = hi[k]
+			}
+		}
+		corners[c] = mgl64.TransformCoordinate(corner, world_to_camera)
+	}
+	// box is convex, so it is outside if all corners are outside the same plane
+	for _, g := range planes {
+		outside := true
+		for _, p := range corners {
+			if g(p) >= 0 {
+				outside = false
+				break
+			}
+		}
+		if outside {
+			return true
+		}
+	}
+	return false
+}
+
+// Draw the edges of the box [lo, hi] in yellow and the coordinate axes from the origin in red (x), green (y)
+// and blue (z) into rgba, which holds the window of the detector. Points along each line are projected
+// with the camera of the frame (see pixel_ray_at) and points behind the camera are skipped.
+func draw_overlay(rgba *image.RGBA, camera mgl64.Mat4, f, R float64, res int, window image.Rectangle, geometry string, lo, hi mgl64.Vec3) {
+	world_to_camera := camera.Inv()
+	half := float64(res) / 2
+	line := func(a, b mgl64.Vec3, c color.RGBA) {
+		n := 4 * res
+		for k := 0; k <= n; k++ {
+			p := mgl64.TransformCoordinate(a.Add(b.Sub(a).Mul(float64(k)/float64(n))), world_to_camera)
+			if p[2] >= 0 {
+				continue
+			}
+			u := f * p[0] / -p[2]
+			v := f * p[1] / -p[2]
+			if geometry == "fan_beam" {
+				v = f * p[1] / R
+			}
+			i := int(math.Floor((u + 1) * half))
+			j := int(math.Floor((v + 1) * half))
+			if (image.Point{i, res - 1 - j}).In(window) {
+				rgba.SetRGBA(i-window.Min.X, res-1-j-window.Min.Y, c)
+			}
+		}
+	}
+	box := [2]mgl64.Vec3{lo, hi}
+	for c := 0; c < 8; c++ {
+		for k := 0; k < 3; k++ {
+			if c&(1<<k) != 0 {
+				continue
+			}
+			// edge from corner c along axis k
+			var a, b mgl64.Vec3
+			for m := 0; m < 3; m++ {
+				a[m] = box[(c>>m)&1][m]
+				b[m] = a[m]
+			}
+			b[k] = hi[k]
+			line(a, b, color.RGBA{255, 255, 0, 255})
+		}
+	}
+	length := hi.Sub(lo).Len() / 2
+	line(mgl64.Vec3{}, mgl64.Vec3{length, 0, 0}, color.RGBA{255, 0, 0, 255})
+	line(mgl64.Vec3{}, mgl64.Vec3{0, length, 0}, color.RGBA{0, 255, 0, 255})
+	line(mgl64.Vec3{}, mgl64.Vec3{0, 0, length}, color.RGBA{0, 0, 255, 255})
+}
+
+// Fill pixels within i in [i0, i1) and j in [j0, j1) which were skipped by a render on every stride-th pixel
+// (i-i0 and j-j0 multiples of stride) with the value of the nearest computed pixel. Normals are filled likewise if not nil.
+func fill_stride(img [][]float64, normals [][]mgl64.Vec3, i0, i1, j0, j1, stride int) {
+	nearest := func(k, k0, k1 int) int {
+		n := int(math.Round(float64(k-k0) / float64(stride)))
+		return k0 + min(n, (k1-1-k0)/stride)*stride
+	}
+	for i := i0; i < i1; i++ {
+		si := nearest(i, i0, i1)
+		for j := j0; j < j1; j++ {
+			sj := nearest(j, j0, j1)
+			img[i][j] = img[si][sj]
+			if normals != nil {
+				normals[i][j] = normals[si][sj]
+			}
+		}
+	}
+}
+
+// Set the pixels in window to the value of rays which miss the scene.
+func fill_background(img [][]float64, normals [][]mgl64.Vec3, res int, window image.Rectangle) {
+	val := math.Exp(-flat_field)
+	if output_quantity == "attenuation" {
+		val = flat_field
+	} else if output_quantity == "depth" {
+		val = math.Inf(1)
+	} else if output_quantity == "mask" {
+		val = 0
+	}
+	for i := window.Min.X; i < window.Max.X; i++ {
+		for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+			img[i][j] = val
+			if sample_counts != nil {
+				sample_counts[i][j] = 0
+			}
+			if normals != nil {
+				normals[i][j] = mgl64.Vec3{}
+			}
+		}
 	}
-	return math.Exp(-T)
 }
 
-// Integrate the density along the ray from the origin to the end point.
-// Hierarchical integration method which is more efficient than simple integration.
-// Refines the integration step size based on the density of the scene.
-func integrate_hierarchical(origin, direction mgl64.Vec3, DS, smin, smax float64) float64 {
-	direction = direction.Normalize()
-	// check clipping
-	if density(origin[0]+direction[0]*smin, origin[1]+direction[1]*smin, origin[2]+direction[2]*smin) > 0 && !warned_clipping_min {
-		log.Warn().Msg("Clipping at smin detected")
-		warned_clipping_min = true
+// Add the pixels of img in window to sum, or copy them if first is set.
+func accumulate_window(sum, img [][]float64, window image.Rectangle, res int, first bool) {
+	for i := window.Min.X; i < window.Max.X; i++ {
+		for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+			if first {
+				sum[i][j] = 0
+			}
+			sum[i][j] += img[i][j]
+		}
 	}
-	if density(origin[0]+direction[0]*smax, origin[1]+direction[1]*smax, origin[2]+direction[2]*smax) > 0 && !warned_clipping_max {
-		log.Warn().Msg("Clipping at smax detected")
-		warned_clipping_max = true
+}
+
+// Set the pixels of img in window to f times those of src.
+func scale_window(img, src [][]float64, f float64, window image.Rectangle, res int) {
+	for i := window.Min.X; i < window.Max.X; i++ {
+		for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+			img[i][j] = f * src[i][j]
+		}
 	}
-	// integrate using sliding window
-	right := smin + DS
-	left := smin
-	ds := DS / 10.0
-	prev_rho := 0.0
-	T := flat_field
-	for right <= smax {
-		x := origin[0] + direction[0]*right
-		y := origin[1] + direction[1]*right
-		z := origin[2] + direction[2]*right
-		rho := density(x, y, z)
-		if (rho == 0) != (prev_rho == 0) { // rho changed between left and right
-			left += ds
-			for left < right {
-				x := origin[0] + direction[0]*left
-				y := origin[1] + direction[1]*left
-				z := origin[2] + direction[2]*left
-				T += density(x, y, z) * ds
-				left += ds
+}
+
+// Slab intersection of the ray origin + s*direction (s >= 0) with the box [lo, hi].
+// Returns the entry and exit distances in units of direction and whether the ray hits the box.
+func ray_box_intersection(origin, direction, lo, hi mgl64.Vec3) (float64, float64, bool) {
+	smin, smax := 0.0, math.Inf(1)
+	for k := 0; k < 3; k++ {
+		if direction[k] == 0 {
+			if origin[k] < lo[k] || origin[k] > hi[k] {
+				return 0, 0, false
 			}
-			T += rho * ds // reuse rho from right
-		} else {
-			T += rho * DS
+			continue
+		}
+		s1 := (lo[k] - origin[k]) / direction[k]
+		s2 := (hi[k] - origin[k]) / direction[k]
+		if s1 > s2 {
+			s1, s2 = s2, s1
+		}
+		smin = math.Max(smin, s1)
+		smax = math.Min(smax, s2)
+		if smin > smax {
+			return 0, 0, false
 		}
-		prev_rho = rho
-		left = right
-		right += DS
 	}
-	return math.Exp(-T)
+	return smin, smax, true
 }
 
-// Compute the pixel value for ray starting at origin and going in direction,
-// between smin and smax, with step size ds. Set the value in the image at i, j.
-func computePixel(img [][]float64, i, j int, origin, direction mgl64.Vec3, ds, smin, smax float64, wg *sync.WaitGroup) {
-	defer wg.Done()
-	img[i][j] = integrate(origin, direction, ds, smin, smax)
+// Add deformation to the scene. Deformations are composed in the order they are added.
+func AddDeformation(d deformations.Deformation) {
+	df = append(df, d)
 }
 
-// Helper function to measure elapsed time.
-func timer() func() {
-	start := time.Now()
-	return func() {
-		log.Info().Msgf("Elapsed time: %v", time.Since(start))
+// Main function to render images based on the input parameters.
+// Loads object from params.Input and renders it. Returns the camera parameters of the rendered frames.
+func render(params RenderParams) TransformParams {
+	// modifies global variable lat
+	if err := load_object(params.Input); err != nil {
+		log.Fatal().Msgf("Error loading object: %v", err)
 	}
+	return render_scene(params)
 }
 
-// Parameters for each image.
-type OneFrameParams struct {
-	FilePath        string      `json:"file_path"`
-	Time            float64     `json:"time"`
-	TransformMatrix [][]float64 `json:"transform_matrix"`
+// Resolution of preview images
+const preview_res = 128
+
+// Parameters for a quick preview: one in-plane frame at reduced resolution saved as preview.png.
+func preview_params(params RenderParams) RenderParams {
+	if params.Res > preview_res {
+		params.Res = preview_res
+		params.FlatFieldImage = "" // defined at full resolution
+	}
+	params.NumImages = 1
+	params.OutOfPlane = false
+	params.JobsModulo = 1
+	params.JobNum = 0
+	params.OutputFormat = "png"
+	params.ROI = nil
+	if len(params.Roll) > 1 {
+		params.Roll = params.Roll[:1]
+	}
+	params.Resume = false
+	params.NormalMap = false
+	params.ProfileSamples = false
+	params.CameraExport = ""
+	return params
 }
 
-// Transform parameters for all images.
-type TransformParams struct {
-	CameraAngle float64          `json:"camera_angle_x"`
-	FL_X        float64          `json:"fl_x"`
-	FL_Y        float64          `json:"fl_y"`
-	W           int              `json:"w"`
-	H           int              `json:"h"`
-	CX          float64          `json:"cx"`
-	CY          float64          `json:"cy"`
-	Frames      []OneFrameParams `json:"frames"`
+// Existing files a render with params would overwrite: the images of the frames rendered by this job
+// (every JobsModulo-th frame from JobNum, as named by render_scene) and the transforms file.
+// Images of sibling jobs sharing the output directory are not counted, and neither is the transforms file
+// of an unchunked multi-job run, which the jobs share.
+func files_to_overwrite(params RenderParams) []string {
+	// reused camera poses give the number of frames, an unreadable file is reported by render
+	num_images := params.NumImages
+	if len(params.ReuseTransforms) > 0 {
+		if prev, err := read_transforms_file(params.ReuseTransforms); err == nil {
+			num_images = len(prev.Frames)
+		}
+	}
+	output_dir, transforms_file := params.OutputDir, params.TransformsFile
+	if params.ChunkAngles {
+		suffix := fmt.Sprintf("_job%d", params.JobNum)
+		output_dir = filepath.Clean(output_dir) + suffix
+		ext := filepath.Ext(transforms_file)
+		transforms_file = strings.TrimSuffix(transforms_file, ext) + suffix + ext
+	}
+	fname_pattern := params.FnamePattern
+	if params.OutputFormat == "exr" && filepath.Ext(fname_pattern) == ".png" {
+		fname_pattern = strings.TrimSuffix(fname_pattern, ".png") + ".exr"
+	}
+	jobs_modulo := max(params.JobsModulo, 1)
+	var existing []string
+	exists := func(fn string) bool {
+		_, err := os.Stat(fn)
+		return err == nil
+	}
+	if params.OutputFormat == "hdf5" {
+		if fn := filepath.Join(output_dir, hdf5_name); exists(fn) {
+			existing = append(existing, fn)
+		}
+	} else {
+		for i_img := params.JobNum; i_img < num_images; i_img += jobs_modulo {
+			fn := filepath.Join(output_dir, fmt.Sprintf(fname_pattern, i_img))
+			if params.ChunkAngles {
+				fn = filepath.Join(output_dir, fmt.Sprintf(fname_pattern, (i_img-params.JobNum)/jobs_modulo))
+			}
+			if exists(fn) {
+				existing = append(existing, fn)
+			}
+		}
+	}
+	if (jobs_modulo == 1 || params.ChunkAngles) && exists(transforms_file) {
+		existing = append(existing, transforms_file)
+	}
+	return existing
 }
 
-// Main function to render images based on the input parameters.
-func render(
-	input string,
-	output_dir string,
-	fname_pattern string,
-	res int,
-	num_images int,
-	out_of_plane bool,
-	ds float64,
-	R float64,
-	fov float64,
-	jobs_modulo int,
-	job_num int,
-	transforms_file string,
-	deformation_file string,
-	time_label float64,
-	transparency bool,
-) {
+// Refuse to render over an existing dataset unless params allow overwriting, resuming or write only a preview.
+func check_overwrite(params RenderParams) error {
+	if params.Overwrite || params.Resume || params.Preview {
+		return nil
+	}
+	existing := files_to_overwrite(params)
+	if len(existing) == 0 {
+		return nil
+	}
+	list := strings.Join(existing, ", ")
+	if len(existing) > 5 {
+		list = strings.Join(existing[:5], ", ") + ", ..."
+	}
+	return fmt.Errorf("%d existing files would be overwritten (%s), use --overwrite or --resume", len(existing), list)
+}
+
+// Render images of the scene built from AddObject and AddDeformation (or loaded from file).
+// Deformations from params.DeformationFile and params.DeformationSchedule, and those prepended for
+// params.CenterObject and params.ObjectEuler, apply to this render only, so the scene can be rendered again.
+// Returns the camera parameters of the rendered frames, as written to params.TransformsFile.
+func render_scene(params RenderParams) TransformParams {
 	defer timer()()
+	// df is extended and re-sliced per frame below, so work on a copy and restore the scene's deformations on return
+	scene_df, scene_schedule := df, df_schedule
+	df = append([]deformations.Deformation{}, df...)
+	df_schedule = append([]ScheduleEntry{}, df_schedule...)
+	defer func() { df, df_schedule = scene_df, scene_schedule }()
+	if params.Preview {
+		params = preview_params(params)
+		log.Info().Msgf("Rendering preview at resolution %d", params.Res)
+	}
 	wrt := os.Stdout
+	output_dir := params.OutputDir
+	fname_pattern := params.FnamePattern
+	res := params.Res
+	num_images := params.NumImages
+	out_of_plane := params.OutOfPlane
+	ds := params.DS
+	R := params.R
+	fov := params.FOV
+	jobs_modulo := params.JobsModulo
+	job_num := params.JobNum
+	transforms_file := params.TransformsFile
+	if params.ChunkAngles {
+		// images_job1/image_000.png and transforms_job1.json next to the unchunked outputs
+		suffix := fmt.Sprintf("_job%d", job_num)
+		output_dir = filepath.Clean(output_dir) + suffix
+		ext := filepath.Ext(transforms_file)
+		transforms_file = strings.TrimSuffix(transforms_file, ext) + suffix + ext
+	}
+	time_label := params.TimeLabel
+	transparency := params.Transparency
+	roi := params.ROI
+	grayscale := params.Grayscale
+	roll := params.Roll
+	geometry := params.Geometry
+	if geometry == "" {
+		geometry = "cone_beam"
+	}
+	if geometry != "cone_beam" && geometry != "fan_beam" {
+		log.Fatal().Msgf("Unknown geometry: %s", geometry)
+	}
+	refine_factor = 10
+	if params.RefineFactor != 0 {
+		if params.RefineFactor < 1 {
+			log.Fatal().Msgf("Refinement factor must be at least 1, got %d", params.RefineFactor)
+		}
+		refine_factor = params.RefineFactor
+	}
+	if params.PixelStride < 0 {
+		log.Fatal().Msgf("Pixel stride must be positive, got %d", params.PixelStride)
+	}
+	pixel_stride := max(params.PixelStride, 1)
+	if params.ClampMax < 0 {
+		log.Fatal().Msgf("clamp_max must be non-negative, got %v", params.ClampMax)
+	}
+	if params.ScatterFraction < 0 || params.ScatterFraction > 1 {
+		log.Fatal().Msgf("Scatter fraction must be in [0, 1], got %v", params.ScatterFraction)
+	}
+	if params.ScatterFraction > 0 && output_quantity != "transmittance" {
+		log.Fatal().Msg("Scatter is only available for transmittance output")
+	}
+	if params.EdgeEnhance < 0 || params.EdgeEnhance > 1 {
+		log.Fatal().Msgf("Edge enhancement weight must be in [0, 1], got %v", params.EdgeEnhance)
+	}
+	if params.EdgeEnhance > 0 && (output_quantity == "depth" || output_quantity == "mask") {
+		log.Fatal().Msgf("Edge enhancement is not available for %s output", output_quantity)
+	}
+	camera_convention := params.CameraConvention
+	if camera_convention == "" {
+		camera_convention = "opengl"
+	}
+	if camera_convention != "opengl" && camera_convention != "opencv" {
+		log.Fatal().Msgf("Unknown camera convention: %s", camera_convention)
+	}
+	if params.CameraExport != "" && params.CameraExport != "colmap" {
+		log.Fatal().Msgf("Unknown camera export format: %s", params.CameraExport)
+	}
+	if geometry == "fan_beam" && params.CameraExport == "colmap" {
+		log.Fatal().Msg("COLMAP export describes pinhole cameras and is not available for fan beam geometry")
+	}
+	if geometry == "fan_beam" && out_of_plane {
+		log.Fatal().Msg("Fan beam geometry is restricted to polar angle of 90 degrees (no out_of_plane)")
+	}
+	var reused_frames []OneFrameParams
+	var reused_convention string
+	if len(params.ReuseTransforms) > 0 {
+		prev, err := read_transforms_file(params.ReuseTransforms)
+		if err != nil {
+			log.Fatal().Msgf("Error reading transforms to reuse: %v", err)
+		}
+		if len(prev.Frames) == 0 {
+			log.Fatal().Msgf("No frames in '%s'", params.ReuseTransforms)
+		}
+		f := 1 / math.Tan(mgl64.DegToRad(fov/2))
+		if prev.W != res || prev.H != res || math.Abs(prev.FL_X-f*float64(res)/2.0) > 1e-6 {
+			log.Warn().Msgf("Intrinsics in '%s' (w=%d, h=%d, fl_x=%v) differ from the current settings", params.ReuseTransforms, prev.W, prev.H, prev.FL_X)
+		}
+		if (prev.Geometry == "fan_beam") != (geometry == "fan_beam") {
+			log.Warn().Msgf("Geometry in '%s' differs from %s", params.ReuseTransforms, geometry)
+		}
+		reused_frames = prev.Frames
+		reused_convention = prev.CameraConvention
+		num_images = len(reused_frames)
+		log.Info().Msgf("Reusing %d camera poses from '%s'", num_images, params.ReuseTransforms)
+	}
+	orbit_axis := mgl64.Vec3{0, 0, 1}
+	if len(params.OrbitAxis) > 0 {
+		if len(params.OrbitAxis) != 3 {
+			log.Fatal().Msgf("Orbit axis must have 3 components, got %d", len(params.OrbitAxis))
+		}
+		orbit_axis = mgl64.Vec3{params.OrbitAxis[0], params.OrbitAxis[1], params.OrbitAxis[2]}
+		if orbit_axis.Len() == 0 {
+			log.Fatal().Msg("Orbit axis must be non-zero")
+		}
+		orbit_axis = orbit_axis.Normalize()
+	}
+	var keyframes []mgl64.Mat4
+	if len(params.CameraKeyframes) > 0 {
+		if reused_frames != nil {
+			log.Fatal().Msg("Camera keyframes and reused transforms both set the camera poses, give only one")
+		}
+		var err error
+		if keyframes, err = load_camera_keyframes(params.CameraKeyframes, orbit_axis); err != nil {
+			log.Fatal().Msgf("Error loading camera keyframes: %v", err)
+		}
+		log.Info().Msgf("Interpolating camera path through %d keyframes from '%s'", len(keyframes), params.CameraKeyframes)
+	}
+	polar_min, polar_max := params.PolarMin, params.PolarMax
+	if polar_min == 0 && polar_max == 0 {
+		polar_max = 180
+	}
+	if polar_min < 0 || polar_min > polar_max || polar_max > 180 {
+		log.Fatal().Msgf("Polar angle bounds must satisfy 0 <= min <= max <= 180, got [%v, %v]", polar_min, polar_max)
+	}
+	if len(params.FrameTimes) > 0 && len(params.FrameTimes) != num_images {
+		log.Fatal().Msgf("Expected %d frame times, got %d", num_images, len(params.FrameTimes))
+	}
+	if params.MotionBlurSamples < 0 {
+		log.Fatal().Msgf("Number of motion blur samples must be non-negative, got %d", params.MotionBlurSamples)
+	}
+	if params.MotionBlurSamples > 1 && output_quantity == "depth" {
+		log.Fatal().Msg("Motion blur is not available for depth output")
+	}
+	if len(params.FlatFieldRefs) > 0 && len(params.FlatFieldRefs) != num_images {
+		log.Fatal().Msgf("Expected %d flat-field references, got %d", num_images, len(params.FlatFieldRefs))
+	}
+	for _, ref := range params.FlatFieldRefs {
+		if ref < 0 {
+			log.Fatal().Msgf("Flat-field references must be non-negative, got %d", ref)
+		}
+	}
+	if len(roll) > 1 && len(roll) != num_images {
+		log.Fatal().Msgf("Expected 1 or %d roll angles, got %d", num_images, len(roll))
+	}
 
-	load_object(input) // modifies global variable lat
 	if len(lat) != 1 {
 		log.Fatal().Msgf("Expected 1 object, got %d", len(lat))
 	}
-	err := load_deformation(deformation_file) // modifies global variable df
+	err := load_deformation(params.DeformationFile) // modifies global variable df
 	if err != nil {
 		log.Fatal().Msgf("Error loading deformation: %v", err)
 	}
+	err = load_deformation_schedule(params.DeformationSchedule, time_label) // modifies global variable df_schedule
+	if err != nil {
+		log.Fatal().Msgf("Error loading deformation schedule: %v", err)
+	}
+	if len(df_schedule) > 0 && len(df) > 0 {
+		log.Warn().Msg("Deformation schedule overrides deformation file")
+	}
+	if params.MotionBlurSamples > 1 && len(df_schedule) == 0 {
+		log.Warn().Msg("Motion blur needs a deformation schedule, rendering without it")
+	}
+	// deformations at the start of df which are kept when the schedule selects per-frame deformations
+	n_fixed_df := 0
+	bounding_radius := objects.BoundingRadius(lat[0])
+	if params.CenterObject {
+		lo, hi := lat[0].BoundingBox()
+		if math.IsInf(lo.Len(), 0) || math.IsInf(hi.Len(), 0) {
+			log.Fatal().Msg("Cannot center object with unbounded bounding box")
+		}
+		c := lo.Add(hi).Mul(0.5)
+		// rigid displacement c moves the object by -c. Applied first so that deformations act in object coordinates
+		centering := &deformations.RigidDeformation{Displacements: []float64{c[0], c[1], c[2]}, Type: "rigid"}
+		df = append([]deformations.Deformation{centering}, df...)
+		n_fixed_df = 1
+		bounding_radius = hi.Sub(lo).Len() / 2
+		log.Info().Msgf("Centering object by translating it by %v", c.Mul(-1))
+	}
+	if len(params.ObjectEuler) > 0 {
+		if len(params.ObjectEuler) != 3 {
+			log.Fatal().Msgf("Object Euler angles must have 3 components, got %d", len(params.ObjectEuler))
+		}
+		// applied first, so that the (centred and deformed) object is rotated about the origin.
+		// Distances from the origin and hence bounding_radius are unchanged
+		rotation := deformations.NewEulerRotation(params.ObjectEuler[0], params.ObjectEuler[1], params.ObjectEuler[2])
+		df = append([]deformations.Deformation{rotation}, df...)
+		n_fixed_df++
+		log.Info().Msgf("Rotating object by Euler angles %v degrees", params.ObjectEuler)
+	}
 	// create output directory if it doesn't exist
 	if _, err := os.Stat(output_dir); os.IsNotExist(err) {
 		log.Info().Msgf("Creating output directory '%s'", output_dir)
@@ -281,9 +2119,58 @@ func render(
 	} else {
 		log.Info().Msgf("Output to directory '%s'", output_dir)
 	}
+	// half length of the integration span around the centre of the scene
+	span_margin, err := resolve_span_margin(params.SpanMargin)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	half_span := cube_half_diagonal * span_margin
+	if params.AutoDistance {
+		if math.IsInf(bounding_radius, 0) || math.IsNaN(bounding_radius) {
+			// e.g. collections with per-object deformations, whose extent is unknown
+			log.Fatal().Msg("Cannot compute distance for auto_distance: object is unbounded. Set R and fov instead")
+		}
+		R = distance_for_radius(bounding_radius, fov, params.AutoDistanceMargin)
+		half_span = math.Max(cube_half_diagonal, bounding_radius) * span_margin
+		log.Info().Msgf("Setting R to %f", R)
+	}
+	// deformations can move the object, so only undeformed (possibly centred) objects are checked.
+	// The box of an object rotated by ObjectEuler is checked unrotated
+	if len(df) == n_fixed_df && len(df_schedule) == 0 {
+		lo, hi := lat[0].BoundingBox()
+		if params.CenterObject {
+			shift := lo.Add(hi).Mul(-0.5)
+			lo, hi = lo.Add(shift), hi.Add(shift)
+		}
+		if err := check_renderable(lo, hi, half_span); err != nil {
+			if params.Strict {
+				log.Fatal().Msg(err.Error())
+			}
+			log.Warn().Msgf("%v. Move the object, scale it or widen the span with span_margin", err)
+		}
+	}
+	if params.ExportDeformation != "" && !params.Preview && job_num == 0 {
+		n := params.DeformationGridRes
+		if n == 0 {
+			n = default_deformation_export_res
+		}
+		if n < 1 {
+			log.Fatal().Msgf("Deformation export resolution must be positive, got %d", n)
+		}
+		if len(df_schedule) > 0 {
+			log.Warn().Msg("Deformation export does not include the per-frame deformations of the schedule")
+		}
+		// the rays integrate within half_span of the origin
+		lo, hi := mgl64.Vec3{-half_span, -half_span, -half_span}, mgl64.Vec3{half_span, half_span, half_span}
+		log.Info().Msgf("Writing displacement sampled on %d^3 grid over [%v, %v]^3 to '%s'", n, -half_span, half_span, params.ExportDeformation)
+		if err := write_deformation_volume(params.ExportDeformation, n, lo, hi); err != nil {
+			log.Fatal().Msgf("Error writing deformation: %v", err)
+		}
+	}
+
 	// set or compute ds
 	if ds < 0 {
-		ds = lat[0].MinFeatureSize() / 3.0
+		ds = auto_ds(lat[0], res, fov, R, geometry)
 		log.Info().Msgf("Setting ds to %f", ds)
 	}
 
@@ -298,26 +2185,160 @@ func render(
 	log.Info().Msgf("Will render every %dth projection starting from %d", jobs_modulo, job_num)
 	res_f := float64(res)
 
+	// region of interest of the detector given as x0,y0,x1,y1 in image coordinates
+	window := image.Rect(0, 0, res, res)
+	if len(roi) > 0 {
+		if len(roi) != 4 {
+			log.Fatal().Msgf("Region of interest must have 4 values, got %d", len(roi))
+		}
+		window = image.Rect(roi[0], roi[1], roi[2], roi[3])
+		if window.Empty() || !window.In(image.Rect(0, 0, res, res)) {
+			log.Fatal().Msgf("Region of interest %v is empty or outside of image %dx%d", roi, res, res)
+		}
+		log.Info().Msgf("Rendering region of interest %v", window)
+	}
+
+	var flat_img [][]float64
+	if len(params.FlatFieldImage) > 0 {
+		flat_img, err = load_flat_field_image(params.FlatFieldImage, res)
+		if err != nil {
+			log.Fatal().Msgf("Error loading flat field image: %v", err)
+		}
+		if params.FlatFieldImageMode != "" && params.FlatFieldImageMode != "multiply" && params.FlatFieldImageMode != "add" {
+			log.Fatal().Msgf("Unknown flat field image mode: %s", params.FlatFieldImageMode)
+		}
+	}
+
+	output_format := params.OutputFormat
+	if output_format == "" {
+		output_format = "png"
+	}
+	if output_format != "png" && output_format != "exr" && output_format != "hdf5" {
+		log.Fatal().Msgf("Unknown output format: %s", output_format)
+	}
+	if output_format == "hdf5" && (params.Resume || params.Preview) {
+		log.Fatal().Msg("hdf5 output holds the whole run in one file and is not available with resume or preview")
+	}
+	if output_format == "hdf5" && jobs_modulo > 1 && !params.ChunkAngles {
+		log.Fatal().Msg("hdf5 output with several jobs requires chunk_angles so that each job writes its own file")
+	}
+	tonemap_mode := params.Tonemap
+	if tonemap_mode == "" {
+		tonemap_mode = "linear"
+	}
+	if tonemap_mode != "linear" && tonemap_mode != "gamma" && tonemap_mode != "log" {
+		log.Fatal().Msgf("Unknown tone map: %s", tonemap_mode)
+	}
+	tonemap_exponent := default_tonemap_exponent
+	if params.TonemapExponent != 0 {
+		if params.TonemapExponent < 0 {
+			log.Fatal().Msgf("Tone map exponent must be positive, got %v", params.TonemapExponent)
+		}
+		tonemap_exponent = params.TonemapExponent
+	}
+	if tonemap_mode != "linear" && output_format != "png" {
+		log.Fatal().Msg("Tone mapping is only applied to png output, exr and hdf5 store raw values")
+	}
+	if params.MaxInMemory < 0 {
+		log.Fatal().Msgf("Maximum number of projections in memory must be non-negative, got %d", params.MaxInMemory)
+	}
+	// projections of all frames for hdf5 output
+	stack := projection_spool{max_in_memory: params.MaxInMemory, dir: output_dir}
+	defer stack.close()
+	if output_format == "exr" && filepath.Ext(fname_pattern) == ".png" {
+		fname_pattern = strings.TrimSuffix(fname_pattern, ".png") + ".exr"
+	}
+	if params.DrawBBox && (output_format != "png" || grayscale || output_quantity == "mask") {
+		log.Fatal().Msg("Bounding box overlay requires RGBA png output (no exr, hdf5, grayscale or mask)")
+	}
+	if output_quantity == "mask" && transparency {
+		log.Warn().Msg("Transparency is not supported for mask output. Ignoring transparency")
+		transparency = false
+	}
+
+	if grayscale && transparency {
+		log.Warn().Msg("Transparency is not supported for grayscale output. Ignoring transparency")
+		transparency = false
+	}
+
 	// create 2D image. It will be reused for each projection
 	img := make([][]float64, res)
 	for i := range img {
 		img[i] = make([]float64, res) // [0.0, 0.0, ... 0.0
 	}
+	if params.ProfileSamples {
+		sample_counts = make([][]int, res)
+		for i := range sample_counts {
+			sample_counts[i] = make([]int, res)
+		}
+		defer func() { sample_counts = nil }()
+	}
+	var normals [][]mgl64.Vec3
+	var darkfield [][]float64
+	if params.EmitDarkfield {
+		if output_format == "hdf5" {
+			log.Fatal().Msg("Dark-field output is not available with hdf5 output")
+		}
+		darkfield = make([][]float64, res)
+		for i := range darkfield {
+			darkfield[i] = make([]float64, res)
+		}
+	}
+	if params.NormalMap {
+		normals = make([][]mgl64.Vec3, res)
+		for i := range normals {
+			normals[i] = make([]mgl64.Vec3, res)
+		}
+	}
+
+	// running sums of the sub-frame projections for motion blur
+	var blur_img, blur_darkfield [][]float64
+	if params.MotionBlurSamples > 1 && len(df_schedule) > 0 {
+		blur_img = make([][]float64, res)
+		for i := range blur_img {
+			blur_img[i] = make([]float64, res)
+		}
+		if darkfield != nil {
+			blur_darkfield = make([][]float64, res)
+			for i := range blur_darkfield {
+				blur_darkfield[i] = make([]float64, res)
+			}
+		}
+	}
 
 	transform_params := TransformParams{
 		CameraAngle: fov * math.Pi / 180.0,
-		W:           res,
-		H:           res,
-		CX:          res_f / 2.0,
-		CY:          res_f / 2.0,
+		W:           window.Dx(),
+		H:           window.Dy(),
+		CX:          res_f/2.0 - float64(window.Min.X),
+		CY:          res_f/2.0 - float64(window.Min.Y),
 		Frames:      []OneFrameParams{},
 	}
+	if geometry == "fan_beam" {
+		transform_params.Geometry = geometry
+		transform_params.RowSpacing = 2.0 * R / (res_f * (1 / math.Tan(mgl64.DegToRad(fov/2))))
+	}
+	if camera_convention == "opencv" {
+		transform_params.CameraConvention = camera_convention
+	}
+	if tonemap_mode != "linear" {
+		transform_params.Tonemap = tonemap_mode
+		transform_params.TonemapExponent = tonemap_exponent
+	}
+	if len(roi) > 0 {
+		transform_params.ROI = []int{window.Min.X, window.Min.Y, window.Max.X, window.Max.Y}
+	}
 	// keep track of min and max values - useful for setting appropriate density of object
 	min_val, max_val := 1.0, 0.0
+	// clipping counters summed over views
+	var run_clip_rays, run_clipped_smin, run_clipped_smax int64
 
 	var bar *progressbar.ProgressBar
 	// Progress indicator either as text or as a progress bar
-	if text_progress {
+	if quiet {
+		text_progress = false
+		bar = progressbar.DefaultSilent(int64(num_images))
+	} else if text_progress {
 		wrt.Write([]byte("Rendering images...\n"))
 		s := fmt.Sprintf("%7s%54s%6s%6s\n", "Image", "Progress", "Pix/s", "ETA")
 		wrt.Write([]byte(s))
@@ -328,6 +2349,21 @@ func render(
 	t0 := time.Now()
 
 	// loop over all images. job_num and jobs_modulo can be set if running multiple jobs in parallel on the same object
+	// record of rendered frames which allows resuming interrupted runs
+	sidecar_file := transforms_file + ".frames"
+	done_frames := map[string]OneFrameParams{}
+	if params.Preview {
+		sidecar_file = ""
+	} else if params.Resume {
+		done_frames, err = read_frame_records(sidecar_file)
+		if err != nil {
+			log.Fatal().Msgf("Error reading frame records: %v", err)
+		}
+		log.Info().Msgf("Resuming with %d frames recorded in '%s'", len(done_frames), sidecar_file)
+	} else {
+		os.Remove(sidecar_file)
+	}
+
 	for i_img := job_num; i_img < num_images; i_img += jobs_modulo {
 		var s string
 		if text_progress {
@@ -337,17 +2373,55 @@ func render(
 			bar.Add(1)
 		}
 
-		dth := 360.0 / float64(num_images)
-		var th, phi float64
-
-		th = float64(i_img)*dth + 90.0
+		filename := filepath.Join(output_dir, fmt.Sprintf(fname_pattern, i_img))
+		if params.ChunkAngles {
+			// frames are numbered locally within the chunk
+			filename = filepath.Join(output_dir, fmt.Sprintf(fname_pattern, (i_img-job_num)/jobs_modulo))
+		}
+		if params.Preview {
+			filename = filepath.Join(output_dir, "preview.png")
+		}
+		if output_format == "hdf5" {
+			// frames are identified by their position in the projections dataset
+			filename = filepath.Join(output_dir, hdf5_name)
+		}
+		dname, fname := filepath.Split(filename)
+		rel_path := filepath.ToSlash(filepath.Join(filepath.Base(dname), fname))
+		if frame, ok := done_frames[rel_path]; ok && image_complete(filename, window.Dx(), window.Dy()) {
+			log.Debug().Msgf("Skipping already rendered '%s'", filename)
+			transform_params.Frames = append(transform_params.Frames, frame)
+			if text_progress {
+				wrt.Write([]byte("] skipped\n"))
+			}
+			continue
+		}
 
-		if out_of_plane { // phi random
-			z := rand.Float64()*2 - 1
-			phi = math.Acos(z)
-		} else {
-			phi = math.Pi / 2.0
+		// select deformation for this frame from the schedule
+		frame_time := time_label
+		// scheduled deformation states at the start of this frame and of the next one (nil for none)
+		var blur_from, blur_to deformations.Deformation
+		if len(df_schedule) > 0 {
+			df = df[:n_fixed_df]
+			if entry, ok := scheduled_entry(i_img); ok {
+				df = append(df, entry.Deformation)
+				frame_time = entry.Time
+				blur_from = entry.Deformation
+			}
+			if entry, ok := scheduled_entry(i_img + 1); ok {
+				blur_to = entry.Deformation
+			}
+		}
+		// the object only moves during the exposure if the next frame has a different entry
+		blur_samples := 1
+		if blur_img != nil && blur_from != blur_to {
+			blur_samples = params.MotionBlurSamples
 		}
+		// explicit per-frame times take precedence over the schedule
+		if len(params.FrameTimes) > 0 {
+			frame_time = params.FrameTimes[i_img]
+		}
+
+		th, phi := generateCameraAngles(i_img, num_images, out_of_plane, polar_min, polar_max)
 
 		// zero out img
 		for i := 0; i < res; i++ {
@@ -356,18 +2430,36 @@ func render(
 			}
 		}
 
-		eye := mgl64.Vec3{R * math.Cos(mgl64.DegToRad(float64(th))) * math.Sin(phi), R * math.Sin(mgl64.DegToRad(float64(th))) * math.Sin(phi), math.Cos(phi) * R}
-		center := mgl64.Vec3{0, 0, 0}
-		up := mgl64.Vec3{0, 0, 1}
-		camera := mgl64.LookAtV(eye, center, up)
-		// use the matrix to transform coordinates from camera space to world space
-		camera = camera.Inv()
+		var camera mgl64.Mat4
+		R_img := R // distance of the camera from the centre of the scene
+		if reused_frames != nil {
+			// camera to world matrix of the previous run
+			for r := 0; r < 4; r++ {
+				for c := 0; c < 4; c++ {
+					camera.Set(r, c, reused_frames[i_img].TransformMatrix[r][c])
+				}
+			}
+			camera = convert_camera_convention(camera, reused_convention)
+			R_img = camera.Col(3).Vec3().Len()
+		} else if keyframes != nil {
+			camera = camera_on_path(keyframes, i_img, num_images)
+			R_img = camera.Col(3).Vec3().Len()
+		} else {
+			camera = camera_from_angles(th, phi, R, orbit_axis)
+			// roll detector about the view direction (camera z axis)
+			if len(roll) == 1 {
+				camera = camera.Mul4(mgl64.HomogRotate3DZ(mgl64.DegToRad(roll[0])))
+			} else if len(roll) > 1 {
+				camera = camera.Mul4(mgl64.HomogRotate3DZ(mgl64.DegToRad(roll[i_img])))
+			}
+		}
 
+		stored_camera := convert_camera_convention(camera, camera_convention)
 		transform_matrix := make([][]float64, 4)
 		for i := 0; i < 4; i++ {
 			transform_matrix[i] = make([]float64, 4)
 			for j := 0; j < 4; j++ {
-				transform_matrix[i][j] = camera.At(i, j)
+				transform_matrix[i][j] = stored_camera.At(i, j)
 			}
 		}
 
@@ -376,35 +2468,150 @@ func render(
 		f := 1 / math.Tan(mgl64.DegToRad(fov/2)) // focal length
 		transform_params.FL_X = f * res_f / 2.0  // focal length in pixels
 		transform_params.FL_Y = f * res_f / 2.0  // focal length in pixels
-		for i := 0; i < res; i++ {
-			for j := 0; j < res; j++ {
-				wg.Add(1)
-				vx := mgl64.Vec3{float64(i)/(res_f/2) - 1, float64(j)/(res_f/2) - 1, -f}
-				vx = mgl64.TransformCoordinate(vx, camera) // coordinates of pixel (i,j) at focal plane in real space
-				go computePixel(img, i, j, eye, vx.Sub(eye), ds, R-cube_half_diagonal, R+cube_half_diagonal, &wg)
-				if text_progress && (i*res+j)%(pix_step) == 0 {
-					wrt.Write([]byte("-"))
+		ray_at := func(x, y float64) (mgl64.Vec3, mgl64.Vec3) {
+			return pixel_ray_at(x, y, res_f, f, R_img, camera, geometry)
+		}
+		// image row r corresponds to j = res-1-r
+		reset_clipping()
+		// with motion blur, the exposure is sampled from the end towards the start of the frame, so that
+		// the last pass renders the frame's own deformation state, in which normals and sample counts are taken
+		for k := blur_samples - 1; k >= 0; k-- {
+			if blur_samples > 1 {
+				df = append(df[:n_fixed_df], deformations.NewInterpolatedDeformation(blur_from, blur_to, float64(k)/float64(blur_samples)))
+			}
+			if view_is_empty(camera, f, R_img, res, window, geometry) {
+				// whole view is background, no pixel can see the scene
+				log.Debug().Msgf("Scene outside view %d, skipping pixel loop", i_img)
+				fill_background(img, normals, res, window)
+				if darkfield != nil {
+					for i := window.Min.X; i < window.Max.X; i++ {
+						for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+							darkfield[i][j] = 0
+						}
+					}
+				}
+			} else {
+				for i := window.Min.X; i < window.Max.X; i += pixel_stride {
+					for j := res - window.Max.Y; j < res-window.Min.Y; j += pixel_stride {
+						wg.Add(1)
+						origin, direction := pixel_ray(i, j, res_f, f, R_img, camera, geometry)
+						smin, smax := R_img-half_span, R_img+half_span
+						if keyframes != nil {
+							// a free camera need not look at the origin, and may be inside the scene
+							smin, smax = ray_span(origin, direction, half_span)
+						}
+						if params.SPP > 1 {
+							go computePixelSupersampled(img, i, j, i_img, params.SPP, ray_at, ds, smin, smax, &wg)
+						} else {
+							go computePixel(img, i, j, origin, direction, ds, smin, smax, &wg)
+						}
+						if darkfield != nil {
+							wg.Add(1)
+							if params.SPP > 1 {
+								go computeDarkfieldSupersampled(darkfield, i, j, i_img, params.SPP, ray_at, ds, smin, smax, &wg)
+							} else {
+								go computeDarkfield(darkfield, i, j, origin, direction, ds, smin, smax, &wg)
+							}
+						}
+						if normals != nil && k == 0 {
+							wg.Add(1)
+							go computeNormal(normals, i, j, origin, direction, ds, smin, smax, &wg)
+						}
+						if text_progress && k == 0 && (i*res+j)%(pix_step) == 0 {
+							wrt.Write([]byte("-"))
+						}
+					}
+				}
+			}
+			wg.Wait()
+			if blur_samples > 1 {
+				accumulate_window(blur_img, img, window, res, k == blur_samples-1)
+				if darkfield != nil {
+					accumulate_window(blur_darkfield, darkfield, window, res, k == blur_samples-1)
 				}
 			}
 		}
-		wg.Wait()
+		if blur_samples > 1 {
+			// average of the sub-frame projections
+			scale_window(img, blur_img, 1/float64(blur_samples), window, res)
+			if darkfield != nil {
+				scale_window(darkfield, blur_darkfield, 1/float64(blur_samples), window, res)
+			}
+		}
+		if smin_frac, smax_frac := clipping_fractions(); smin_frac > 0 || smax_frac > 0 {
+			log.Debug().Msgf("View %d: %.2f%% of rays clipped at smin and %.2f%% at smax", i_img, 100*smin_frac, 100*smax_frac)
+		}
+		run_clip_rays += clip_rays.Load()
+		run_clipped_smin += clipped_smin.Load()
+		run_clipped_smax += clipped_smax.Load()
+		if pixel_stride > 1 {
+			fill_stride(img, normals, window.Min.X, window.Max.X, res-window.Max.Y, res-window.Min.Y, pixel_stride)
+			if darkfield != nil {
+				fill_stride(darkfield, nil, window.Min.X, window.Max.X, res-window.Max.Y, res-window.Min.Y, pixel_stride)
+			}
+		}
 
 		// progress indicator
 		if text_progress {
 			eta := time.Since(t0) * time.Duration(num_images-i_img-1) / time.Duration(i_img+1)
-			pix_per_sec := float64(res*res) / time.Since(t1).Seconds()
+			pix_per_sec := float64(window.Dx()*window.Dy()) / time.Since(t1).Seconds()
 			s = fmt.Sprintf("] %5.0f %02d:%02d\n", pix_per_sec, int(eta.Minutes()), int(eta.Seconds())%60)
 			wrt.Write([]byte(s))
 		}
 
+		if params.ScatterFraction > 0 {
+			add_scatter(img, window.Min.X, window.Max.X, res-window.Max.Y, res-window.Min.Y, params.ScatterFraction, params.ScatterBlur)
+		}
+		if params.EdgeEnhance > 0 {
+			edge_enhance(img, window.Min.X, window.Max.X, res-window.Max.Y, res-window.Min.Y, params.EdgeEnhance)
+		}
+
 		// create image and set pixel values
-		myImage := image.NewRGBA(image.Rect(0, 0, res, res))
-		for i := 0; i < res; i++ {
-			for j := 0; j < res; j++ {
+		// grayscale images are single channel 16-bit, masks single channel 8-bit with values 0 and 255,
+		// otherwise RGBA with identical channels
+		var myImage image.Image
+		var grayImage *image.Gray16
+		var maskImage *image.Gray
+		var rgbaImage *image.RGBA
+		if output_quantity == "mask" {
+			maskImage = image.NewGray(image.Rect(0, 0, window.Dx(), window.Dy()))
+			myImage = maskImage
+		} else if grayscale {
+			grayImage = image.NewGray16(image.Rect(0, 0, window.Dx(), window.Dy()))
+			myImage = grayImage
+		} else {
+			rgbaImage = image.NewRGBA(image.Rect(0, 0, window.Dx(), window.Dy()))
+			myImage = rgbaImage
+		}
+		n_clamped := 0
+		for i := window.Min.X; i < window.Max.X; i++ {
+			for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
 				val := img[i][j]
+				if maskImage != nil {
+					// binary, so flat field and display transforms do not apply
+					var v uint8
+					if (val >= 0.5) != params.Invert {
+						v = 0xff
+					}
+					maskImage.SetGray(i-window.Min.X, res-1-j-window.Min.Y, color.Gray{v})
+					min_val = math.Min(min_val, val)
+					max_val = math.Max(max_val, val)
+					continue
+				}
+				if output_quantity == "depth" {
+					// stored relative to the far end of the integration span, misses are 1
+					val = math.Min(val/(R_img+half_span), 1.0)
+				} else if flat_img != nil {
+					if params.FlatFieldImageMode == "add" {
+						val += flat_img[i][j]
+					} else {
+						val *= flat_img[i][j]
+					}
+				}
 				var alpha uint16
 				if transparency {
-					if val < 1.0 {
+					// background is transmittance 1 or attenuation 0
+					if (output_quantity == "attenuation" && val > 0.0) || (output_quantity != "attenuation" && val < 1.0) || (output_quantity == "depth" && !math.IsInf(img[i][j], 1)) {
 						alpha = uint16(0xffff)
 					} else {
 						alpha = uint16(0x0000)
@@ -412,33 +2619,216 @@ func render(
 				} else {
 					alpha = uint16(0xffff)
 				}
-				c := color.RGBA64{uint16(val * 0xffff), uint16(val * 0xffff), uint16(val * 0xffff), alpha}
-				// image has origin at top left, so we need to flip the y coordinate
-				myImage.SetRGBA64(i, res-j, c)
-				if val < min_val {
-					min_val = val
+				// display transforms only, applied after transparency has been decided on the physical value.
+				// Gain and offset act on the final value, i.e. after flat_field has attenuated the background to exp(-flat_field)
+				if output_quantity != "depth" {
+					if params.ClampMax > 0 {
+						val /= params.ClampMax
+					}
+					val = background_gain*val + background_offset
+				}
+				// png stores values in [0, 1], out of range values would wrap around in the conversion to uint16
+				if val < 0.0 || val > 1.0 {
+					val = math.Max(0.0, math.Min(1.0, val))
+					n_clamped++
+				}
+				val = tonemap(val, tonemap_mode, tonemap_exponent)
+				if params.Invert {
+					val = 1.0 - val
+				}
+				// image has origin at top left, so we need to flip the y coordinate
+				if grayscale {
+					grayImage.SetGray16(i-window.Min.X, res-1-j-window.Min.Y, color.Gray16{uint16(val * 0xffff)})
+				} else {
+					c := color.RGBA64{uint16(val * 0xffff), uint16(val * 0xffff), uint16(val * 0xffff), alpha}
+					rgbaImage.SetRGBA64(i-window.Min.X, res-1-j-window.Min.Y, c)
+				}
+				if val < min_val {
+					min_val = val
+				}
+				if val > max_val {
+					max_val = val
+				}
+			}
+		}
+		if params.DrawBBox {
+			lo, hi := lat[0].BoundingBox()
+			draw_overlay(rgbaImage, camera, f, R_img, res, window, geometry, lo, hi)
+		}
+		if n_clamped > 0 && output_format == "png" {
+			log.Warn().Msgf("Clamped %d pixel values outside [0, 1] in '%s', consider setting clamp_max", n_clamped, filename)
+		}
+		if i_img == 0 || i_img == num_images-1 {
+			log.Info().Msgf("Min value: %f, Max value: %f", min_val, max_val)
+		}
+		// Save image to file, or keep raw values for the single hdf5 file written after the loop
+		if output_format == "hdf5" {
+			if err := stack.add(raw_pixels(img, res, window)); err != nil {
+				log.Fatal().Msgf("Error spooling projection: %v", err)
+			}
+		} else {
+			out, err := os.Create(filename)
+			if err != nil {
+				log.Panic().Err(err)
+			}
+			log.Debug().Msgf("Saving image to '%s'", filename)
+			if output_format == "exr" {
+				err = exr.Encode(out, window.Dx(), window.Dy(), raw_pixels(img, res, window))
+			} else {
+				err = png.Encode(out, myImage)
+			}
+			if err != nil {
+				log.Error().Msgf("Error encoding image: %v", err)
+			}
+			out.Close()
+		}
+		if sample_counts != nil {
+			// raw counts as 16-bit grayscale
+			samplesImage := image.NewGray16(image.Rect(0, 0, window.Dx(), window.Dy()))
+			for i := window.Min.X; i < window.Max.X; i++ {
+				for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+					samplesImage.SetGray16(i-window.Min.X, res-1-j-window.Min.Y, color.Gray16{uint16(min(sample_counts[i][j], 0xffff))})
+				}
+			}
+			samples_fn := filepath.Join(dname, "samples_"+strings.TrimSuffix(fname, filepath.Ext(fname))+".png")
+			if sout, err := os.Create(samples_fn); err == nil {
+				png.Encode(sout, samplesImage)
+				sout.Close()
+			} else {
+				log.Error().Msgf("Error saving sample counts: %v", err)
+			}
+		}
+		if darkfield != nil {
+			// raw values in exr, otherwise 16-bit grayscale scaled by clamp_max like the projection
+			stem := filepath.Join(dname, "darkfield_"+strings.TrimSuffix(fname, filepath.Ext(fname)))
+			var err error
+			if output_format == "exr" {
+				err = write_exr(stem+".exr", window.Dx(), window.Dy(), raw_pixels(darkfield, res, window))
+			} else {
+				darkImage := image.NewGray16(image.Rect(0, 0, window.Dx(), window.Dy()))
+				for i := window.Min.X; i < window.Max.X; i++ {
+					for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+						val := darkfield[i][j]
+						if params.ClampMax > 0 {
+							val /= params.ClampMax
+						}
+						darkImage.SetGray16(i-window.Min.X, res-1-j-window.Min.Y, color.Gray16{uint16(math.Max(0, math.Min(1, val)) * 0xffff)})
+					}
 				}
-				if val > max_val {
-					max_val = val
+				err = write_png(stem+".png", darkImage)
+			}
+			if err != nil {
+				log.Error().Msgf("Error saving dark-field image: %v", err)
+			}
+		}
+		if normals != nil {
+			// normals encoded as RGB (n+1)/2, background transparent
+			normalImage := image.NewRGBA64(image.Rect(0, 0, window.Dx(), window.Dy()))
+			for i := window.Min.X; i < window.Max.X; i++ {
+				for j := res - window.Max.Y; j < res-window.Min.Y; j++ {
+					n := normals[i][j]
+					if n.Len() == 0 {
+						continue
+					}
+					c := color.RGBA64{uint16((n[0] + 1) / 2 * 0xffff), uint16((n[1] + 1) / 2 * 0xffff), uint16((n[2] + 1) / 2 * 0xffff), 0xffff}
+					normalImage.SetRGBA64(i-window.Min.X, res-1-j-window.Min.Y, c)
 				}
 			}
+			normal_fn := filepath.Join(dname, "normal_"+strings.TrimSuffix(fname, filepath.Ext(fname))+".png")
+			if nout, err := os.Create(normal_fn); err == nil {
+				png.Encode(nout, normalImage)
+				nout.Close()
+			} else {
+				log.Error().Msgf("Error saving normal map: %v", err)
+			}
 		}
-		if i_img == 0 || i_img == num_images-1 {
-			log.Info().Msgf("Min value: %f, Max value: %f", min_val, max_val)
+
+		frame := OneFrameParams{FilePath: rel_path, TransformMatrix: transform_matrix, Time: frame_time}
+		if params.ChunkAngles {
+			index := i_img
+			frame.FrameIndex = &index
 		}
-		// Save image to file
-		filename := filepath.Join(output_dir, fmt.Sprintf(fname_pattern, i_img))
-		out, err := os.Create(filename)
-		if err != nil {
-			log.Panic().Err(err)
+		if len(params.FlatFieldRefs) > 0 {
+			ref := params.FlatFieldRefs[i_img]
+			frame.FlatFieldRef = &ref
 		}
-		log.Debug().Msgf("Saving image to '%s'", filename)
-		png.Encode(out, myImage)
-		out.Close()
+		if output_format == "hdf5" {
+			// all frames share file_path, projections are stacked in the order of the frames
+			index := len(transform_params.Frames)
+			frame.DatasetIndex = &index
+		}
+		transform_params.Frames = append(transform_params.Frames, frame)
+		if sidecar_file == "" {
+			continue
+		}
+		if err := append_frame_record(sidecar_file, frame); err != nil {
+			log.Warn().Msgf("Error recording frame: %v", err)
+		}
+	}
 
-		dname, fname := filepath.Split(filename)
-		rel_path := filepath.Join(filepath.Base(dname), fname)
-		transform_params.Frames = append(transform_params.Frames, OneFrameParams{FilePath: filepath.ToSlash(rel_path), TransformMatrix: transform_matrix, Time: time_label})
+	var clipped_fraction_smin, clipped_fraction_smax float64
+	if run_clip_rays > 0 {
+		clipped_fraction_smin = float64(run_clipped_smin) / float64(run_clip_rays)
+		clipped_fraction_smax = float64(run_clipped_smax) / float64(run_clip_rays)
+	}
+	if clipped_fraction_smin > 0 || clipped_fraction_smax > 0 {
+		log.Warn().Msgf("%.2f%% of rays clipped at smin and %.2f%% at smax, consider increasing R or span_margin",
+			100*clipped_fraction_smin, 100*clipped_fraction_smax)
+	}
+
+	if params.Preview {
+		log.Info().Msgf("Preview saved to '%s'", filepath.Join(output_dir, "preview.png"))
+		return transform_params
+	}
+
+	manifest := Manifest{
+		Params: ManifestParams{
+			RenderParams:     params,
+			Integration:      integration_method,
+			RefineFactor:     refine_factor,
+			ClipMin:          json_vec3(clip_min),
+			ClipMax:          json_vec3(clip_max),
+			BoundarySoftness: objects.BoundarySoftness,
+			MaskThreshold:    mask_threshold,
+			OutputQuantity:   output_quantity,
+		},
+		Resolution:        res,
+		NumFrames:         len(transform_params.Frames),
+		MinValue:          min_val,
+		MaxValue:          max_val,
+		ElapsedSeconds:    time.Since(t0).Seconds(),
+		DensityMultiplier: density_multiplier,
+		FlatField:         flat_field,
+		BackgroundGain:    background_gain,
+		BackgroundOffset:  background_offset,
+		OutputQuantity:    output_quantity,
+		ClippedSmin:       clipped_fraction_smin,
+		ClippedSmax:       clipped_fraction_smax,
+	}
+	if len(params.Input) > 0 {
+		if data, err := os.ReadFile(params.Input); err == nil {
+			sum := sha256.Sum256(data)
+			manifest.ObjectSHA256 = hex.EncodeToString(sum[:])
+		}
+	}
+	if len(df_schedule) > 0 {
+		for _, entry := range df_schedule {
+			manifest.Deformations = append(manifest.Deformations, map[string]interface{}{
+				"frame": entry.Frame, "time": entry.Time, "deformation": entry.Deformation.ToMap(),
+			})
+		}
+	} else {
+		for _, d := range df {
+			manifest.Deformations = append(manifest.Deformations, d.ToMap())
+		}
+	}
+	manifest_file := filepath.Join(filepath.Dir(transforms_file), "manifest.json")
+	if params.ChunkAngles {
+		manifest_file = filepath.Join(filepath.Dir(transforms_file), fmt.Sprintf("manifest_job%d.json", job_num))
+	}
+	log.Info().Msgf("Writing run manifest to '%s'", manifest_file)
+	if err := write_json(manifest_file, manifest); err != nil {
+		log.Error().Msgf("Error writing manifest: %v", err)
 	}
 
 	// write transform parameters to JSON
@@ -452,22 +2842,168 @@ func render(
 		log.Fatal().Msg("Error writing JSON to file")
 	}
 
+	if output_format == "hdf5" {
+		fn := filepath.Join(output_dir, hdf5_name)
+		log.Info().Msgf("Writing projections to '%s'", fn)
+		data, err := stack.data()
+		if err != nil {
+			log.Fatal().Msgf("Error reading spooled projections: %v", err)
+		}
+		if err := write_hdf5(fn, transform_params, data, orbit_axis); err != nil {
+			log.Fatal().Msgf("Error writing hdf5 file: %v", err)
+		}
+	}
+
+	if len(params.AnglesCSV) > 0 {
+		log.Info().Msgf("Writing camera angles to '%s'", params.AnglesCSV)
+		if err := write_angles_csv(params.AnglesCSV, transform_params, orbit_axis); err != nil {
+			log.Fatal().Msgf("Error writing camera angles: %v", err)
+		}
+	}
+
+	if params.CameraExport == "colmap" {
+		colmap_dir := filepath.Dir(transforms_file)
+		log.Info().Msgf("Writing COLMAP cameras to '%s'", colmap_dir)
+		if err := write_colmap(colmap_dir, transform_params); err != nil {
+			log.Fatal().Msgf("Error writing COLMAP cameras: %v", err)
+		}
+	}
+
+	if params.SkipObjectDump {
+		return transform_params
+	}
 	// write object to JSON or YAML
 	// data, err := json.MarshalIndent(lat[0].ToMap(), "", "  ")
+	if err := objects.CheckRoundTrip(lat[0].ToMap()); err != nil {
+		log.Error().Msgf("Not writing object: %v", err)
+		return transform_params
+	}
 	data, err := yaml.Marshal(lat[0].ToMap())
 	if err != nil {
 		log.Fatal().Msg("Error marshalling object to YAML")
 	}
-	obj_path := filepath.Join(filepath.Dir(output_dir), "object.yaml")
+	obj_path := params.ObjectOut
+	if obj_path == "" {
+		obj_path = filepath.Join(filepath.Dir(output_dir), "object.yaml")
+	}
 	log.Info().Msgf("Writing object to '%s'", filepath.ToSlash(obj_path))
 	err = os.WriteFile(obj_path, data, 0644)
 	if err != nil {
-		log.Fatal().Msg("Error writing object.json to file")
+		log.Fatal().Msgf("Error writing object to '%s'", obj_path)
 	}
+	return transform_params
 }
 
-func main() {
-	app := &cli.App{
+// Configure the global logger. With log_file set, structured JSON logs go to the file and the
+// console is left clean; otherwise human-readable logs go to stderr.
+// Returned file (nil for stderr) should be closed by the caller.
+func setup_logging(log_file string, verbose bool) (*os.File, error) {
+	if verbose {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+	if log_file == "" {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		return nil, nil
+	}
+	f, err := os.OpenFile(log_file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Logger = zerolog.New(f).With().Timestamp().Logger()
+	return f, nil
+}
+
+// Command line application with the render action and its subcommands
+func new_app() *cli.App {
+	return &cli.App{
+		Commands: []cli.Command{
+			{
+				Name:  "info",
+				Usage: "Load an object and print its type, number of children, bounding box, min feature size and estimated volume fraction without rendering",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "input",
+						Usage: "Input yaml or json file describing the object",
+					},
+					&cli.IntFlag{
+						Name:  "samples",
+						Usage: "Number of Monte Carlo samples for the volume fraction and mass estimates",
+						Value: 100000,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					setup_logging("", false)
+					if len(cCtx.String("input")) == 0 {
+						return fmt.Errorf("input must be given")
+					}
+					if cCtx.Int("samples") <= 0 {
+						return fmt.Errorf("samples must be positive, got %d", cCtx.Int("samples"))
+					}
+					if err := load_object(cCtx.String("input")); err != nil {
+						return err
+					}
+					write_info(os.Stdout, lat[len(lat)-1], cCtx.Int("samples"))
+					return nil
+				},
+			},
+			{
+				Name:  "trace",
+				Usage: "Trace the ray through pixel (i, j) of one view and write every density sample of the integrator as CSV",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "input", Usage: "Input yaml or json file describing the object"},
+					&cli.IntFlag{Name: "i", Usage: "Pixel column, counted from the left"},
+					&cli.IntFlag{Name: "j", Usage: "Pixel row, counted from the bottom"},
+					&cli.Float64Flag{Name: "angle", Usage: "Azimuthal angle of the camera in degrees", Value: 90.0},
+					&cli.Float64Flag{Name: "polar", Usage: "Polar angle of the camera in degrees", Value: 90.0},
+					&cli.IntFlag{Name: "resolution", Usage: "Resolution of the square image", Value: 512},
+					&cli.Float64Flag{Name: "fov", Usage: "Field of view in degrees", Value: 45.0},
+					&cli.Float64Flag{Name: "R", Usage: "Distance between camera and centre of scene", Value: 5.0},
+					&cli.Float64Flag{Name: "ds", Usage: "Integration step size. If negative, infer from the object and pixel footprint as for rendering", Value: -1.0},
+					&cli.StringFlag{Name: "integration", Usage: "Integration method to trace", Value: "hierarchical"},
+					&cli.Float64Flag{Name: "span_margin", Usage: "Multiplier of the scene half diagonal giving the half length of the integration span, as for rendering", Value: default_span_margin},
+					&cli.StringFlag{Name: "output", Usage: "Output CSV file", Value: "trace.csv"},
+				},
+				Action: func(cCtx *cli.Context) error {
+					setup_logging("", false)
+					if len(cCtx.String("input")) == 0 {
+						return fmt.Errorf("input must be given")
+					}
+					if err := set_integration(cCtx.String("integration")); err != nil {
+						return err
+					}
+					if err := load_object(cCtx.String("input")); err != nil {
+						return err
+					}
+					R := cCtx.Float64("R")
+					ds := cCtx.Float64("ds")
+					if ds < 0 {
+						ds = auto_ds(lat[0], cCtx.Int("resolution"), cCtx.Float64("fov"), R, "cone_beam")
+					}
+					res_f := float64(cCtx.Int("resolution"))
+					f := 1 / math.Tan(mgl64.DegToRad(cCtx.Float64("fov")/2))
+					camera := camera_from_angles(cCtx.Float64("angle"), mgl64.DegToRad(cCtx.Float64("polar")), R, mgl64.Vec3{0, 0, 1})
+					origin, direction := pixel_ray(cCtx.Int("i"), cCtx.Int("j"), res_f, f, R, camera, "cone_beam")
+					out, err := os.Create(cCtx.String("output"))
+					if err != nil {
+						return err
+					}
+					defer out.Close()
+					span_margin, err := resolve_span_margin(cCtx.Float64("span_margin"))
+					if err != nil {
+						return err
+					}
+					half_span := cube_half_diagonal * span_margin
+					T, err := trace_ray(out, origin, direction, ds, R-half_span, R+half_span)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("optical depth %g, transmittance %g, samples written to '%s'\n", T, math.Exp(-T), cCtx.String("output"))
+					return nil
+				},
+			},
+		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "output_dir",
@@ -475,9 +3011,32 @@ func main() {
 				Value: "images",
 			},
 			&cli.StringFlag{
-				Name:     "input",
-				Usage:    "Input yaml file describing the object",
-				Required: true,
+				Name:  "input",
+				Usage: "Input yaml file describing the object. Required unless builtin_lattice or phantom is given",
+			},
+			&cli.StringFlag{
+				Name:  "phantom",
+				Usage: "Render a built-in test phantom instead of input. Options are 'bent_beam' (cylinder with bend deformation). Ground truth displacement p - deform(p) is written to displacement.json next to transforms_file",
+			},
+			&cli.StringFlag{
+				Name:  "builtin_lattice",
+				Usage: "Render a built-in lattice instead of input file. Options are 'kelvin' or 'diamond'",
+				Value: "",
+			},
+			&cli.Float64Flag{
+				Name:  "lattice_strut_radius",
+				Usage: "Strut radius for builtin_lattice",
+				Value: 0.02,
+			},
+			&cli.Float64Flag{
+				Name:  "lattice_cell_size",
+				Usage: "Unit cell size for builtin_lattice. Lattice fills the cube [-0.5,0.5]^3",
+				Value: 0.25,
+			},
+			&cli.Float64Flag{
+				Name:  "lattice_density",
+				Usage: "Strut density for builtin_lattice",
+				Value: 1.0,
 			},
 			&cli.IntFlag{
 				Name:  "num_projections",
@@ -493,6 +3052,16 @@ func main() {
 				Name:  "out_of_plane",
 				Usage: "Generate out of plane projections",
 			},
+			&cli.Float64Flag{
+				Name:  "polar_min",
+				Usage: "Minimum polar angle in degrees for out of plane projections",
+				Value: 0.0,
+			},
+			&cli.Float64Flag{
+				Name:  "polar_max",
+				Usage: "Maximum polar angle in degrees for out of plane projections",
+				Value: 180.0,
+			},
 			&cli.StringFlag{
 				Name:  "fname_pattern",
 				Usage: "Sprintf pattern for output file name",
@@ -508,6 +3077,53 @@ func main() {
 				Usage: "Distance between camera and centre of scene",
 				Value: 5.0,
 			},
+			&cli.BoolFlag{
+				Name:  "center_object",
+				Usage: "Translate the object so that the centre of its bounding box is at the origin",
+			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Fail instead of warning when the object lies wholly or mostly outside the renderable region [-1, 1]^3",
+			},
+			&cli.StringFlag{
+				Name:  "object_euler",
+				Usage: "Rotate the object about the origin by angles rx,ry,rz in degrees about the fixed x, y and z axes, applied in that order",
+			},
+			&cli.StringFlag{
+				Name:  "export_deformation",
+				Usage: "Write the displacement p - deform(p) of the loaded deformations (same sign as the phantom displacement.json) on a grid over the integrated region [-s, s]^3, s the half integration span, as float32 volumes of shape (3, n, n, n) to this .npy (or raw) file",
+			},
+			&cli.IntFlag{
+				Name:  "export_deformation_resolution",
+				Usage: "Grid points along each axis of the deformation export",
+				Value: default_deformation_export_res,
+			},
+			&cli.BoolTFlag{
+				Name:  "write_object",
+				Usage: "Write the rendered object as YAML after the run. Set --write_object=false to skip it",
+			},
+			&cli.StringFlag{
+				Name:  "object_out",
+				Usage: "File for the object dump. Default is object.yaml in the parent of output_dir",
+			},
+			&cli.IntFlag{
+				Name:  "max_projections_in_memory",
+				Usage: "With hdf5 output, hold at most this many projections in memory and spool the rest to a temporary file in output_dir. 0 for no limit",
+			},
+			&cli.StringFlag{
+				Name: "camera_keyframes",
+				Usage: "JSON or YAML list of camera keyframes with 'eye' and optional 'target' (default origin) and 'up' (default orbit_axis)." +
+					" Frames follow a smooth path through them (Catmull-Rom positions, slerp orientations) instead of the orbit",
+			},
+			&cli.BoolFlag{
+				Name:  "auto_distance",
+				Usage: "Compute R from the bounding box of the object so that it fits in the field of view",
+			},
+			&cli.Float64Flag{
+				Name:  "auto_distance_margin",
+				Usage: "Relative margin around the object when using auto_distance",
+				Value: 0.1,
+			},
 			&cli.Float64Flag{
 				Name:  "fov",
 				Usage: "Field of view in degrees",
@@ -515,14 +3131,55 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:  "integration",
-				Usage: "Integration method to use. Options are 'simple' or 'hierarchical'. ",
+				Usage: "Integration method to use. Options are 'simple', 'hierarchical', 'importance' or 'reference' (slow midpoint rule with step DS/100 for validation). ",
 				Value: "hierarchical",
 			},
+			&cli.IntFlag{
+				Name: "refine_factor",
+				Usage: "Number of fine steps per coarse step ds where the hierarchical method refines near density changes (at least 1)." +
+					" Boundary error scales with ds/refine_factor while samples per boundary grow with refine_factor",
+				Value: 10,
+			},
+			&cli.Float64Flag{
+				Name:  "span_margin",
+				Usage: "Multiplier of the scene half diagonal (1.74) giving the half length of the integration span along each ray, so that objects touching the unit cube are not clipped",
+				Value: default_span_margin,
+			},
+			&cli.StringFlag{
+				Name: "output_quantity",
+				Usage: "Quantity to store in pixels. Options are 'transmittance' (exp(-T)), 'attenuation'" +
+					" (optical depth T, i.e. line integral of density), 'depth' (distance to the first nonzero density," +
+					" infinite for misses in exr and relative to the far end of the integration span in png)" +
+					" or 'mask' (1 where the density along the ray exceeds mask_threshold, 0 otherwise; 8-bit png)",
+				Value: "transmittance",
+			},
+			&cli.Float64Flag{
+				Name:  "mask_threshold",
+				Usage: "Density above which a ray counts as occupied in mask output",
+				Value: 0.0,
+			},
 			&cli.Float64Flag{
 				Name:  "flat_field",
 				Usage: "Flat field value to add to all pixels",
 				Value: 0.0,
 			},
+			&cli.Float64Flag{
+				Name: "clamp_max",
+				Usage: "Value encoded as white in png output: values are divided by clamp_max before background_gain and offset." +
+					" Values outside [0, 1] are clamped (with a warning) rather than wrapped. 0 keeps the values unscaled",
+				Value: 0.0,
+			},
+			&cli.Float64Flag{
+				Name: "background_gain",
+				Usage: "Gain applied to png pixel values (not depth) as gain*value + background_offset, e.g. to mimic detector response." +
+					" Applied after flat_field, which acts on the optical depth, and before invert",
+				Value: 1.0,
+			},
+			&cli.Float64Flag{
+				Name:  "background_offset",
+				Usage: "Constant offset added to png pixel values (not depth) after background_gain, e.g. to mimic detector bias",
+				Value: 0.0,
+			},
 			&cli.IntFlag{
 				Name: "jobs_modulo",
 				Usage: "Number of jobs which are being run independently" +
@@ -535,11 +3192,29 @@ func main() {
 					" (e.g. job=1 with jobs_modulo=4 will render projections 1, 5, 9, ...)",
 				Value: 0,
 			},
+			&cli.BoolFlag{
+				Name: "chunk_angles",
+				Usage: "Write the projections of this job to output_dir_job<job> with local numbering and" +
+					" to a partial transforms_job<job>.json which can be combined with merge_transforms",
+			},
+			&cli.StringFlag{
+				Name: "merge_transforms",
+				Usage: "Comma separated list of partial transforms files from chunk_angles jobs." +
+					" Merges them into transforms_file and exits without rendering",
+			},
 			&cli.StringFlag{
 				Name:  "transforms_file",
 				Usage: "Output file to save the transform parameters",
 				Value: "transforms.json",
 			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Skip projections already rendered by a previous run (recorded next to transforms_file)",
+			},
+			&cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Allow overwriting existing images and transforms file. Without it (or resume) rendering into an existing dataset is refused",
+			},
 			&cli.Float64Flag{
 				Name:  "density_multiplier",
 				Usage: "Multiply all densities by this number",
@@ -550,19 +3225,200 @@ func main() {
 				Usage: "File containing deformation parameters",
 				Value: "",
 			},
+			&cli.StringFlag{
+				Name:  "deformation_schedule",
+				Usage: "File containing a list of per-frame deformations (overrides deformation_file)",
+				Value: "",
+			},
+			&cli.IntFlag{
+				Name:  "motion_blur_samples",
+				Usage: "Average this many projections per frame, interpolating the scheduled deformation from the frame's state to the next frame's, to simulate motion blur during the exposure",
+			},
 			&cli.Float64Flag{
 				Name:  "time_label",
 				Usage: "Label to pass to image metadata",
 				Value: 0.0,
 			},
+			&cli.StringFlag{
+				Name:  "frame_times",
+				Usage: "Comma-separated time label per frame, overriding time_label",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "flat_field_refs",
+				Usage: "Comma-separated index of the flat-field reference acquisition per frame, stored as flat_field_ref in the transforms (e.g. for 4D-CT)",
+				Value: "",
+			},
 			&cli.BoolFlag{
 				Name:  "text_progress",
 				Usage: "Use text progress bar",
 			},
+			&cli.BoolFlag{
+				Name:  "quiet",
+				Usage: "Suppress the progress bar",
+			},
+			&cli.StringFlag{
+				Name:  "log_file",
+				Usage: "Write structured JSON logs to this file instead of the console",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "roi",
+				Usage: "Render only region of interest of the detector given as integer pixel coordinates x0,y0,x1,y1 (e.g. for tiled rendering)",
+				Value: "",
+			},
 			&cli.BoolFlag{
 				Name:  "transparency",
 				Usage: "Enable transparency in output images",
 			},
+			&cli.StringFlag{
+				Name:  "orbit_axis",
+				Usage: "Axis x,y,z about which the camera orbits, also used as up direction",
+				Value: "0,0,1",
+			},
+			&cli.StringFlag{
+				Name:  "roll",
+				Usage: "Detector roll about the view direction in degrees. Single value or comma-separated value per projection",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "geometry",
+				Usage: "Beam geometry. Options are 'cone_beam' or 'fan_beam' (single-slice fan per detector row, polar angle 90 only)",
+				Value: "cone_beam",
+			},
+			&cli.StringFlag{
+				Name:  "camera_convention",
+				Usage: "Axes of the stored transform_matrix. Options are 'opengl' (camera looks along -z, y up) or 'opencv' (looks along +z, y down)",
+				Value: "opengl",
+			},
+			&cli.StringFlag{
+				Name:  "flat_field_image",
+				Usage: "PNG image with per-pixel beam profile applied to pixel values (must match resolution)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "flat_field_image_mode",
+				Usage: "How flat_field_image is applied. Options are 'multiply' or 'add'",
+				Value: "multiply",
+			},
+			&cli.StringFlag{
+				Name:  "output_format",
+				Usage: "Image format. Options are 'png', 'exr' (single channel 32-bit float with raw pixel values) or 'hdf5' (raw values of all projections with angles and intrinsics in one projections.h5)",
+				Value: "png",
+			},
+			&cli.Float64Flag{
+				Name:  "clip_xmin",
+				Usage: "Treat the scene as empty for world x below this value",
+				Value: math.Inf(-1),
+			},
+			&cli.Float64Flag{
+				Name:  "clip_xmax",
+				Usage: "Treat the scene as empty for world x above this value",
+				Value: math.Inf(1),
+			},
+			&cli.Float64Flag{
+				Name:  "clip_ymin",
+				Usage: "Treat the scene as empty for world y below this value",
+				Value: math.Inf(-1),
+			},
+			&cli.Float64Flag{
+				Name:  "clip_ymax",
+				Usage: "Treat the scene as empty for world y above this value",
+				Value: math.Inf(1),
+			},
+			&cli.Float64Flag{
+				Name:  "clip_zmin",
+				Usage: "Treat the scene as empty for world z below this value",
+				Value: math.Inf(-1),
+			},
+			&cli.Float64Flag{
+				Name:  "clip_zmax",
+				Usage: "Treat the scene as empty for world z above this value",
+				Value: math.Inf(1),
+			},
+			&cli.Float64Flag{
+				Name:  "boundary_softness",
+				Usage: "Width (world units) of the shell over which density of sphere, box, cube and cylinder ramps to zero. 0 gives hard edges",
+				Value: 0.0,
+			},
+			&cli.StringFlag{
+				Name:  "camera_export",
+				Usage: "Additionally export cameras in another format next to transforms_file. Options are '' or 'colmap' (cameras.txt and images.txt)",
+				Value: "",
+			},
+			&cli.StringFlag{
+				Name:  "angles_csv",
+				Usage: "Optional CSV file listing the azimuthal and polar angle (degrees) and eye position of each frame",
+			},
+			&cli.StringFlag{
+				Name:  "reuse_transforms",
+				Usage: "Render from the exact camera poses in a transforms file of a previous run instead of generating angles",
+				Value: "",
+			},
+			&cli.BoolFlag{
+				Name:  "profile_samples",
+				Usage: "Also save the number of density evaluations per pixel as 16-bit samples_<image>.png",
+			},
+			&cli.BoolFlag{
+				Name:  "preview",
+				Usage: fmt.Sprintf("Render a single in-plane image at resolution %d to output_dir/preview.png for a quick check. No transforms or object files are written", preview_res),
+			},
+			&cli.BoolFlag{
+				Name:  "invert",
+				Usage: "Invert pixel values (1 - value) so that the object is bright on a dark background",
+			},
+			&cli.BoolFlag{
+				Name:  "normal_map",
+				Usage: "Also save world-space surface normals at the first hit of each ray as normal_<image>.png",
+			},
+			&cli.BoolFlag{
+				Name:  "emit_darkfield",
+				Usage: "Also save the line integral of the per-object emission coefficient (without attenuation) as darkfield_<image>, mimicking dark-field contrast",
+			},
+			&cli.Float64Flag{
+				Name: "scatter_fraction",
+				Usage: "First-order scatter model: add this fraction of the absorbed signal (1 - transmittance)," +
+					" blurred by a Gaussian of width scatter_blur, back to each transmittance projection. 0 disables",
+				Value: 0.0,
+			},
+			&cli.Float64Flag{
+				Name:  "scatter_blur",
+				Usage: "Standard deviation in pixels of the Gaussian blur of the scatter component",
+				Value: 20.0,
+			},
+			&cli.IntFlag{
+				Name:  "pixel_stride",
+				Usage: "Compute only every Nth pixel in each direction and fill the gaps from the nearest computed pixel, for fast previews at full framing",
+				Value: 1,
+			},
+			&cli.BoolFlag{
+				Name:  "draw_bbox",
+				Usage: "Draw the bounding box of the scene (yellow) and the coordinate axes (x red, y green, z blue) over each image for orientation checks",
+			},
+			&cli.StringFlag{
+				Name:  "tonemap",
+				Usage: "Tone map of png values for visualisation: 'linear', 'gamma' (value^tonemap_exponent) or 'log' (compresses tonemap_exponent decades)",
+				Value: "linear",
+			},
+			&cli.Float64Flag{
+				Name:  "tonemap_exponent",
+				Usage: "Exponent of the gamma and log tone maps",
+				Value: default_tonemap_exponent,
+			},
+			&cli.Float64Flag{
+				Name:  "edge_enhance",
+				Usage: "Blend Sobel gradient magnitude of each projection into it with this weight in [0, 1] to highlight edges. 0 disables",
+				Value: 0.0,
+			},
+			&cli.IntFlag{
+				Name:  "spp",
+				Usage: "Rays per pixel for anti-aliasing. Sub-pixel offsets are derived from a hash of pixel, sample and frame indices, so renders are reproducible",
+				Value: 1,
+			},
+			&cli.BoolFlag{
+				Name:  "grayscale",
+				Usage: "Save 16-bit single channel grayscale images instead of RGBA",
+			},
 			// verbose flag
 			&cli.BoolFlag{
 				Name:  "v",
@@ -570,46 +3426,176 @@ func main() {
 			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-			if cCtx.Bool("v") {
-				zerolog.SetGlobalLevel(zerolog.InfoLevel)
-			} else {
-				zerolog.SetGlobalLevel(zerolog.WarnLevel)
-			}
-			if cCtx.String("integration") == "simple" {
-				integrate = integrate_along_ray
-				log.Info().Msg("Using simple integration method")
-			} else if cCtx.String("integration") == "hierarchical" {
-				integrate = integrate_hierarchical
-				log.Info().Msg("Using hierarchical integration method")
+			log_f, err := setup_logging(cCtx.String("log_file"), cCtx.Bool("v"))
+			if err != nil {
+				return fmt.Errorf("error opening log file: %w", err)
+			}
+			if log_f != nil {
+				defer log_f.Close()
+			}
+			if merge := cCtx.String("merge_transforms"); len(merge) > 0 {
+				merged, err := MergeTransforms(strings.Split(merge, ","))
+				if err != nil {
+					log.Fatal().Msgf("Error merging transforms: %v", err)
+				}
+				log.Info().Msgf("Writing %d merged frames to '%s'", len(merged.Frames), cCtx.String("transforms_file"))
+				if err := write_json(cCtx.String("transforms_file"), merged); err != nil {
+					log.Fatal().Msgf("Error writing merged transforms: %v", err)
+				}
+				return nil
+			}
+			if err := set_integration(cCtx.String("integration")); err != nil {
+				log.Fatal().Msg(err.Error())
+			}
+			if q := cCtx.String("output_quantity"); q == "transmittance" || q == "attenuation" || q == "depth" || q == "mask" {
+				output_quantity = q
+				log.Info().Msgf("Storing %s in pixels", q)
 			} else {
-				log.Fatal().Msgf("Unknown integration method: %s", cCtx.String("integration"))
+				log.Fatal().Msgf("Unknown output quantity: %s", q)
 			}
+			mask_threshold = cCtx.Float64("mask_threshold")
 			flat_field = cCtx.Float64("flat_field")
+			background_gain = cCtx.Float64("background_gain")
+			background_offset = cCtx.Float64("background_offset")
 			density_multiplier = cCtx.Float64("density_multiplier")
+			for k, axis := range []string{"x", "y", "z"} {
+				clip_min[k] = cCtx.Float64("clip_" + axis + "min")
+				clip_max[k] = cCtx.Float64("clip_" + axis + "max")
+				if clip_min[k] >= clip_max[k] {
+					log.Fatal().Msgf("clip_%smin must be smaller than clip_%smax", axis, axis)
+				}
+			}
+			objects.BoundarySoftness = cCtx.Float64("boundary_softness")
+			if objects.BoundarySoftness < 0.0 {
+				log.Fatal().Msgf("boundary_softness must be non-negative, got %v", objects.BoundarySoftness)
+			}
 			text_progress = cCtx.Bool("text_progress")
-			render(
-				cCtx.String("input"),
-				cCtx.String("output_dir"),
-				cCtx.String("fname_pattern"),
-				cCtx.Int("resolution"),
-				cCtx.Int("num_projections"),
-				cCtx.Bool("out_of_plane"),
-				cCtx.Float64("ds"),
-				cCtx.Float64("R"),
-				cCtx.Float64("fov"),
-				cCtx.Int("jobs_modulo"),
-				cCtx.Int("job"),
-				cCtx.String("transforms_file"),
-				cCtx.String("deformation_file"),
-				cCtx.Float64("time_label"),
-				cCtx.Bool("transparency"),
-			)
+			quiet = cCtx.Bool("quiet")
+			roi, err := parseIntList(cCtx.String("roi"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing roi: %v", err)
+			}
+			orbit_axis, err := parseFloatList(cCtx.String("orbit_axis"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing orbit_axis: %v", err)
+			}
+			frame_times, err := parseFloatList(cCtx.String("frame_times"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing frame_times: %v", err)
+			}
+			flat_field_refs, err := parseIntList(cCtx.String("flat_field_refs"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing flat_field_refs: %v", err)
+			}
+			object_euler, err := parseFloatList(cCtx.String("object_euler"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing object_euler: %v", err)
+			}
+			roll, err := parseFloatList(cCtx.String("roll"))
+			if err != nil {
+				log.Fatal().Msgf("Error parsing roll: %v", err)
+			}
+			params := RenderParams{
+				Input:               cCtx.String("input"),
+				OutputDir:           cCtx.String("output_dir"),
+				FnamePattern:        cCtx.String("fname_pattern"),
+				Res:                 cCtx.Int("resolution"),
+				NumImages:           cCtx.Int("num_projections"),
+				OutOfPlane:          cCtx.Bool("out_of_plane"),
+				PolarMin:            cCtx.Float64("polar_min"),
+				PolarMax:            cCtx.Float64("polar_max"),
+				DS:                  cCtx.Float64("ds"),
+				R:                   cCtx.Float64("R"),
+				FOV:                 cCtx.Float64("fov"),
+				JobsModulo:          cCtx.Int("jobs_modulo"),
+				JobNum:              cCtx.Int("job"),
+				ChunkAngles:         cCtx.Bool("chunk_angles"),
+				TransformsFile:      cCtx.String("transforms_file"),
+				DeformationFile:     cCtx.String("deformation_file"),
+				DeformationSchedule: cCtx.String("deformation_schedule"),
+				MotionBlurSamples:   cCtx.Int("motion_blur_samples"),
+				TimeLabel:           cCtx.Float64("time_label"),
+				FrameTimes:          frame_times,
+				FlatFieldRefs:       flat_field_refs,
+				Transparency:        cCtx.Bool("transparency"),
+				ROI:                 roi,
+				Grayscale:           cCtx.Bool("grayscale"),
+				Roll:                roll,
+				Geometry:            cCtx.String("geometry"),
+				FlatFieldImage:      cCtx.String("flat_field_image"),
+				FlatFieldImageMode:  cCtx.String("flat_field_image_mode"),
+				AutoDistance:        cCtx.Bool("auto_distance"),
+				AutoDistanceMargin:  cCtx.Float64("auto_distance_margin"),
+				CenterObject:        cCtx.Bool("center_object"),
+				Strict:              cCtx.Bool("strict"),
+				ObjectEuler:         object_euler,
+				ExportDeformation:   cCtx.String("export_deformation"),
+				DeformationGridRes:  cCtx.Int("export_deformation_resolution"),
+				OrbitAxis:           orbit_axis,
+				Resume:              cCtx.Bool("resume"),
+				Overwrite:           cCtx.Bool("overwrite"),
+				OutputFormat:        cCtx.String("output_format"),
+				Invert:              cCtx.Bool("invert"),
+				CameraExport:        cCtx.String("camera_export"),
+				CameraConvention:    cCtx.String("camera_convention"),
+				AnglesCSV:           cCtx.String("angles_csv"),
+				ReuseTransforms:     cCtx.String("reuse_transforms"),
+				CameraKeyframes:     cCtx.String("camera_keyframes"),
+				SkipObjectDump:      !cCtx.BoolT("write_object"),
+				ObjectOut:           cCtx.String("object_out"),
+				MaxInMemory:         cCtx.Int("max_projections_in_memory"),
+				ProfileSamples:      cCtx.Bool("profile_samples"),
+				Preview:             cCtx.Bool("preview"),
+				NormalMap:           cCtx.Bool("normal_map"),
+				EmitDarkfield:       cCtx.Bool("emit_darkfield"),
+				SPP:                 cCtx.Int("spp"),
+				RefineFactor:        cCtx.Int("refine_factor"),
+				SpanMargin:          cCtx.Float64("span_margin"),
+				Tonemap:             cCtx.String("tonemap"),
+				TonemapExponent:     cCtx.Float64("tonemap_exponent"),
+				PixelStride:         cCtx.Int("pixel_stride"),
+				DrawBBox:            cCtx.Bool("draw_bbox"),
+				EdgeEnhance:         cCtx.Float64("edge_enhance"),
+				ScatterFraction:     cCtx.Float64("scatter_fraction"),
+				ClampMax:            cCtx.Float64("clamp_max"),
+				ScatterBlur:         cCtx.Float64("scatter_blur"),
+			}
+			if err := check_overwrite(params); err != nil {
+				return err
+			}
+			if name := cCtx.String("builtin_lattice"); len(name) > 0 {
+				obj, err := builtin_lattice(name, cCtx.Float64("lattice_strut_radius"), cCtx.Float64("lattice_cell_size"), cCtx.Float64("lattice_density"))
+				if err != nil {
+					log.Fatal().Msgf("Error creating lattice: %v", err)
+				}
+				AddObject(obj)
+				render_scene(params)
+			} else if name := cCtx.String("phantom"); len(name) > 0 {
+				obj, d, err := phantom(name)
+				if err != nil {
+					log.Fatal().Msgf("Error creating phantom: %v", err)
+				}
+				AddObject(obj)
+				AddDeformation(d)
+				displacement_file := filepath.Join(filepath.Dir(params.TransformsFile), "displacement.json")
+				log.Info().Msgf("Writing phantom displacement field to '%s'", displacement_file)
+				if err := write_displacement_grid(displacement_file, d, 21, -1.0, 1.0); err != nil {
+					log.Fatal().Msgf("Error writing displacement field: %v", err)
+				}
+				render_scene(params)
+			} else if len(params.Input) > 0 {
+				render(params)
+			} else {
+				log.Fatal().Msg("Either input, builtin_lattice or phantom must be given")
+			}
 			return nil
 		},
 	}
+}
 
+func main() {
+	app := new_app()
 	if err := app.Run(os.Args); err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Msg(err.Error())
 	}
 }
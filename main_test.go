@@ -1,21 +1,123 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-gl/mathgl/mgl64"
+	"github.com/igrega348/xray_projection_render/deformations"
+	"github.com/igrega348/xray_projection_render/objects"
 	"github.com/pkg/profile"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
-func TestMain(m *testing.M) {
-	defer profile.Start().Stop()
+// Reset global scene state between tests
+func reset_scene() {
+	lat = []objects.Object{}
+	df = []deformations.Deformation{}
+	df_schedule = []ScheduleEntry{}
+	reset_clipping()
+	warned_non_finite = false
+	clip_min = mgl64.Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	clip_max = mgl64.Vec3{math.Inf(1), math.Inf(1), math.Inf(1)}
+}
+
+// Write contents to file in directory dir and return its path
+func write_file(t *testing.T, dir, name, contents string) string {
+	fn := filepath.Join(dir, name)
+	if err := os.WriteFile(fn, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// Render parameters for a single small projection
+func test_params(input, output_dir, transforms_file string, res int) RenderParams {
+	return RenderParams{
+		Input:          input,
+		OutputDir:      output_dir,
+		FnamePattern:   "image_%03d.png",
+		Res:            res,
+		NumImages:      1,
+		DS:             0.01,
+		R:              5.0,
+		FOV:            45.0,
+		JobsModulo:     1,
+		TransformsFile: transforms_file,
+	}
+}
+
+// Load transform parameters written by render
+func read_transforms(t *testing.T, fn string) TransformParams {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transform_params TransformParams
+	if err := json.Unmarshal(data, &transform_params); err != nil {
+		t.Fatal(err)
+	}
+	return transform_params
+}
+
+// Load png image from file
+func read_png(t *testing.T, fn string) image.Image {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// Load png image and return the centroid of the attenuation (1 - intensity)
+func attenuation_centroid(t *testing.T, fn string) (float64, float64) {
+	img := read_png(t, fn)
+	var sx, sy, sw float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, a := img.At(x, y).RGBA()
+			if a == 0 { // pixel not written
+				continue
+			}
+			w := 1.0 - float64(r)/0xffff
+			sx += w * float64(x)
+			sy += w * float64(y)
+			sw += w
+		}
+	}
+	return sx / sw, sy / sw
+}
+
+func TestRender(t *testing.T) {
+	defer profile.Start(profile.ProfilePath(t.TempDir())).Stop()
+	reset_scene()
+	if err := load_object("cube.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	out_dir := t.TempDir()
 	const res = 128
 	const num_images = 2
 	const R = 4.0
@@ -75,13 +177,2660 @@ func TestMain(m *testing.M) {
 			}
 		}
 		// Save to out.png
-		filename := fmt.Sprintf("pics/out%d.png", i_img)
+		filename := filepath.Join(out_dir, fmt.Sprintf("out%d.png", i_img))
 		out, err := os.Create(filename)
 		if err != nil {
-			panic(err)
+			t.Fatal(err)
 		}
 		png.Encode(out, myImage)
 		out.Close()
 
 	}
 }
+
+func TestDeformationSchedule(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.2\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	schedule := write_file(t, dir, "schedule.yaml", `
+- frame: 0
+  time: 0.0
+  deformation: {type: rigid, displacements: [0.0, 0.0, 0.0]}
+- frame: 1
+  time: 0.5
+  deformation: {type: rigid, displacements: [0.0, 0.0, -0.5]}
+- frame: 2
+  time: 1.0
+  deformation: {type: rigid, displacements: [0.0, 0.0, 0.5]}
+`)
+	out_dir := filepath.Join(dir, "images")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, out_dir, transforms, 32)
+	params.NumImages = 3
+	params.DeformationSchedule = schedule
+	render(params)
+
+	// rigid displacement d moves the object by -d, so frame 1 is up and frame 2 is down
+	expected_time := []float64{0.0, 0.5, 1.0}
+	ys := make([]float64, 3)
+	for i := 0; i < 3; i++ {
+		_, ys[i] = attenuation_centroid(t, filepath.Join(out_dir, fmt.Sprintf("image_%03d.png", i)))
+	}
+	if !(ys[1] < ys[0]-3 && ys[2] > ys[0]+3) {
+		t.Errorf("object not moved as scheduled, centroid rows %v", ys)
+	}
+	transform_params := read_transforms(t, transforms)
+	if len(transform_params.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(transform_params.Frames))
+	}
+	for i, frame := range transform_params.Frames {
+		if frame.Time != expected_time[i] {
+			t.Errorf("frame %d: expected time %v, got %v", i, expected_time[i], frame.Time)
+		}
+	}
+}
+
+func TestMotionBlur(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.2\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	// object moves up by 0.6 between frames 0 and 1, then stays
+	schedule := write_file(t, dir, "schedule.yaml", `
+- frame: 0
+  deformation: {type: rigid, displacements: [0.0, 0.0, 0.0]}
+- frame: 1
+  deformation: {type: rigid, displacements: [0.0, 0.0, -0.6]}
+`)
+	// rows containing attenuated pixels
+	extent := func(fn string) int {
+		img := read_png(t, fn)
+		b := img.Bounds()
+		n := 0
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r < 0xffff*99/100 {
+					n++
+					break
+				}
+			}
+		}
+		return n
+	}
+	extents := make(map[int][]int)
+	for _, samples := range []int{1, 8} {
+		reset_scene()
+		out := filepath.Join(dir, fmt.Sprintf("samples_%d", samples))
+		params := test_params(input, out, out+".json", 32)
+		params.NumImages = 2
+		params.DeformationSchedule = schedule
+		params.MotionBlurSamples = samples
+		render(params)
+		for i := 0; i < 2; i++ {
+			extents[samples] = append(extents[samples], extent(filepath.Join(out, fmt.Sprintf("image_%03d.png", i))))
+		}
+	}
+	reset_scene()
+	if extents[8][0] < extents[1][0]+4 {
+		t.Errorf("expected moving object to be spread by motion blur, got extent %d rows vs %d sharp", extents[8][0], extents[1][0])
+	}
+	// nothing moves after the last scheduled entry
+	if extents[8][1] != extents[1][1] {
+		t.Errorf("expected stationary frame to be sharp, got extent %d rows vs %d", extents[8][1], extents[1][1])
+	}
+}
+
+func TestRenderROI(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.2, 0.0, 0.3]\nrho: 1.0\n")
+	const res = 32
+	roi := []int{16, 0, 32, 16} // top right quadrant
+
+	reset_scene()
+	full_dir := filepath.Join(dir, "full")
+	render(test_params(input, full_dir, filepath.Join(dir, "full.json"), res))
+	reset_scene()
+	roi_dir := filepath.Join(dir, "roi")
+	params := test_params(input, roi_dir, filepath.Join(dir, "roi.json"), res)
+	params.ROI = roi
+	render(params)
+	reset_scene()
+
+	full := read_png(t, filepath.Join(full_dir, "image_000.png"))
+	tile := read_png(t, filepath.Join(roi_dir, "image_000.png"))
+	if tile.Bounds().Dx() != 16 || tile.Bounds().Dy() != 16 {
+		t.Fatalf("expected 16x16 tile, got %v", tile.Bounds())
+	}
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			if full.At(x+roi[0], y+roi[1]) != tile.At(x, y) {
+				t.Fatalf("pixel (%d,%d) differs: %v vs %v", x, y, full.At(x+roi[0], y+roi[1]), tile.At(x, y))
+			}
+		}
+	}
+	transform_params := read_transforms(t, filepath.Join(dir, "roi.json"))
+	if transform_params.W != 16 || transform_params.H != 16 || transform_params.CX != 0 || transform_params.CY != 16 || len(transform_params.ROI) != 4 {
+		t.Errorf("unexpected ROI metadata %+v", transform_params)
+	}
+}
+
+func TestRenderGrayscale(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 16
+
+	reset_scene()
+	rgba_dir := filepath.Join(dir, "rgba")
+	render(test_params(input, rgba_dir, filepath.Join(dir, "rgba.json"), res))
+	reset_scene()
+	gray_dir := filepath.Join(dir, "gray")
+	params := test_params(input, gray_dir, filepath.Join(dir, "gray.json"), res)
+	params.Grayscale = true
+	render(params)
+	reset_scene()
+
+	rgba := read_png(t, filepath.Join(rgba_dir, "image_000.png"))
+	gray, ok := read_png(t, filepath.Join(gray_dir, "image_000.png")).(*image.Gray16)
+	if !ok {
+		t.Fatal("grayscale output does not decode to Gray16")
+	}
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			// RGBA output keeps only the 8 most significant bits
+			r, _, _, _ := rgba.At(x, y).RGBA()
+			if uint32(gray.Gray16At(x, y).Y)>>8 != r>>8 {
+				t.Fatalf("pixel (%d,%d): gray %d, rgba %d", x, y, gray.Gray16At(x, y).Y, r)
+			}
+		}
+	}
+}
+
+func TestAttenuationOutput(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	defer func() { output_quantity = "transmittance" }()
+	lat = append(lat, &objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	origin := mgl64.Vec3{5, 0, 0}
+	img := [][]float64{{0, 0, 0}, {0, 0, 0}}
+	var wg sync.WaitGroup
+	for j, offset := range []float64{0.0, 0.3, 0.6} {
+		dir := mgl64.Vec3{-5, offset, 0}
+		output_quantity = "transmittance"
+		wg.Add(1)
+		computePixel(img, 0, j, origin, dir, 0.01, 3.0, 7.0, &wg)
+		output_quantity = "attenuation"
+		wg.Add(1)
+		computePixel(img, 1, j, origin, dir, 0.01, 3.0, 7.0, &wg)
+		if math.Abs(img[1][j]+math.Log(img[0][j])) > 1e-12 {
+			t.Errorf("offset %v: attenuation %v != -log(transmittance %v)", offset, img[1][j], img[0][j])
+		}
+	}
+	if img[1][0] <= 0.0 || img[1][2] != 0.0 {
+		t.Errorf("unexpected attenuation values %v", img[1])
+	}
+}
+
+func TestRenderProgrammaticScene(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	scene := objects.NewCollection().
+		Add(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.4, Rho: 1.0}).
+		Add(&objects.Cylinder{P0: mgl64.Vec3{0, 0, -0.8}, P1: mgl64.Vec3{0, 0, 0.8}, Radius: 0.1, Rho: 1.0})
+	if len(scene.Objects) != 2 {
+		t.Fatalf("expected 2 objects in collection, got %d", len(scene.Objects))
+	}
+	AddObject(scene)
+	AddDeformation(&deformations.RigidDeformation{Displacements: []float64{0.0, 0.0, -0.3}})
+	out_dir := filepath.Join(dir, "images")
+	render_scene(test_params("", out_dir, filepath.Join(dir, "transforms.json"), 32))
+
+	// rigid displacement moves the scene up, so attenuation centroid is above the image centre
+	_, y := attenuation_centroid(t, filepath.Join(out_dir, "image_000.png"))
+	if y > 15.5-2 {
+		t.Errorf("expected scene shifted up, centroid row %v", y)
+	}
+}
+
+func TestRenderSceneRepeatable(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	AddObject(&objects.Box{Center: mgl64.Vec3{0.3, 0.1, 0}, Sides: mgl64.Vec3{0.6, 0.3, 0.2}, Rho: 1.0})
+	AddDeformation(&deformations.RigidDeformation{Displacements: []float64{0.0, 0.0, -0.2}, Type: "rigid"})
+	deformation := write_file(t, dir, "deformation.yaml", "type: rigid\ndisplacements: [0.1, 0.0, 0.0]\n")
+	var images [2][]byte
+	for k := range images {
+		out := filepath.Join(dir, fmt.Sprintf("run_%d", k))
+		params := test_params("", out, out+".json", 16)
+		params.CenterObject = true
+		params.ObjectEuler = []float64{0, 30, 45}
+		params.DeformationFile = deformation
+		render_scene(params)
+		if len(df) != 1 {
+			t.Fatalf("run %d: expected the scene to keep its 1 deformation, got %d", k, len(df))
+		}
+		var err error
+		if images[k], err = os.ReadFile(filepath.Join(out, "image_000.png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("second render of the same scene differs from the first")
+	}
+}
+
+func TestDetectorRoll(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.6]\nrho: 1.0\n")
+	const res = 32
+
+	reset_scene()
+	plain_dir := filepath.Join(dir, "plain")
+	render(test_params(input, plain_dir, filepath.Join(dir, "plain.json"), res))
+	reset_scene()
+	roll_dir := filepath.Join(dir, "roll")
+	params := test_params(input, roll_dir, filepath.Join(dir, "roll.json"), res)
+	params.Roll = []float64{90.0}
+	render(params)
+	reset_scene()
+
+	const c = (res - 1) / 2.0
+	x, y := attenuation_centroid(t, filepath.Join(plain_dir, "image_000.png"))
+	if math.Abs(x-c) > 1 || y > c-4 {
+		t.Fatalf("expected sphere at top of image without roll, centroid (%v, %v)", x, y)
+	}
+	x, y = attenuation_centroid(t, filepath.Join(roll_dir, "image_000.png"))
+	if math.Abs(y-c) > 1 || math.Abs(x-c) < 4 {
+		t.Errorf("expected sphere at side of image with 90 degree roll, centroid (%v, %v)", x, y)
+	}
+	// roll is recorded in the transform matrix: camera x axis becomes the former y axis
+	plain := read_transforms(t, filepath.Join(dir, "plain.json")).Frames[0].TransformMatrix
+	rolled := read_transforms(t, filepath.Join(dir, "roll.json")).Frames[0].TransformMatrix
+	for i := 0; i < 3; i++ {
+		if math.Abs(rolled[i][0]-plain[i][1]) > 1e-9 {
+			t.Errorf("transform matrix does not record roll: %v vs %v", rolled, plain)
+		}
+	}
+}
+
+func TestFanBeamRays(t *testing.T) {
+	const res_f, R = 32.0, 5.0
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	camera := mgl64.LookAtV(mgl64.Vec3{0, R, 0}, mgl64.Vec3{0, 0, 0}, mgl64.Vec3{0, 0, 1}).Inv()
+
+	// within a row rays share the source point and diverge
+	o0, d0 := pixel_ray(0, 5, res_f, f, R, camera, "fan_beam")
+	o1, d1 := pixel_ray(31, 5, res_f, f, R, camera, "fan_beam")
+	if !o0.ApproxEqual(o1) {
+		t.Errorf("rays in a row do not share source: %v %v", o0, o1)
+	}
+	if d0.Normalize().ApproxEqual(d1.Normalize()) {
+		t.Errorf("rays in a row do not diverge")
+	}
+	// across rows rays are parallel with sources offset along z
+	o2, d2 := pixel_ray(0, 25, res_f, f, R, camera, "fan_beam")
+	if !d0.Normalize().ApproxEqual(d2.Normalize()) || d0[2] != 0 {
+		t.Errorf("rays across rows are not parallel and horizontal: %v %v", d0, d2)
+	}
+	if math.Abs(o2[2]-o0[2]) < 1e-3 || math.Abs(o2[0]-o0[0]) > 1e-9 || math.Abs(o2[1]-o0[1]) > 1e-9 {
+		t.Errorf("sources of different rows not offset vertically: %v %v", o0, o2)
+	}
+	// cone beam rays across rows are not parallel
+	_, c0 := pixel_ray(0, 5, res_f, f, R, camera, "cone_beam")
+	_, c2 := pixel_ray(0, 25, res_f, f, R, camera, "cone_beam")
+	if c0.Normalize().ApproxEqual(c2.Normalize()) {
+		t.Errorf("cone beam rays should diverge across rows")
+	}
+}
+
+func TestFlatFieldImage(t *testing.T) {
+	dir := t.TempDir()
+	// empty scene, so output equals the beam profile
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 0.0\n")
+	const res = 16
+	gradient := image.NewGray16(image.Rect(0, 0, res, res))
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			gradient.SetGray16(x, y, color.Gray16{uint16(0xffff * x / (res - 1))})
+		}
+	}
+	ff_fn := filepath.Join(dir, "flat.png")
+	out, err := os.Create(ff_fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(out, gradient)
+	out.Close()
+
+	if _, err := load_flat_field_image(ff_fn, res+1); err == nil {
+		t.Errorf("expected error for mismatched flat field dimensions")
+	}
+
+	reset_scene()
+	defer reset_scene()
+	out_dir := filepath.Join(dir, "images")
+	params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+	params.FlatFieldImage = ff_fn
+	params.Grayscale = true
+	render(params)
+	img := read_png(t, filepath.Join(out_dir, "image_000.png")).(*image.Gray16)
+	for y := 0; y < res; y++ {
+		for x := 1; x < res; x++ {
+			if img.Gray16At(x, y).Y <= img.Gray16At(x-1, y).Y {
+				t.Fatalf("brightness does not increase across detector at (%d,%d)", x, y)
+			}
+		}
+	}
+	if v := img.Gray16At(res-1, 0).Y; v != 0xffff {
+		t.Errorf("expected full brightness at right edge, got %d", v)
+	}
+}
+
+func TestAutoDistance(t *testing.T) {
+	const fov = 45.0
+	sphere := &objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 2.0, Rho: 1.0}
+	R := auto_distance(sphere, fov, 0.1)
+	// silhouette of the sphere subtends asin(r/R); the frame half-width is tan(fov/2)
+	half_angle := math.Asin(2.0 / R)
+	if half_angle >= mgl64.DegToRad(fov/2) {
+		t.Fatalf("sphere does not fit in frame at R=%v", R)
+	}
+	ratio := math.Tan(mgl64.DegToRad(fov/2)) / math.Tan(half_angle)
+	if ratio < 1.05 || ratio > 1.2 {
+		t.Errorf("expected ~10%% margin, got frame/silhouette ratio %v at R=%v", ratio, R)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	out_dir := filepath.Join(dir, "images")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, out_dir, transforms, 16)
+	params.NumImages = 3
+	reset_scene()
+	defer reset_scene()
+	render(params)
+	first := read_transforms(t, transforms)
+
+	// simulate interrupted run: last image missing, earlier ones marked old
+	os.Remove(filepath.Join(out_dir, "image_002.png"))
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		os.Chtimes(filepath.Join(out_dir, fmt.Sprintf("image_%03d.png", i)), old, old)
+	}
+	os.Remove(transforms)
+
+	reset_scene()
+	params.Resume = true
+	render(params)
+	for i := 0; i < 2; i++ {
+		info, err := os.Stat(filepath.Join(out_dir, fmt.Sprintf("image_%03d.png", i)))
+		if err != nil || !info.ModTime().Equal(old) {
+			t.Errorf("image %d was not skipped", i)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(out_dir, "image_002.png")); err != nil {
+		t.Errorf("missing image was not rendered: %v", err)
+	}
+	second := read_transforms(t, transforms)
+	if len(second.Frames) != 3 {
+		t.Fatalf("expected 3 frames after resume, got %d", len(second.Frames))
+	}
+	for i := range first.Frames {
+		if second.Frames[i].FilePath != first.Frames[i].FilePath || second.Frames[i].TransformMatrix[0][0] != first.Frames[i].TransformMatrix[0][0] {
+			t.Errorf("frame %d differs after resume: %+v vs %+v", i, second.Frames[i], first.Frames[i])
+		}
+	}
+}
+
+func TestNormalMap(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	lat = append(lat, &objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	normals := [][]mgl64.Vec3{make([]mgl64.Vec3, 2)}
+	origin := mgl64.Vec3{5, 0, 0}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	computeNormal(normals, 0, 0, origin, mgl64.Vec3{-5, 0.2, 0.1}, 0.001, 3.0, 7.0, &wg)
+	computeNormal(normals, 0, 1, origin, mgl64.Vec3{-5, 2, 0}, 0.001, 3.0, 7.0, &wg)
+	// normal at the hit point is radial
+	s, hit := first_hit(origin, mgl64.Vec3{-5, 0.2, 0.1}, 0.001, 3.0, 7.0)
+	if !hit {
+		t.Fatal("expected ray to hit sphere")
+	}
+	p := origin.Add(mgl64.Vec3{-5, 0.2, 0.1}.Normalize().Mul(s))
+	if normals[0][0].Dot(p.Normalize()) < 0.99 {
+		t.Errorf("normal %v not radial at %v", normals[0][0], p)
+	}
+	if normals[0][1].Len() != 0 {
+		t.Errorf("expected zero normal for missed ray, got %v", normals[0][1])
+	}
+}
+
+func TestPolarBand(t *testing.T) {
+	polar_min, polar_max := 30.0, 80.0
+	zmin, zmax := math.Cos(mgl64.DegToRad(polar_max)), math.Cos(mgl64.DegToRad(polar_min))
+	n := 20000
+	bins := make([]int, 5)
+	for i := 0; i < n; i++ {
+		_, phi := generateCameraAngles(i, n, true, polar_min, polar_max)
+		deg := mgl64.RadToDeg(phi)
+		if deg < polar_min-1e-9 || deg > polar_max+1e-9 {
+			t.Fatalf("polar angle %v outside [%v, %v]", deg, polar_min, polar_max)
+		}
+		k := int((math.Cos(phi) - zmin) / (zmax - zmin) * float64(len(bins)))
+		if k == len(bins) {
+			k--
+		}
+		bins[k]++
+	}
+	// uniform in cos(phi): each bin holds ~n/5 samples
+	expected := float64(n) / float64(len(bins))
+	for k, c := range bins {
+		if math.Abs(float64(c)-expected) > 0.05*expected {
+			t.Errorf("bin %d has %d samples, expected about %v", k, c, expected)
+		}
+	}
+	_, phi := generateCameraAngles(0, 1, false, polar_min, polar_max)
+	if phi != math.Pi/2 {
+		t.Errorf("expected in-plane polar angle pi/2, got %v", phi)
+	}
+}
+
+func TestRenderInvert(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 16
+
+	reset_scene()
+	std_dir := filepath.Join(dir, "std")
+	params := test_params(input, std_dir, filepath.Join(dir, "std.json"), res)
+	params.Grayscale = true
+	render(params)
+	reset_scene()
+	inv_dir := filepath.Join(dir, "inv")
+	params = test_params(input, inv_dir, filepath.Join(dir, "inv.json"), res)
+	params.Grayscale = true
+	params.Invert = true
+	render(params)
+	reset_scene()
+
+	std := read_png(t, filepath.Join(std_dir, "image_000.png")).(*image.Gray16)
+	inv := read_png(t, filepath.Join(inv_dir, "image_000.png")).(*image.Gray16)
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			// allow one unit of quantization difference
+			diff := int(std.Gray16At(x, y).Y) + int(inv.Gray16At(x, y).Y) - 0xffff
+			if diff < -1 || diff > 1 {
+				t.Fatalf("pixel (%d,%d): standard %d, inverted %d", x, y, std.Gray16At(x, y).Y, inv.Gray16At(x, y).Y)
+			}
+		}
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	defer setup_logging("", false)
+	log_file := filepath.Join(t.TempDir(), "render.log")
+
+	// capture stderr while logging
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	f, err := setup_logging(log_file, true)
+	if err != nil {
+		os.Stderr = stderr
+		t.Fatal(err)
+	}
+	log.Info().Msg("first")
+	log.Warn().Int("frame", 3).Msg("second")
+	f.Close()
+	os.Stderr = stderr
+	w.Close()
+	captured, _ := io.ReadAll(r)
+	if len(captured) != 0 {
+		t.Errorf("expected empty stderr, got %q", captured)
+	}
+
+	data, err := os.ReadFile(log_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Errorf("invalid JSON log line %q: %v", line, err)
+		}
+		if _, ok := entry["message"]; !ok {
+			t.Errorf("log line without message: %q", line)
+		}
+	}
+}
+
+func TestFileExtensions(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	yml := write_file(t, dir, "sphere.yml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	upper := write_file(t, dir, "sphere.JSON", `{"type": "sphere", "radius": 0.5, "center": [0.0, 0.0, 0.0], "rho": 1.0}`)
+	for _, fn := range []string{yml, upper} {
+		if err := load_object(fn); err != nil {
+			t.Errorf("loading '%s': %v", fn, err)
+		}
+	}
+	if len(lat) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(lat))
+	}
+	deformation := write_file(t, dir, "rigid.yml", "type: rigid\ndisplacements: [0.1, 0.0, 0.0]\n")
+	if err := load_deformation(deformation); err != nil {
+		t.Errorf("loading '%s': %v", deformation, err)
+	}
+
+	short := write_file(t, dir, "abc", "type: sphere\n")
+	if err := load_object(short); err == nil {
+		t.Error("expected error for file without extension")
+	}
+	if err := load_object(write_file(t, dir, "sphere.txt", "type: sphere\n")); err == nil {
+		t.Error("expected error for unknown extension")
+	}
+	// filenames shorter than 4 characters used to panic
+	if err := load_object("ab"); err == nil {
+		t.Error("expected error for short filename")
+	}
+	if _, err := read_deformation(short); err == nil {
+		t.Error("expected error for deformation file without extension")
+	}
+}
+
+func TestSceneRelativeDataPath(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	buf := make([]byte, 0, 16)
+	for _, v := range []float32{0, 0, 0, 0.5} {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+	}
+	write_file(t, dir, "cloud.bin", string(buf))
+	// path is relative to the scene file, not to the working directory
+	input := write_file(t, dir, "cloud.yaml", "type: sphere_cloud\npath: cloud.bin\nrho: 1.0\n")
+	if err := load_object(input); err != nil {
+		t.Fatal(err)
+	}
+	if rho := lat[0].Density(0, 0, 0); rho != 1.0 {
+		t.Errorf("expected density 1 at the centre of the cloud, got %v", rho)
+	}
+}
+
+func TestDeformationFileFormats(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	// integer displacements as commonly written in yaml
+	for _, fn := range []string{
+		write_file(t, dir, "rigid.yml", "type: rigid\ndisplacements: [1, 0, 0.5]\n"),
+		write_file(t, dir, "rigid.YML", "type: rigid\ndisplacements: [1, 0, 0.5]\n"),
+		write_file(t, dir, "rigid.Json", `{"type": "rigid", "displacements": [1, 0, 0.5]}`),
+	} {
+		d, err := read_deformation(fn)
+		if err != nil {
+			t.Errorf("loading '%s': %v", fn, err)
+			continue
+		}
+		if x, y, z := d.Apply(0, 0, 0); x != 1 || y != 0 || z != 0.5 {
+			t.Errorf("'%s': expected displacement (1, 0, 0.5), got (%v, %v, %v)", fn, x, y, z)
+		}
+	}
+	for _, fn := range []string{
+		write_file(t, dir, "rigid.txt", "type: rigid\ndisplacements: [1, 0, 0]\n"),
+		write_file(t, dir, "d", "type: rigid\n"),
+		write_file(t, dir, "unknown.yml", "type: twist\n"),
+		write_file(t, dir, "bad.yml", "type: rigid\ndisplacements: [a, 0, 0]\n"),
+	} {
+		if err := load_deformation(fn); err == nil {
+			t.Errorf("expected error loading '%s'", fn)
+		}
+	}
+	if len(df) != 0 {
+		t.Errorf("failed loads added %d deformations", len(df))
+	}
+}
+
+func TestColmapExport(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+	params.NumImages = 3
+	params.OutOfPlane = true
+	params.CameraExport = "colmap"
+	render(params)
+
+	cameras, err := os.ReadFile(filepath.Join(dir, "cameras.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := read_transforms(t, transforms)
+	expected_camera := fmt.Sprintf("1 PINHOLE %d %d %g %g %g %g", tp.W, tp.H, tp.FL_X, tp.FL_Y, tp.CX, tp.CY)
+	if !strings.Contains(string(cameras), expected_camera) {
+		t.Errorf("cameras.txt does not contain '%s':\n%s", expected_camera, cameras)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "images.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var id, camera_id int
+		var q mgl64.Quat
+		var tr mgl64.Vec3
+		var name string
+		_, err := fmt.Sscanf(line, "%d %g %g %g %g %g %g %g %d %s", &id, &q.W, &q.V[0], &q.V[1], &q.V[2], &tr[0], &tr[1], &tr[2], &camera_id, &name)
+		if err != nil {
+			t.Fatalf("parsing '%s': %v", line, err)
+		}
+		frame := tp.Frames[id-1]
+		if name != frame.FilePath {
+			t.Errorf("image %d: expected name %s, got %s", id, frame.FilePath, name)
+		}
+		// camera center C = -R^T t must match the eye position
+		rot := q.Mat4().Mat3()
+		center := rot.Transpose().Mul3x1(tr).Mul(-1)
+		eye := mgl64.Vec3{frame.TransformMatrix[0][3], frame.TransformMatrix[1][3], frame.TransformMatrix[2][3]}
+		if !center.ApproxEqualThreshold(eye, 1e-6) || math.Abs(eye.Len()-params.R) > 1e-6 {
+			t.Errorf("image %d: camera center %v, expected eye %v", id, center, eye)
+		}
+		// camera looks along +z towards the scene center
+		view := rot.Transpose().Mul3x1(mgl64.Vec3{0, 0, 1})
+		if !view.ApproxEqualThreshold(eye.Normalize().Mul(-1), 1e-6) {
+			t.Errorf("image %d: view direction %v does not point at the origin from %v", id, view, eye)
+		}
+		n++
+	}
+	if n != params.NumImages {
+		t.Errorf("expected %d images, got %d", params.NumImages, n)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	out_dir := filepath.Join(dir, "images")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, out_dir, transforms, 256)
+	params.NumImages = 10
+	params.OutOfPlane = true
+	params.Preview = true
+	render(params)
+
+	entries, err := os.ReadDir(out_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "preview.png" {
+		t.Fatalf("expected only preview.png, got %v", entries)
+	}
+	img := read_png(t, filepath.Join(out_dir, "preview.png"))
+	if img.Bounds().Dx() != preview_res || img.Bounds().Dy() != preview_res {
+		t.Errorf("expected %dx%d preview, got %v", preview_res, preview_res, img.Bounds())
+	}
+	for _, fn := range []string{transforms, transforms + ".frames", filepath.Join(dir, "object.yaml")} {
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("expected no '%s' for preview", fn)
+		}
+	}
+}
+
+func TestLoadObjectErrors(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	unknown := write_file(t, dir, "unknown.yaml", "type: dodecahedron\nrho: 1.0\n")
+	if err := load_object(unknown); err == nil || !strings.Contains(err.Error(), "dodecahedron") {
+		t.Errorf("expected unknown type error, got %v", err)
+	}
+	broken := write_file(t, dir, "broken.yaml", "type: sphere\nradius: 0.5\n")
+	if err := load_object(broken); err == nil {
+		t.Error("expected error for sphere without center")
+	}
+	if len(lat) != 0 {
+		t.Errorf("expected no objects added on failed load, got %d", len(lat))
+	}
+}
+
+func TestBentBeamPhantom(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	obj, d, err := phantom("bent_beam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddObject(obj)
+	AddDeformation(d)
+	// beam end is displaced towards +x, centre stays in place
+	bend := d.(*deformations.BendDeformation)
+	end_x := (1 - math.Cos(0.8*bend.Curvature)) / bend.Curvature
+	end_z := math.Sin(0.8*bend.Curvature) / bend.Curvature
+	if density(0, 0, 0) != 1.0 || density(end_x-0.05, 0, end_z-0.01) != 1.0 || density(0, 0, end_z-0.01) != 0.0 {
+		t.Error("bent beam not at the expected position")
+	}
+
+	fn := filepath.Join(t.TempDir(), "displacement.json")
+	if err := write_displacement_grid(fn, d, 5, -1.0, 1.0); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grid DisplacementGrid
+	if err := json.Unmarshal(data, &grid); err != nil {
+		t.Fatal(err)
+	}
+	if len(grid.Points) != 125 || len(grid.Displacements) != 125 {
+		t.Fatalf("expected 125 samples, got %d points and %d displacements", len(grid.Points), len(grid.Displacements))
+	}
+	for i, p := range grid.Points {
+		x, y, z := d.Apply(p[0], p[1], p[2])
+		u := grid.Displacements[i]
+		if math.Abs(p[0]-u[0]-x) > 1e-12 || math.Abs(p[1]-u[1]-y) > 1e-12 || math.Abs(p[2]-u[2]-z) > 1e-12 {
+			t.Fatalf("point %v: displacement %v does not match deformation", p, u)
+		}
+	}
+}
+
+func TestRenderReturnsTransforms(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+	params.NumImages = 4
+	returned := render(params)
+	if len(returned.Frames) != params.NumImages {
+		t.Fatalf("expected %d frames, got %d", params.NumImages, len(returned.Frames))
+	}
+	returned_json, err := json.Marshal(returned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written_json, err := json.Marshal(read_transforms(t, transforms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(returned_json) != string(written_json) {
+		t.Errorf("returned transforms differ from file:\n%s\n%s", returned_json, written_json)
+	}
+}
+
+func TestClipSlab(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	out_dir := filepath.Join(dir, "images")
+	clip_min[2], clip_max[2] = -0.1, 0.1
+	const res = 32
+	render(test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res))
+
+	img := read_png(t, filepath.Join(out_dir, "image_000.png"))
+	// slab of height 0.2 at distance 5 with 45 degree field of view is thinner than two pixel rows
+	// (0.13 each at the origin), so only rows next to the centre see the sphere, over its full width
+	rows := []int{}
+	for y := 0; y < res; y++ {
+		attenuated := 0
+		for x := 0; x < res; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r < 0xffff {
+				attenuated++
+			}
+		}
+		if attenuated > 0 {
+			rows = append(rows, y)
+			if attenuated < 6 {
+				t.Errorf("row %d: expected attenuation band across the sphere, got %d pixels", y, attenuated)
+			}
+		}
+	}
+	if len(rows) == 0 || len(rows) > 2 {
+		t.Fatalf("expected attenuation in 1 or 2 central rows, got rows %v", rows)
+	}
+	for _, y := range rows {
+		if y < res/2-2 || y > res/2+1 {
+			t.Errorf("attenuated row %d outside of the slab", y)
+		}
+	}
+}
+
+func TestReuseTransforms(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "box.yaml", "type: cube\ncenter: [0.1, 0.0, 0.2]\nside: 0.6\nrho: 1.0\n")
+	const res = 16
+
+	reset_scene()
+	first := test_params(input, filepath.Join(dir, "first"), filepath.Join(dir, "first.json"), res)
+	first.NumImages = 3
+	first.OutOfPlane = true
+	first.Roll = []float64{15.0}
+	render(first)
+	reset_scene()
+	second := test_params(input, filepath.Join(dir, "second"), filepath.Join(dir, "second.json"), res)
+	second.ReuseTransforms = filepath.Join(dir, "first.json")
+	render(second)
+	reset_scene()
+
+	tp1 := read_transforms(t, filepath.Join(dir, "first.json"))
+	tp2 := read_transforms(t, filepath.Join(dir, "second.json"))
+	if len(tp2.Frames) != len(tp1.Frames) {
+		t.Fatalf("expected %d frames, got %d", len(tp1.Frames), len(tp2.Frames))
+	}
+	for i := range tp1.Frames {
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				if math.Abs(tp1.Frames[i].TransformMatrix[r][c]-tp2.Frames[i].TransformMatrix[r][c]) > 1e-9 {
+					t.Fatalf("frame %d: transform matrices differ", i)
+				}
+			}
+		}
+		name := fmt.Sprintf("image_%03d.png", i)
+		img1 := read_png(t, filepath.Join(dir, "first", name))
+		img2 := read_png(t, filepath.Join(dir, "second", name))
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				if img1.At(x, y) != img2.At(x, y) {
+					t.Fatalf("frame %d pixel (%d,%d) differs: %v vs %v", i, x, y, img1.At(x, y), img2.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestProfileSamples(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	out_dir := filepath.Join(dir, "images")
+	params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), 16)
+	params.DS = 0.05
+	params.ProfileSamples = true
+	render(params)
+
+	counts, ok := read_png(t, filepath.Join(out_dir, "samples_image_000.png")).(*image.Gray16)
+	if !ok {
+		t.Fatal("sample counts do not decode to Gray16")
+	}
+	// rays through the sphere are refined at both boundary crossings
+	center := counts.Gray16At(8, 8).Y
+	background := counts.Gray16At(0, 0).Y
+	if background == 0 || center <= background {
+		t.Errorf("expected more samples through the centre (%d) than in the background (%d)", center, background)
+	}
+	if sample_counts != nil {
+		t.Error("sample counts not reset after rendering")
+	}
+}
+
+func TestBuiltinLatticeDensity(t *testing.T) {
+	defer reset_scene()
+	origin := mgl64.Vec3{5, 0.01, 0.02}
+	direction := mgl64.Vec3{-1, 0.03, 0.05}
+	T := make([]float64, 2)
+	for k, rho := range []float64{1.0, 0.5} {
+		reset_scene()
+		obj, err := builtin_lattice("kelvin", 0.05, 0.25, rho)
+		if err != nil {
+			t.Fatal(err)
+		}
+		AddObject(obj)
+		T[k], _ = integrate_along_ray(origin, direction, 0.001, 3.0, 7.0)
+	}
+	if T[0] == 0 || math.Abs(T[1]/T[0]-0.5) > 1e-9 {
+		t.Errorf("expected half attenuation with half strut density, got %v and %v", T[0], T[1])
+	}
+}
+
+func TestImportanceIntegration(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	// thin spherical shell of thickness 0.05 as difference of two spheres
+	shell := objects.NewCollection().
+		Add(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0}).
+		Add(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.45, Rho: -1.0})
+	AddObject(shell)
+	origin := mgl64.Vec3{5, 0, 0}
+	for _, offset := range []float64{0.0, 0.3, 0.47} {
+		direction := mgl64.Vec3{-5, offset, 0.01}
+		T_ref, n_ref := integrate_along_ray(origin, direction, 0.002, 3.0, 7.0)
+		T, n := integrate_importance(origin, direction, 0.02, 3.0, 7.0)
+		// both sample step functions, so each of the 4 boundary crossings contributes up to one fine step of error
+		if math.Abs(T-T_ref) > 4*0.002 {
+			t.Errorf("offset %v: importance %v differs from fine uniform %v", offset, T, T_ref)
+		}
+		if n > n_ref/5 {
+			t.Errorf("offset %v: expected far fewer samples than %d, got %d", offset, n_ref, n)
+		}
+	}
+	// rays missing the shell only do the coarse scan
+	T, n := integrate_importance(origin, mgl64.Vec3{-5, 0.6, 0}, 0.02, 3.0, 7.0)
+	if T != 0 || n > 201 {
+		t.Errorf("expected no attenuation with coarse samples only, got T=%v with %d samples", T, n)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	contents := "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n"
+	input := write_file(t, dir, "sphere.yaml", contents)
+	deformation := write_file(t, dir, "rigid.yaml", "type: rigid\ndisplacements: [0.1, 0.0, 0.0]\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.NumImages = 3
+	params.DeformationFile = deformation
+	render(params)
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"params", "object_sha256", "deformations", "resolution", "num_frames", "min_value", "max_value", "elapsed_seconds"} {
+		if _, ok := manifest[field]; !ok {
+			t.Errorf("manifest is missing '%s'", field)
+		}
+	}
+	if n := manifest["num_frames"].(float64); n != 3 {
+		t.Errorf("expected 3 frames, got %v", n)
+	}
+	sum := sha256.Sum256([]byte(contents))
+	if manifest["object_sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected object hash %v", manifest["object_sha256"])
+	}
+	if d := manifest["deformations"].([]interface{}); len(d) != 1 || d[0].(map[string]interface{})["type"] != "rigid" {
+		t.Errorf("unexpected deformations %v", d)
+	}
+	manifest_params := manifest["params"].(map[string]interface{})
+	if manifest_params["resolution"].(float64) != 8 {
+		t.Errorf("unexpected params %v", manifest_params)
+	}
+	// global settings are recorded next to the render parameters
+	for field, want := range map[string]interface{}{"integration": "hierarchical", "refine_factor": 10.0, "output_quantity": "transmittance", "boundary_softness": objects.BoundarySoftness} {
+		if manifest_params[field] != want {
+			t.Errorf("expected params.%s %v, got %v", field, want, manifest_params[field])
+		}
+	}
+	if clip := manifest_params["clip_min"].([]interface{}); len(clip) != 3 || clip[0] != nil {
+		t.Errorf("expected unbounded clip_min, got %v", clip)
+	}
+}
+
+func TestCenterObject(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "box.yaml", "type: cube\ncenter: [0.3, 0.2, 0.4]\nside: 0.4\nrho: 1.0\n")
+	out_dir := filepath.Join(dir, "images")
+	const res = 32
+	params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+	params.CenterObject = true
+	render(params)
+
+	// ray through the origin passes the corner shared by the four central pixels
+	x, y := attenuation_centroid(t, filepath.Join(out_dir, "image_000.png"))
+	if math.Abs(x-(res/2-0.5)) > 0.1 || math.Abs(y-(res/2-0.5)) > 0.1 {
+		t.Errorf("expected centroid at image centre, got (%v, %v)", x, y)
+	}
+}
+
+func TestOrbitAxis(t *testing.T) {
+	x_axis := mgl64.Vec3{1, 0, 0}
+	const R = 4.0
+	for i := 0; i < 4; i++ {
+		th, phi := generateCameraAngles(i, 4, false, 0, 180)
+		camera := camera_from_angles(th, phi, R, x_axis)
+		eye := camera.Col(3).Vec3()
+		if math.Abs(eye.Dot(x_axis)) > 1e-12 || math.Abs(eye.Len()-R) > 1e-12 {
+			t.Errorf("frame %d: eye %v not on the orbit about x", i, eye)
+		}
+		// detector up direction is the orbit axis
+		if up := camera.Col(1).Vec3(); up.Sub(x_axis).Len() > 1e-9 {
+			t.Errorf("frame %d: camera up %v, expected %v", i, up, x_axis)
+		}
+	}
+	th, phi := generateCameraAngles(0, 4, false, 0, 180)
+	if eye := camera_from_angles(th, phi, R, x_axis).Col(3).Vec3(); eye.Sub(mgl64.Vec3{0, R, 0}).Len() > 1e-9 {
+		t.Errorf("expected first eye at (0, %v, 0), got %v", R, eye)
+	}
+	// default orbit about z is unchanged
+	th, phi = generateCameraAngles(1, 4, false, 0, 180)
+	if eye := camera_from_angles(th, phi, R, mgl64.Vec3{0, 0, 1}).Col(3).Vec3(); eye.Sub(mgl64.Vec3{-R, 0, 0}).Len() > 1e-9 {
+		t.Errorf("expected second eye at (%v, 0, 0), got %v", -R, eye)
+	}
+}
+
+func TestRayHitsScene(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	if RayHitsScene(mgl64.Vec3{5, 0, 0}, mgl64.Vec3{-1, 0, 0}) {
+		t.Error("expected no hit for empty scene")
+	}
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	origin := mgl64.Vec3{5, 0, 0}
+	for _, c := range []struct {
+		direction mgl64.Vec3
+		hit       bool
+	}{
+		{mgl64.Vec3{-1, 0, 0}, true},
+		{mgl64.Vec3{-5, 0.45, 0.45}, true}, // passes the bounding box corner region
+		{mgl64.Vec3{-5, 0.6, 0}, false},
+		{mgl64.Vec3{1, 0, 0}, false}, // pointing away
+		{mgl64.Vec3{0, 1, 0}, false},
+	} {
+		if hit := RayHitsScene(origin, c.direction); hit != c.hit {
+			t.Errorf("direction %v: expected hit %v, got %v", c.direction, c.hit, hit)
+		}
+	}
+	// axis-parallel ray inside the slab
+	if !RayHitsScene(mgl64.Vec3{0.2, 0.2, 5}, mgl64.Vec3{0, 0, -1}) {
+		t.Error("expected hit for ray parallel to z through the box")
+	}
+}
+
+// Object with density that is not a number everywhere
+type nanObject struct {
+	objects.Sphere
+}
+
+func (n *nanObject) Density(x, y, z float64) float64 {
+	return math.NaN()
+}
+
+func TestNonFiniteDensity(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	AddObject(&nanObject{})
+	if rho := density(0.1, 0.2, 0.3); rho != 0.0 {
+		t.Errorf("expected NaN density to be treated as 0, got %v", rho)
+	}
+	if !warned_non_finite {
+		t.Error("expected warning for non-finite density")
+	}
+	T, _ := integrate_along_ray(mgl64.Vec3{5, 0, 0}, mgl64.Vec3{-1, 0, 0}, 0.01, 3.0, 7.0)
+	if T != 0 {
+		t.Errorf("expected zero optical depth, got %v", T)
+	}
+}
+
+func TestDepthOutput(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	defer func() { output_quantity = "transmittance" }()
+	output_quantity = "depth"
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	// odd resolution puts the centre of pixel res/2 on the optical axis
+	const res = 15
+	const R = 5.0
+	const ds = 0.001
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	camera := camera_from_angles(90, math.Pi/2, R, mgl64.Vec3{0, 0, 1})
+	img := [][]float64{{0, 0}}
+	var wg sync.WaitGroup
+	for k, pix := range [][2]int{{res / 2, res / 2}, {0, 0}} {
+		origin, direction := pixel_ray(pix[0], pix[1], res, f, R, camera, "cone_beam")
+		wg.Add(1)
+		computePixel(img, 0, k, origin, direction, ds, R-cube_half_diagonal, R+cube_half_diagonal, &wg)
+	}
+	if math.Abs(img[0][0]-(R-0.5)) > ds {
+		t.Errorf("expected central depth %v, got %v", R-0.5, img[0][0])
+	}
+	if !math.IsInf(img[0][1], 1) {
+		t.Errorf("expected infinite depth for corner pixel, got %v", img[0][1])
+	}
+}
+
+func TestMaskOutput(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	defer func() { output_quantity = "transmittance" }()
+	output_quantity = "mask"
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 0.2\n")
+	const res = 32
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	render(params)
+
+	img, ok := read_png(t, filepath.Join(dir, "images", "image_000.png")).(*image.Gray)
+	if !ok {
+		t.Fatal("expected 8-bit grayscale mask")
+	}
+	// silhouette of the sphere subtends the half angle asin(r/R) at the camera
+	f := 1 / math.Tan(mgl64.DegToRad(params.FOV/2))
+	radius := f * math.Tan(math.Asin(0.5/params.R)) * res / 2
+	n_checked := 0
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			v := img.GrayAt(x, y).Y
+			if v != 0 && v != 0xff {
+				t.Fatalf("pixel (%d,%d): expected binary value, got %d", x, y, v)
+			}
+			// pixel (i,j) looks through detector position (i+0.5, j+0.5) relative to the centre res/2
+			d := math.Hypot(float64(x)+0.5-res/2, float64(res-1-y)+0.5-res/2)
+			if math.Abs(d-radius) < 0.5 {
+				continue
+			}
+			if inside := d < radius; inside != (v == 0xff) {
+				t.Errorf("pixel (%d,%d) at distance %.2f from centre: expected occupied %v for radius %.2f", x, y, d, inside, radius)
+			}
+			n_checked++
+		}
+	}
+	if n_checked < res*res*3/4 {
+		t.Errorf("only %d pixels away from the silhouette edge", n_checked)
+	}
+}
+
+func TestTonemap(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 16
+	pixels := func(name, mode string, exponent float64) ([]float64, TransformParams) {
+		reset_scene()
+		transforms := filepath.Join(dir, name+".json")
+		params := test_params(input, filepath.Join(dir, name), transforms, res)
+		params.Tonemap = mode
+		params.TonemapExponent = exponent
+		render(params)
+		img := read_png(t, filepath.Join(dir, name, "image_000.png"))
+		vals := make([]float64, 0, res*res)
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				vals = append(vals, float64(r)/0xffff)
+			}
+		}
+		return vals, read_transforms(t, transforms)
+	}
+	linear, tp := pixels("linear", "", 0)
+	if tp.Tonemap != "" {
+		t.Errorf("expected no tone map recorded for linear output, got %q", tp.Tonemap)
+	}
+	unit, _ := pixels("unit", "gamma", 1)
+	for k := range linear {
+		if unit[k] != linear[k] {
+			t.Fatalf("pixel %d: gamma 1 gives %v, linear %v", k, unit[k], linear[k])
+		}
+	}
+	gamma, tp := pixels("gamma", "gamma", 2.2)
+	if tp.Tonemap != "gamma" || tp.TonemapExponent != 2.2 {
+		t.Errorf("expected gamma 2.2 recorded in transforms, got %q %v", tp.Tonemap, tp.TonemapExponent)
+	}
+	n_mid := 0
+	for k := range linear {
+		// both images are quantised to 8 bits
+		if math.Abs(gamma[k]-math.Pow(linear[k], 2.2)) > 3.0/255 {
+			t.Errorf("pixel %d: expected %v, got %v", k, math.Pow(linear[k], 2.2), gamma[k])
+		}
+		if linear[k] > 0.2 && linear[k] < 0.8 {
+			n_mid++
+			if gamma[k] >= linear[k] {
+				t.Errorf("pixel %d: midtone %v not darkened, got %v", k, linear[k], gamma[k])
+			}
+		}
+	}
+	if n_mid == 0 {
+		t.Error("no midtone pixels in the projection")
+	}
+}
+
+func TestObjectEuler(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "box.yaml", "type: box\ncenter: [0.2, 0.1, 0.0]\nsides: [0.8, 0.3, 0.5]\nrho: 1.0\n")
+	rotation := write_file(t, dir, "rotation.yaml", "type: rotation\naxis: [0.0, 0.0, 1.0]\nangle: 90.0\n")
+	render_pixels := func(name string, modify func(*RenderParams)) []byte {
+		reset_scene()
+		params := test_params(input, filepath.Join(dir, name), filepath.Join(dir, name+".json"), 16)
+		modify(&params)
+		render(params)
+		data, err := os.ReadFile(filepath.Join(dir, name, "image_000.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	plain := render_pixels("plain", func(p *RenderParams) {})
+	euler := render_pixels("euler", func(p *RenderParams) { p.ObjectEuler = []float64{0, 0, 90} })
+	manual := render_pixels("manual", func(p *RenderParams) { p.DeformationFile = rotation })
+	if !bytes.Equal(euler, manual) {
+		t.Error("object_euler 0,0,90 differs from a 90 degree rotation deformation about z")
+	}
+	if bytes.Equal(euler, plain) {
+		t.Error("object_euler did not change the image")
+	}
+}
+
+func TestExportDeformation(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	deformation := write_file(t, dir, "linear.yaml", "type: linear\nstrains: [0.1, 0.0, -0.2]\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.DeformationFile = deformation
+	params.ExportDeformation = filepath.Join(dir, "deformation.npy")
+	params.DeformationGridRes = 5
+	render(params)
+
+	data, err := os.ReadFile(params.ExportDeformation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "\x93NUMPY\x01\x00") {
+		t.Fatal("missing npy magic")
+	}
+	header_len := int(binary.LittleEndian.Uint16(data[8:]))
+	if (10+header_len)%64 != 0 {
+		t.Errorf("header of %d bytes is not aligned to 64 bytes", header_len)
+	}
+	if header := string(data[10 : 10+header_len]); !strings.Contains(header, "'shape': (3, 5, 5, 5)") || !strings.Contains(header, "'<f4'") {
+		t.Errorf("unexpected header %q", header)
+	}
+	vol := make([]float32, 3*5*5*5)
+	if err := binary.Read(bytes.NewReader(data[10+header_len:]), binary.LittleEndian, vol); err != nil {
+		t.Fatal(err)
+	}
+	// grid spans the integrated region [-half_span, half_span]^3 and holds the displacement p - deform(p),
+	// with the same sign as the phantom displacement grid
+	half_span := cube_half_diagonal * default_span_margin
+	points, displacements := sample_displacements((&deformations.LinearDeformation{Strains: []float64{0.1, 0.0, -0.2}}).Apply,
+		5, mgl64.Vec3{-half_span, -half_span, -half_span}, mgl64.Vec3{half_span, half_span, half_span})
+	if points[0][0] != -half_span || points[124][2] != half_span {
+		t.Errorf("expected grid over [%v, %v]^3, got corners %v and %v", -half_span, half_span, points[0], points[124])
+	}
+	for idx, p := range points {
+		for a, strain := range []float64{0.1, 0.0, -0.2} {
+			want := -strain * p[a]
+			if math.Abs(displacements[idx][a]-want) > 1e-12 || math.Abs(float64(vol[a*125+idx])-want) > 1e-6 {
+				t.Fatalf("point %v component %d: expected %v, got %v and %v", p, a, want, displacements[idx][a], vol[a*125+idx])
+			}
+		}
+	}
+}
+
+func TestObjectOutsideScene(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		center string
+		warn   bool
+	}{
+		{"[10.0, 10.0, 10.0]", true},
+		{"[0.2, 0.0, 0.0]", false},
+		// outside [-1, 1]^3 but within the integration span
+		{"[1.5, 0.0, 0.0]", false},
+	} {
+		reset_scene()
+		buf.Reset()
+		input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: "+tc.center+"\nrho: 1.0\n")
+		render(test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8))
+		if warned := strings.Contains(buf.String(), "wholly outside the renderable region"); warned != tc.warn {
+			t.Errorf("sphere at %s: expected warning %v, got log %s", tc.center, tc.warn, buf.String())
+		}
+	}
+
+	if f := fraction_in_cube(mgl64.Vec3{0.5, -0.5, -0.5}, mgl64.Vec3{1.5, 0.5, 0.5}, 1); f != 0.5 {
+		t.Errorf("expected half of the box inside, got %v", f)
+	}
+	if err := check_renderable(mgl64.Vec3{0.5, -0.5, -0.5}, mgl64.Vec3{1.5, 0.5, 0.5}, 1); err == nil {
+		t.Error("expected error for box half outside")
+	}
+	if err := check_renderable(mgl64.Vec3{0.5, -0.5, -0.5}, mgl64.Vec3{1.5, 0.5, 0.5}, 2); err != nil {
+		t.Errorf("expected box to pass with a wider span, got %v", err)
+	}
+	if err := check_renderable(mgl64.Vec3{-1, -1, -1}, mgl64.Vec3{math.Inf(1), 1, 1}, 1); err != nil {
+		t.Errorf("expected unbounded box to pass, got %v", err)
+	}
+}
+
+func TestCameraKeyframes(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	keyframes := write_file(t, dir, "keyframes.yaml", "- eye: [5.0, 0.0, 0.0]\n- eye: [0.0, 4.0, 0.0]\n  target: [0.0, 0.0, 0.0]\n")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+	params.NumImages = 3
+	params.CameraKeyframes = keyframes
+	render(params)
+
+	tp := read_transforms(t, transforms)
+	if len(tp.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(tp.Frames))
+	}
+	eye := func(i int) mgl64.Vec3 {
+		m := tp.Frames[i].TransformMatrix
+		return mgl64.Vec3{m[0][3], m[1][3], m[2][3]}
+	}
+	view := func(i int) mgl64.Vec3 {
+		// camera looks along its -z axis
+		m := tp.Frames[i].TransformMatrix
+		return mgl64.Vec3{-m[0][2], -m[1][2], -m[2][2]}
+	}
+	// with two keyframes the Catmull-Rom spline is symmetric, so the middle frame is halfway between them
+	for i, want := range []mgl64.Vec3{{5, 0, 0}, {2.5, 2, 0}, {0, 4, 0}} {
+		if eye(i).Sub(want).Len() > 1e-9 {
+			t.Errorf("frame %d: expected eye %v, got %v", i, want, eye(i))
+		}
+	}
+	// orientation halfway between looking along -x and along -y
+	if want := (mgl64.Vec3{-1, -1, 0}).Normalize(); view(1).Sub(want).Len() > 1e-9 {
+		t.Errorf("expected middle view direction %v, got %v", want, view(1))
+	}
+	if view(2).Sub(mgl64.Vec3{0, -1, 0}).Len() > 1e-9 {
+		t.Errorf("expected last frame to look along -y, got %v", view(2))
+	}
+}
+
+func TestCameraKeyframesInsideScene(t *testing.T) {
+	dir := t.TempDir()
+	front := "{type: sphere, radius: 0.2, center: [0.0, 0.0, -0.4], rho: 1.0}"
+	behind := "{type: sphere, radius: 0.15, center: [0.0, 0.0, 0.8], rho: 1.0}"
+	// fly-through camera inside the scene cube looking along -z, with a second sphere behind it
+	keyframes := write_file(t, dir, "keyframes.yaml", `
+- {eye: [0.0, 0.0, 0.5], target: [0.0, 0.0, -1.0], up: [0.0, 1.0, 0.0]}
+- {eye: [0.0, 0.0, 0.4], target: [0.0, 0.0, -1.0], up: [0.0, 1.0, 0.0]}
+`)
+	var images [2][]byte
+	for k, objs := range []string{front, front + ", " + behind} {
+		reset_scene()
+		input := write_file(t, dir, fmt.Sprintf("scene_%d.yaml", k), "type: object_collection\nobjects: ["+objs+"]\n")
+		out := filepath.Join(dir, fmt.Sprintf("images_%d", k))
+		params := test_params(input, out, out+".json", 16)
+		params.CameraKeyframes = keyframes
+		render(params)
+		var err error
+		if images[k], err = os.ReadFile(filepath.Join(out, "image_000.png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset_scene()
+	img := read_png(t, filepath.Join(dir, "images_0", "image_000.png"))
+	if r, _, _, _ := img.At(8, 8).RGBA(); r > 0xffff*9/10 {
+		t.Errorf("expected sphere in front of the camera to attenuate the centre pixel, got %v", r)
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Error("sphere behind the camera contributes to the image")
+	}
+}
+
+func TestObjectDump(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.SkipObjectDump = true
+	render(params)
+	if _, err := os.Stat(filepath.Join(dir, "object.yaml")); !os.IsNotExist(err) {
+		t.Error("expected no object.yaml with the object dump skipped")
+	}
+
+	reset_scene()
+	params.SkipObjectDump = false
+	params.ObjectOut = filepath.Join(dir, "dump", "sphere_out.yaml")
+	if err := os.Mkdir(filepath.Dir(params.ObjectOut), 0755); err != nil {
+		t.Fatal(err)
+	}
+	render(params)
+	if _, err := os.Stat(filepath.Join(dir, "object.yaml")); !os.IsNotExist(err) {
+		t.Error("expected no object.yaml in the default location with object_out set")
+	}
+	var dumped map[string]interface{}
+	if err := unmarshal_file(params.ObjectOut, &dumped); err != nil {
+		t.Fatal(err)
+	}
+	if dumped["type"] != "sphere" {
+		t.Errorf("expected dumped sphere, got %v", dumped)
+	}
+}
+
+func TestFrameTimes(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	transforms := filepath.Join(dir, "transforms.json")
+	params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+	params.NumImages = 3
+	params.TimeLabel = 5.0
+	params.FrameTimes = []float64{0.1, 0.7, 0.3}
+	render(params)
+
+	transform_params := read_transforms(t, transforms)
+	if len(transform_params.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(transform_params.Frames))
+	}
+	for i, frame := range transform_params.Frames {
+		if frame.Time != params.FrameTimes[i] {
+			t.Errorf("frame %d: expected time %v, got %v", i, params.FrameTimes[i], frame.Time)
+		}
+	}
+}
+
+// Compare integrators against analytic line integrals through a sphere and a slab
+func TestBeerLambert(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	const DS = 0.01
+	const r = 0.5
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: r, Rho: 1.0})
+	origin := mgl64.Vec3{-5, 0, 0}
+	for b := 0.0; b < r-DS; b += 0.0137 {
+		chord := 2 * math.Sqrt(r*r-b*b)
+		// ray origin offset perpendicular to the direction of travel
+		o := origin.Add(mgl64.Vec3{0, b, 0})
+		T_simple, _ := integrate_along_ray(o, mgl64.Vec3{1, 0, 0}, DS/10, 3.0, 7.0)
+		T_hier, _ := integrate_hierarchical(o, mgl64.Vec3{1, 0, 0}, DS, 3.0, 7.0)
+		T_ref, _ := integrate_reference(o, mgl64.Vec3{1, 0, 0}, DS, 3.0, 7.0)
+		// both integrators sample the step function with fine step DS/10, so each boundary contributes up to one step of error
+		if math.Abs(T_simple-chord) > 2*DS/10 {
+			t.Errorf("sphere offset %.4f: simple %v differs from chord %v", b, T_simple, chord)
+		}
+		if math.Abs(T_hier-chord) > 2*DS/10 {
+			t.Errorf("sphere offset %.4f: hierarchical %v differs from chord %v", b, T_hier, chord)
+		}
+		if math.Abs(T_ref-chord) > 2*DS/100 {
+			t.Errorf("sphere offset %.4f: reference %v differs from chord %v", b, T_ref, chord)
+		}
+		if math.Abs(math.Exp(-T_hier)-math.Exp(-chord)) > 2*DS/10 {
+			t.Errorf("sphere offset %.4f: transmittance %v differs from %v", b, math.Exp(-T_hier), math.Exp(-chord))
+		}
+	}
+
+	// slab of thickness 0.2 normal to x crossed at increasing obliquity
+	reset_scene()
+	const thickness = 0.2
+	AddObject(&objects.Box{Center: mgl64.Vec3{0, 0, 0}, Sides: mgl64.Vec3{thickness, 3, 3}, Rho: 2.0})
+	for th := 0.0; th < 60; th += 7.3 {
+		direction := mgl64.Vec3{math.Cos(th * math.Pi / 180), math.Sin(th * math.Pi / 180), 0}
+		for _, y := range []float64{-0.3, 0.0, 0.21} {
+			o := mgl64.Vec3{0, y, 0}.Sub(direction.Mul(5.0))
+			expected := 2.0 * thickness / direction[0]
+			T_simple, _ := integrate_along_ray(o, direction, DS/10, 3.0, 7.0)
+			T_hier, _ := integrate_hierarchical(o, direction, DS, 3.0, 7.0)
+			T_ref, _ := integrate_reference(o, direction, DS, 3.0, 7.0)
+			if math.Abs(T_simple-expected) > 2*2.0*DS/10 {
+				t.Errorf("slab angle %v y %v: simple %v differs from %v", th, y, T_simple, expected)
+			}
+			if math.Abs(T_hier-expected) > 2*2.0*DS/10 {
+				t.Errorf("slab angle %v y %v: hierarchical %v differs from %v", th, y, T_hier, expected)
+			}
+			if math.Abs(T_ref-expected) > 2*2.0*DS/100 {
+				t.Errorf("slab angle %v y %v: reference %v differs from %v", th, y, T_ref, expected)
+			}
+		}
+	}
+}
+
+func TestChunkAnglesMerge(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	transforms := filepath.Join(dir, "transforms.json")
+	var partials []string
+	for job := 0; job < 2; job++ {
+		reset_scene()
+		params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+		params.NumImages = 8
+		params.JobsModulo = 2
+		params.JobNum = job
+		params.ChunkAngles = true
+		render(params)
+		partial := filepath.Join(dir, fmt.Sprintf("transforms_job%d.json", job))
+		if n := len(read_transforms(t, partial).Frames); n != 4 {
+			t.Fatalf("job %d: expected 4 frames, got %d", job, n)
+		}
+		partials = append(partials, partial)
+	}
+	// second job reversed to check ordering by frame index
+	merged, err := MergeTransforms([]string{partials[1], partials[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Frames) != 8 {
+		t.Fatalf("expected 8 merged frames, got %d", len(merged.Frames))
+	}
+	for i, frame := range merged.Frames {
+		expected := fmt.Sprintf("images_job%d/image_%03d.png", i%2, i/2)
+		if *frame.FrameIndex != i || frame.FilePath != expected {
+			t.Errorf("frame %d: got index %d and path %s, expected %s", i, *frame.FrameIndex, frame.FilePath, expected)
+		}
+		if _, err := os.Stat(filepath.Join(dir, frame.FilePath)); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+	}
+	// camera of merged frame 3 matches an unchunked render
+	reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), transforms, 8)
+	params.NumImages = 8
+	full := render(params)
+	if fmt.Sprint(full.Frames[3].TransformMatrix) != fmt.Sprint(merged.Frames[3].TransformMatrix) {
+		t.Errorf("merged frame 3 camera differs from unchunked render")
+	}
+
+	if _, err := MergeTransforms(partials[:1]); err == nil {
+		t.Error("expected error for incomplete frame indices")
+	}
+}
+
+func TestPixelJitter(t *testing.T) {
+	// offsets lie in [0,1) and fill a 4x4 grid of bins roughly uniformly
+	var bins [4][4]int
+	const n = 16000
+	for k := 0; k < n; k++ {
+		dx, dy := pixel_jitter(k%40, k/40%20, k/800, 3)
+		if dx < 0 || dx >= 1 || dy < 0 || dy >= 1 {
+			t.Fatalf("offset (%v, %v) outside [0,1)", dx, dy)
+		}
+		bins[int(dx*4)][int(dy*4)]++
+	}
+	for a := range bins {
+		for b, c := range bins[a] {
+			if math.Abs(float64(c)-n/16) > 0.1*n/16 {
+				t.Errorf("bin (%d, %d) has %d offsets, expected about %d", a, b, c, n/16)
+			}
+		}
+	}
+
+	// two supersampled renders are byte-identical
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	var images [][]byte
+	for run := 0; run < 2; run++ {
+		reset_scene()
+		out_dir := filepath.Join(dir, fmt.Sprintf("images%d", run))
+		params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), 16)
+		params.SPP = 4
+		render(params)
+		data, err := os.ReadFile(filepath.Join(out_dir, "image_000.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, data)
+	}
+	if string(images[0]) != string(images[1]) {
+		t.Error("renders with the same parameters differ")
+	}
+}
+
+func TestBackgroundGainOffset(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 16
+	defer func() { background_gain, background_offset = 1.0, 0.0 }()
+
+	var images []*image.Gray16
+	for k, gain_offset := range [][2]float64{{1.0, 0.0}, {0.5, 0.2}} {
+		reset_scene()
+		background_gain, background_offset = gain_offset[0], gain_offset[1]
+		out_dir := filepath.Join(dir, fmt.Sprintf("images%d", k))
+		params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+		params.Grayscale = true
+		render(params)
+		images = append(images, read_png(t, filepath.Join(out_dir, "image_000.png")).(*image.Gray16))
+	}
+	reset_scene()
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			transmittance := float64(images[0].Gray16At(x, y).Y) / 0xffff
+			expected := 0.5*transmittance + 0.2
+			if got := float64(images[1].Gray16At(x, y).Y) / 0xffff; math.Abs(got-expected) > 2.0/0xffff {
+				t.Fatalf("pixel (%d,%d): expected %v, got %v", x, y, expected, got)
+			}
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [1.0, 0.0, 0.0]\nrho: 2.0\n")
+	if err := load_object(input); err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	write_info(&sb, lat[0], 200000)
+	out := sb.String()
+	for _, line := range []string{
+		"type: sphere\n",
+		"children: 0\n",
+		"bounding box: [0.5 -0.5 -0.5] to [1.5 0.5 0.5]\n",
+		"min feature size: 0.5\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in info output:\n%s", line, out)
+		}
+	}
+	// sphere fills pi/6 of its bounding box
+	var fraction, mass float64
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "volume fraction: ") {
+			fmt.Sscanf(line, "volume fraction: %g", &fraction)
+		} else if strings.HasPrefix(line, "mass: ") {
+			fmt.Sscanf(line, "mass: %g", &mass)
+		}
+	}
+	if math.Abs(fraction-math.Pi/6) > 0.01 {
+		t.Errorf("expected volume fraction %v, got %v", math.Pi/6, fraction)
+	}
+	if expected := 2.0 * 4.0 / 3.0 * math.Pi * 0.5 * 0.5 * 0.5; math.Abs(mass-expected)/expected > 0.02 {
+		t.Errorf("expected mass %v, got %v", expected, mass)
+	}
+
+	// no samples would give a NaN volume fraction
+	logger := log.Logger
+	defer func() { log.Logger = logger }()
+	for _, samples := range []string{"0", "-1"} {
+		err := new_app().Run([]string{"xray_projection_render", "info", "--input", input, "--samples", samples})
+		if err == nil || !strings.Contains(err.Error(), "samples") {
+			t.Errorf("--samples %s: expected error, got %v", samples, err)
+		}
+	}
+}
+
+func TestEdgeEnhance(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 20.0\n")
+	const res = 64
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.Grayscale = true
+	params.EdgeEnhance = 0.5
+	render(params)
+	img := read_png(t, filepath.Join(dir, "images", "image_000.png")).(*image.Gray16)
+	// brightest pixel of the middle row lies on the silhouette, between the opaque disc and the background
+	row := res / 2
+	brightest, bright_x := uint16(0), 0
+	for x := 0; x < res; x++ {
+		if v := img.Gray16At(x, row).Y; v > brightest {
+			brightest, bright_x = v, x
+		}
+	}
+	background := img.Gray16At(0, row).Y
+	centre := img.Gray16At(res/2, row).Y
+	if brightest <= background || brightest <= centre {
+		t.Errorf("no bright ring: edge %d, background %d, centre %d", brightest, background, centre)
+	}
+	// silhouette radius in pixels for a sphere of radius 0.5 at distance 5 with 45 degree field of view
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	r_pix := f * 0.5 / math.Sqrt(5*5-0.5*0.5) * res / 2
+	if d := math.Abs(math.Abs(float64(bright_x-res/2)) - r_pix); d > 2 {
+		t.Errorf("brightest pixel at x=%d is %v pixels from the silhouette", bright_x, d)
+	}
+}
+
+func TestTraceRay(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	const DS = 0.01
+	var sb strings.Builder
+	T, err := trace_ray(&sb, mgl64.Vec3{-5, 0, 0}, mgl64.Vec3{2, 0, 0}, DS, 3.0, 7.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if density_trace != nil {
+		t.Error("trace hook left installed")
+	}
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if lines[0] != "s,x,y,z,density" {
+		t.Fatalf("unexpected header %q", lines[0])
+	}
+	// sphere occupies s in (4.5, 5.5) along the ray
+	on, off := math.Inf(1), math.Inf(-1)
+	for _, line := range lines[1:] {
+		var s, x, y, z, rho float64
+		if _, err := fmt.Sscanf(strings.ReplaceAll(line, ",", " "), "%g %g %g %g %g", &s, &x, &y, &z, &rho); err != nil {
+			t.Fatalf("parsing %q: %v", line, err)
+		}
+		if math.Abs(x-(-5+s)) > 1e-9 {
+			t.Errorf("sample at s=%v has x=%v", s, x)
+		}
+		if rho > 0 {
+			on, off = math.Min(on, s), math.Max(off, s)
+		}
+	}
+	// refinement resolves the boundaries to the fine step DS/10
+	if math.Abs(on-4.5) > DS/10+1e-9 || math.Abs(off-5.5) > DS/10+1e-9 {
+		t.Errorf("density on at %v and off at %v, expected 4.5 and 5.5", on, off)
+	}
+	if math.Abs(T-1.0) > 2*DS/10 {
+		t.Errorf("expected optical depth 1, got %v", T)
+	}
+}
+
+func TestTraceSpanMargin(t *testing.T) {
+	logger := log.Logger
+	defer func() { log.Logger = logger }()
+	reset_scene()
+	defer reset_scene()
+	defer set_integration("hierarchical")
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	output := filepath.Join(dir, "trace.csv")
+	args := []string{"xray_projection_render", "trace", "--input", input, "--integration", "simple", "--ds", "0.01",
+		"--span_margin", "0.5", "--resolution", "8", "--i", "4", "--j", "4", "--output", output}
+	if err := new_app().Run(args); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// samples cover the span R -+ 0.5 * cube_half_diagonal
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		var s float64
+		fmt.Sscanf(line, "%g,", &s)
+		lo, hi = math.Min(lo, s), math.Max(hi, s)
+	}
+	half_span := 0.5 * cube_half_diagonal
+	if math.Abs(lo-(5-half_span)) > 0.02 || math.Abs(hi-(5+half_span)) > 0.02 {
+		t.Errorf("expected samples over [%v, %v], got [%v, %v]", 5-half_span, 5+half_span, lo, hi)
+	}
+}
+
+func TestTraceDefaultDS(t *testing.T) {
+	logger := log.Logger
+	defer func() { log.Logger = logger }()
+	reset_scene()
+	defer reset_scene()
+	defer set_integration("hierarchical")
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	// at low resolution the pixel footprint is coarser than a third of the radius
+	const res = 8
+	if auto_ds(&objects.Sphere{Radius: 0.5}, res, 45.0, 5.0, "cone_beam") <= 0.5/3 {
+		t.Fatal("pixel footprint does not set ds")
+	}
+	set_integration("simple")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.DS = -1
+	params.Grayscale = true
+	render(params)
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	// trace looks from azimuth 90 degrees by default
+	camera := camera_from_angles(90, math.Pi/2, 5.0, mgl64.Vec3{0, 0, 1})
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			if math.Abs(camera.At(r, c)-tp.Frames[0].TransformMatrix[r][c]) > 1e-9 {
+				t.Fatalf("first frame is not at azimuth 90: %v", tp.Frames[0].TransformMatrix)
+			}
+		}
+	}
+	rendered := float64(read_png(t, filepath.Join(dir, "images", "image_000.png")).(*image.Gray16).Gray16At(3, res-1-4).Y) / 0xffff
+
+	reset_scene()
+	args := []string{"xray_projection_render", "trace", "--input", input, "--integration", "simple",
+		"--resolution", "8", "--i", "3", "--j", "4", "--output", filepath.Join(dir, "trace.csv")}
+	// optical depth is printed to stdout
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	err = new_app().Run(args)
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed, _ := io.ReadAll(r)
+	var T float64
+	if _, err := fmt.Sscanf(string(printed), "optical depth %g", &T); err != nil {
+		t.Fatalf("unexpected trace output %q: %v", printed, err)
+	}
+	if math.Abs(math.Exp(-T)-rendered) > 1e-4 {
+		t.Errorf("trace gives transmittance %v, render %v", math.Exp(-T), rendered)
+	}
+}
+
+func TestEmptyViewCull(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	const res = 16
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	window := image.Rect(0, 0, res, res)
+	camera := camera_from_angles(90.0, math.Pi/2, 5.0, mgl64.Vec3{0, 0, 1})
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 1.0})
+	if view_is_empty(camera, f, 5.0, res, window, "cone_beam") {
+		t.Error("centred sphere reported outside the view")
+	}
+	// sphere just inside the top of the view is kept
+	reset_scene()
+	AddObject(&objects.Sphere{Center: mgl64.Vec3{0, 0, 1.9}, Radius: 0.2, Rho: 1.0})
+	if view_is_empty(camera, f, 5.0, res, window, "cone_beam") {
+		t.Error("sphere at the edge of the view reported outside it")
+	}
+
+	// sphere far above the view: every pixel is background and no ray is integrated
+	reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 10.0]\nrho: 1.0\n")
+	if err := load_object(input); err != nil {
+		t.Fatal(err)
+	}
+	if !view_is_empty(camera, f, 5.0, res, window, "cone_beam") {
+		t.Fatal("off-axis sphere not detected as outside the view")
+	}
+	reset_scene()
+	out_dir := filepath.Join(dir, "images")
+	params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+	params.ProfileSamples = true
+	render(params)
+	img := read_png(t, filepath.Join(out_dir, "image_000.png"))
+	counts := read_png(t, filepath.Join(out_dir, "samples_image_000.png")).(*image.Gray16)
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r != 0xffff {
+				t.Fatalf("pixel (%d,%d) is %d, expected background", x, y, r)
+			}
+			if c := counts.Gray16At(x, y).Y; c != 0 {
+				t.Fatalf("pixel (%d,%d) has %d density samples, expected pixel loop to be skipped", x, y, c)
+			}
+		}
+	}
+}
+
+func TestRefineFactor(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	defer func() { refine_factor = 10 }()
+	// thin spherical shell between radii 0.45 and 0.5
+	const r1, r2 = 0.5, 0.45
+	AddObject(objects.NewCollection().
+		Add(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: r1, Rho: 1.0}).
+		Add(&objects.Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: r2, Rho: -1.0}))
+	const DS = 0.05
+	mean_error := func() float64 {
+		sum, n := 0.0, 0
+		for b := 0.0; b < r2; b += 0.0123 {
+			expected := 2 * (math.Sqrt(r1*r1-b*b) - math.Sqrt(r2*r2-b*b))
+			T, _ := integrate_hierarchical(mgl64.Vec3{-5, b, 0}, mgl64.Vec3{1, 0, 0}, DS, 3.0, 7.0)
+			sum += math.Abs(T - expected)
+			n++
+		}
+		return sum / float64(n)
+	}
+	prev := math.Inf(1)
+	for _, factor := range []int{1, 4, 20, 100} {
+		refine_factor = factor
+		err := mean_error()
+		if err >= prev {
+			t.Errorf("refine factor %d: mean error %v not below %v", factor, err, prev)
+		}
+		prev = err
+	}
+	if prev > DS/100 {
+		t.Errorf("mean error %v with refine factor 100 exceeds DS/100", prev)
+	}
+}
+
+func TestAutoDS(t *testing.T) {
+	// thin features: step is set by the pixel footprint, which grows with source-to-object distance
+	// as magnification decreases
+	thin := &objects.Cylinder{P0: mgl64.Vec3{0, 0, -0.5}, P1: mgl64.Vec3{0, 0, 0.5}, Radius: 1e-4, Rho: 1.0}
+	ds5 := auto_ds(thin, 256, 45.0, 5.0, "cone_beam")
+	ds10 := auto_ds(thin, 256, 45.0, 10.0, "cone_beam")
+	if math.Abs(ds10/ds5-2.0) > 1e-12 {
+		t.Errorf("expected ds to double with distance, got %v and %v", ds5, ds10)
+	}
+	if expected := pixel_footprint(256, 45.0, 5.0); ds5 != expected {
+		t.Errorf("expected ds %v, got %v", expected, ds5)
+	}
+	// footprint at R is the pixel pitch 2/res at focal length f scaled by R/f
+	f := 1 / math.Tan(mgl64.DegToRad(22.5))
+	if fp := pixel_footprint(256, 45.0, 5.0); math.Abs(fp-5.0*2.0/256/f) > 1e-15 {
+		t.Errorf("unexpected pixel footprint %v", fp)
+	}
+	// coarse features and fan beam keep a third of the feature size
+	sphere := &objects.Sphere{Radius: 0.3, Rho: 1.0}
+	if ds := auto_ds(sphere, 256, 45.0, 5.0, "cone_beam"); ds != sphere.Radius/3.0 {
+		t.Errorf("expected ds %v for coarse sphere, got %v", sphere.Radius/3.0, ds)
+	}
+	if ds := auto_ds(thin, 256, 45.0, 5.0, "fan_beam"); ds != thin.Radius/3.0 {
+		t.Errorf("expected fan beam ds %v, got %v", thin.Radius/3.0, ds)
+	}
+}
+
+func TestAnglesCSV(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.NumImages = 4
+	params.AnglesCSV = filepath.Join(dir, "angles.csv")
+	render(params)
+
+	data, err := os.ReadFile(params.AnglesCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if lines[0] != "file_path,azimuth,polar,eye_x,eye_y,eye_z" || len(lines) != 5 {
+		t.Fatalf("unexpected CSV:\n%s", data)
+	}
+	// views start at 90 degrees and are spaced by 360/4
+	for i, line := range lines[1:] {
+		fields := strings.Split(line, ",")
+		var azimuth, polar, x, y, z float64
+		fmt.Sscan(fields[1], &azimuth)
+		fmt.Sscan(fields[2], &polar)
+		fmt.Sscan(fields[3], &x)
+		fmt.Sscan(fields[4], &y)
+		fmt.Sscan(fields[5], &z)
+		expected := math.Mod(90.0+90.0*float64(i), 360)
+		if fields[0] != fmt.Sprintf("images/image_%03d.png", i) || math.Abs(azimuth-expected) > 1e-6 || math.Abs(polar-90) > 1e-6 {
+			t.Errorf("frame %d: expected azimuth %v and polar 90, got %s", i, expected, line)
+		}
+		eye := mgl64.Vec3{5 * math.Cos(mgl64.DegToRad(expected)), 5 * math.Sin(mgl64.DegToRad(expected)), 0}
+		if !eye.ApproxEqualThreshold(mgl64.Vec3{x, y, z}, 1e-6) {
+			t.Errorf("frame %d: expected eye %v, got %v", i, eye, mgl64.Vec3{x, y, z})
+		}
+	}
+}
+
+func TestScatter(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.4\ncenter: [0.0, 0.0, 0.0]\nrho: 5.0\n")
+	const res = 32
+	var images []*image.Gray16
+	for k, fraction := range []float64{0.0, 0.2} {
+		reset_scene()
+		out_dir := filepath.Join(dir, fmt.Sprintf("images%d", k))
+		params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+		params.Grayscale = true
+		params.ScatterFraction = fraction
+		params.ScatterBlur = 2.0
+		render(params)
+		images = append(images, read_png(t, filepath.Join(out_dir, "image_000.png")).(*image.Gray16))
+	}
+	reset_scene()
+	if c := res / 2; images[1].Gray16At(c, c).Y <= images[0].Gray16At(c, c).Y {
+		t.Errorf("scatter did not raise the pixel behind the object: %d vs %d", images[1].Gray16At(c, c).Y, images[0].Gray16At(c, c).Y)
+	}
+
+	// dense disc far from the border: the blur conserves the scattered signal
+	img := make([][]float64, res)
+	for i := range img {
+		img[i] = make([]float64, res)
+		for j := range img[i] {
+			img[i][j] = 1.0
+			if math.Hypot(float64(i-res/2), float64(j-res/2)) < 6 {
+				img[i][j] = 0.1
+			}
+		}
+	}
+	absorbed, added := 0.0, 0.0
+	for i := range img {
+		for j := range img[i] {
+			absorbed += 1 - img[i][j]
+			added -= img[i][j]
+		}
+	}
+	add_scatter(img, 0, res, 0, res, 0.2, 2.0)
+	for i := range img {
+		for j := range img[i] {
+			added += img[i][j]
+		}
+	}
+	if math.Abs(added/absorbed-0.2) > 1e-9 {
+		t.Errorf("expected scattered signal to be 0.2 of absorbed, got %v", added/absorbed)
+	}
+}
+
+// Render a small fixed scene and compare it with the reference image in testdata.
+// Set UPDATE_GOLDEN=1 to regenerate the reference after an intended change.
+func TestGoldenImage(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	AddObject(objects.NewCollection().
+		Add(&objects.Sphere{Center: mgl64.Vec3{0.3, 0, 0}, Radius: 0.3, Rho: 1.0}).
+		Add(&objects.Box{Center: mgl64.Vec3{-0.3, 0, 0}, Sides: mgl64.Vec3{0.4, 0.4, 0.4}, Rho: 0.5}).
+		Add(&objects.Cylinder{P0: mgl64.Vec3{0, 0, -0.8}, P1: mgl64.Vec3{0, 0, 0.8}, Radius: 0.1, Rho: 0.8}))
+	params := test_params("", filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 32)
+	params.NumImages = 8
+	params.Grayscale = true
+	render_scene(params)
+	got := read_png(t, filepath.Join(dir, "images", "image_001.png")).(*image.Gray16)
+
+	golden := filepath.Join("testdata", "golden_collection.png")
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		data, err := os.ReadFile(filepath.Join(dir, "images", "image_001.png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("Updated '%s'", golden)
+		return
+	}
+	want, ok := read_png(t, golden).(*image.Gray16)
+	if !ok || want.Bounds() != got.Bounds() {
+		t.Fatalf("reference '%s' is not a %v Gray16 image", golden, got.Bounds())
+	}
+	// tolerance of 0.2% allows for floating point differences between platforms
+	const tol = 0xffff / 500
+	for y := 0; y < got.Bounds().Dy(); y++ {
+		for x := 0; x < got.Bounds().Dx(); x++ {
+			g, w := int(got.Gray16At(x, y).Y), int(want.Gray16At(x, y).Y)
+			if g-w > tol || w-g > tol {
+				t.Fatalf("pixel (%d,%d) is %d, reference %d", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestClampMax(t *testing.T) {
+	defer func() { output_quantity = "transmittance" }()
+	output_quantity = "attenuation"
+	dir := t.TempDir()
+	// optical depth 3 through the centre is outside the encodable range
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.0, 0.0, 0.0]\nrho: 3.0\n")
+	// odd resolution puts the centre of pixel res/2 on the optical axis
+	const res = 15
+	centre := func(clamp_max float64) uint16 {
+		reset_scene()
+		out_dir := filepath.Join(dir, fmt.Sprintf("images_%v", clamp_max))
+		params := test_params(input, out_dir, filepath.Join(dir, "transforms.json"), res)
+		params.Grayscale = true
+		params.ClampMax = clamp_max
+		render(params)
+		return read_png(t, filepath.Join(out_dir, "image_000.png")).(*image.Gray16).Gray16At(res/2, res-1-res/2).Y
+	}
+	defer reset_scene()
+	if v := centre(0); v != 0xffff {
+		t.Errorf("over-range value encoded as %d, expected full white", v)
+	}
+	if v := float64(centre(6.0)) / 0xffff; math.Abs(v-0.5) > 0.02 {
+		t.Errorf("expected optical depth 3 scaled by clamp_max 6 to encode as 0.5, got %v", v)
+	}
+}
+
+func TestIntrinsics(t *testing.T) {
+	dir := t.TempDir()
+	center := mgl64.Vec3{0.35, -0.25, 0.2}
+	input := write_file(t, dir, "sphere.yaml", fmt.Sprintf("type: sphere\nradius: 0.15\ncenter: [%v, %v, %v]\nrho: 5.0\n", center[0], center[1], center[2]))
+	const res = 128
+	defer reset_scene()
+	// pixel of the sphere centre predicted by the intrinsics in transforms.json, continuous with pixel
+	// (x, y) covering [x, x+1) x [y, y+1), and the attenuation centroid in pixel indices
+	project := func(name string, roi []int) (mgl64.Vec2, mgl64.Vec2) {
+		reset_scene()
+		params := test_params(input, filepath.Join(dir, name), filepath.Join(dir, name+".json"), res)
+		params.ROI = roi
+		render(params)
+		tp := read_transforms(t, filepath.Join(dir, name+".json"))
+		var camera mgl64.Mat4
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				camera.Set(r, c, tp.Frames[0].TransformMatrix[r][c])
+			}
+		}
+		// OpenGL camera looks along -z with y up, image rows go down
+		p := mgl64.TransformCoordinate(center, camera.Inv())
+		predicted := mgl64.Vec2{tp.CX + tp.FL_X*p[0]/-p[2], tp.CY - tp.FL_Y*p[1]/-p[2]}
+		x, y := attenuation_centroid(t, filepath.Join(dir, name, "image_000.png"))
+		return predicted, mgl64.Vec2{x + 0.5, y + 0.5}
+	}
+	predicted, got := project("full", nil)
+	if predicted.Sub(mgl64.Vec2{res / 2, res / 2}).Len() < 10 {
+		t.Fatalf("sphere projects to %v, too close to the centre to test the intrinsics", predicted)
+	}
+	if d := got.Sub(predicted); math.Abs(d[0]) > 0.1 || math.Abs(d[1]) > 0.1 {
+		t.Errorf("sphere centre expected at pixel %v from the intrinsics, found at %v", predicted, got)
+	}
+	x0, y0 := int(predicted[0])-20, int(predicted[1])-13
+	predicted, got = project("roi", []int{x0, y0, x0 + 40, y0 + 30})
+	if d := got.Sub(predicted); math.Abs(d[0]) > 0.1 || math.Abs(d[1]) > 0.1 {
+		t.Errorf("ROI: sphere centre expected at pixel %v from the intrinsics, found at %v", predicted, got)
+	}
+}
+
+func TestCameraConvention(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 8
+	tps := map[string]TransformParams{}
+	for _, convention := range []string{"opengl", "opencv"} {
+		reset_scene()
+		params := test_params(input, filepath.Join(dir, convention), filepath.Join(dir, convention+".json"), res)
+		params.NumImages = 3
+		params.Roll = []float64{20.0}
+		params.CameraConvention = convention
+		render(params)
+		tps[convention] = read_transforms(t, filepath.Join(dir, convention+".json"))
+	}
+	reset_scene()
+	if tps["opencv"].CameraConvention != "opencv" || tps["opengl"].CameraConvention != "" {
+		t.Errorf("unexpected camera_convention fields %q and %q", tps["opengl"].CameraConvention, tps["opencv"].CameraConvention)
+	}
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	for i := range tps["opengl"].Frames {
+		var gl, cv mgl64.Mat4
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				gl.Set(r, c, tps["opengl"].Frames[i].TransformMatrix[r][c])
+				cv.Set(r, c, tps["opencv"].Frames[i].TransformMatrix[r][c])
+			}
+		}
+		// cv = gl * diag(1, -1, -1, 1)
+		signs := []float64{1, -1, -1, 1}
+		for r := 0; r < 4; r++ {
+			for c := 0; c < 4; c++ {
+				if math.Abs(cv.At(r, c)-signs[c]*gl.At(r, c)) > 1e-12 {
+					t.Fatalf("frame %d: element (%d,%d) is %v, expected %v", i, r, c, cv.At(r, c), signs[c]*gl.At(r, c))
+				}
+			}
+		}
+		// OpenCV camera looks along +z towards the origin
+		eye := cv.Col(3).Vec3()
+		if d := cv.Col(2).Vec3().Dot(eye.Mul(-1).Normalize()); math.Abs(d-1) > 1e-9 {
+			t.Errorf("frame %d: opencv +z axis is not the view direction (dot %v)", i, d)
+		}
+		// converting back reproduces the same world rays
+		back := convert_camera_convention(cv, "opencv")
+		for _, px := range [][2]int{{0, 0}, {3, 5}, {7, 2}} {
+			o1, d1 := pixel_ray(px[0], px[1], float64(res), f, 5, gl, "cone_beam")
+			o2, d2 := pixel_ray(px[0], px[1], float64(res), f, 5, back, "cone_beam")
+			if !o1.ApproxEqualThreshold(o2, 1e-9) || !d1.ApproxEqualThreshold(d2, 1e-9) {
+				t.Errorf("frame %d pixel %v: rays differ after round trip", i, px)
+			}
+		}
+	}
+	// images are unaffected by the convention
+	for i := range tps["opengl"].Frames {
+		name := fmt.Sprintf("image_%03d.png", i)
+		img1 := read_png(t, filepath.Join(dir, "opengl", name))
+		img2 := read_png(t, filepath.Join(dir, "opencv", name))
+		for y := 0; y < res; y++ {
+			for x := 0; x < res; x++ {
+				if img1.At(x, y) != img2.At(x, y) {
+					t.Fatalf("frame %d pixel (%d,%d) differs", i, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDrawBBox(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "cube.yaml", "type: cube\ncenter: [0.0, 0.0, 0.0]\nside: 0.6\nrho: 0.5\n")
+	const res = 32
+	reset_scene()
+	defer reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.DrawBBox = true
+	render(params)
+
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	var camera mgl64.Mat4
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			camera.Set(r, c, tp.Frames[0].TransformMatrix[r][c])
+		}
+	}
+	img := read_png(t, filepath.Join(dir, "images", "image_000.png"))
+	is_gray := func(x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r == g && g == b
+	}
+	// midpoint of an edge of the box projected with the camera of the frame
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	p := mgl64.TransformCoordinate(mgl64.Vec3{0.3, 0.15, 0.3}, camera.Inv())
+	i := int(math.Round((f*p[0]/-p[2] + 1) * res / 2))
+	j := int(math.Round((f*p[1]/-p[2] + 1) * res / 2))
+	if r, g, b, _ := img.At(i, res-1-j).RGBA(); r != 0xffff || g != 0xffff || b != 0 {
+		t.Errorf("expected yellow box edge at pixel (%d,%d), got %v", i, res-1-j, img.At(i, res-1-j))
+	}
+	if !is_gray(0, 0) {
+		t.Errorf("expected gray background at corner, got %v", img.At(0, 0))
+	}
+}
+
+func TestPixelStride(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.5\ncenter: [0.1, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 15
+	images := map[int]image.Image{}
+	for _, stride := range []int{0, 1, 2} {
+		reset_scene()
+		out := filepath.Join(dir, fmt.Sprintf("stride_%d", stride))
+		params := test_params(input, out, out+".json", res)
+		params.PixelStride = stride
+		render(params)
+		images[stride] = read_png(t, filepath.Join(out, "image_000.png"))
+	}
+	reset_scene()
+	full := images[0]
+	for _, stride := range []int{1, 2} {
+		if images[stride].Bounds() != full.Bounds() {
+			t.Fatalf("stride %d: bounds %v differ from %v", stride, images[stride].Bounds(), full.Bounds())
+		}
+	}
+	n_diff := 0
+	for y := 0; y < res; y++ {
+		for x := 0; x < res; x++ {
+			if images[1].At(x, y) != full.At(x, y) {
+				t.Fatalf("stride 1 pixel (%d,%d) differs from full render", x, y)
+			}
+			// computed pixels have even i and j, image rows are flipped
+			if x%2 == 0 && (res-1-y)%2 == 0 {
+				if images[2].At(x, y) != full.At(x, y) {
+					t.Errorf("stride 2 computed pixel (%d,%d) differs from full render", x, y)
+				}
+			} else if images[2].At(x, y) != full.At(x, y) {
+				n_diff++
+			}
+		}
+	}
+	if n_diff == 0 {
+		t.Error("expected filled pixels to differ from the full render near the sphere edge")
+	}
+}
+
+func TestHDF5Output(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	const res = 8
+	reset_scene()
+	defer reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.NumImages = 3
+	params.OutputFormat = "hdf5"
+	render(params)
+
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	if len(tp.Frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(tp.Frames))
+	}
+	for i, frame := range tp.Frames {
+		if frame.FilePath != "images/"+hdf5_name {
+			t.Errorf("expected frames to refer to %s, got %s", hdf5_name, frame.FilePath)
+		}
+		if frame.DatasetIndex == nil || *frame.DatasetIndex != i {
+			t.Errorf("frame %d: expected dataset index %d, got %v", i, i, frame.DatasetIndex)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "images"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != hdf5_name {
+		t.Fatalf("expected only %s in output directory, got %v", hdf5_name, entries)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "images", hdf5_name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "\x89HDF\r\n\x1a\n") {
+		t.Error("missing hdf5 signature")
+	}
+	if len(data) < 4*3*res*res {
+		t.Errorf("file of %d bytes cannot hold 3 projections of %dx%d", len(data), res, res)
+	}
+}
+
+func TestMaxProjectionsInMemory(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.1, 0.0, 0.0]\nrho: 1.0\n")
+	files := make(map[int][]byte)
+	for _, max_in_memory := range []int{0, 1, 2} {
+		reset_scene()
+		out := filepath.Join(dir, fmt.Sprintf("max_%d", max_in_memory))
+		params := test_params(input, out, out+".json", 8)
+		params.NumImages = 3
+		params.OutputFormat = "hdf5"
+		params.MaxInMemory = max_in_memory
+		render(params)
+		entries, err := os.ReadDir(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("max %d: expected spool file to be removed, got %v", max_in_memory, entries)
+		}
+		if files[max_in_memory], err = os.ReadFile(filepath.Join(out, hdf5_name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reset_scene()
+	for _, max_in_memory := range []int{1, 2} {
+		if !bytes.Equal(files[max_in_memory], files[0]) {
+			t.Errorf("max %d: hdf5 file differs from the one assembled in memory", max_in_memory)
+		}
+	}
+}
+
+func TestSpanMargin(t *testing.T) {
+	dir := t.TempDir()
+	// sphere reaching the corners of the unit cube, i.e. touching the unmargined span
+	input := write_file(t, dir, "sphere.yaml", fmt.Sprintf("type: sphere\nradius: %v\ncenter: [0.0, 0.0, 0.0]\nrho: 0.1\n", cube_half_diagonal-1e-3))
+	for _, tc := range []struct {
+		margin   float64
+		clipping bool
+	}{
+		{0, false},
+		{0.9, true},
+	} {
+		reset_scene()
+		out := filepath.Join(dir, fmt.Sprintf("margin_%v", tc.margin))
+		params := test_params(input, out, out+".json", 8)
+		params.SpanMargin = tc.margin
+		render(params)
+		// single view, so the counters hold its rays
+		if clipping := clipped_smin.Load()+clipped_smax.Load() > 0; clipping != tc.clipping {
+			t.Errorf("margin %v: expected clipping %v, got %v", tc.margin, tc.clipping, clipping)
+		}
+	}
+	reset_scene()
+}
+
+func TestClippedFraction(t *testing.T) {
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	// sphere larger than the scene cube: central rays start and end inside it, rays near the corners miss it
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 2.0\ncenter: [0.0, 0.0, 0.0]\nrho: 0.1\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.NumImages = 2
+	render(params)
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	for name, fraction := range map[string]float64{"smin": manifest.ClippedSmin, "smax": manifest.ClippedSmax} {
+		if fraction <= 0 || fraction >= 1 {
+			t.Errorf("expected fraction of rays clipped at %s in (0, 1), got %v", name, fraction)
+		}
+	}
+	smin_frac, smax_frac := clipping_fractions()
+	if smin_frac != manifest.ClippedSmin || smax_frac != manifest.ClippedSmax {
+		t.Errorf("last view fractions %v, %v differ from run fractions %v, %v of identical views", smin_frac, smax_frac, manifest.ClippedSmin, manifest.ClippedSmax)
+	}
+}
+
+func TestDarkfield(t *testing.T) {
+	dir := t.TempDir()
+	const radius, emission = 0.5, 0.8
+	input := write_file(t, dir, "sphere.yaml", fmt.Sprintf("type: sphere\nradius: %v\ncenter: [0.0, 0.0, 0.0]\nrho: 0.2\nemission: %v\n", radius, emission))
+	const res = 16
+	reset_scene()
+	defer reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.EmitDarkfield = true
+	params.ClampMax = 1.0
+	render(params)
+
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	var camera mgl64.Mat4
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			camera.Set(r, c, tp.Frames[0].TransformMatrix[r][c])
+		}
+	}
+	img := read_png(t, filepath.Join(dir, "images", "darkfield_image_000.png"))
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	n_inside := 0
+	for i := 0; i < res; i++ {
+		for j := 0; j < res; j++ {
+			// chord length of the ray through the sphere from its distance to the centre
+			origin, direction := pixel_ray(i, j, res, f, 5.0, camera, "cone_beam")
+			d := origin.Sub(direction.Normalize().Mul(origin.Dot(direction.Normalize()))).Len()
+			chord := 0.0
+			if d < radius {
+				chord = 2 * math.Sqrt(radius*radius-d*d)
+				n_inside++
+			}
+			r, _, _, _ := img.At(i, res-1-j).RGBA()
+			if got := float64(r) / 0xffff; math.Abs(got-emission*chord) > 0.01 {
+				t.Errorf("pixel (%d,%d): expected dark-field %v, got %v", i, j, emission*chord, got)
+			}
+		}
+	}
+	if n_inside == 0 {
+		t.Error("no ray passed through the sphere")
+	}
+}
+
+func TestDarkfieldSupersampled(t *testing.T) {
+	dir := t.TempDir()
+	const radius, emission = 0.5, 0.8
+	input := write_file(t, dir, "sphere.yaml", fmt.Sprintf("type: sphere\nradius: %v\ncenter: [0.0, 0.0, 0.0]\nrho: 0.2\nemission: %v\n", radius, emission))
+	const res, spp = 16, 8
+	reset_scene()
+	defer reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), res)
+	params.EmitDarkfield = true
+	params.ClampMax = 1.0
+	params.SPP = spp
+	render(params)
+
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	var camera mgl64.Mat4
+	for r := 0; r < 4; r++ {
+		for c := 0; c < 4; c++ {
+			camera.Set(r, c, tp.Frames[0].TransformMatrix[r][c])
+		}
+	}
+	img := read_png(t, filepath.Join(dir, "images", "darkfield_image_000.png"))
+	f := 1 / math.Tan(mgl64.DegToRad(45.0/2))
+	n_partial := 0
+	for i := 0; i < res; i++ {
+		for j := 0; j < res; j++ {
+			// mean chord over the same jittered rays as the projection
+			expected := 0.0
+			n_hit := 0
+			for k := 0; k < spp; k++ {
+				dx, dy := pixel_jitter(i, j, k, 0)
+				origin, direction := pixel_ray_at(float64(i)+dx, float64(j)+dy, res, f, 5.0, camera, "cone_beam")
+				d := origin.Sub(direction.Normalize().Mul(origin.Dot(direction.Normalize()))).Len()
+				if d < radius {
+					expected += emission * 2 * math.Sqrt(radius*radius-d*d) / spp
+					n_hit++
+				}
+			}
+			if n_hit > 0 && n_hit < spp {
+				n_partial++
+			}
+			r, _, _, _ := img.At(i, res-1-j).RGBA()
+			if got := float64(r) / 0xffff; math.Abs(got-expected) > 0.01 {
+				t.Errorf("pixel (%d,%d): expected dark-field %v, got %v", i, j, expected, got)
+			}
+		}
+	}
+	if n_partial == 0 {
+		t.Error("no pixel on the edge of the sphere")
+	}
+}
+
+func TestCheckOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.NumImages = 2
+	if err := check_overwrite(params); err != nil {
+		t.Fatalf("unexpected error before the first run: %v", err)
+	}
+	reset_scene()
+	render(params)
+	reset_scene()
+
+	err := check_overwrite(params)
+	if err == nil {
+		t.Fatal("expected error for second run into the same directory")
+	}
+	for _, fn := range []string{"image_000.png", "image_001.png", "transforms.json"} {
+		if !strings.Contains(err.Error(), fn) {
+			t.Errorf("error does not report %s: %v", fn, err)
+		}
+	}
+	for _, allow := range []func(p *RenderParams){
+		func(p *RenderParams) { p.Overwrite = true },
+		func(p *RenderParams) { p.Resume = true },
+	} {
+		p := params
+		allow(&p)
+		if err := check_overwrite(p); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	// other file name patterns and formats do not clash
+	other := params
+	other.FnamePattern = "proj_%d.png"
+	other.TransformsFile = filepath.Join(dir, "other.json")
+	if err := check_overwrite(other); err != nil {
+		t.Errorf("unexpected error for different pattern: %v", err)
+	}
+	// with reused camera poses the frame count comes from the reused file
+	reuse := params
+	reuse.NumImages = 1
+	reuse.ReuseTransforms = params.TransformsFile
+	reuse.TransformsFile = filepath.Join(dir, "reused.json")
+	if err := check_overwrite(reuse); err == nil || !strings.Contains(err.Error(), "image_001.png") {
+		t.Errorf("expected reused frame image_001.png to be reported, got %v", err)
+	}
+	// parallel jobs sharing the directory only check their own frames
+	job := params
+	job.NumImages = 4
+	job.JobsModulo = 2
+	job.JobNum = 1
+	if err := check_overwrite(job); err == nil || strings.Contains(err.Error(), "image_000.png") || !strings.Contains(err.Error(), "image_001.png") {
+		t.Errorf("expected job 1 to report only its own frame image_001.png, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "images", "image_001.png"))
+	if err := check_overwrite(job); err != nil {
+		t.Errorf("unexpected error for job whose frames do not exist: %v", err)
+	}
+}
+
+func TestSecondRunRefused(t *testing.T) {
+	logger := log.Logger
+	defer func() { log.Logger = logger }()
+	reset_scene()
+	defer reset_scene()
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	args := []string{"xray_projection_render", "--input", input, "--output_dir", filepath.Join(dir, "images"),
+		"--transforms_file", filepath.Join(dir, "transforms.json"), "--num_projections", "2", "--resolution", "8", "--ds", "0.01", "--quiet"}
+	if err := new_app().Run(args); err != nil {
+		t.Fatalf("unexpected error in first run: %v", err)
+	}
+	reset_scene()
+	err := new_app().Run(args)
+	if err == nil || !strings.Contains(err.Error(), "--overwrite") {
+		t.Fatalf("expected second run into the same directory to fail, got %v", err)
+	}
+	reset_scene()
+	if err := new_app().Run(append(args, "--overwrite")); err != nil {
+		t.Errorf("unexpected error with --overwrite: %v", err)
+	}
+}
+
+func TestParseIntList(t *testing.T) {
+	if refs, err := parseIntList(" 0, 1,1 "); err != nil || !reflect.DeepEqual(refs, []int{0, 1, 1}) {
+		t.Errorf("expected [0 1 1], got %v (%v)", refs, err)
+	}
+	if refs, err := parseIntList(""); err != nil || len(refs) != 0 {
+		t.Errorf("expected empty list, got %v (%v)", refs, err)
+	}
+	// flat-field references and ROI corners are indices, so fractions are rejected rather than truncated
+	for _, s := range []string{"0,1.7", "0.5,0,256.9,256"} {
+		if _, err := parseIntList(s); err == nil {
+			t.Errorf("%q: expected error for non-integral value", s)
+		}
+	}
+}
+
+func TestFrameTimesAndFlatFieldRefs(t *testing.T) {
+	dir := t.TempDir()
+	input := write_file(t, dir, "sphere.yaml", "type: sphere\nradius: 0.3\ncenter: [0.0, 0.0, 0.0]\nrho: 1.0\n")
+	reset_scene()
+	defer reset_scene()
+	params := test_params(input, filepath.Join(dir, "images"), filepath.Join(dir, "transforms.json"), 8)
+	params.NumImages = 4
+	params.FrameTimes = []float64{0.0, 0.25, 0.5, 0.75}
+	params.FlatFieldRefs = []int{0, 0, 1, 1}
+	render(params)
+
+	tp := read_transforms(t, filepath.Join(dir, "transforms.json"))
+	if len(tp.Frames) != 4 {
+		t.Fatalf("expected 4 frames, got %d", len(tp.Frames))
+	}
+	for i, frame := range tp.Frames {
+		if frame.Time != params.FrameTimes[i] {
+			t.Errorf("frame %d: expected time %v, got %v", i, params.FrameTimes[i], frame.Time)
+		}
+		if frame.FlatFieldRef == nil || *frame.FlatFieldRef != params.FlatFieldRefs[i] {
+			t.Errorf("frame %d: expected flat_field_ref %d, got %v", i, params.FlatFieldRefs[i], frame.FlatFieldRef)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "transforms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\"flat_field_ref\""); n != 4 {
+		t.Errorf("expected 4 flat_field_ref entries, found %d", n)
+	}
+	// the reference is omitted when not requested
+	reset_scene()
+	params = test_params(input, filepath.Join(dir, "plain"), filepath.Join(dir, "plain.json"), 8)
+	render(params)
+	if data, err = os.ReadFile(filepath.Join(dir, "plain.json")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "flat_field_ref") {
+		t.Error("expected no flat_field_ref without flat-field references")
+	}
+}
@@ -1,34 +1,108 @@
 package objects
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/go-gl/mathgl/mgl64"
+	"github.com/igrega348/xray_projection_render/deformations"
 )
 
+// Width of the shell around the surface of hard primitives (sphere, box, cube, cylinder) over which
+// density ramps linearly from Rho to 0. Zero gives hard edges.
+var BoundarySoftness = 0.0
+
+// Directory against which relative paths of data files (sphere_cloud, label_voxel_grid) are resolved,
+// set to the directory of the scene file while it is loaded. Empty resolves them against the working directory.
+var DataDir = ""
+
+// Absolute path of the data file at path, resolved against DataDir if relative, so that
+// objects written with ToMap can be read back from any directory
+func resolveDataPath(path string) (string, error) {
+	if !filepath.IsAbs(path) && DataDir != "" {
+		path = filepath.Join(DataDir, path)
+	}
+	return filepath.Abs(path)
+}
+
+// Return an error if data, as given by ToMap, contains objects which cannot be read back with FromMap,
+// i.e. sphere clouds built in memory with NewSphereCloud and never saved to a file
+func CheckRoundTrip(data map[string]interface{}) error {
+	if data["type"] == "sphere_cloud" && data["path"] == "" {
+		return fmt.Errorf("sphere_cloud has no path, its spheres exist only in memory")
+	}
+	for _, v := range data {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if err := CheckRoundTrip(v); err != nil {
+				return err
+			}
+		case []map[string]interface{}:
+			for _, child := range v {
+				if err := CheckRoundTrip(child); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Density for signed distance sd to the surface (negative inside) with BoundarySoftness applied
+func softDensity(sd, rho float64) float64 {
+	if BoundarySoftness <= 0.0 {
+		if sd < 0.0 {
+			return rho
+		}
+		return 0.0
+	}
+	t := 0.5 - sd/BoundarySoftness
+	return rho * math.Max(0.0, math.Min(1.0, t))
+}
+
+// Signed distance to a box with half sides h from a point p given relative to the box center
+func boxDistance(p, h mgl64.Vec3) float64 {
+	q := mgl64.Vec3{math.Abs(p[0]) - h[0], math.Abs(p[1]) - h[1], math.Abs(p[2]) - h[2]}
+	outside := mgl64.Vec3{math.Max(q[0], 0), math.Max(q[1], 0), math.Max(q[2], 0)}
+	return outside.Len() + math.Min(math.Max(q[0], math.Max(q[1], q[2])), 0.0)
+}
+
 type Object interface {
 	Density(x, y, z float64) float64
 	ToMap() map[string]interface{}
 	FromMap(data map[string]interface{}) error
 	MinFeatureSize() float64
+	BoundingBox() (mgl64.Vec3, mgl64.Vec3) // min and max corners
 }
 
 type Sphere struct {
 	Object
 	// parameters are center and radius
-	Center mgl64.Vec3
-	Radius float64
-	Rho    float64
+	Center   mgl64.Vec3
+	Radius   float64
+	Rho      float64
+	Emission float64 // optional dark-field emission coefficient, see Emitter
 }
 
 func (s *Sphere) ToMap() map[string]interface{} {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"type":   "sphere",
 		"center": s.Center,
 		"radius": s.Radius,
 		"rho":    s.Rho,
 	}
+	if s.Emission != 0 {
+		data["emission"] = s.Emission
+	}
+	return data
 }
 
 func (s *Sphere) FromMap(data map[string]interface{}) error {
@@ -37,8 +111,8 @@ func (s *Sphere) FromMap(data map[string]interface{}) error {
 	if slice, ok = data["center"].([]interface{}); !ok {
 		return fmt.Errorf("center is not a Vec3")
 	}
-	for i, val := range slice {
-		s.Center[i] = val.(float64)
+	if err := ToVec(&slice, &s.Center); err != nil {
+		return fmt.Errorf("center: %v", err)
 	}
 	if s.Radius, ok = data["radius"].(float64); !ok {
 		return fmt.Errorf("radius is not a float64")
@@ -46,40 +120,155 @@ func (s *Sphere) FromMap(data map[string]interface{}) error {
 	if s.Rho, ok = data["rho"].(float64); !ok {
 		return fmt.Errorf("rho is not a float64")
 	}
-	return nil
+	return emissionFromMap(data, &s.Emission)
 }
 
 func (s *Sphere) Density(x, y, z float64) float64 {
+	return s.fill(x, y, z, s.Rho)
+}
+
+func (s *Sphere) EmissionAt(x, y, z float64) float64 {
+	return s.fill(x, y, z, s.Emission)
+}
+
+// Value inside the sphere, with BoundarySoftness applied
+func (s *Sphere) fill(x, y, z, value float64) float64 {
 	x = x - s.Center[0]
 	y = y - s.Center[1]
 	z = z - s.Center[2]
 	r_2 := x*x + y*y + z*z
+	if BoundarySoftness > 0.0 {
+		return softDensity(math.Sqrt(r_2)-s.Radius, value)
+	}
 	if r_2 < s.Radius*s.Radius {
-		return s.Rho
+		return value
 	}
 	return 0.0
 }
 
+func (s *Sphere) SignedDistance(x, y, z float64) float64 {
+	return mgl64.Vec3{x, y, z}.Sub(s.Center).Len() - s.Radius
+}
+
+// Outward unit normal of the sphere surface in the radial direction through the point, zero at the centre
+func (s *Sphere) SurfaceNormal(x, y, z float64) mgl64.Vec3 {
+	d := mgl64.Vec3{x, y, z}.Sub(s.Center)
+	if d.Len() == 0 {
+		return mgl64.Vec3{}
+	}
+	return d.Normalize()
+}
+
 func (s *Sphere) MinFeatureSize() float64 {
 	return s.Radius
 }
 
+func (s *Sphere) BoundingSphere() (mgl64.Vec3, float64) {
+	return s.Center, s.Radius + 0.5*BoundarySoftness
+}
+
+func (s *Sphere) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	rad := s.Radius + 0.5*BoundarySoftness
+	r := mgl64.Vec3{rad, rad, rad}
+	return s.Center.Sub(r), s.Center.Add(r)
+}
+
+type RadialProfile struct {
+	Object
+	// sphere with density varying with distance from center.
+	// Profile is sampled uniformly from center to surface and interpolated linearly
+	Center  mgl64.Vec3
+	Radius  float64
+	Profile []float64
+}
+
+func (rp *RadialProfile) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "radial_profile",
+		"center":  rp.Center,
+		"radius":  rp.Radius,
+		"profile": rp.Profile,
+	}
+}
+
+func (rp *RadialProfile) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var slice []interface{}
+	var err error
+	if slice, ok = data["center"].([]interface{}); !ok {
+		return fmt.Errorf("center is not a Vec3")
+	}
+	if err = ToVec(&slice, &rp.Center); err != nil {
+		return fmt.Errorf("center: %v", err)
+	}
+	if rp.Radius, err = ToFloat64(data["radius"]); err != nil {
+		return fmt.Errorf("radius is not a float64")
+	}
+	if slice, ok = data["profile"].([]interface{}); !ok || len(slice) == 0 {
+		return fmt.Errorf("profile is not a non-empty list")
+	}
+	rp.Profile = make([]float64, len(slice))
+	for i, val := range slice {
+		if rp.Profile[i], err = ToFloat64(val); err != nil {
+			return fmt.Errorf("profile[%d] is not a float64", i)
+		}
+	}
+	return nil
+}
+
+func (rp *RadialProfile) Density(x, y, z float64) float64 {
+	r := mgl64.Vec3{x, y, z}.Sub(rp.Center).Len()
+	if r >= rp.Radius {
+		return 0.0
+	}
+	n := len(rp.Profile)
+	if n == 1 {
+		return rp.Profile[0]
+	}
+	// position in profile samples and linear interpolation between neighbours
+	t := r / rp.Radius * float64(n-1)
+	k := int(t)
+	if k >= n-1 {
+		return rp.Profile[n-1]
+	}
+	w := t - float64(k)
+	return (1-w)*rp.Profile[k] + w*rp.Profile[k+1]
+}
+
+func (rp *RadialProfile) MinFeatureSize() float64 {
+	return rp.Radius / float64(len(rp.Profile))
+}
+
+func (rp *RadialProfile) BoundingSphere() (mgl64.Vec3, float64) {
+	return rp.Center, rp.Radius
+}
+
+func (rp *RadialProfile) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	r := mgl64.Vec3{rp.Radius, rp.Radius, rp.Radius}
+	return rp.Center.Sub(r), rp.Center.Add(r)
+}
+
 type Cube struct {
 	Object
 	// parameters are center and side length
-	Center mgl64.Vec3
-	Side   float64
-	Rho    float64
-	Box    Box
+	Center   mgl64.Vec3
+	Side     float64
+	Rho      float64
+	Emission float64 // optional dark-field emission coefficient, see Emitter
+	Box      Box
 }
 
 func (c *Cube) ToMap() map[string]interface{} {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"type":   "cube",
 		"center": c.Center,
 		"side":   c.Side,
 		"rho":    c.Rho,
 	}
+	if c.Emission != 0 {
+		data["emission"] = c.Emission
+	}
+	return data
 }
 
 func (c *Cube) FromMap(data map[string]interface{}) error {
@@ -88,8 +277,8 @@ func (c *Cube) FromMap(data map[string]interface{}) error {
 	if slice, ok = data["center"].([]interface{}); !ok {
 		return fmt.Errorf("center is not a Vec3")
 	}
-	for i, val := range slice {
-		c.Center[i] = val.(float64)
+	if err := ToVec(&slice, &c.Center); err != nil {
+		return fmt.Errorf("center: %v", err)
 	}
 	if c.Side, ok = data["side"].(float64); !ok {
 		return fmt.Errorf("side is not a float64")
@@ -97,7 +286,10 @@ func (c *Cube) FromMap(data map[string]interface{}) error {
 	if c.Rho, ok = data["rho"].(float64); !ok {
 		return fmt.Errorf("rho is not a float64")
 	}
-	c.Box = Box{Center: c.Center, Sides: mgl64.Vec3{c.Side, c.Side, c.Side}, Rho: c.Rho}
+	if err := emissionFromMap(data, &c.Emission); err != nil {
+		return err
+	}
+	c.Box = Box{Center: c.Center, Sides: mgl64.Vec3{c.Side, c.Side, c.Side}, Rho: c.Rho, Emission: c.Emission}
 	return nil
 }
 
@@ -105,25 +297,42 @@ func (c *Cube) Density(x, y, z float64) float64 {
 	return c.Box.Density(x, y, z)
 }
 
+func (c *Cube) EmissionAt(x, y, z float64) float64 {
+	return c.Box.EmissionAt(x, y, z)
+}
+
+func (c *Cube) SignedDistance(x, y, z float64) float64 {
+	return c.Box.SignedDistance(x, y, z)
+}
+
 func (c *Cube) MinFeatureSize() float64 {
 	return c.Box.MinFeatureSize()
 }
 
+func (c *Cube) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	return c.Box.BoundingBox()
+}
+
 type Box struct {
 	Object
 	// parameters are center and side lengths
-	Center mgl64.Vec3
-	Sides  mgl64.Vec3
-	Rho    float64
+	Center   mgl64.Vec3
+	Sides    mgl64.Vec3
+	Rho      float64
+	Emission float64 // optional dark-field emission coefficient, see Emitter
 }
 
 func (b *Box) ToMap() map[string]interface{} {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"type":   "box",
 		"center": b.Center,
 		"sides":  b.Sides,
 		"rho":    b.Rho,
 	}
+	if b.Emission != 0 {
+		data["emission"] = b.Emission
+	}
+	return data
 }
 
 func (b *Box) FromMap(data map[string]interface{}) error {
@@ -134,35 +343,57 @@ func (b *Box) FromMap(data map[string]interface{}) error {
 	}
 	err := ToVec(&slice, &b.Center)
 	if err != nil {
-		return err
+		return fmt.Errorf("center: %v", err)
 	}
 	if slice, ok = data["sides"].([]interface{}); !ok {
 		return fmt.Errorf("sides is not a Vec3")
 	}
 	err = ToVec(&slice, &b.Sides)
 	if err != nil {
-		return err
+		return fmt.Errorf("sides: %v", err)
 	}
 	if b.Rho, err = ToFloat64(data["rho"]); err != nil {
 		return fmt.Errorf("rho is not a float64")
 	}
-	return nil
+	return emissionFromMap(data, &b.Emission)
 }
 
 func (b *Box) Density(x, y, z float64) float64 {
+	return b.fill(x, y, z, b.Rho)
+}
+
+func (b *Box) EmissionAt(x, y, z float64) float64 {
+	return b.fill(x, y, z, b.Emission)
+}
+
+// Value inside the box, with BoundarySoftness applied
+func (b *Box) fill(x, y, z, value float64) float64 {
+	if BoundarySoftness > 0.0 {
+		p := mgl64.Vec3{x, y, z}.Sub(b.Center)
+		return softDensity(boxDistance(p, b.Sides.Mul(0.5)), value)
+	}
 	x = math.Abs(x - b.Center[0])
 	y = math.Abs(y - b.Center[1])
 	z = math.Abs(z - b.Center[2])
 	if x < 0.5*b.Sides[0] && y < 0.5*b.Sides[1] && z < 0.5*b.Sides[2] {
-		return b.Rho
+		return value
 	}
 	return 0.0
 }
 
+func (b *Box) SignedDistance(x, y, z float64) float64 {
+	return boxDistance(mgl64.Vec3{x, y, z}.Sub(b.Center), b.Sides.Mul(0.5))
+}
+
 func (b *Box) MinFeatureSize() float64 {
 	return math.Min(b.Sides[0], math.Min(b.Sides[1], b.Sides[2]))
 }
 
+func (b *Box) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	h := b.Sides.Mul(0.5).Add(mgl64.Vec3{1, 1, 1}.Mul(0.5 * BoundarySoftness))
+	return b.Center.Sub(h), b.Center.Add(h)
+}
+
 type Parallelepiped struct {
 	Object
 	// parameters are origin and vectors for sides
@@ -191,36 +422,50 @@ func (p *Parallelepiped) FromMap(data map[string]interface{}) error {
 	}
 	err := ToVec(&slice, &p.Origin)
 	if err != nil {
-		return err
+		return fmt.Errorf("origin: %v", err)
 	}
 	if slice, ok = data["v1"].([]interface{}); !ok {
 		return fmt.Errorf("v1 is not a Vec3")
 	}
 	err = ToVec(&slice, &p.V1)
 	if err != nil {
-		return err
+		return fmt.Errorf("v1: %v", err)
 	}
 	if slice, ok = data["v2"].([]interface{}); !ok {
 		return fmt.Errorf("v2 is not a Vec3")
 	}
 	err = ToVec(&slice, &p.V2)
 	if err != nil {
-		return err
+		return fmt.Errorf("v2: %v", err)
 	}
 	if slice, ok = data["v3"].([]interface{}); !ok {
 		return fmt.Errorf("v3 is not a Vec3")
 	}
 	err = ToVec(&slice, &p.V3)
 	if err != nil {
-		return err
+		return fmt.Errorf("v3: %v", err)
 	}
 	if p.Rho, err = ToFloat64(data["rho"]); err != nil {
 		return fmt.Errorf("rho is not a float64")
 	}
-	p.mat = mgl64.Mat3FromCols(p.V1, p.V2, p.V3).Inv()
+	basis := mgl64.Mat3FromCols(p.V1, p.V2, p.V3)
+	if degenerateBasis(basis) {
+		return fmt.Errorf("v1, v2 and v3 are linearly dependent")
+	}
+	p.mat = basis.Inv()
 	return nil
 }
 
+// Relative volume below which basis vectors are treated as linearly dependent, see degenerateBasis
+const basisTolerance = 1e-9
+
+// Report whether the columns of basis are (nearly) linearly dependent: the volume they span is at most
+// basisTolerance times the product of their lengths, so that the inverse would be huge or not finite.
+func degenerateBasis(basis mgl64.Mat3) bool {
+	scale := basis.Col(0).Len() * basis.Col(1).Len() * basis.Col(2).Len()
+	return !(math.Abs(basis.Det()) > basisTolerance*scale)
+}
+
 func (p *Parallelepiped) Density(x, y, z float64) float64 {
 	// transform point to parallelepiped coordinates
 	pt := mgl64.Vec3{x, y, z}
@@ -235,6 +480,202 @@ func (p *Parallelepiped) MinFeatureSize() float64 {
 	return 0.2 * math.Min(p.V1.Len(), math.Min(p.V2.Len(), p.V3.Len()))
 }
 
+func (p *Parallelepiped) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	lo, hi := p.Origin, p.Origin
+	for _, v := range []mgl64.Vec3{p.V1, p.V2, p.V3} {
+		for k := 0; k < 3; k++ {
+			if v[k] < 0 {
+				lo[k] += v[k]
+			} else {
+				hi[k] += v[k]
+			}
+		}
+	}
+	return lo, hi
+}
+
+type Quadric struct {
+	Object
+	// region where Ax^2+By^2+Cz^2+Dxy+Exz+Fyz+Gx+Hy+Iz+J < 0,
+	// optionally clipped by half-spaces n.p + d <= 0 given as Planes [nx, ny, nz, d]
+	Coefficients [10]float64
+	Planes       [][4]float64
+	Rho          float64
+}
+
+func (q *Quadric) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":         "quadric",
+		"coefficients": q.Coefficients,
+		"planes":       q.Planes,
+		"rho":          q.Rho,
+	}
+}
+
+func (q *Quadric) FromMap(data map[string]interface{}) error {
+	var err error
+	slice, ok := data["coefficients"].([]interface{})
+	if !ok || len(slice) != 10 {
+		return fmt.Errorf("coefficients is not a list of 10 numbers")
+	}
+	for i, val := range slice {
+		if q.Coefficients[i], err = ToFloat64(val); err != nil {
+			return fmt.Errorf("coefficients[%d] is not a float64", i)
+		}
+	}
+	q.Planes = [][4]float64{}
+	if planes, ok := data["planes"].([]interface{}); ok {
+		for i, plane := range planes {
+			vals, ok := plane.([]interface{})
+			if !ok || len(vals) != 4 {
+				return fmt.Errorf("planes[%d] is not a list of 4 numbers", i)
+			}
+			var p [4]float64
+			for k, val := range vals {
+				if p[k], err = ToFloat64(val); err != nil {
+					return fmt.Errorf("planes[%d][%d] is not a float64", i, k)
+				}
+			}
+			q.Planes = append(q.Planes, p)
+		}
+	}
+	if q.Rho, err = ToFloat64(data["rho"]); err != nil {
+		return fmt.Errorf("rho is not a float64")
+	}
+	return nil
+}
+
+func (q *Quadric) Density(x, y, z float64) float64 {
+	c := &q.Coefficients
+	f := c[0]*x*x + c[1]*y*y + c[2]*z*z + c[3]*x*y + c[4]*x*z + c[5]*y*z + c[6]*x + c[7]*y + c[8]*z + c[9]
+	if f >= 0.0 {
+		return 0.0
+	}
+	for _, p := range q.Planes {
+		if p[0]*x+p[1]*y+p[2]*z+p[3] > 0.0 {
+			return 0.0
+		}
+	}
+	return q.Rho
+}
+
+// Matrix and vector of the quadric form p^T M p + g^T p + J
+func (q *Quadric) form() (mgl64.Mat3, mgl64.Vec3) {
+	c := &q.Coefficients
+	M := mgl64.Mat3{
+		c[0], c[3] / 2, c[4] / 2,
+		c[3] / 2, c[1], c[5] / 2,
+		c[4] / 2, c[5] / 2, c[2],
+	}
+	return M, mgl64.Vec3{c[6], c[7], c[8]}
+}
+
+func (q *Quadric) MinFeatureSize() float64 {
+	// characteristic size sqrt(|J|/max quadratic coefficient), exact for spheres
+	c := &q.Coefficients
+	a := math.Max(math.Abs(c[0]), math.Max(math.Abs(c[1]), math.Abs(c[2])))
+	lo, hi := q.BoundingBox()
+	if !math.IsInf(lo[0], 0) {
+		return 0.5 * math.Min(hi[0]-lo[0], math.Min(hi[1]-lo[1], hi[2]-lo[2]))
+	}
+	if a == 0 || c[9] == 0 {
+		return 0.1
+	}
+	return math.Sqrt(math.Abs(c[9]) / a)
+}
+
+func (q *Quadric) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	// bounded only if M is positive definite (ellipsoid): (p-c)^T M (p-c) < k
+	inf := math.Inf(1)
+	M, g := q.form()
+	if !(M.At(0, 0) > 0 && M.Mat2().Det() > 0 && M.Det() > 0) {
+		return mgl64.Vec3{-inf, -inf, -inf}, mgl64.Vec3{inf, inf, inf}
+	}
+	Minv := M.Inv()
+	c := Minv.Mul3x1(g).Mul(-0.5)
+	k := c.Dot(M.Mul3x1(c)) - q.Coefficients[9]
+	if k <= 0 {
+		return c, c
+	}
+	var h mgl64.Vec3
+	for i := 0; i < 3; i++ {
+		h[i] = math.Sqrt(k * Minv.At(i, i))
+	}
+	return c.Sub(h), c.Add(h)
+}
+
+// Objects which can compute the outward unit normal of their surface nearest to a point
+type SurfaceNormaler interface {
+	SurfaceNormal(x, y, z float64) mgl64.Vec3
+}
+
+// Gradient of the density of obj at given point by central differences with step h. For hard-edged
+// objects it is nonzero only within h of the surface, where it points into the object (opposite to the surface normal).
+func Gradient(obj Object, x, y, z, h float64) mgl64.Vec3 {
+	return mgl64.Vec3{
+		(obj.Density(x+h, y, z) - obj.Density(x-h, y, z)) / (2 * h),
+		(obj.Density(x, y+h, z) - obj.Density(x, y-h, z)) / (2 * h),
+		(obj.Density(x, y, z+h) - obj.Density(x, y, z-h)) / (2 * h),
+	}
+}
+
+// Outward unit surface normal of obj near given point. Uses the analytic normal if obj provides one,
+// otherwise the reversed Gradient with step h, which is zero away from the surface.
+func SurfaceNormal(obj Object, x, y, z, h float64) mgl64.Vec3 {
+	if n, ok := obj.(SurfaceNormaler); ok {
+		return n.SurfaceNormal(x, y, z)
+	}
+	g := Gradient(obj, x, y, z, h)
+	if g.Len() == 0 {
+		return g
+	}
+	return g.Normalize().Mul(-1)
+}
+
+// Objects with an emission coefficient, integrated along rays without attenuation into the dark-field channel
+type Emitter interface {
+	EmissionAt(x, y, z float64) float64
+}
+
+// Emission coefficient of obj at given point, 0 if obj does not implement Emitter
+func Emission(obj Object, x, y, z float64) float64 {
+	if e, ok := obj.(Emitter); ok {
+		return e.EmissionAt(x, y, z)
+	}
+	return 0.0
+}
+
+// Return an error if data sets an emission coefficient which obj ignores. Only primitives have their own
+// emission; composites such as collections, lattices and blends emit through their children.
+func CheckEmission(obj Object, data map[string]interface{}) error {
+	if _, ok := data["emission"]; !ok {
+		return nil
+	}
+	switch obj.(type) {
+	case *Sphere, *Cube, *Box, *Cylinder:
+		return nil
+	}
+	return fmt.Errorf("emission is only supported on sphere, cube, box and cylinder objects, not %v", data["type"])
+}
+
+// Hard-edged objects which can compute the signed distance to their surface (negative inside)
+type SignedDistancer interface {
+	SignedDistance(x, y, z float64) float64
+}
+
+// Read the optional emission coefficient from data into emission, leaving it 0 if absent
+func emissionFromMap(data map[string]interface{}, emission *float64) error {
+	*emission = 0
+	if _, ok := data["emission"]; !ok {
+		return nil
+	}
+	var err error
+	if *emission, err = ToFloat64(data["emission"]); err != nil {
+		return fmt.Errorf("emission is not a float64")
+	}
+	return nil
+}
+
 func ToFloat64(data interface{}) (float64, error) {
 	switch t := data.(type) {
 	case int:
@@ -247,33 +688,89 @@ func ToFloat64(data interface{}) (float64, error) {
 }
 
 func ToVec(data *[]interface{}, vec *mgl64.Vec3) error {
+	if len(*data) != 3 {
+		return fmt.Errorf("expected 3 elements, got %d", len(*data))
+	}
 	for i, val := range *data {
 		switch t := val.(type) {
 		case int:
 			vec[i] = float64(t)
 		case float64:
 			vec[i] = t
+		default:
+			return fmt.Errorf("element %d (%v) is not a number", i, val)
 		}
 	}
 	return nil
 }
 
+// Union of two axis-aligned boxes given by their min and max corners
+func BoxUnion(lo1, hi1, lo2, hi2 mgl64.Vec3) (mgl64.Vec3, mgl64.Vec3) {
+	for k := 0; k < 3; k++ {
+		lo1[k] = math.Min(lo1[k], lo2[k])
+		hi1[k] = math.Max(hi1[k], hi2[k])
+	}
+	return lo1, hi1
+}
+
+// Objects which can provide a tighter bounding sphere than their bounding box
+type BoundingSpherer interface {
+	BoundingSphere() (mgl64.Vec3, float64) // center and radius
+}
+
+// Radius of a sphere centered at the origin which contains obj.
+// Uses the bounding sphere if obj provides one, otherwise the bounding box.
+func BoundingRadius(obj Object) float64 {
+	if bs, ok := obj.(BoundingSpherer); ok {
+		c, r := bs.BoundingSphere()
+		return c.Len() + r
+	}
+	lo, hi := obj.BoundingBox()
+	var r2 float64
+	for k := 0; k < 3; k++ {
+		m := math.Max(math.Abs(lo[k]), math.Abs(hi[k]))
+		r2 += m * m
+	}
+	return math.Sqrt(r2)
+}
+
+// Monte Carlo estimate of the mass (integral of density) of obj within the box [lo, hi] and of
+// the fraction of the box volume where density is nonzero, from n uniformly distributed samples.
+func EstimateMass(obj Object, lo, hi mgl64.Vec3, n int, rng *rand.Rand) (float64, float64) {
+	ext := hi.Sub(lo)
+	sum := 0.0
+	nonzero := 0
+	for i := 0; i < n; i++ {
+		rho := obj.Density(lo[0]+rng.Float64()*ext[0], lo[1]+rng.Float64()*ext[1], lo[2]+rng.Float64()*ext[2])
+		sum += rho
+		if rho != 0 {
+			nonzero++
+		}
+	}
+	return sum / float64(n) * ext[0] * ext[1] * ext[2], float64(nonzero) / float64(n)
+}
+
 type Cylinder struct {
 	Object
 	// cylinder is a line segment with thickness
-	P0, P1 mgl64.Vec3
-	Radius float64
-	Rho    float64
+	P0, P1   mgl64.Vec3
+	Radius   float64
+	Rho      float64
+	Emission float64 // optional dark-field emission coefficient, see Emitter
 }
 
 func (c *Cylinder) ToMap() map[string]interface{} {
-	return map[string]interface{}{
+	data := map[string]interface{}{
 		"type":   "cylinder",
 		"p0":     c.P0,
 		"p1":     c.P1,
 		"radius": c.Radius,
 		"rho":    c.Rho,
 	}
+	if c.Emission != 0 {
+		data["emission"] = c.Emission
+	}
+	return data
 }
 
 func (c *Cylinder) FromMap(data map[string]interface{}) error {
@@ -284,14 +781,14 @@ func (c *Cylinder) FromMap(data map[string]interface{}) error {
 	}
 	err := ToVec(&slice, &c.P0)
 	if err != nil {
-		return err
+		return fmt.Errorf("p0: %v", err)
 	}
 	if slice, ok = data["p1"].([]interface{}); !ok {
-		return fmt.Errorf("p0 is not a Vec3")
+		return fmt.Errorf("p1 is not a Vec3")
 	}
 	err = ToVec(&slice, &c.P1)
 	if err != nil {
-		return err
+		return fmt.Errorf("p1: %v", err)
 	}
 	if c.Radius, ok = data["radius"].(float64); !ok {
 		return fmt.Errorf("radius is not a float64")
@@ -299,136 +796,347 @@ func (c *Cylinder) FromMap(data map[string]interface{}) error {
 	if c.Rho, err = ToFloat64(data["rho"]); err != nil {
 		return fmt.Errorf("rho is not a float64")
 	}
-	return nil
+	return emissionFromMap(data, &c.Emission)
 }
 
 func (cyl *Cylinder) Density(x, y, z float64) float64 {
+	return cyl.fill(x, y, z, cyl.Rho)
+}
+
+func (cyl *Cylinder) EmissionAt(x, y, z float64) float64 {
+	return cyl.fill(x, y, z, cyl.Emission)
+}
+
+// Value inside the cylinder, with BoundarySoftness applied
+func (cyl *Cylinder) fill(x, y, z, value float64) float64 {
 	// get the vector from the point to the line
 	v := cyl.P1.Sub(cyl.P0)
 	w := mgl64.Vec3{x, y, z}.Sub(cyl.P0)
 	// get the projection of w onto v
 	c := w.Dot(v) / v.Dot(v)
+	if BoundarySoftness > 0.0 {
+		// signed distances to the mantle and to the end caps, combined as for a 2D box
+		d := w.Sub(v.Mul(c)).Len()
+		L := v.Len()
+		return softDensity(boxDistance(mgl64.Vec3{d, (c - 0.5) * L, 0}, mgl64.Vec3{cyl.Radius, 0.5 * L, math.Inf(1)}), value)
+	}
 	if c < 0.0 || c > 1.0 { // point is definitely not on the line
 		return 0.0
 	}
 	// get the distance from the point to the line
 	d := w.Sub(v.Mul(c)).Len()
 	if d < cyl.Radius {
-		return cyl.Rho
+		return value
 	} else {
 		return 0.0
 	}
 }
 
+func (cyl *Cylinder) SignedDistance(x, y, z float64) float64 {
+	v := cyl.P1.Sub(cyl.P0)
+	w := mgl64.Vec3{x, y, z}.Sub(cyl.P0)
+	c := w.Dot(v) / v.Dot(v)
+	d := w.Sub(v.Mul(c)).Len()
+	L := v.Len()
+	return boxDistance(mgl64.Vec3{d, (c - 0.5) * L, 0}, mgl64.Vec3{cyl.Radius, 0.5 * L, math.Inf(1)})
+}
+
 func (cyl *Cylinder) MinFeatureSize() float64 {
 	return cyl.Radius
 }
 
+func (cyl *Cylinder) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	// conservative box around both end caps
+	rad := cyl.Radius + 0.5*BoundarySoftness
+	r := mgl64.Vec3{rad, rad, rad}
+	lo, hi := BoxUnion(cyl.P0, cyl.P0, cyl.P1, cyl.P1)
+	return lo.Sub(r), hi.Add(r)
+}
+
 type ObjectCollection struct {
 	Object
 	Objects        []Object
 	GreedyDensEval bool
+	// how densities of the objects are combined: sum (default), greedy (first nonzero) or max.
+	// Empty means greedy if GreedyDensEval is set, otherwise sum
+	Reduce string
+	// optional deformation of each object, applied to the query point before evaluating it.
+	// Either nil or of the same length as Objects with nil entries for undeformed objects
+	Deformations []deformations.Deformation
+	// optional density scale of each object. Either nil or of the same length as Objects
+	DensityScales []float64
+}
+
+// Create empty object collection. Objects can be added with Add.
+func NewCollection() *ObjectCollection {
+	return &ObjectCollection{Objects: []Object{}}
+}
+
+// Add object to the collection. Returns the collection so that calls can be chained.
+func (oc *ObjectCollection) Add(obj Object) *ObjectCollection {
+	oc.Objects = append(oc.Objects, obj)
+	return oc
 }
 
 func (oc *ObjectCollection) ToMap() map[string]interface{} {
 	var objects = make([]map[string]interface{}, len(oc.Objects))
 	for i, object := range oc.Objects {
 		objects[i] = object.ToMap()
+		if d := oc.deformation(i); d != nil {
+			objects[i]["deformation"] = d.ToMap()
+		}
+		if scale := oc.densityScale(i); scale != 1.0 {
+			objects[i]["density_scale"] = scale
+		}
 	}
-	return map[string]interface{}{
+	out := map[string]interface{}{
 		"type":    "object_collection",
 		"objects": objects,
 	}
+	if oc.Reduce != "" {
+		out["reduce"] = oc.Reduce
+	}
+	if oc.GreedyDensEval {
+		out["greedy_dens_eval"] = true
+	}
+	return out
 }
 
 func (oc *ObjectCollection) FromMap(data map[string]interface{}) error {
 	var objects []Object
+	var object_deformations []deformations.Deformation
+	var density_scales []float64
+	factory := &deformations.DeformationFactory{}
 	if objects_data, ok := data["objects"].([]interface{}); ok {
 		objects = make([]Object, len(objects_data))
 		for i, object_data := range objects_data {
-			switch object_data.(map[string]interface{})["type"] {
-			case "sphere":
-				object := Sphere{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
-				}
-				objects[i] = &object
-			case "cube":
-				object := Cube{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
-				}
-				objects[i] = &object
-			case "box":
-				object := Box{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
+			object_map, ok := object_data.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("object %d is not a map", i)
+			}
+			object, err := NewObject(object_map)
+			if err != nil {
+				return err
+			}
+			objects[i] = object
+			if deformation_data, ok := object_map["deformation"].(map[string]interface{}); ok {
+				d, err := factory.Create(deformation_data)
+				if err != nil {
+					return fmt.Errorf("object %d deformation: %v", i, err)
 				}
-				objects[i] = &object
-			case "cylinder":
-				object := Cylinder{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
+				if object_deformations == nil {
+					object_deformations = make([]deformations.Deformation, len(objects_data))
 				}
-				objects[i] = &object
-			case "parallelepiped":
-				object := Parallelepiped{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
+				object_deformations[i] = d
+			}
+			if scale_data, ok := object_map["density_scale"]; ok {
+				scale, err := ToFloat64(scale_data)
+				if err != nil {
+					return fmt.Errorf("object %d density_scale is not a float64", i)
 				}
-				objects[i] = &object
-			case "tessellated_obj_coll":
-				object := TessellatedObjColl{}
-				if err := object.FromMap(object_data.(map[string]interface{})); err != nil {
-					return err
+				if density_scales == nil {
+					density_scales = make([]float64, len(objects_data))
+					for k := range density_scales {
+						density_scales[k] = 1.0
+					}
 				}
-				objects[i] = &object
-			default:
-				return fmt.Errorf("unknown object type")
+				density_scales[i] = scale
 			}
 		}
 	} else {
 		return fmt.Errorf("objects is not a list")
 	}
 	oc.Objects = objects
+	oc.Deformations = object_deformations
+	oc.DensityScales = density_scales
+	oc.GreedyDensEval = false
+	if greedy, ok := data["greedy_dens_eval"]; ok {
+		if oc.GreedyDensEval, ok = greedy.(bool); !ok {
+			return fmt.Errorf("greedy_dens_eval is not a bool")
+		}
+	}
+	oc.Reduce = ""
+	if reduce, ok := data["reduce"]; ok {
+		switch reduce {
+		case "sum", "greedy", "max":
+			oc.Reduce = reduce.(string)
+		default:
+			return fmt.Errorf("reduce must be one of sum, greedy or max, got %v", reduce)
+		}
+	}
 	return nil
 }
 
-func (oc *ObjectCollection) Density(x, y, z float64) float64 {
-	var density float64
-	for _, object := range oc.Objects {
-		rho := object.Density(x, y, z)
-		if oc.GreedyDensEval && rho > 0.0 {
-			return rho
-		}
-		density += rho
+// Reduction mode of the collection
+func (oc *ObjectCollection) reduce() string {
+	if oc.Reduce == "" && oc.GreedyDensEval {
+		return "greedy"
 	}
-	// clip between 0 and 1
-	if density < 0.0 {
-		density = 0.0
-	} else if density > 1.0 {
-		density = 1.0
+	return oc.Reduce
+}
+
+// Density scale of i-th object, 1 if not set
+func (oc *ObjectCollection) densityScale(i int) float64 {
+	if i < len(oc.DensityScales) {
+		return oc.DensityScales[i]
 	}
-	return density
+	return 1.0
 }
 
-func (oc *ObjectCollection) MinFeatureSize() float64 {
-	out := math.Inf(1)
-	for _, object := range oc.Objects {
-		out = math.Min(out, object.MinFeatureSize())
+// Deformation of i-th object or nil if it is not deformed
+func (oc *ObjectCollection) deformation(i int) deformations.Deformation {
+	if i < len(oc.Deformations) {
+		return oc.Deformations[i]
 	}
-	return out
+	return nil
 }
 
-type UnitCell struct {
-	// object collection. But overload density method and provide bounds
-	Struts                             ObjectCollection
-	Xmin, Xmax, Ymin, Ymax, Zmin, Zmax float64
+// Constructors of empty objects by type name, see RegisterObject
+var registry = map[string]func() Object{
+	"sphere":               func() Object { return &Sphere{} },
+	"cube":                 func() Object { return &Cube{} },
+	"box":                  func() Object { return &Box{} },
+	"cylinder":             func() Object { return &Cylinder{} },
+	"parallelepiped":       func() Object { return &Parallelepiped{} },
+	"quadric":              func() Object { return &Quadric{} },
+	"radial_profile":       func() Object { return &RadialProfile{} },
+	"tessellated_obj_coll": func() Object { return &TessellatedObjColl{} },
+	"lattice_repeat":       func() Object { return &LatticeRepeat{} },
+	"menger":               func() Object { return &Menger{} },
+	"instanced":            func() Object { return &Instanced{} },
+	"sphere_cloud":         func() Object { return &SphereCloud{} },
+	"label_voxel_grid":     func() Object { return &LabelVoxelGrid{} },
+	"blend":                func() Object { return &Blend{} },
+	"grf":                  func() Object { return &GaussianRandomField{} },
+	"offset":               func() Object { return &Offset{} },
+	"object_collection":    func() Object { return &ObjectCollection{} },
 }
+var registryMu sync.RWMutex
 
-func (uc *UnitCell) Density(x, y, z float64) float64 {
-	// check if point is within bounds. But account for struts a bit smaller
-	if x < uc.Xmin || x > uc.Xmax || y < uc.Ymin || y > uc.Ymax || z < uc.Zmin || z > uc.Zmax {
+// Register constructor of empty objects of type typeName, replacing any previous constructor for it.
+// Registered types can be built by NewObject and nested in collections and other composite objects.
+func RegisterObject(typeName string, constructor func() Object) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[typeName] = constructor
+}
+
+// Sorted names of the registered object types
+func ObjectTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Construct empty object of type typeName
+func NewObjectOfType(typeName string) (Object, error) {
+	registryMu.RLock()
+	constructor, ok := registry[typeName]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown object type '%s'", typeName)
+	}
+	return constructor(), nil
+}
+
+// Construct object of the type given in data["type"] and populate it from data
+func NewObject(data map[string]interface{}) (Object, error) {
+	typeName, _ := data["type"].(string)
+	object, err := NewObjectOfType(typeName)
+	if err != nil {
+		return nil, err
+	}
+	if err := object.FromMap(data); err != nil {
+		return nil, err
+	}
+	if err := CheckEmission(object, data); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+func (oc *ObjectCollection) Density(x, y, z float64) float64 {
+	var density float64
+	mode := oc.reduce()
+	for i, object := range oc.Objects {
+		var rho float64
+		if d := oc.deformation(i); d != nil {
+			rho = object.Density(d.Apply(x, y, z))
+		} else {
+			rho = object.Density(x, y, z)
+		}
+		rho *= oc.densityScale(i)
+		switch mode {
+		case "greedy":
+			if rho > 0.0 {
+				return rho
+			}
+		case "max":
+			if i == 0 || rho > density {
+				density = rho
+			}
+		default:
+			density += rho
+		}
+	}
+	// clip between 0 and 1
+	if density < 0.0 {
+		density = 0.0
+	} else if density > 1.0 {
+		density = 1.0
+	}
+	return density
+}
+
+// Sum of the emission of the objects, independent of Reduce and the density scales
+func (oc *ObjectCollection) EmissionAt(x, y, z float64) float64 {
+	var emission float64
+	for i, object := range oc.Objects {
+		px, py, pz := x, y, z
+		if d := oc.deformation(i); d != nil {
+			px, py, pz = d.Apply(x, y, z)
+		}
+		emission += Emission(object, px, py, pz)
+	}
+	return emission
+}
+
+func (oc *ObjectCollection) MinFeatureSize() float64 {
+	out := math.Inf(1)
+	for _, object := range oc.Objects {
+		out = math.Min(out, object.MinFeatureSize())
+	}
+	return out
+}
+
+func (oc *ObjectCollection) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	inf := math.Inf(1)
+	lo, hi := mgl64.Vec3{inf, inf, inf}, mgl64.Vec3{-inf, -inf, -inf}
+	for i, object := range oc.Objects {
+		if oc.deformation(i) != nil {
+			// extent of deformed object is not known
+			return mgl64.Vec3{-inf, -inf, -inf}, mgl64.Vec3{inf, inf, inf}
+		}
+		olo, ohi := object.BoundingBox()
+		lo, hi = BoxUnion(lo, hi, olo, ohi)
+	}
+	return lo, hi
+}
+
+type UnitCell struct {
+	// object collection. But overload density method and provide bounds
+	Struts                             ObjectCollection
+	Xmin, Xmax, Ymin, Ymax, Zmin, Zmax float64
+}
+
+func (uc *UnitCell) Density(x, y, z float64) float64 {
+	// check if point is within bounds. But account for struts a bit smaller
+	if x < uc.Xmin || x > uc.Xmax || y < uc.Ymin || y > uc.Ymax || z < uc.Zmin || z > uc.Zmax {
 		return 0.0
 	}
 	return uc.Struts.Density(x, y, z)
@@ -436,14 +1144,15 @@ func (uc *UnitCell) Density(x, y, z float64) float64 {
 
 func (uc *UnitCell) ToMap() map[string]interface{} {
 	return map[string]interface{}{
-		"type":   "unit_cell",
-		"struts": uc.Struts.ToMap(),
-		"xmin":   uc.Xmin,
-		"xmax":   uc.Xmax,
-		"ymin":   uc.Ymin,
-		"ymax":   uc.Ymax,
-		"zmin":   uc.Zmin,
-		"zmax":   uc.Zmax,
+		"type":             "unit_cell",
+		"struts":           uc.Struts.ToMap(),
+		"greedy_dens_eval": uc.Struts.GreedyDensEval,
+		"xmin":             uc.Xmin,
+		"xmax":             uc.Xmax,
+		"ymin":             uc.Ymin,
+		"ymax":             uc.Ymax,
+		"zmin":             uc.Zmin,
+		"zmax":             uc.Zmax,
 	}
 }
 
@@ -455,10 +1164,18 @@ func (uc *UnitCell) FromMap(data map[string]interface{}) error {
 			return err
 		}
 		uc.Struts = struts
-		uc.Struts.GreedyDensEval = true
+		// struts are greedy unless greedy_dens_eval is given for the unit cell or its struts
+		if _, ok := struts_data["greedy_dens_eval"]; !ok {
+			uc.Struts.GreedyDensEval = true
+		}
 	} else {
 		return fmt.Errorf("struts is not a map")
 	}
+	if greedy, ok := data["greedy_dens_eval"]; ok {
+		if uc.Struts.GreedyDensEval, ok = greedy.(bool); !ok {
+			return fmt.Errorf("greedy_dens_eval is not a bool")
+		}
+	}
 	if uc.Xmin, err = ToFloat64(data["xmin"]); err != nil {
 		return fmt.Errorf("xmin is not a float64")
 	}
@@ -552,48 +1269,1143 @@ func (l *TessellatedObjColl) MinFeatureSize() float64 {
 	return l.UC.Struts.MinFeatureSize()
 }
 
-func MakeKelvin(rad float64, scale float64) UnitCell {
+func (l *TessellatedObjColl) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	return mgl64.Vec3{l.Xmin, l.Ymin, l.Zmin}, mgl64.Vec3{l.Xmax, l.Ymax, l.Zmax}
+}
+
+// Menger sponge fractal in a cube of side Scale centred at Center.
+// Each iteration splits every remaining cube into 27 subcubes and removes the central one and the 6 face centres.
+type Menger struct {
+	Object
+	Center     mgl64.Vec3
+	Scale      float64
+	Iterations int
+	Rho        float64
+}
+
+func (mg *Menger) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "menger",
+		"center":     mg.Center,
+		"scale":      mg.Scale,
+		"iterations": mg.Iterations,
+		"rho":        mg.Rho,
+	}
+}
+
+func (mg *Menger) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var slice []interface{}
+	if slice, ok = data["center"].([]interface{}); !ok {
+		return fmt.Errorf("center is not a Vec3")
+	}
+	err := ToVec(&slice, &mg.Center)
+	if err != nil {
+		return fmt.Errorf("center: %v", err)
+	}
+	if mg.Scale, err = ToFloat64(data["scale"]); err != nil {
+		return fmt.Errorf("scale is not a float64")
+	}
+	iterations, err := ToFloat64(data["iterations"])
+	if err != nil || iterations < 0 || iterations != math.Trunc(iterations) {
+		return fmt.Errorf("iterations is not a non-negative integer")
+	}
+	mg.Iterations = int(iterations)
+	if mg.Rho, err = ToFloat64(data["rho"]); err != nil {
+		return fmt.Errorf("rho is not a float64")
+	}
+	return nil
+}
+
+func (mg *Menger) Density(x, y, z float64) float64 {
+	// coordinates within the unit cube
+	u := mgl64.Vec3{x, y, z}.Sub(mg.Center).Mul(1 / mg.Scale).Add(mgl64.Vec3{0.5, 0.5, 0.5})
+	if u[0] < 0 || u[0] >= 1 || u[1] < 0 || u[1] >= 1 || u[2] < 0 || u[2] >= 1 {
+		return 0.0
+	}
+	for k := 0; k < mg.Iterations; k++ {
+		// fold into subcube and count axes along which it is the middle one
+		middle := 0
+		for a := 0; a < 3; a++ {
+			u[a] *= 3
+			digit := math.Floor(u[a])
+			if digit == 1 {
+				middle++
+			}
+			u[a] -= digit
+		}
+		if middle >= 2 {
+			return 0.0
+		}
+	}
+	return mg.Rho
+}
+
+func (mg *Menger) MinFeatureSize() float64 {
+	return mg.Scale / math.Pow(3, float64(mg.Iterations))
+}
+
+func (mg *Menger) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	h := mgl64.Vec3{1, 1, 1}.Mul(0.5 * mg.Scale)
+	return mg.Center.Sub(h), mg.Center.Add(h)
+}
+
+// LatticeRepeat repeats a child object on a general lattice with basis vectors A1, A2, A3.
+// The child is defined in the fundamental cell Origin + u*A1 + v*A2 + w*A3 with u, v, w in [0, 1)
+// and is repeated for integer cell indices within the inclusive ranges [Min[k], Max[k]].
+type LatticeRepeat struct {
+	Object
+	Child      Object
+	Origin     mgl64.Vec3
+	A1, A2, A3 mgl64.Vec3
+	Min, Max   [3]int
+	mat        mgl64.Mat3 // inverse of basis matrix
+}
+
+func NewLatticeRepeat(child Object, origin, a1, a2, a3 mgl64.Vec3, min, max [3]int) *LatticeRepeat {
+	return &LatticeRepeat{
+		Child: child, Origin: origin, A1: a1, A2: a2, A3: a3, Min: min, Max: max,
+		mat: mgl64.Mat3FromCols(a1, a2, a3).Inv(),
+	}
+}
+
+func (l *LatticeRepeat) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":   "lattice_repeat",
+		"object": l.Child.ToMap(),
+		"origin": l.Origin,
+		"a1":     l.A1,
+		"a2":     l.A2,
+		"a3":     l.A3,
+		"n1":     []int{l.Min[0], l.Max[0]},
+		"n2":     []int{l.Min[1], l.Max[1]},
+		"n3":     []int{l.Min[2], l.Max[2]},
+	}
+}
+
+func (l *LatticeRepeat) FromMap(data map[string]interface{}) error {
+	child_data, ok := data["object"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("object is not a map")
+	}
+	child, err := NewObject(child_data)
+	if err != nil {
+		return fmt.Errorf("object: %v", err)
+	}
+	l.Child = child
+	l.Origin = mgl64.Vec3{}
+	if slice, ok := data["origin"].([]interface{}); ok {
+		if err := ToVec(&slice, &l.Origin); err != nil {
+			return fmt.Errorf("origin: %v", err)
+		}
+	}
+	for k, key := range []string{"a1", "a2", "a3"} {
+		slice, ok := data[key].([]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a Vec3", key)
+		}
+		v := []*mgl64.Vec3{&l.A1, &l.A2, &l.A3}[k]
+		if err := ToVec(&slice, v); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	for k, key := range []string{"n1", "n2", "n3"} {
+		slice, ok := data[key].([]interface{})
+		if !ok || len(slice) != 2 {
+			return fmt.Errorf("%s is not a range [min, max]", key)
+		}
+		for e, bound := range []*int{&l.Min[k], &l.Max[k]} {
+			f, err := ToFloat64(slice[e])
+			if err != nil || f != math.Trunc(f) {
+				return fmt.Errorf("%s: element %d (%v) is not an integer", key, e, slice[e])
+			}
+			*bound = int(f)
+		}
+		if l.Min[k] > l.Max[k] {
+			return fmt.Errorf("%s: min %d is greater than max %d", key, l.Min[k], l.Max[k])
+		}
+	}
+	basis := mgl64.Mat3FromCols(l.A1, l.A2, l.A3)
+	if degenerateBasis(basis) {
+		return fmt.Errorf("lattice vectors are linearly dependent")
+	}
+	l.mat = basis.Inv()
+	return nil
+}
+
+// Map the point to the fundamental cell, false if it lies outside the repeated cells
+func (l *LatticeRepeat) cellPoint(x, y, z float64) (mgl64.Vec3, bool) {
+	// cell indices from lattice coordinates of the point
+	pt := mgl64.Vec3{x, y, z}
+	u := l.mat.Mul3x1(pt.Sub(l.Origin))
+	n := mgl64.Vec3{math.Floor(u[0]), math.Floor(u[1]), math.Floor(u[2])}
+	for k := 0; k < 3; k++ {
+		if n[k] < float64(l.Min[k]) || n[k] > float64(l.Max[k]) {
+			return pt, false
+		}
+	}
+	return pt.Sub(l.A1.Mul(n[0])).Sub(l.A2.Mul(n[1])).Sub(l.A3.Mul(n[2])), true
+}
+
+func (l *LatticeRepeat) Density(x, y, z float64) float64 {
+	pt, ok := l.cellPoint(x, y, z)
+	if !ok {
+		return 0.0
+	}
+	return l.Child.Density(pt[0], pt[1], pt[2])
+}
+
+func (l *LatticeRepeat) EmissionAt(x, y, z float64) float64 {
+	pt, ok := l.cellPoint(x, y, z)
+	if !ok {
+		return 0.0
+	}
+	return Emission(l.Child, pt[0], pt[1], pt[2])
+}
+
+func (l *LatticeRepeat) MinFeatureSize() float64 {
+	return l.Child.MinFeatureSize()
+}
+
+func (l *LatticeRepeat) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	// union of the fundamental cell (clipped child) translated to the corner cells
+	clo, chi := l.Child.BoundingBox()
+	plo, phi := (&Parallelepiped{Origin: l.Origin, V1: l.A1, V2: l.A2, V3: l.A3}).BoundingBox()
+	for k := 0; k < 3; k++ {
+		clo[k], chi[k] = math.Max(clo[k], plo[k]), math.Min(chi[k], phi[k])
+	}
+	inf := math.Inf(1)
+	lo, hi := mgl64.Vec3{inf, inf, inf}, mgl64.Vec3{-inf, -inf, -inf}
+	for _, n1 := range []int{l.Min[0], l.Max[0]} {
+		for _, n2 := range []int{l.Min[1], l.Max[1]} {
+			for _, n3 := range []int{l.Min[2], l.Max[2]} {
+				t := l.A1.Mul(float64(n1)).Add(l.A2.Mul(float64(n2))).Add(l.A3.Mul(float64(n3)))
+				lo, hi = BoxUnion(lo, hi, clo.Add(t), chi.Add(t))
+			}
+		}
+	}
+	return lo, hi
+}
+
+// Rigid transform of an instance: rotation by Angle (radians) about Axis followed by Translation
+type Instance struct {
+	Translation mgl64.Vec3
+	Axis        mgl64.Vec3
+	Angle       float64
+}
+
+func (in Instance) rotation() mgl64.Mat3 {
+	if in.Angle == 0 {
+		return mgl64.Ident3()
+	}
+	return mgl64.QuatRotate(in.Angle, in.Axis.Normalize()).Mat4().Mat3()
+}
+
+// Instanced places copies of a single child geometry at a list of rigid transforms.
+// Density is evaluated by mapping the query point into the local frame of each instance
+// and combining the results with Reduce: greedy (first nonzero) or max (default).
+type Instanced struct {
+	Object
+	Child     Object
+	Instances []Instance
+	Reduce    string
+	rot       []mgl64.Mat3 // rotation matrix of each instance
+}
+
+func NewInstanced(child Object, instances []Instance) *Instanced {
+	in := &Instanced{Child: child, Instances: instances}
+	in.init()
+	return in
+}
+
+func (in *Instanced) init() {
+	in.rot = make([]mgl64.Mat3, len(in.Instances))
+	for i, inst := range in.Instances {
+		in.rot[i] = inst.rotation()
+	}
+}
+
+func (in *Instanced) ToMap() map[string]interface{} {
+	instances := make([]map[string]interface{}, len(in.Instances))
+	for i, inst := range in.Instances {
+		instances[i] = map[string]interface{}{
+			"translation": inst.Translation,
+			"axis":        inst.Axis,
+			"angle":       inst.Angle,
+		}
+	}
+	out := map[string]interface{}{
+		"type":      "instanced",
+		"object":    in.Child.ToMap(),
+		"instances": instances,
+	}
+	if in.Reduce != "" {
+		out["reduce"] = in.Reduce
+	}
+	return out
+}
+
+func (in *Instanced) FromMap(data map[string]interface{}) error {
+	child_data, ok := data["object"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("object is not a map")
+	}
+	child, err := NewObject(child_data)
+	if err != nil {
+		return fmt.Errorf("object: %v", err)
+	}
+	in.Child = child
+	instances_data, ok := data["instances"].([]interface{})
+	if !ok {
+		return fmt.Errorf("instances is not a list")
+	}
+	in.Instances = make([]Instance, len(instances_data))
+	for i, instance_data := range instances_data {
+		instance_map, ok := instance_data.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("instance %d is not a map", i)
+		}
+		inst := Instance{Axis: mgl64.Vec3{0, 0, 1}}
+		if slice, ok := instance_map["translation"].([]interface{}); ok {
+			if err := ToVec(&slice, &inst.Translation); err != nil {
+				return fmt.Errorf("instance %d translation: %v", i, err)
+			}
+		}
+		if slice, ok := instance_map["axis"].([]interface{}); ok {
+			if err := ToVec(&slice, &inst.Axis); err != nil {
+				return fmt.Errorf("instance %d axis: %v", i, err)
+			}
+			if inst.Axis.Len() == 0 {
+				return fmt.Errorf("instance %d axis must be non-zero", i)
+			}
+		}
+		if angle_data, ok := instance_map["angle"]; ok {
+			if inst.Angle, err = ToFloat64(angle_data); err != nil {
+				return fmt.Errorf("instance %d angle is not a float64", i)
+			}
+		}
+		in.Instances[i] = inst
+	}
+	in.Reduce = ""
+	if reduce, ok := data["reduce"]; ok {
+		switch reduce {
+		case "greedy", "max":
+			in.Reduce = reduce.(string)
+		default:
+			return fmt.Errorf("reduce must be one of greedy or max, got %v", reduce)
+		}
+	}
+	in.init()
+	return nil
+}
+
+func (in *Instanced) Density(x, y, z float64) float64 {
+	pt := mgl64.Vec3{x, y, z}
+	density := 0.0
+	for i, inst := range in.Instances {
+		// inverse of rotation is its transpose
+		local := in.rot[i].Transpose().Mul3x1(pt.Sub(inst.Translation))
+		rho := in.Child.Density(local[0], local[1], local[2])
+		if in.Reduce == "greedy" && rho > 0.0 {
+			return rho
+		}
+		density = math.Max(density, rho)
+	}
+	return density
+}
+
+// Emission of the first occupied instance if greedy, else the largest over the instances
+func (in *Instanced) EmissionAt(x, y, z float64) float64 {
+	pt := mgl64.Vec3{x, y, z}
+	emission := 0.0
+	for i, inst := range in.Instances {
+		local := in.rot[i].Transpose().Mul3x1(pt.Sub(inst.Translation))
+		e := Emission(in.Child, local[0], local[1], local[2])
+		if in.Reduce == "greedy" && in.Child.Density(local[0], local[1], local[2]) > 0.0 {
+			return e
+		}
+		emission = math.Max(emission, e)
+	}
+	return emission
+}
+
+func (in *Instanced) MinFeatureSize() float64 {
+	return in.Child.MinFeatureSize()
+}
+
+func (in *Instanced) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	// union of the transformed corners of the child box
+	clo, chi := in.Child.BoundingBox()
+	inf := math.Inf(1)
+	lo, hi := mgl64.Vec3{inf, inf, inf}, mgl64.Vec3{-inf, -inf, -inf}
+	for i, inst := range in.Instances {
+		for c := 0; c < 8; c++ {
+			corner := clo
+			for k := 0; k < 3; k++ {
+				if c&(1<<k) != 0 {
+					corner[k] = chi[k]
+				}
+			}
+			p := in.rot[i].Mul3x1(corner).Add(inst.Translation)
+			lo, hi = BoxUnion(lo, hi, p, p)
+		}
+	}
+	return lo, hi
+}
+
+// SphereCloud is the union of many spheres of density Rho, e.g. particles from a simulation.
+// Spheres are read from Path (relative to DataDir), a packed little-endian float32 array of [x, y, z, r] records,
+// and binned into a uniform grid so that Density only tests the spheres overlapping the query cell.
+// Edges are hard, BoundarySoftness is not applied.
+type SphereCloud struct {
+	Object
+	Path    string
+	Rho     float64
+	Centers []mgl64.Vec3
+	Radii   []float64
+	// optional memoization of density, see EnableCache
+	cache *densityCache
+	// grid of cells of side h starting at lo. Spheres overlapping cell c are items[start[c]:start[c+1]]
+	lo, hi mgl64.Vec3
+	h      float64
+	dims   [3]int
+	start  []int32
+	items  []int32
+}
+
+func NewSphereCloud(centers []mgl64.Vec3, radii []float64, rho float64) *SphereCloud {
+	sc := &SphereCloud{Centers: centers, Radii: radii, Rho: rho}
+	sc.buildGrid()
+	return sc
+}
+
+func (sc *SphereCloud) ToMap() map[string]interface{} {
+	data := map[string]interface{}{
+		"type": "sphere_cloud",
+		"path": sc.Path,
+		"rho":  sc.Rho,
+	}
+	if sc.cache != nil {
+		data["cache"] = true
+		data["cache_resolution"] = sc.cache.resolution
+	}
+	return data
+}
+
+// Memoize density at points snapped to a lattice of spacing resolution. Non-positive resolution
+// uses a tenth of the smallest radius. Trades memory for speed when nearby points are queried repeatedly.
+func (sc *SphereCloud) EnableCache(resolution float64) {
+	if resolution <= 0 {
+		resolution = sc.MinFeatureSize() / 10
+	}
+	sc.cache = newDensityCache(resolution)
+}
+
+func (sc *SphereCloud) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var err error
+	if sc.Path, ok = data["path"].(string); !ok {
+		return fmt.Errorf("path is not a string")
+	}
+	if sc.Rho, err = ToFloat64(data["rho"]); err != nil {
+		return fmt.Errorf("rho is not a float64")
+	}
+	if sc.Path, err = resolveDataPath(sc.Path); err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	raw, err := os.ReadFile(sc.Path)
+	if err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	if len(raw)%16 != 0 {
+		return fmt.Errorf("%s: size %d is not a multiple of 16 bytes ([x, y, z, r] float32 records)", sc.Path, len(raw))
+	}
+	n := len(raw) / 16
+	sc.Centers = make([]mgl64.Vec3, n)
+	sc.Radii = make([]float64, n)
+	for i := 0; i < n; i++ {
+		var rec [4]float64
+		for k := range rec {
+			rec[k] = float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[16*i+4*k:])))
+		}
+		if rec[3] < 0 || math.IsNaN(rec[3]) {
+			return fmt.Errorf("%s: sphere %d has invalid radius %v", sc.Path, i, rec[3])
+		}
+		sc.Centers[i] = mgl64.Vec3{rec[0], rec[1], rec[2]}
+		sc.Radii[i] = rec[3]
+	}
+	sc.buildGrid()
+	sc.cache = nil
+	if cache, ok := data["cache"].(bool); ok && cache {
+		resolution := 0.0
+		if _, ok := data["cache_resolution"]; ok {
+			if resolution, err = ToFloat64(data["cache_resolution"]); err != nil || resolution <= 0 {
+				return fmt.Errorf("cache_resolution is not a positive float64")
+			}
+		}
+		sc.EnableCache(resolution)
+	}
+	return nil
+}
+
+// Bin spheres into the uniform grid. Cell side is the larger of the mean sphere diameter
+// and the side giving about one sphere per cell over the bounding box.
+func (sc *SphereCloud) buildGrid() {
+	n := len(sc.Centers)
+	sc.start = []int32{0}
+	sc.items = nil
+	inf := math.Inf(1)
+	sc.lo, sc.hi = mgl64.Vec3{inf, inf, inf}, mgl64.Vec3{-inf, -inf, -inf}
+	if n == 0 {
+		sc.dims = [3]int{0, 0, 0}
+		return
+	}
+	mean_r := 0.0
+	for i, c := range sc.Centers {
+		r := mgl64.Vec3{sc.Radii[i], sc.Radii[i], sc.Radii[i]}
+		sc.lo, sc.hi = BoxUnion(sc.lo, sc.hi, c.Sub(r), c.Add(r))
+		mean_r += sc.Radii[i] / float64(n)
+	}
+	ext := sc.hi.Sub(sc.lo)
+	sc.h = math.Max(2*mean_r, math.Cbrt(ext[0]*ext[1]*ext[2]/float64(n)))
+	if sc.h == 0 {
+		sc.h = math.Max(ext[0], math.Max(ext[1], math.Max(ext[2], 1.0)))
+	}
+	// a flat or elongated cloud of small spheres has near-zero volume, coarsen to at most 8 cells per sphere
+	for (ext[0]/sc.h+1)*(ext[1]/sc.h+1)*(ext[2]/sc.h+1) > 8*float64(n)+8 {
+		sc.h *= 2
+	}
+	for k := 0; k < 3; k++ {
+		sc.dims[k] = int(ext[k]/sc.h) + 1
+	}
+	// cell index ranges covered by bounding box of sphere i
+	cellRange := func(i int) ([3]int, [3]int) {
+		var a, b [3]int
+		for k := 0; k < 3; k++ {
+			a[k] = sc.cellCoord(sc.Centers[i][k]-sc.Radii[i], k)
+			b[k] = sc.cellCoord(sc.Centers[i][k]+sc.Radii[i], k)
+		}
+		return a, b
+	}
+	// count spheres per cell, then fill
+	counts := make([]int32, sc.dims[0]*sc.dims[1]*sc.dims[2]+1)
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < n; i++ {
+			a, b := cellRange(i)
+			for cx := a[0]; cx <= b[0]; cx++ {
+				for cy := a[1]; cy <= b[1]; cy++ {
+					for cz := a[2]; cz <= b[2]; cz++ {
+						c := (cx*sc.dims[1]+cy)*sc.dims[2] + cz
+						if pass == 0 {
+							counts[c+1]++
+						} else {
+							sc.items[counts[c]] = int32(i)
+							counts[c]++
+						}
+					}
+				}
+			}
+		}
+		if pass == 0 {
+			for c := 1; c < len(counts); c++ {
+				counts[c] += counts[c-1]
+			}
+			sc.start = make([]int32, len(counts))
+			copy(sc.start, counts)
+			sc.items = make([]int32, counts[len(counts)-1])
+		}
+	}
+}
+
+// Grid cell coordinate along axis k, clamped to the grid
+func (sc *SphereCloud) cellCoord(v float64, k int) int {
+	c := int(math.Floor((v - sc.lo[k]) / sc.h))
+	return max(0, min(c, sc.dims[k]-1))
+}
+
+func (sc *SphereCloud) Density(x, y, z float64) float64 {
+	if sc.cache != nil {
+		return sc.cache.density(x, y, z, sc.density)
+	}
+	return sc.density(x, y, z)
+}
+
+func (sc *SphereCloud) density(x, y, z float64) float64 {
+	if len(sc.items) == 0 || x < sc.lo[0] || x > sc.hi[0] || y < sc.lo[1] || y > sc.hi[1] || z < sc.lo[2] || z > sc.hi[2] {
+		return 0.0
+	}
+	pt := mgl64.Vec3{x, y, z}
+	c := (sc.cellCoord(x, 0)*sc.dims[1]+sc.cellCoord(y, 1))*sc.dims[2] + sc.cellCoord(z, 2)
+	for _, i := range sc.items[sc.start[c]:sc.start[c+1]] {
+		d := pt.Sub(sc.Centers[i])
+		if d.Dot(d) < sc.Radii[i]*sc.Radii[i] {
+			return sc.Rho
+		}
+	}
+	return 0.0
+}
+
+func (sc *SphereCloud) MinFeatureSize() float64 {
+	out := math.Inf(1)
+	for _, r := range sc.Radii {
+		if r > 0 {
+			out = math.Min(out, r)
+		}
+	}
+	return out
+}
+
+func (sc *SphereCloud) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	return sc.lo, sc.hi
+}
+
+// Memoized densities at points snapped to a cubic lattice of spacing resolution, safe for concurrent use.
+// The cache is emptied once it holds maxEntries points, so memory stays bounded when a render sweeps
+// through more distinct lattice points than fit.
+type densityCache struct {
+	resolution float64
+	maxEntries int64
+	values     atomic.Pointer[sync.Map] // [3]int64 lattice index -> float64
+	n          atomic.Int64             // entries stored in values
+}
+
+// Points held by a density cache before it is emptied, about 100 MB
+const densityCacheMaxEntries = 1 << 20
+
+func newDensityCache(resolution float64) *densityCache {
+	dc := &densityCache{resolution: resolution, maxEntries: densityCacheMaxEntries}
+	dc.values.Store(&sync.Map{})
+	return dc
+}
+
+// Density at the lattice point nearest to (x, y, z), evaluated with f on a miss
+func (dc *densityCache) density(x, y, z float64, f func(x, y, z float64) float64) float64 {
+	key := [3]int64{int64(math.Round(x / dc.resolution)), int64(math.Round(y / dc.resolution)), int64(math.Round(z / dc.resolution))}
+	values := dc.values.Load()
+	if v, ok := values.Load(key); ok {
+		return v.(float64)
+	}
+	v := f(float64(key[0])*dc.resolution, float64(key[1])*dc.resolution, float64(key[2])*dc.resolution)
+	if dc.n.Add(1) > dc.maxEntries {
+		dc.n.Store(0)
+		dc.values.Store(&sync.Map{})
+		return v
+	}
+	values.Store(key, v)
+	return v
+}
+
+// LabelVoxelGrid is a segmented volume of integer material labels mapped to densities by LabelToRho.
+// Labels are read from Path as a packed little-endian uint8 or uint16 (DType) array of Shape[0]*Shape[1]*Shape[2]
+// voxels with x varying fastest, and the grid fills the box [Min, Max]. Density is that of the label of the
+// voxel containing the point, without interpolation, so material boundaries stay crisp.
+// Labels missing from LabelToRho have zero density.
+type LabelVoxelGrid struct {
+	Object
+	Path       string
+	DType      string
+	Shape      [3]int
+	Min, Max   mgl64.Vec3
+	LabelToRho map[int]float64
+	Labels     []uint16
+}
+
+func (g *LabelVoxelGrid) ToMap() map[string]interface{} {
+	label_to_rho := make(map[string]interface{}, len(g.LabelToRho))
+	for label, rho := range g.LabelToRho {
+		label_to_rho[strconv.Itoa(label)] = rho
+	}
+	return map[string]interface{}{
+		"type":         "label_voxel_grid",
+		"path":         g.Path,
+		"dtype":        g.DType,
+		"shape":        []int{g.Shape[0], g.Shape[1], g.Shape[2]},
+		"min":          g.Min,
+		"max":          g.Max,
+		"label_to_rho": label_to_rho,
+	}
+}
+
+func (g *LabelVoxelGrid) FromMap(data map[string]interface{}) error {
+	var ok bool
+	if g.Path, ok = data["path"].(string); !ok {
+		return fmt.Errorf("path is not a string")
+	}
+	g.DType = "uint8"
+	if dtype, ok := data["dtype"]; ok {
+		if g.DType, ok = dtype.(string); !ok || (g.DType != "uint8" && g.DType != "uint16") {
+			return fmt.Errorf("dtype must be uint8 or uint16, got %v", dtype)
+		}
+	}
+	shape, ok := data["shape"].([]interface{})
+	if !ok || len(shape) != 3 {
+		return fmt.Errorf("shape is not a list of 3 integers")
+	}
+	for k, n := range shape {
+		f, err := ToFloat64(n)
+		if err != nil || f < 1 || f != math.Trunc(f) {
+			return fmt.Errorf("shape: element %d (%v) is not a positive integer", k, n)
+		}
+		g.Shape[k] = int(f)
+	}
+	g.Min, g.Max = mgl64.Vec3{-1, -1, -1}, mgl64.Vec3{1, 1, 1}
+	for key, v := range map[string]*mgl64.Vec3{"min": &g.Min, "max": &g.Max} {
+		if slice, ok := data[key].([]interface{}); ok {
+			if err := ToVec(&slice, v); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	for k := 0; k < 3; k++ {
+		if g.Min[k] >= g.Max[k] {
+			return fmt.Errorf("min must be smaller than max along every axis")
+		}
+	}
+	// yaml gives integer keys, json string keys
+	g.LabelToRho = map[int]float64{}
+	add_label := func(key interface{}, val interface{}) error {
+		var label int
+		switch k := key.(type) {
+		case int:
+			label = k
+		case string:
+			var err error
+			if label, err = strconv.Atoi(k); err != nil {
+				return fmt.Errorf("label_to_rho: key %q is not an integer", k)
+			}
+		default:
+			return fmt.Errorf("label_to_rho: key %v is not an integer", key)
+		}
+		rho, err := ToFloat64(val)
+		if err != nil {
+			return fmt.Errorf("label_to_rho: density of label %d is not a float64", label)
+		}
+		g.LabelToRho[label] = rho
+		return nil
+	}
+	switch m := data["label_to_rho"].(type) {
+	case map[string]interface{}:
+		for key, val := range m {
+			if err := add_label(key, val); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key, val := range m {
+			if err := add_label(key, val); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("label_to_rho is not a map")
+	}
+	path, err := resolveDataPath(g.Path)
+	if err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	g.Path = path
+	raw, err := os.ReadFile(g.Path)
+	if err != nil {
+		return fmt.Errorf("path: %v", err)
+	}
+	n := g.Shape[0] * g.Shape[1] * g.Shape[2]
+	size := 1
+	if g.DType == "uint16" {
+		size = 2
+	}
+	if len(raw) != n*size {
+		return fmt.Errorf("%s: expected %d bytes for %v %s voxels, got %d", g.Path, n*size, g.Shape, g.DType, len(raw))
+	}
+	g.Labels = make([]uint16, n)
+	for i := range g.Labels {
+		if size == 1 {
+			g.Labels[i] = uint16(raw[i])
+		} else {
+			g.Labels[i] = binary.LittleEndian.Uint16(raw[2*i:])
+		}
+	}
+	return nil
+}
+
+func (g *LabelVoxelGrid) Density(x, y, z float64) float64 {
+	p := [3]float64{x, y, z}
+	var idx [3]int
+	for k := 0; k < 3; k++ {
+		if p[k] < g.Min[k] || p[k] > g.Max[k] {
+			return 0.0
+		}
+		// voxel containing the point, points on the max face belong to the last voxel
+		idx[k] = min(int((p[k]-g.Min[k])/(g.Max[k]-g.Min[k])*float64(g.Shape[k])), g.Shape[k]-1)
+	}
+	label := g.Labels[(idx[2]*g.Shape[1]+idx[1])*g.Shape[0]+idx[0]]
+	return g.LabelToRho[int(label)]
+}
+
+func (g *LabelVoxelGrid) MinFeatureSize() float64 {
+	out := math.Inf(1)
+	for k := 0; k < 3; k++ {
+		out = math.Min(out, (g.Max[k]-g.Min[k])/float64(g.Shape[k]))
+	}
+	return out
+}
+
+func (g *LabelVoxelGrid) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	return g.Min, g.Max
+}
+
+// Blend interpolates between the densities of children A and B as (1-w)*A + w*B, where the weight
+// w rises from 0 to 1 along axis Direction (x, y or z) as a sigmoid centred at Center with width Lengthscale.
+type Blend struct {
+	Object
+	A, B        Object
+	Direction   string
+	Center      float64
+	Lengthscale float64
+}
+
+func (bl *Blend) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "blend",
+		"a":    bl.A.ToMap(),
+		"b":    bl.B.ToMap(),
+		"weight": map[string]interface{}{
+			"direction":   bl.Direction,
+			"center":      bl.Center,
+			"lengthscale": bl.Lengthscale,
+		},
+	}
+}
+
+func (bl *Blend) FromMap(data map[string]interface{}) error {
+	for key, child := range map[string]*Object{"a": &bl.A, "b": &bl.B} {
+		child_data, ok := data[key].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not a map", key)
+		}
+		obj, err := NewObject(child_data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*child = obj
+	}
+	weight, ok := data["weight"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("weight is not a map")
+	}
+	if bl.Direction, ok = weight["direction"].(string); !ok || (bl.Direction != "x" && bl.Direction != "y" && bl.Direction != "z") {
+		return fmt.Errorf("weight direction must be x, y or z")
+	}
+	var err error
+	if bl.Center, err = ToFloat64(weight["center"]); err != nil {
+		return fmt.Errorf("weight center is not a float64")
+	}
+	if bl.Lengthscale, err = ToFloat64(weight["lengthscale"]); err != nil || bl.Lengthscale <= 0 {
+		return fmt.Errorf("weight lengthscale is not a positive float64")
+	}
+	return nil
+}
+
+// Weight of child B at the given coordinates
+func (bl *Blend) Weight(x, y, z float64) float64 {
+	t := x
+	if bl.Direction == "y" {
+		t = y
+	} else if bl.Direction == "z" {
+		t = z
+	}
+	return deformations.Sigmoid(t, bl.Center, bl.Lengthscale)
+}
+
+func (bl *Blend) Density(x, y, z float64) float64 {
+	w := bl.Weight(x, y, z)
+	return (1-w)*bl.A.Density(x, y, z) + w*bl.B.Density(x, y, z)
+}
+
+func (bl *Blend) EmissionAt(x, y, z float64) float64 {
+	w := bl.Weight(x, y, z)
+	return (1-w)*Emission(bl.A, x, y, z) + w*Emission(bl.B, x, y, z)
+}
+
+func (bl *Blend) MinFeatureSize() float64 {
+	return math.Min(bl.A.MinFeatureSize(), bl.B.MinFeatureSize())
+}
+
+func (bl *Blend) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	alo, ahi := bl.A.BoundingBox()
+	blo, bhi := bl.B.BoundingBox()
+	return BoxUnion(alo, ahi, blo, bhi)
+}
+
+// Number of sample directions of an Offset around a child without signed distance when not given
+const defaultOffsetSamples = 64
+
+// Offset is the Minkowski sum of Child with a ball of radius Radius, filled with density Rho.
+// It rounds the edges and corners of the child uniformly, e.g. a box into a rounded box.
+// Exact for children implementing SignedDistancer. Otherwise a point is inside if the child
+// has nonzero density at the point or at any of Samples directions at distance Radius or Radius/2.
+type Offset struct {
+	Object
+	Child   Object
+	Radius  float64
+	Rho     float64
+	Samples int
+	offsets []mgl64.Vec3 // sample points relative to the query point
+}
+
+func NewOffset(child Object, radius, rho float64) *Offset {
+	o := &Offset{Child: child, Radius: radius, Rho: rho, Samples: defaultOffsetSamples}
+	o.init()
+	return o
+}
+
+func (o *Offset) init() {
+	o.offsets = make([]mgl64.Vec3, 0, 2*o.Samples)
+	// Fibonacci sphere: directions spread evenly over the unit sphere
+	golden := math.Pi * (3 - math.Sqrt(5))
+	for i := 0; i < o.Samples; i++ {
+		z := 1 - (2*float64(i)+1)/float64(o.Samples)
+		r := math.Sqrt(1 - z*z)
+		d := mgl64.Vec3{r * math.Cos(golden*float64(i)), r * math.Sin(golden*float64(i)), z}
+		o.offsets = append(o.offsets, d.Mul(o.Radius), d.Mul(0.5*o.Radius))
+	}
+}
+
+func (o *Offset) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "offset",
+		"child":   o.Child.ToMap(),
+		"radius":  o.Radius,
+		"rho":     o.Rho,
+		"samples": o.Samples,
+	}
+}
+
+func (o *Offset) FromMap(data map[string]interface{}) error {
+	child_data, ok := data["child"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("child is not a map")
+	}
+	var err error
+	if o.Child, err = NewObject(child_data); err != nil {
+		return fmt.Errorf("child: %v", err)
+	}
+	if o.Radius, err = ToFloat64(data["radius"]); err != nil || o.Radius < 0 {
+		return fmt.Errorf("radius is not a non-negative float64")
+	}
+	if o.Rho, err = ToFloat64(data["rho"]); err != nil {
+		return fmt.Errorf("rho is not a float64")
+	}
+	o.Samples = defaultOffsetSamples
+	if _, ok := data["samples"]; ok {
+		samples, err := ToFloat64(data["samples"])
+		if err != nil || samples < 1 || samples != math.Trunc(samples) {
+			return fmt.Errorf("samples is not a positive integer")
+		}
+		o.Samples = int(samples)
+	}
+	o.init()
+	return nil
+}
+
+func (o *Offset) Density(x, y, z float64) float64 {
+	if sd, ok := o.Child.(SignedDistancer); ok {
+		if sd.SignedDistance(x, y, z) < o.Radius {
+			return o.Rho
+		}
+		return 0.0
+	}
+	if o.Child.Density(x, y, z) != 0 {
+		return o.Rho
+	}
+	for _, d := range o.offsets {
+		if o.Child.Density(x+d[0], y+d[1], z+d[2]) != 0 {
+			return o.Rho
+		}
+	}
+	return 0.0
+}
+
+func (o *Offset) MinFeatureSize() float64 {
+	return o.Child.MinFeatureSize()
+}
+
+func (o *Offset) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	lo, hi := o.Child.BoundingBox()
+	r := mgl64.Vec3{o.Radius, o.Radius, o.Radius}
+	return lo.Sub(r), hi.Add(r)
+}
+
+// Number of Fourier modes of a GaussianRandomField when not given
+const defaultGRFModes = 256
+
+// GaussianRandomField is a porous texture of density Rho within the cube of side Side at Center.
+// A random field of unit variance is synthesised as a sum of Modes cosines with random phases and
+// wave vectors drawn from a Gaussian spectrum, giving correlation length CorrelationLength.
+// Points where the field exceeds the threshold with upper tail probability Level are filled,
+// so that Level is the expected volume fraction. Modes are drawn deterministically from Seed.
+type GaussianRandomField struct {
+	Object
+	Center            mgl64.Vec3
+	Side              float64
+	CorrelationLength float64
+	Seed              int64
+	Level             float64
+	Modes             int
+	Rho               float64
+	k                 []mgl64.Vec3 // wave vector of each mode
+	phase             []float64
+	threshold         float64
+}
+
+func NewGaussianRandomField(center mgl64.Vec3, side, correlationLength float64, seed int64, level, rho float64) *GaussianRandomField {
+	grf := &GaussianRandomField{Center: center, Side: side, CorrelationLength: correlationLength, Seed: seed, Level: level, Modes: defaultGRFModes, Rho: rho}
+	grf.init()
+	return grf
+}
+
+func (grf *GaussianRandomField) init() {
+	rng := rand.New(rand.NewSource(grf.Seed))
+	grf.k = make([]mgl64.Vec3, grf.Modes)
+	grf.phase = make([]float64, grf.Modes)
+	for i := range grf.k {
+		// spectrum of the Gaussian covariance exp(-r^2 / (2 l^2))
+		grf.k[i] = mgl64.Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}.Mul(1 / grf.CorrelationLength)
+		grf.phase[i] = 2 * math.Pi * rng.Float64()
+	}
+	// standard normal quantile of 1 - Level
+	grf.threshold = math.Sqrt2 * math.Erfinv(1-2*grf.Level)
+}
+
+func (grf *GaussianRandomField) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"type":               "grf",
+		"center":             grf.Center,
+		"side":               grf.Side,
+		"correlation_length": grf.CorrelationLength,
+		"seed":               grf.Seed,
+		"level":              grf.Level,
+		"modes":              grf.Modes,
+		"rho":                grf.Rho,
+	}
+}
+
+func (grf *GaussianRandomField) FromMap(data map[string]interface{}) error {
+	var ok bool
+	var slice []interface{}
+	if slice, ok = data["center"].([]interface{}); !ok {
+		return fmt.Errorf("center is not a Vec3")
+	}
+	err := ToVec(&slice, &grf.Center)
+	if err != nil {
+		return fmt.Errorf("center: %v", err)
+	}
+	if grf.Side, err = ToFloat64(data["side"]); err != nil {
+		return fmt.Errorf("side is not a float64")
+	}
+	if grf.CorrelationLength, err = ToFloat64(data["correlation_length"]); err != nil || grf.CorrelationLength <= 0 {
+		return fmt.Errorf("correlation_length is not a positive float64")
+	}
+	seed, err := ToFloat64(data["seed"])
+	if err != nil || seed != math.Trunc(seed) {
+		return fmt.Errorf("seed is not an integer")
+	}
+	grf.Seed = int64(seed)
+	if grf.Level, err = ToFloat64(data["level"]); err != nil || grf.Level <= 0 || grf.Level >= 1 {
+		return fmt.Errorf("level must be a volume fraction in (0, 1)")
+	}
+	grf.Modes = defaultGRFModes
+	if _, ok := data["modes"]; ok {
+		modes, err := ToFloat64(data["modes"])
+		if err != nil || modes < 1 || modes != math.Trunc(modes) {
+			return fmt.Errorf("modes is not a positive integer")
+		}
+		grf.Modes = int(modes)
+	}
+	if grf.Rho, err = ToFloat64(data["rho"]); err != nil {
+		return fmt.Errorf("rho is not a float64")
+	}
+	grf.init()
+	return nil
+}
+
+// Value of the unit variance random field at the given coordinates
+func (grf *GaussianRandomField) Field(x, y, z float64) float64 {
+	sum := 0.0
+	for i, k := range grf.k {
+		sum += math.Cos(k[0]*x + k[1]*y + k[2]*z + grf.phase[i])
+	}
+	return sum * math.Sqrt(2/float64(len(grf.k)))
+}
+
+func (grf *GaussianRandomField) Density(x, y, z float64) float64 {
+	h := 0.5 * grf.Side
+	if math.Abs(x-grf.Center[0]) > h || math.Abs(y-grf.Center[1]) > h || math.Abs(z-grf.Center[2]) > h {
+		return 0.0
+	}
+	if grf.Field(x, y, z) > grf.threshold {
+		return grf.Rho
+	}
+	return 0.0
+}
+
+func (grf *GaussianRandomField) MinFeatureSize() float64 {
+	return grf.CorrelationLength
+}
+
+func (grf *GaussianRandomField) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	h := mgl64.Vec3{1, 1, 1}.Mul(0.5 * grf.Side)
+	return grf.Center.Sub(h), grf.Center.Add(h)
+}
+
+// Kelvin (tetrakaidecahedron) unit cell with all struts of density rho.
+func MakeKelvin(rad float64, scale float64, rho float64) UnitCell {
+	return MakeKelvinFunc(rad, scale, func(int) float64 { return rho })
+}
+
+// Kelvin unit cell with density rho(idx) of strut idx, e.g. for graded lattices.
+func MakeKelvinFunc(rad float64, scale float64, rho func(idx int) float64) UnitCell {
 	var struts = []Cylinder{
-		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.75}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.75}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.00, 0.25, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 0.00, 0.75}, P1: mgl64.Vec3{0.75, 0.00, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 1.00, 0.75}, P1: mgl64.Vec3{0.75, 1.00, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 0.00, 0.75}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.75, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.75, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.75, 0.00, 0.50}, P1: mgl64.Vec3{1.00, 0.25, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 0.00, 0.25}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.50, 0.75}, P1: mgl64.Vec3{0.75, 0.50, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.75, 0.50}, P1: mgl64.Vec3{0.75, 1.00, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.50, 0.25}, P1: mgl64.Vec3{0.75, 0.50, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.00, 0.75, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 1.00, 0.75}, P1: mgl64.Vec3{0.50, 0.75, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 1.00, 0.25}, P1: mgl64.Vec3{0.50, 0.75, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.25, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.75}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.25, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.75}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.25, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.25, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.50, 0.75}, P1: mgl64.Vec3{0.25, 0.50, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.50, 0.75}, P1: mgl64.Vec3{0.00, 0.75, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.50, 0.75}, P1: mgl64.Vec3{1.00, 0.75, 0.50}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.75, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{1.00, 0.75, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.25}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.00, 0.50, 0.25}, P1: mgl64.Vec3{0.25, 0.50, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.75, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.75, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.25, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 0.75, 0.00}, P1: mgl64.Vec3{0.75, 0.50, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.50, 0.75, 1.00}, P1: mgl64.Vec3{0.75, 0.50, 1.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.75, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad, Rho: 1.0},
-		{P0: mgl64.Vec3{0.75, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad, Rho: 1.0},
+		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.75}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.75}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.00, 0.50}, P1: mgl64.Vec3{0.00, 0.25, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 0.00, 0.75}, P1: mgl64.Vec3{0.75, 0.00, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 1.00, 0.75}, P1: mgl64.Vec3{0.75, 1.00, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 0.00, 0.75}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.75, 0.00, 0.50}, P1: mgl64.Vec3{0.50, 0.00, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.75, 1.00, 0.50}, P1: mgl64.Vec3{0.50, 1.00, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.75, 0.00, 0.50}, P1: mgl64.Vec3{1.00, 0.25, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 0.00, 0.25}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.50, 0.75}, P1: mgl64.Vec3{0.75, 0.50, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.75, 0.50}, P1: mgl64.Vec3{0.75, 1.00, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.50, 0.25}, P1: mgl64.Vec3{0.75, 0.50, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 1.00, 0.50}, P1: mgl64.Vec3{0.00, 0.75, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 1.00, 0.75}, P1: mgl64.Vec3{0.50, 0.75, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 1.00, 0.25}, P1: mgl64.Vec3{0.50, 0.75, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.25, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.75}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.25, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.75}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.25, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.25, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.50, 0.75}, P1: mgl64.Vec3{0.25, 0.50, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.50, 0.75}, P1: mgl64.Vec3{0.00, 0.75, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.50, 0.75}, P1: mgl64.Vec3{1.00, 0.75, 0.50}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.75, 0.50}, P1: mgl64.Vec3{0.00, 0.50, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{1.00, 0.75, 0.50}, P1: mgl64.Vec3{1.00, 0.50, 0.25}, Radius: rad},
+		{P0: mgl64.Vec3{0.00, 0.50, 0.25}, P1: mgl64.Vec3{0.25, 0.50, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.75, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.75, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.25, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 0.75, 0.00}, P1: mgl64.Vec3{0.75, 0.50, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.50, 0.75, 1.00}, P1: mgl64.Vec3{0.75, 0.50, 1.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.75, 0.50, 0.00}, P1: mgl64.Vec3{0.50, 0.25, 0.00}, Radius: rad},
+		{P0: mgl64.Vec3{0.75, 0.50, 1.00}, P1: mgl64.Vec3{0.50, 0.25, 1.00}, Radius: rad},
 	}
 	for i := 0; i < len(struts); i++ {
 		struts[i].P0 = struts[i].P0.Mul(scale)
 		struts[i].P1 = struts[i].P1.Mul(scale)
+		struts[i].Rho = rho(i)
 	}
 	var objects = make([]Object, len(struts))
 	for i, strut := range struts {
@@ -603,6 +2415,28 @@ func MakeKelvin(rad float64, scale float64) UnitCell {
 	return uc
 }
 
+// Diamond cubic unit cell. Every atom has 4 neighbours (tetrahedral coordination).
+// Struts connect the 4 atoms inside the cell to their neighbours on the cell faces and corners,
+// so all 16 struts lie within the cell.
+func MakeDiamond(rad float64, scale float64, rho float64) UnitCell {
+	return MakeDiamondFunc(rad, scale, func(int) float64 { return rho })
+}
+
+// Diamond cubic unit cell with density rho(idx) of strut idx.
+func MakeDiamondFunc(rad float64, scale float64, rho func(idx int) float64) UnitCell {
+	// atoms inside the cell and bond directions from them to the face/corner atoms
+	inner := []mgl64.Vec3{{0.25, 0.25, 0.25}, {0.25, 0.75, 0.75}, {0.75, 0.25, 0.75}, {0.75, 0.75, 0.25}}
+	bonds := []mgl64.Vec3{{-0.25, -0.25, -0.25}, {-0.25, 0.25, 0.25}, {0.25, -0.25, 0.25}, {0.25, 0.25, -0.25}}
+	var objects = make([]Object, 0, len(inner)*len(bonds))
+	for _, p := range inner {
+		for _, b := range bonds {
+			objects = append(objects, &Cylinder{P0: p.Mul(scale), P1: p.Add(b).Mul(scale), Radius: rad, Rho: rho(len(objects))})
+		}
+	}
+	uc := UnitCell{Struts: ObjectCollection{Objects: objects, GreedyDensEval: true}, Xmin: 0.0, Xmax: 1.0 * scale, Ymin: 0.0, Ymax: 1.0 * scale, Zmin: 0.0, Zmax: 1.0 * scale}
+	return uc
+}
+
 // func MakeOctet(rad float64) Lattice {
 // 	s2 := math.Sqrt(2)
 // 	var struts = []Cylinder{
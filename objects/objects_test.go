@@ -0,0 +1,1098 @@
+package objects
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl64"
+)
+
+func TestRadialProfile(t *testing.T) {
+	rp := RadialProfile{}
+	err := rp.FromMap(map[string]interface{}{
+		"type":    "radial_profile",
+		"center":  []interface{}{1.0, 0.0, 0.0},
+		"radius":  0.5,
+		"profile": []interface{}{1.0, 0.2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ r, rho float64 }{
+		{0.0, 1.0},
+		{0.25, 0.6},
+		{0.4, 0.36},
+		{0.6, 0.0},
+	} {
+		if rho := rp.Density(1.0, tc.r, 0.0); math.Abs(rho-tc.rho) > 1e-12 {
+			t.Errorf("r=%v: expected density %v, got %v", tc.r, tc.rho, rho)
+		}
+	}
+	if rp.MinFeatureSize() != 0.25 {
+		t.Errorf("expected min feature size 0.25, got %v", rp.MinFeatureSize())
+	}
+}
+
+func TestBoundingBox(t *testing.T) {
+	oc := NewCollection().
+		Add(&Sphere{Center: mgl64.Vec3{1, 0, 0}, Radius: 0.5}).
+		Add(&Cylinder{P0: mgl64.Vec3{0, 0, -1}, P1: mgl64.Vec3{0, 0, 1}, Radius: 0.1})
+	lo, hi := oc.BoundingBox()
+	if !lo.ApproxEqual(mgl64.Vec3{-0.1, -0.5, -1.1}) || !hi.ApproxEqual(mgl64.Vec3{1.5, 0.5, 1.1}) {
+		t.Errorf("unexpected bounding box %v %v", lo, hi)
+	}
+	if r := BoundingRadius(oc); math.Abs(r-math.Sqrt(1.5*1.5+0.5*0.5+1.1*1.1)) > 1e-12 {
+		t.Errorf("unexpected bounding radius %v", r)
+	}
+}
+
+func TestMakeDiamond(t *testing.T) {
+	const scale = 0.5
+	uc := MakeDiamond(0.02, scale, 1.0)
+	if n := len(uc.Struts.Objects); n != 16 {
+		t.Fatalf("expected 16 struts, got %d", n)
+	}
+	// every strut has length sqrt(3)/4 of the cell and lies within the cell
+	for i, obj := range uc.Struts.Objects {
+		cyl := obj.(*Cylinder)
+		if l := cyl.P1.Sub(cyl.P0).Len(); math.Abs(l-math.Sqrt(3)/4*scale) > 1e-12 {
+			t.Errorf("strut %d has length %v", i, l)
+		}
+		for _, p := range []mgl64.Vec3{cyl.P0, cyl.P1} {
+			for k := 0; k < 3; k++ {
+				if p[k] < 0 || p[k] > scale {
+					t.Errorf("strut %d end %v outside cell", i, p)
+				}
+			}
+		}
+	}
+	// tessellate 2x2x2 and check that bonds of atoms on cell boundaries are continuous
+	lat := TessellatedObjColl{UC: uc, Xmin: 0, Xmax: 2 * scale, Ymin: 0, Ymax: 2 * scale, Zmin: 0, Zmax: 2 * scale}
+	atoms := []mgl64.Vec3{{1, 1, 1}, {1, 0.5, 0.5}, {0.5, 1, 0.5}, {0.5, 0.5, 1}, {1, 1.5, 1.5}}
+	bonds := []mgl64.Vec3{{1, 1, 1}, {1, -1, -1}, {-1, 1, -1}, {-1, -1, 1}}
+	for _, a := range atoms {
+		for _, b := range bonds {
+			for _, f := range []float64{0.05, 0.5, 0.95} {
+				p := a.Add(b.Mul(0.25 * f)).Mul(scale)
+				if lat.Density(p[0], p[1], p[2]) == 0 {
+					t.Errorf("gap in tessellated lattice at %v (atom %v, bond %v)", p, a, b)
+				}
+			}
+		}
+	}
+	if lat.Density(0.5*scale, 0.5*scale, 0.5*scale) != 0 {
+		t.Errorf("expected empty space at cell centre")
+	}
+}
+
+func TestToVecErrors(t *testing.T) {
+	var v mgl64.Vec3
+	if err := ToVec(&[]interface{}{1, 2.5, -3}, &v); err != nil || v != (mgl64.Vec3{1, 2.5, -3}) {
+		t.Errorf("unexpected result %v, %v", v, err)
+	}
+	err := ToVec(&[]interface{}{0.0, "x", 0.0}, &v)
+	if err == nil || !strings.Contains(err.Error(), "element 1") || !strings.Contains(err.Error(), "x") {
+		t.Errorf("expected error naming element 1, got %v", err)
+	}
+	if err := ToVec(&[]interface{}{0.0, 1.0}, &v); err == nil {
+		t.Errorf("expected error for short vector")
+	}
+	// errors propagate through FromMap with the field name
+	s := Sphere{}
+	err = s.FromMap(map[string]interface{}{"center": []interface{}{0.0, "x", 0.0}, "radius": 1.0, "rho": 1.0})
+	if err == nil || !strings.Contains(err.Error(), "center") {
+		t.Errorf("expected center error from sphere, got %v", err)
+	}
+	c := Cylinder{}
+	err = c.FromMap(map[string]interface{}{"p0": []interface{}{0.0, 0.0, 0.0}, "p1": []interface{}{0.0, 0.0, true}, "radius": 1.0, "rho": 1.0})
+	if err == nil || !strings.Contains(err.Error(), "p1") {
+		t.Errorf("expected p1 error from cylinder, got %v", err)
+	}
+}
+
+func TestQuadric(t *testing.T) {
+	// sphere of radius 0.5 centered at (0.2, 0, 0): x^2+y^2+z^2-0.4x+0.04-0.25
+	sphere := Sphere{Center: mgl64.Vec3{0.2, 0, 0}, Radius: 0.5, Rho: 1.0}
+	qs := Quadric{}
+	err := qs.FromMap(map[string]interface{}{
+		"coefficients": []interface{}{1, 1, 1, 0, 0, 0, -0.4, 0, 0, 0.04 - 0.25},
+		"rho":          1.0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// elliptic cylinder along z with semi-axes 0.6 and 0.3
+	qc := Quadric{Coefficients: [10]float64{1 / 0.36, 1 / 0.09, 0, 0, 0, 0, 0, 0, 0, -1}, Rho: 1.0}
+	// grid offset to avoid points exactly on the surfaces
+	for x := -0.787; x <= 0.8; x += 0.1 {
+		for y := -0.793; y <= 0.8; y += 0.1 {
+			for _, z := range []float64{-5.0, 0.0, 0.35} {
+				if qs.Density(x, y, z) != sphere.Density(x, y, z) {
+					t.Errorf("quadric sphere differs from sphere at (%v,%v,%v)", x, y, z)
+				}
+				inside := x*x/0.36+y*y/0.09 < 1
+				if (qc.Density(x, y, z) == 1.0) != inside {
+					t.Errorf("elliptic cylinder wrong at (%v,%v,%v)", x, y, z)
+				}
+			}
+		}
+	}
+	lo, hi := qs.BoundingBox()
+	if !lo.ApproxEqualThreshold(mgl64.Vec3{-0.3, -0.5, -0.5}, 1e-9) || !hi.ApproxEqualThreshold(mgl64.Vec3{0.7, 0.5, 0.5}, 1e-9) {
+		t.Errorf("unexpected sphere bounding box %v %v", lo, hi)
+	}
+	if lo, _ := qc.BoundingBox(); !math.IsInf(lo[2], -1) {
+		t.Errorf("expected unbounded cylinder, got %v", lo)
+	}
+	// cap: sphere clipped by half-space z <= 0.3
+	qs.Planes = [][4]float64{{0, 0, 1, -0.3}}
+	if qs.Density(0.2, 0, 0.2) != 1.0 || qs.Density(0.2, 0, 0.4) != 0.0 {
+		t.Errorf("clipping plane not applied")
+	}
+}
+
+func TestGradient(t *testing.T) {
+	sphere := &Sphere{Center: mgl64.Vec3{0.1, -0.2, 0.3}, Radius: 0.5, Rho: 1.0}
+	// collection has no analytic normal, so central differences are used
+	numeric := NewCollection().Add(sphere)
+	const h = 0.01
+	dirs := []mgl64.Vec3{{1, 0, 0}, {0, -1, 0}, {0, 0, 1}, {1, 1, 0}, {-1, 0, 1}, {1, 1, 1}, {-1, 1, -1}}
+	for _, d := range dirs {
+		d = d.Normalize()
+		// point just inside the surface
+		p := sphere.Center.Add(d.Mul(sphere.Radius - h/2))
+		g := Gradient(numeric, p[0], p[1], p[2], h)
+		if g.Len() == 0 {
+			t.Fatalf("zero numeric gradient at %v", p)
+		}
+		normal := g.Normalize().Mul(-1)
+		analytic := SurfaceNormal(sphere, p[0], p[1], p[2], h)
+		if fallback := SurfaceNormal(numeric, p[0], p[1], p[2], h); fallback.Sub(normal).Len() > 1e-12 {
+			t.Errorf("numeric surface normal %v differs from reversed gradient %v", fallback, normal)
+		}
+		if normal.Dot(d) < 1-1e-9 || analytic.Dot(d) < 1-1e-9 {
+			t.Errorf("normal not radial for direction %v: numeric %v, analytic %v", d, normal, analytic)
+		}
+	}
+	// away from the surface the gradient of a hard sphere vanishes, whether or not it has an analytic normal
+	for _, obj := range []Object{numeric, sphere} {
+		for _, p := range []mgl64.Vec3{{0.1, -0.2, 0.3}, {0.2, -0.2, 0.3}, {2, 2, 2}} {
+			if g := Gradient(obj, p[0], p[1], p[2], h); g.Len() != 0 {
+				t.Errorf("%T: expected zero gradient at %v, got %v", obj, p, g)
+			}
+		}
+	}
+	// soft boundary: the gradient is the slope of the density ramp across the shell
+	defer func() { BoundarySoftness = 0.0 }()
+	BoundarySoftness = 0.1
+	p := sphere.Center.Add(mgl64.Vec3{sphere.Radius, 0, 0})
+	if g := Gradient(sphere, p[0], p[1], p[2], h); math.Abs(g[0]+sphere.Rho/BoundarySoftness) > 1e-9 || g[1] != 0 || g[2] != 0 {
+		t.Errorf("expected gradient (%v, 0, 0) on the surface of a soft sphere, got %v", -sphere.Rho/BoundarySoftness, g)
+	}
+}
+
+func TestLatticeRepeat(t *testing.T) {
+	// sheared basis in the xy plane
+	data := map[string]interface{}{
+		"type":   "lattice_repeat",
+		"object": map[string]interface{}{"type": "sphere", "center": []interface{}{0.5, 0.5, 0.5}, "radius": 0.2, "rho": 1.0},
+		"a1":     []interface{}{1.0, 0.0, 0.0},
+		"a2":     []interface{}{0.5, 1.0, 0.0},
+		"a3":     []interface{}{0.0, 0.0, 1.0},
+		"n1":     []interface{}{0, 2},
+		"n2":     []interface{}{-1, 1},
+		"n3":     []interface{}{0, 0},
+	}
+	l := LatticeRepeat{}
+	if err := l.FromMap(data); err != nil {
+		t.Fatal(err)
+	}
+	center := mgl64.Vec3{0.5, 0.5, 0.5}
+	for n1 := 0; n1 <= 2; n1++ {
+		for n2 := -1; n2 <= 1; n2++ {
+			p := center.Add(l.A1.Mul(float64(n1))).Add(l.A2.Mul(float64(n2)))
+			if rho := l.Density(p[0], p[1], p[2]); rho != 1.0 {
+				t.Errorf("cell (%d,%d): expected motif at %v, got density %v", n1, n2, p, rho)
+			}
+		}
+	}
+	// unsheared position of cell (0,1) and cells outside the ranges are empty
+	for _, p := range []mgl64.Vec3{{0.5, 1.5, 0.5}, {3.5, 0.5, 0.5}, {1.5, 2.5, 0.5}, {0.5, 0.5, 1.5}} {
+		if rho := l.Density(p[0], p[1], p[2]); rho != 0.0 {
+			t.Errorf("expected no density at %v, got %v", p, rho)
+		}
+	}
+	lo, hi := l.BoundingBox()
+	for _, p := range []mgl64.Vec3{{-0.2, -0.7, 0.3}, {3.2, 1.7, 0.7}} {
+		for k := 0; k < 3; k++ {
+			if p[k] < lo[k] || p[k] > hi[k] {
+				t.Errorf("motif point %v outside bounding box %v %v", p, lo, hi)
+			}
+		}
+	}
+	data["n1"] = []interface{}{0.5, 2}
+	if err := l.FromMap(data); err == nil {
+		t.Error("expected error for non-integer range")
+	}
+}
+
+func TestDegenerateBasis(t *testing.T) {
+	parallelepiped := func(v2 []interface{}, scale float64) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "parallelepiped", "origin": []interface{}{0.0, 0.0, 0.0}, "rho": 1.0,
+			"v1": []interface{}{scale, 0.0, 0.0}, "v2": v2, "v3": []interface{}{0.0, 0.0, scale},
+		}
+	}
+	// nearly collinear vectors are rejected, small but well-shaped bases are not
+	if _, err := NewObject(parallelepiped([]interface{}{1.0, 1e-12, 0.0}, 1)); err == nil {
+		t.Error("expected error for nearly collinear v1 and v2")
+	}
+	if _, err := NewObject(parallelepiped([]interface{}{0.0, 1e-4, 0.0}, 1e-4)); err != nil {
+		t.Errorf("unexpected error for small cube: %v", err)
+	}
+	l := LatticeRepeat{}
+	err := l.FromMap(map[string]interface{}{
+		"type":   "lattice_repeat",
+		"object": map[string]interface{}{"type": "sphere", "center": []interface{}{0.5, 0.5, 0.5}, "radius": 0.2, "rho": 1.0},
+		"a1":     []interface{}{1.0, 0.0, 0.0},
+		"a2":     []interface{}{1.0, 0.0, 1e-13},
+		"a3":     []interface{}{0.0, 0.0, 1.0},
+		"n1":     []interface{}{0, 1},
+		"n2":     []interface{}{0, 1},
+		"n3":     []interface{}{0, 1},
+	})
+	if err == nil {
+		t.Error("expected error for nearly dependent lattice vectors")
+	}
+}
+
+func TestBoundarySoftness(t *testing.T) {
+	defer func() { BoundarySoftness = 0.0 }()
+	s := Sphere{Center: mgl64.Vec3{0, 0, 0}, Radius: 0.5, Rho: 2.0}
+	cyl := Cylinder{P0: mgl64.Vec3{0, 0, -1}, P1: mgl64.Vec3{0, 0, 1}, Radius: 0.5, Rho: 2.0}
+	if s.Density(0.49, 0, 0) != 2.0 || s.Density(0.51, 0, 0) != 0.0 {
+		t.Error("expected hard edges with zero softness")
+	}
+	BoundarySoftness = 0.1
+	for _, obj := range []Object{&s, &cyl} {
+		rho := obj.Density(0.48, 0, 0)
+		if !(rho > 0.0 && rho < 2.0) {
+			t.Errorf("%T: expected fractional density within the shell, got %v", obj, rho)
+		}
+		if math.Abs(obj.Density(0.5, 0, 0)-1.0) > 1e-9 {
+			t.Errorf("%T: expected half density on the surface, got %v", obj, obj.Density(0.5, 0, 0))
+		}
+		if obj.Density(0.0, 0, 0) != 2.0 || obj.Density(0.56, 0, 0) != 0.0 {
+			t.Errorf("%T: expected full density deep inside and none outside the shell", obj)
+		}
+	}
+	b := Box{Center: mgl64.Vec3{0, 0, 0}, Sides: mgl64.Vec3{1, 1, 1}, Rho: 2.0}
+	if rho := b.Density(0.52, 0.1, 0.1); !(rho > 0.0 && rho < 2.0) {
+		t.Errorf("box: expected fractional density within the shell, got %v", rho)
+	}
+}
+
+func TestPerObjectDeformation(t *testing.T) {
+	sphere := func(deformation map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "sphere", "center": []interface{}{0.0, 0.0, 0.0}, "radius": 0.1, "rho": 1.0,
+			"deformation": deformation,
+		}
+	}
+	// rigid displacement d moves the object by -d
+	data := map[string]interface{}{
+		"type": "object_collection",
+		"objects": []interface{}{
+			sphere(map[string]interface{}{"type": "rigid", "displacements": []interface{}{0.5, 0.0, 0.0}}),
+			sphere(map[string]interface{}{"type": "rigid", "displacements": []interface{}{0.0, 0.0, -0.5}}),
+		},
+	}
+	oc := ObjectCollection{}
+	if err := oc.FromMap(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []mgl64.Vec3{{-0.5, 0, 0}, {0, 0, 0.5}} {
+		if rho := oc.Density(p[0], p[1], p[2]); rho != 1.0 {
+			t.Errorf("expected displaced sphere at %v, got density %v", p, rho)
+		}
+	}
+	if rho := oc.Density(0, 0, 0); rho != 0.0 {
+		t.Errorf("expected no sphere at the original center, got density %v", rho)
+	}
+	// deformations survive a round trip through ToMap
+	m := oc.ToMap()
+	objects := m["objects"].([]map[string]interface{})
+	if _, ok := objects[1]["deformation"]; !ok {
+		t.Error("deformation missing from ToMap output")
+	}
+}
+
+func TestDensityScale(t *testing.T) {
+	sphere := func(x float64) map[string]interface{} {
+		return map[string]interface{}{"type": "sphere", "center": []interface{}{x, 0.0, 0.0}, "radius": 0.2, "rho": 0.3}
+	}
+	scaled := sphere(0.5)
+	scaled["density_scale"] = 2
+	oc := ObjectCollection{}
+	if err := oc.FromMap(map[string]interface{}{"type": "object_collection", "objects": []interface{}{sphere(-0.5), scaled, sphere(0.0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if rho := oc.Density(0.5, 0, 0); math.Abs(rho-0.6) > 1e-12 {
+		t.Errorf("expected scaled density 0.6, got %v", rho)
+	}
+	for _, x := range []float64{-0.5, 0.0} {
+		if rho := oc.Density(x, 0, 0); rho != 0.3 {
+			t.Errorf("expected unscaled density 0.3 at x=%v, got %v", x, rho)
+		}
+	}
+	if _, ok := oc.ToMap()["objects"].([]map[string]interface{})[1]["density_scale"]; !ok {
+		t.Error("density_scale missing from ToMap output")
+	}
+}
+
+func TestLatticeDensity(t *testing.T) {
+	uc := MakeKelvin(0.02, 1.0, 0.4)
+	for i, obj := range uc.Struts.Objects {
+		if rho := obj.(*Cylinder).Rho; rho != 0.4 {
+			t.Errorf("strut %d: expected density 0.4, got %v", i, rho)
+		}
+	}
+	// graded density by strut index
+	uc = MakeDiamondFunc(0.02, 1.0, func(idx int) float64 { return 0.1 * float64(idx%4) })
+	for i, obj := range uc.Struts.Objects {
+		if rho := obj.(*Cylinder).Rho; rho != 0.1*float64(i%4) {
+			t.Errorf("strut %d: expected density %v, got %v", i, 0.1*float64(i%4), rho)
+		}
+	}
+	// density is evaluated on the strut
+	cyl := uc.Struts.Objects[1].(*Cylinder)
+	mid := cyl.P0.Add(cyl.P1).Mul(0.5)
+	if rho := uc.Density(mid[0], mid[1], mid[2]); rho != cyl.Rho {
+		t.Errorf("expected density %v at strut midpoint, got %v", cyl.Rho, rho)
+	}
+}
+
+func TestMenger(t *testing.T) {
+	mg := Menger{}
+	data := map[string]interface{}{"type": "menger", "center": []interface{}{0.0, 0.0, 0.0}, "scale": 3.0, "iterations": 1, "rho": 1.0}
+	if err := mg.FromMap(data); err != nil {
+		t.Fatal(err)
+	}
+	// subcube centres at -1, 0, 1 along each axis
+	filled := 0
+	for i := -1; i <= 1; i++ {
+		for j := -1; j <= 1; j++ {
+			for k := -1; k <= 1; k++ {
+				middle := 0
+				for _, c := range []int{i, j, k} {
+					if c == 0 {
+						middle++
+					}
+				}
+				rho := mg.Density(float64(i), float64(j), float64(k))
+				if rho == 1.0 {
+					filled++
+				}
+				if (middle >= 2) != (rho == 0.0) {
+					t.Errorf("subcube (%d,%d,%d): unexpected density %v", i, j, k, rho)
+				}
+			}
+		}
+	}
+	if filled != 20 {
+		t.Errorf("expected 20 of 27 subcubes, got %d", filled)
+	}
+	if mg.Density(2.0, 0, 0) != 0.0 {
+		t.Error("expected no density outside the sponge")
+	}
+}
+
+func TestSingularParallelepiped(t *testing.T) {
+	p := Parallelepiped{}
+	data := map[string]interface{}{
+		"type": "parallelepiped", "origin": []interface{}{0.0, 0.0, 0.0},
+		"v1": []interface{}{1.0, 0.0, 0.0}, "v2": []interface{}{0.0, 1.0, 0.0}, "v3": []interface{}{1.0, 1.0, 0.0},
+		"rho": 1.0,
+	}
+	if err := p.FromMap(data); err == nil {
+		t.Error("expected error for coplanar vectors")
+	}
+	data["v3"] = []interface{}{0.0, 0.0, 1.0}
+	if err := p.FromMap(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCollectionReduce(t *testing.T) {
+	sphere := func(rho float64) map[string]interface{} {
+		return map[string]interface{}{"type": "sphere", "center": []interface{}{0.0, 0.0, 0.0}, "radius": 0.5, "rho": rho}
+	}
+	expected := map[string]float64{"sum": 1.0, "greedy": 0.3, "max": 0.7}
+	for reduce, rho := range expected {
+		oc := ObjectCollection{}
+		data := map[string]interface{}{"type": "object_collection", "reduce": reduce, "objects": []interface{}{sphere(0.3), sphere(0.7)}}
+		if err := oc.FromMap(data); err != nil {
+			t.Fatal(err)
+		}
+		if got := oc.Density(0, 0, 0); math.Abs(got-rho) > 1e-12 {
+			t.Errorf("%s: expected density %v, got %v", reduce, rho, got)
+		}
+		if oc.ToMap()["reduce"] != reduce {
+			t.Errorf("%s: reduce missing from ToMap output", reduce)
+		}
+	}
+	oc := ObjectCollection{}
+	if err := oc.FromMap(map[string]interface{}{"type": "object_collection", "reduce": "min", "objects": []interface{}{}}); err == nil {
+		t.Error("expected error for unknown reduce mode")
+	}
+}
+
+func TestInstanced(t *testing.T) {
+	in := Instanced{}
+	data := map[string]interface{}{
+		"type":   "instanced",
+		"object": map[string]interface{}{"type": "sphere", "center": []interface{}{0.0, 0.0, 0.0}, "radius": 0.2, "rho": 1.0},
+		"instances": []interface{}{
+			map[string]interface{}{"translation": []interface{}{1.0, 0.0, 0.0}},
+			map[string]interface{}{"translation": []interface{}{0.0, 1.0, 0.0}},
+			map[string]interface{}{"translation": []interface{}{0.0, 0.0, -1.0}, "axis": []interface{}{1, 0, 0}, "angle": math.Pi},
+		},
+	}
+	if err := in.FromMap(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []mgl64.Vec3{{1, 0, 0}, {0, 1, 0}, {0, 0, -1}} {
+		if rho := in.Density(c[0], c[1], c[2]); rho != 1.0 {
+			t.Errorf("expected density 1 at instance center %v, got %v", c, rho)
+		}
+	}
+	if rho := in.Density(0, 0, 0); rho != 0.0 {
+		t.Errorf("expected density 0 at origin, got %v", rho)
+	}
+	lo, hi := in.BoundingBox()
+	if !lo.ApproxEqual(mgl64.Vec3{-0.2, -0.2, -1.2}) || !hi.ApproxEqual(mgl64.Vec3{1.2, 1.2, 0.2}) {
+		t.Errorf("unexpected bounding box %v %v", lo, hi)
+	}
+
+	// rotated box instance: long side along x becomes along y after quarter turn about z
+	box := NewInstanced(&Box{Sides: mgl64.Vec3{1.0, 0.2, 0.2}, Rho: 1.0},
+		[]Instance{{Translation: mgl64.Vec3{0, 0, 1}, Axis: mgl64.Vec3{0, 0, 1}, Angle: math.Pi / 2}})
+	if rho := box.Density(0, 0.4, 1); rho != 1.0 {
+		t.Errorf("expected density 1 inside rotated box, got %v", rho)
+	}
+	if rho := box.Density(0.4, 0, 1); rho != 0.0 {
+		t.Errorf("expected density 0 outside rotated box, got %v", rho)
+	}
+}
+
+func TestSphereCloud(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const n = 500
+	centers := make([]mgl64.Vec3, n)
+	radii := make([]float64, n)
+	buf := make([]byte, 0, 16*n)
+	for i := range centers {
+		rec := [4]float32{rng.Float32()*2 - 1, rng.Float32()*2 - 1, rng.Float32()*2 - 1, 0.01 + 0.1*rng.Float32()}
+		for _, v := range rec {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+		}
+		centers[i] = mgl64.Vec3{float64(rec[0]), float64(rec[1]), float64(rec[2])}
+		radii[i] = float64(rec[3])
+	}
+	path := filepath.Join(t.TempDir(), "cloud.bin")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sc := SphereCloud{}
+	if err := sc.FromMap(map[string]interface{}{"type": "sphere_cloud", "path": path, "rho": 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.Centers) != n {
+		t.Fatalf("expected %d spheres, got %d", n, len(sc.Centers))
+	}
+	inside := 0
+	for k := 0; k < 20000; k++ {
+		p := mgl64.Vec3{rng.Float64()*2.4 - 1.2, rng.Float64()*2.4 - 1.2, rng.Float64()*2.4 - 1.2}
+		expected := 0.0
+		for i, c := range centers {
+			if p.Sub(c).Len() < radii[i] {
+				expected = 0.5
+				break
+			}
+		}
+		if rho := sc.Density(p[0], p[1], p[2]); rho != expected {
+			t.Fatalf("point %v: expected density %v, got %v", p, expected, rho)
+		}
+		if expected > 0 {
+			inside++
+		}
+	}
+	if inside == 0 {
+		t.Error("no sample points fell inside the cloud")
+	}
+
+	if err := os.WriteFile(path, buf[:17], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.FromMap(map[string]interface{}{"type": "sphere_cloud", "path": path, "rho": 0.5}); err == nil {
+		t.Error("expected error for truncated file")
+	}
+}
+
+func TestSphereCloudPath(t *testing.T) {
+	dir := t.TempDir()
+	buf := make([]byte, 0, 16)
+	for _, v := range []float32{0, 0, 0, 0.5} {
+		buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(v))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cloud.bin"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { DataDir = "" }()
+	DataDir = dir
+	sc := SphereCloud{}
+	if err := sc.FromMap(map[string]interface{}{"type": "sphere_cloud", "path": "cloud.bin", "rho": 1.0}); err != nil {
+		t.Fatal(err)
+	}
+	// written out with the absolute path, so it can be read back from anywhere
+	DataDir = t.TempDir()
+	if err := sc.FromMap(sc.ToMap()); err != nil {
+		t.Fatal(err)
+	}
+	if rho := sc.Density(0, 0, 0); rho != 1.0 {
+		t.Errorf("expected density 1 at the centre, got %v", rho)
+	}
+
+	if err := CheckRoundTrip(sc.ToMap()); err != nil {
+		t.Error(err)
+	}
+	oc := NewCollection().Add(&sc).Add(NewSphereCloud([]mgl64.Vec3{{0, 0, 0}}, []float64{0.1}, 1.0))
+	if err := CheckRoundTrip(oc.ToMap()); err == nil {
+		t.Error("expected error for a sphere cloud without path")
+	}
+}
+
+func TestDensityCacheBounded(t *testing.T) {
+	dc := newDensityCache(0.1)
+	dc.maxEntries = 100
+	f := func(x, y, z float64) float64 { return x + y + z }
+	for i := 0; i < 1000; i++ {
+		x := float64(i) * 0.1
+		if v := dc.density(x, 0, 0, f); math.Abs(v-x) > 1e-9 {
+			t.Fatalf("point %v: expected density %v, got %v", x, x, v)
+		}
+		if n := dc.n.Load(); n > dc.maxEntries {
+			t.Fatalf("cache holds %d entries, more than %d", n, dc.maxEntries)
+		}
+	}
+	stored := 0
+	dc.values.Load().Range(func(_, _ interface{}) bool {
+		stored++
+		return true
+	})
+	if stored > 100 {
+		t.Errorf("expected at most 100 cached points, got %d", stored)
+	}
+}
+
+func TestSphereCloudFlat(t *testing.T) {
+	// small spheres in a plane: the bounding box has almost no volume
+	const n = 100
+	centers := make([]mgl64.Vec3, 0, n*n)
+	radii := make([]float64, 0, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			centers = append(centers, mgl64.Vec3{float64(i), float64(j), 0})
+			radii = append(radii, 1e-6)
+		}
+	}
+	sc := NewSphereCloud(centers, radii, 1.0)
+	if cells := sc.dims[0] * sc.dims[1] * sc.dims[2]; cells > 8*len(centers)+8 {
+		t.Errorf("expected at most %d grid cells, got %d (%v)", 8*len(centers)+8, cells, sc.dims)
+	}
+	if rho := sc.Density(42, 17, 0); rho != 1.0 {
+		t.Errorf("expected density 1 at a sphere centre, got %v", rho)
+	}
+	if rho := sc.Density(42.5, 17, 0); rho != 0.0 {
+		t.Errorf("expected density 0 between spheres, got %v", rho)
+	}
+}
+
+func TestSphereCloudCache(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	centers := make([]mgl64.Vec3, 200)
+	radii := make([]float64, len(centers))
+	for i := range centers {
+		centers[i] = mgl64.Vec3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}
+		radii[i] = 0.05 + 0.1*rng.Float64()
+	}
+	plain := NewSphereCloud(centers, radii, 1.0)
+	cached := NewSphereCloud(centers, radii, 1.0)
+	cached.EnableCache(0.01)
+	if cached.ToMap()["cache_resolution"] != 0.01 || plain.ToMap()["cache"] != nil {
+		t.Errorf("unexpected cache fields in ToMap: %v, %v", cached.ToMap(), plain.ToMap())
+	}
+	pts := make([]mgl64.Vec3, 2000)
+	for i := range pts {
+		// lattice points, so that cached and uncached densities must agree exactly
+		pts[i] = mgl64.Vec3{float64(rng.Intn(200) - 100), float64(rng.Intn(200) - 100), float64(rng.Intn(200) - 100)}.Mul(0.01)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, len(pts))
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pass := 0; pass < 2; pass++ {
+				for _, p := range pts {
+					if a, b := plain.Density(p[0], p[1], p[2]), cached.Density(p[0], p[1], p[2]); a != b {
+						errs <- fmt.Sprintf("point %v: uncached %v, cached %v", p, a, b)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+	// off-lattice points take the value at the nearest lattice point
+	p := mgl64.Vec3{0.1234, -0.5678, 0.0049}
+	if a, b := cached.Density(p[0], p[1], p[2]), plain.Density(0.12, -0.57, 0.0); a != b {
+		t.Errorf("expected density %v at the nearest lattice point, got %v", b, a)
+	}
+}
+
+// Query points spread over [-1, 1]^3 shared by the density benchmarks
+func benchmarkPoints() []mgl64.Vec3 {
+	rng := rand.New(rand.NewSource(0))
+	pts := make([]mgl64.Vec3, 1024)
+	for i := range pts {
+		pts[i] = mgl64.Vec3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}
+	}
+	return pts
+}
+
+func benchmarkDensity(b *testing.B, obj Object) {
+	pts := benchmarkPoints()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := pts[i%len(pts)]
+		obj.Density(p[0], p[1], p[2])
+	}
+}
+
+func BenchmarkSphereDensity(b *testing.B) {
+	benchmarkDensity(b, &Sphere{Center: mgl64.Vec3{0.1, 0, 0}, Radius: 0.5, Rho: 1.0})
+}
+
+func BenchmarkCollectionDensity(b *testing.B) {
+	oc := NewCollection().
+		Add(&Sphere{Center: mgl64.Vec3{0.3, 0, 0}, Radius: 0.3, Rho: 1.0}).
+		Add(&Box{Center: mgl64.Vec3{-0.3, 0, 0}, Sides: mgl64.Vec3{0.4, 0.4, 0.4}, Rho: 0.5}).
+		Add(&Cylinder{P0: mgl64.Vec3{0, 0, -0.8}, P1: mgl64.Vec3{0, 0, 0.8}, Radius: 0.1, Rho: 0.8})
+	benchmarkDensity(b, oc)
+}
+
+func BenchmarkKelvinLatticeDensity(b *testing.B) {
+	benchmarkDensity(b, &TessellatedObjColl{UC: MakeKelvin(0.02, 0.25, 1.0), Xmin: -1, Xmax: 1, Ymin: -1, Ymax: 1, Zmin: -1, Zmax: 1})
+}
+
+func BenchmarkMengerDensity(b *testing.B) {
+	benchmarkDensity(b, &Menger{Scale: 1.8, Iterations: 4, Rho: 1.0})
+}
+
+func BenchmarkSphereCloudDensity(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	centers := make([]mgl64.Vec3, 10000)
+	radii := make([]float64, len(centers))
+	for i := range centers {
+		centers[i] = mgl64.Vec3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}
+		radii[i] = 0.02
+	}
+	benchmarkDensity(b, NewSphereCloud(centers, radii, 1.0))
+}
+
+// Sphere cloud queried repeatedly at the same few points, as with supersampling, with and without the cache
+func benchmarkSphereCloudRepeated(b *testing.B, cache bool) {
+	rng := rand.New(rand.NewSource(1))
+	centers := make([]mgl64.Vec3, 10000)
+	radii := make([]float64, len(centers))
+	for i := range centers {
+		centers[i] = mgl64.Vec3{rng.Float64()*2 - 1, rng.Float64()*2 - 1, rng.Float64()*2 - 1}
+		radii[i] = 0.2
+	}
+	sc := NewSphereCloud(centers, radii, 1.0)
+	if cache {
+		sc.EnableCache(0.001)
+	}
+	pts := benchmarkPoints()[:64]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := pts[i%len(pts)]
+		sc.Density(p[0], p[1], p[2])
+	}
+}
+
+func BenchmarkSphereCloudRepeated(b *testing.B) {
+	benchmarkSphereCloudRepeated(b, false)
+}
+
+func BenchmarkSphereCloudRepeatedCached(b *testing.B) {
+	benchmarkSphereCloudRepeated(b, true)
+}
+
+func TestLabelVoxelGrid(t *testing.T) {
+	// 4x2x2 volume over [-1, 1]^3: label 1 for x < 0, label 2 for x >= 0 except one voxel of unmapped label 7
+	labels := make([]byte, 16)
+	for i := range labels {
+		labels[i] = 1
+		if i%4 >= 2 {
+			labels[i] = 2
+		}
+	}
+	labels[15] = 7
+	dir := t.TempDir()
+	path8 := filepath.Join(dir, "labels8.raw")
+	if err := os.WriteFile(path8, labels, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path16 := filepath.Join(dir, "labels16.raw")
+	var buf []byte
+	for _, l := range labels {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(l))
+	}
+	if err := os.WriteFile(path16, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []map[string]interface{}{
+		{"path": path8, "shape": []interface{}{4, 2, 2}, "label_to_rho": map[string]interface{}{"1": 0.3, "2": 1}},
+		{"path": path16, "dtype": "uint16", "shape": []interface{}{4, 2, 2}, "label_to_rho": map[interface{}]interface{}{1: 0.3, 2: 1.0}},
+	} {
+		g := LabelVoxelGrid{}
+		if err := g.FromMap(data); err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct{ x, y, z, rho float64 }{
+			{-0.9, -0.5, -0.5, 0.3},
+			{-1e-9, 0.5, 0.5, 0.3}, // just left of the boundary, no blending
+			{0.0, -0.5, -0.5, 1.0},
+			{0.9, -0.5, 0.5, 1.0},
+			{0.9, 0.5, 0.5, 0.0}, // unmapped label
+			{1.1, 0.0, 0.0, 0.0}, // outside the grid
+		} {
+			if rho := g.Density(tc.x, tc.y, tc.z); rho != tc.rho {
+				t.Errorf("%s at (%v, %v, %v): expected density %v, got %v", g.DType, tc.x, tc.y, tc.z, tc.rho, rho)
+			}
+		}
+		if g.MinFeatureSize() != 0.5 {
+			t.Errorf("expected min feature size 0.5, got %v", g.MinFeatureSize())
+		}
+	}
+	g := LabelVoxelGrid{}
+	if err := g.FromMap(map[string]interface{}{"path": path8, "shape": []interface{}{4, 4, 2}, "label_to_rho": map[string]interface{}{}}); err == nil {
+		t.Error("expected error for shape not matching file size")
+	}
+}
+
+func TestBlend(t *testing.T) {
+	box := func(rho float64) map[string]interface{} {
+		return map[string]interface{}{"type": "box", "center": []interface{}{0.0, 0.0, 0.0}, "sides": []interface{}{2.0, 2.0, 2.0}, "rho": rho}
+	}
+	bl := Blend{}
+	data := map[string]interface{}{
+		"type":   "blend",
+		"a":      box(0.2),
+		"b":      box(1.0),
+		"weight": map[string]interface{}{"direction": "z", "center": 0.1, "lengthscale": 0.01},
+	}
+	if err := bl.FromMap(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ z, rho float64 }{
+		{-0.9, 0.2},
+		{0.1, 0.6},
+		{0.9, 1.0},
+	} {
+		if rho := bl.Density(0.3, -0.2, tc.z); math.Abs(rho-tc.rho) > 1e-12 {
+			t.Errorf("z=%v: expected density %v, got %v", tc.z, tc.rho, rho)
+		}
+	}
+	// weight does not depend on the other coordinates
+	if w := bl.Weight(5, 5, 0.1); w != 0.5 {
+		t.Errorf("expected weight 0.5 at the centre, got %v", w)
+	}
+	data["weight"] = map[string]interface{}{"direction": "w", "center": 0.0, "lengthscale": 0.1}
+	if err := bl.FromMap(data); err == nil {
+		t.Error("expected error for invalid direction")
+	}
+}
+
+func TestEmission(t *testing.T) {
+	s := Sphere{}
+	if err := s.FromMap(map[string]interface{}{"type": "sphere", "center": []interface{}{0.0, 0.0, 0.0}, "radius": 0.5, "rho": 1.0, "emission": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if s.ToMap()["emission"] != 2.0 {
+		t.Errorf("expected emission 2 in ToMap, got %v", s.ToMap()["emission"])
+	}
+	oc := NewCollection().
+		Add(&s).
+		Add(&Box{Center: mgl64.Vec3{0.2, 0, 0}, Sides: mgl64.Vec3{0.4, 0.4, 0.4}, Rho: 1.0, Emission: 0.5}).
+		Add(&Menger{Scale: 1.0, Iterations: 1, Rho: 1.0})
+	oc.Reduce = "greedy"
+	for _, tc := range []struct{ x, emission float64 }{
+		{-0.3, 2.0},
+		{0.1, 2.5},
+		{0.8, 0.0},
+	} {
+		if e := Emission(oc, tc.x, 0, 0); e != tc.emission {
+			t.Errorf("x=%v: expected emission %v, got %v", tc.x, tc.emission, e)
+		}
+	}
+}
+
+func TestEmissionComposites(t *testing.T) {
+	sphere := map[string]interface{}{"type": "sphere", "center": []interface{}{0.5, 0.5, 0.5}, "radius": 0.2, "rho": 1.0, "emission": 2.0}
+	l, err := NewObject(map[string]interface{}{
+		"type":   "lattice_repeat",
+		"object": sphere,
+		"a1":     []interface{}{1.0, 0.0, 0.0},
+		"a2":     []interface{}{0.0, 1.0, 0.0},
+		"a3":     []interface{}{0.0, 0.0, 1.0},
+		"n1":     []interface{}{0, 1},
+		"n2":     []interface{}{0, 0},
+		"n3":     []interface{}{0, 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := Emission(l, 1.5, 0.5, 0.5); e != 2.0 {
+		t.Errorf("expected emission 2 in the repeated cell, got %v", e)
+	}
+	if e := Emission(l, 2.5, 0.5, 0.5); e != 0.0 {
+		t.Errorf("expected no emission outside the repeated cells, got %v", e)
+	}
+	// an emission coefficient on an object which does not use it is an error, also when nested
+	for _, data := range []map[string]interface{}{
+		{
+			"type": "parallelepiped", "origin": []interface{}{0.0, 0.0, 0.0}, "rho": 1.0, "emission": 1.0,
+			"v1": []interface{}{1.0, 0.0, 0.0}, "v2": []interface{}{0.0, 1.0, 0.0}, "v3": []interface{}{0.0, 0.0, 1.0},
+		},
+		{
+			"type": "lattice_repeat", "object": sphere, "emission": 1.0,
+			"a1": []interface{}{1.0, 0.0, 0.0}, "a2": []interface{}{0.0, 1.0, 0.0}, "a3": []interface{}{0.0, 0.0, 1.0},
+			"n1": []interface{}{0, 1}, "n2": []interface{}{0, 0}, "n3": []interface{}{0, 0},
+		},
+		{"type": "object_collection", "objects": []interface{}{map[string]interface{}{
+			"type": "quadric", "coefficients": []interface{}{1.0, 1.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, -0.25}, "rho": 1.0, "emission": 1.0,
+		}}},
+	} {
+		if _, err := NewObject(data); err == nil || !strings.Contains(err.Error(), "emission") {
+			t.Errorf("%v: expected emission error, got %v", data["type"], err)
+		}
+	}
+}
+
+// Object of constant density within the unit cube, registered by TestRegisterObject
+type constantObject struct {
+	Object
+	Rho float64
+}
+
+func (c *constantObject) ToMap() map[string]interface{} {
+	return map[string]interface{}{"type": "test_constant", "rho": c.Rho}
+}
+
+func (c *constantObject) FromMap(data map[string]interface{}) error {
+	var err error
+	c.Rho, err = ToFloat64(data["rho"])
+	return err
+}
+
+func (c *constantObject) Density(x, y, z float64) float64 {
+	if math.Abs(x) < 1 && math.Abs(y) < 1 && math.Abs(z) < 1 {
+		return c.Rho
+	}
+	return 0.0
+}
+
+func (c *constantObject) MinFeatureSize() float64 {
+	return 2.0
+}
+
+func (c *constantObject) BoundingBox() (mgl64.Vec3, mgl64.Vec3) {
+	return mgl64.Vec3{-1, -1, -1}, mgl64.Vec3{1, 1, 1}
+}
+
+func TestRegisterObject(t *testing.T) {
+	spec := map[string]interface{}{"type": "test_constant", "rho": 0.25}
+	if _, err := NewObject(spec); err == nil {
+		t.Fatal("expected error for unregistered type")
+	}
+	RegisterObject("test_constant", func() Object { return &constantObject{} })
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test_constant")
+		registryMu.Unlock()
+	}()
+
+	obj, err := NewObject(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rho := obj.Density(0, 0, 0); rho != 0.25 {
+		t.Errorf("expected density 0.25, got %v", rho)
+	}
+	oc := ObjectCollection{}
+	if err := oc.FromMap(map[string]interface{}{"type": "object_collection", "objects": []interface{}{spec}}); err != nil {
+		t.Fatal(err)
+	}
+	if rho := oc.Density(0.5, 0, 0); rho != 0.25 {
+		t.Errorf("expected density 0.25 in collection, got %v", rho)
+	}
+	found := false
+	for _, name := range ObjectTypes() {
+		found = found || name == "test_constant"
+	}
+	if !found {
+		t.Errorf("test_constant not in %v", ObjectTypes())
+	}
+}
+
+func TestGaussianRandomField(t *testing.T) {
+	data := map[string]interface{}{
+		"type": "grf", "center": []interface{}{0.0, 0.0, 0.0}, "side": 1.0,
+		"correlation_length": 0.05, "seed": 7.0, "level": 0.3, "rho": 2.0,
+	}
+	a, err := NewObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data["seed"] = 8.0
+	c, err := NewObject(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 40
+	filled, n_different := 0, 0
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			for k := 0; k < n; k++ {
+				x, y, z := (float64(i)+0.5)/n-0.5, (float64(j)+0.5)/n-0.5, (float64(k)+0.5)/n-0.5
+				rho := a.Density(x, y, z)
+				if rho != b.Density(x, y, z) {
+					t.Fatalf("same seed gives different densities at (%v,%v,%v)", x, y, z)
+				}
+				if rho != c.Density(x, y, z) {
+					n_different++
+				}
+				if rho == 2.0 {
+					filled++
+				} else if rho != 0.0 {
+					t.Fatalf("expected density 0 or 2, got %v", rho)
+				}
+			}
+		}
+	}
+	if fraction := float64(filled) / (n * n * n); math.Abs(fraction-0.3) > 0.03 {
+		t.Errorf("expected volume fraction 0.3, got %v", fraction)
+	}
+	if n_different == 0 {
+		t.Error("different seeds give identical densities")
+	}
+	if a.Density(0.6, 0, 0) != 0.0 {
+		t.Error("expected no density outside the cube")
+	}
+}
+
+func TestOffset(t *testing.T) {
+	box := map[string]interface{}{"type": "box", "center": []interface{}{0.0, 0.0, 0.0}, "sides": []interface{}{1.0, 1.0, 1.0}, "rho": 1.0}
+	exact, err := NewObject(map[string]interface{}{"type": "offset", "child": box, "radius": 0.1, "rho": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// collection does not provide a signed distance, so its offset is sampled
+	sampled, err := NewObject(map[string]interface{}{
+		"type": "offset", "radius": 0.1, "rho": 2.0,
+		"child": map[string]interface{}{"type": "object_collection", "objects": []interface{}{box}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corner := 0.5 + 0.05/math.Sqrt(3) // 0.05 beyond the corner along the diagonal
+	for _, tc := range []struct {
+		p      mgl64.Vec3
+		inside bool
+	}{
+		{mgl64.Vec3{corner, corner, corner}, true},
+		{mgl64.Vec3{0.58, 0, 0}, true},
+		{mgl64.Vec3{0.3, -0.2, 0.1}, true},
+		{mgl64.Vec3{0.58, 0.58, 0.58}, false}, // 0.14 beyond the corner
+		{mgl64.Vec3{0, 0.62, 0}, false},
+	} {
+		for name, obj := range map[string]Object{"exact": exact, "sampled": sampled} {
+			rho := obj.Density(tc.p[0], tc.p[1], tc.p[2])
+			if (rho == 2.0) != tc.inside || (rho != 2.0 && rho != 0.0) {
+				t.Errorf("%s offset at %v: expected inside %v, got density %v", name, tc.p, tc.inside, rho)
+			}
+		}
+	}
+	if (&Box{Sides: mgl64.Vec3{1, 1, 1}, Rho: 1}).Density(corner, corner, corner) != 0 {
+		t.Error("expected no density of the box itself just outside its corner")
+	}
+	lo, hi := exact.BoundingBox()
+	if math.Abs(lo[0]+0.6) > 1e-12 || math.Abs(hi[2]-0.6) > 1e-12 {
+		t.Errorf("expected bounding box grown by the radius, got %v %v", lo, hi)
+	}
+}
+
+func TestUnitCellGreedy(t *testing.T) {
+	sphere := func(rho float64) map[string]interface{} {
+		return map[string]interface{}{"type": "sphere", "center": []interface{}{0.5, 0.5, 0.5}, "radius": 0.3, "rho": rho}
+	}
+	cell := func(greedy interface{}) map[string]interface{} {
+		data := map[string]interface{}{
+			"type":   "unit_cell",
+			"struts": map[string]interface{}{"type": "object_collection", "objects": []interface{}{sphere(0.3), sphere(0.5)}},
+			"xmin":   0.0, "xmax": 1.0, "ymin": 0.0, "ymax": 1.0, "zmin": 0.0, "zmax": 1.0,
+		}
+		if greedy != nil {
+			data["greedy_dens_eval"] = greedy
+		}
+		return data
+	}
+	for _, tc := range []struct {
+		greedy interface{}
+		rho    float64
+	}{
+		{nil, 0.3}, // default keeps the first nonzero strut
+		{true, 0.3},
+		{false, 0.8}, // overlapping struts are summed
+	} {
+		uc := UnitCell{}
+		if err := uc.FromMap(cell(tc.greedy)); err != nil {
+			t.Fatal(err)
+		}
+		if rho := uc.Density(0.5, 0.5, 0.5); math.Abs(rho-tc.rho) > 1e-12 {
+			t.Errorf("greedy_dens_eval %v: expected density %v, got %v", tc.greedy, tc.rho, rho)
+		}
+	}
+	uc := UnitCell{}
+	if err := uc.FromMap(cell("no")); err == nil {
+		t.Error("expected error for non-bool greedy_dens_eval")
+	}
+}